@@ -0,0 +1,106 @@
+package armbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// hostAlias routes requests for another host name to the pools of an added host, see Options.HostAliases.
+type hostAlias struct {
+	host, port             string
+	targetHost, targetPort string
+}
+
+// parseHostAliases normalizes the aliases like hosts added to the builder. Targets must be added hosts,
+// given as host:port, and aliases must not be.
+func parseHostAliases(aliases map[string]string, added map[string]bool) ([]hostAlias, error) {
+	var parsed []hostAlias
+	for alias, target := range aliases {
+		host, port, err := normalizeHost(alias)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host alias: %w", err)
+		}
+		targetHost, targetPort, err := normalizeHost(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target of host alias %q: %w", alias, err)
+		}
+		if added[net.JoinHostPort(host, port)] {
+			return nil, fmt.Errorf("invalid host alias %q: the host has been added to the balancer", alias)
+		}
+		if !added[net.JoinHostPort(targetHost, targetPort)] {
+			return nil, fmt.Errorf("invalid target %q of host alias %q: the host has not been added to the balancer", target, alias)
+		}
+		parsed = append(parsed, hostAlias{host: host, port: port, targetHost: targetHost, targetPort: targetPort})
+	}
+	sort.Slice(parsed, func(i, j int) bool {
+		return net.JoinHostPort(parsed[i].host, parsed[i].port) < net.JoinHostPort(parsed[j].host, parsed[j].port)
+	})
+	return parsed, nil
+}
+
+// lookupAlias returns the pool serving the request's host and audience through one of Options.HostAliases.
+func (t *Balancer) lookupAlias(u *url.URL, audience string) *hostPool {
+	for _, a := range t.aliases {
+		if !matchHostPort(u, a.host, a.port, "") {
+			continue
+		}
+		for _, p := range t.hosts {
+			if p.audience == audience && p.host == a.targetHost && p.port == a.targetPort {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// aliasEnabled returns true if the alias's host is enabled for any audience.
+func (t *Balancer) aliasEnabled(a hostAlias) bool {
+	for _, p := range t.hosts {
+		if p.host == a.targetHost && p.port == a.targetPort && p.Enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// withCanonicalHost rewrites requests sent to an alias of the pool's host to target the pool's host, so that they
+// share its connections. The Host header is derived from the URL unless the pool preserves it.
+func (t *hostPool) withCanonicalHost(req *http.Request) *http.Request {
+	if matchHostPort(req.URL, t.host, t.port, t.defaultPort) {
+		return req
+	}
+	u := *req.URL
+	u.Host = net.JoinHostPort(t.host, t.port)
+	rewritten := *req
+	rewritten.URL = &u
+	rewritten.Host = ""
+	if t.preserveHost {
+		rewritten.Host = req.Host
+		if rewritten.Host == "" {
+			rewritten.Host = req.URL.Host
+		}
+	}
+	return &rewritten
+}
+
+// MatchHostPortAliases is MatchHostPort, also returning true if the request URL targets an alias of the given
+// host and port in aliases, which maps alias hosts to canonical ones like Options.HostAliases.
+func MatchHostPortAliases(reqURL *url.URL, host, port string, aliases map[string]string) bool {
+	if MatchHostPort(reqURL, host, port) {
+		return true
+	}
+	for alias, target := range aliases {
+		targetHost, targetPort, err := normalizeHost(target)
+		if err != nil || targetHost != strings.ToLower(canonicalHostName(host)) || targetPort != port {
+			continue
+		}
+		if aliasHost, aliasPort, err := normalizeHost(alias); err == nil && MatchHostPort(reqURL, aliasHost, aliasPort) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package armbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestHostAliases(t *testing.T) {
+	var lock sync.Mutex
+	var hosts []string
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		hosts = append(hosts, r.Host)
+		lock.Unlock()
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+	alias := "Management.PrivateLink.Azure.com:" + u.Port()
+
+	tests := []struct {
+		name    string
+		targets []string
+	}{
+		{"alias only", []string{"https://" + alias, "https://" + alias, "https://" + alias}},
+		{"mixed", []string{"https://" + alias, svr.URL, "https://" + alias, svr.URL}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts = nil
+			b, err := NewBuilder(svr.Client().Transport.(*http.Transport)).
+				WithOptions(Options{HostAliases: map[string]string{alias: u.Host}}).
+				AddHost(u.Host, HostOptions{PoolSize: 1}).
+				Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+
+			for _, target := range tt.targets {
+				resp, err := b.RoundTrip(httptest.NewRequest(http.MethodGet, target+"/subscriptions", nil))
+				if err != nil {
+					t.Fatalf("expected %s to be served, got: %s", target, err)
+				}
+				resp.Body.Close()
+			}
+			stats := b.Stats()
+			if len(stats.Transports) != 1 || stats.Transports[0].Requests != int64(len(tt.targets)) {
+				t.Errorf("expected every request to be served by the host's pool, got %+v", stats.Transports)
+			}
+			if stats.NewConnectionsLastMinute != 1 {
+				t.Errorf("expected the alias to share the host's connection, got %d connections", stats.NewConnectionsLastMinute)
+			}
+			for _, host := range hosts {
+				if host != u.Host {
+					t.Errorf("expected requests to be sent to %s, got %s", u.Host, host)
+				}
+			}
+
+			want := []string{u.Host, "management.privatelink.azure.com:" + u.Port()}
+			if got := b.SupportedHosts(); !reflect.DeepEqual(got, want) {
+				t.Errorf("expected supported hosts %v, got %v", want, got)
+			}
+			if err := b.ValidateRequestURL("https://management.privatelink.azure.com.:" + u.Port()); err != nil {
+				t.Errorf("expected the alias to be valid, got: %s", err)
+			}
+			if err := b.ValidateRequestURL("https://management.privatelink.azure.com"); err == nil {
+				t.Error("expected the alias to only match its port")
+			}
+		})
+	}
+}
+
+func TestHostAliasesValidation(t *testing.T) {
+	for _, aliases := range []map[string]string{
+		{"management.privatelink.azure.com": "other.azure.com"},
+		{"management.privatelink.azure.com": "management.azure.com:8443"},
+		{"MANAGEMENT.azure.com": "management.azure.com"},
+		{"invalid:host:port": "management.azure.com"},
+	} {
+		_, err := NewBuilder(nil).WithOptions(Options{HostAliases: aliases}).AddHost("management.azure.com", HostOptions{}).Build()
+		if err == nil {
+			t.Errorf("expected aliases %v to be rejected", aliases)
+		}
+	}
+}
+
+func TestMatchHostPortAliases(t *testing.T) {
+	aliases := map[string]string{
+		"management.privatelink.azure.com":        "management.azure.com",
+		"westus.management.privatelink.azure.com": "Management.Azure.com:443",
+		"other.privatelink.azure.com":             "other.azure.com",
+	}
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://management.azure.com", true},
+		{"https://management.privatelink.azure.com/subscriptions", true},
+		{"https://WESTUS.management.privatelink.azure.com:443", true},
+		{"https://management.privatelink.azure.com:8443", false},
+		{"https://other.privatelink.azure.com", false},
+		{"https://unknown.azure.com", false},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := MatchHostPortAliases(u, "management.azure.com", "443", aliases); got != tt.want {
+			t.Errorf("MatchHostPortAliases(%s) = %t, want %t", tt.url, got, tt.want)
+		}
+	}
+}
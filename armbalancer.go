@@ -1,32 +1,50 @@
 package armbalancer
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
-const rateLimitHeaderPrefix = "X-Ms-Ratelimit-Remaining-"
+const (
+	rateLimitHeaderPrefix = "X-Ms-Ratelimit-Remaining-"
+	aggregateHeaderPrefix = "X-Armbalancer-Min-Remaining-"
+	transportIDHeader     = "X-Armbalancer-Transport-Id"
+	generationHeader      = "X-Armbalancer-Generation"
+)
 
 type Options struct {
+	// Transport is the parent of the pooled transports. Its Proxy function is called once per pooled connection,
+	// see TransportStats.Proxy.
 	Transport *http.Transport
 
 	// Host is the only host that can be reached through the round tripper.
-	// Default: management.azure.com
+	// Default: DefaultHost
 	Host string
 
+	// RequireExplicitHost makes New panic, and Builder.Build fail, instead of defaulting to DefaultHost when Host,
+	// or a host added using Builder.AddHost, has no host name, e.g. because of a missing configuration value.
+	// A builder without any host fails as well.
+	RequireExplicitHost bool
+
 	// PoolSize is the max number of connections that will be created by the connection pool.
 	// Default: 8
 	PoolSize int
 
-	// RecycleThreshold is the lowest value of any X-Ms-Ratelimit-Remaining-* header that
-	// can be seen before the associated connection will be re-established.
+	// RecycleThreshold is the value of any X-Ms-Ratelimit-Remaining-* header at or below which
+	// the associated connection will be re-established.
 	// Default: 100
 	RecycleThreshold int64
 
@@ -35,119 +53,1224 @@ type Options struct {
 	// Default: 10
 	MinReqsBeforeRecycle int64
 
+	// MaxConnAge causes connections to be re-established once they are older than the given duration,
+	// regardless of the rate limiting headers. It's evaluated after each response.
+	// Default: 0 (disabled)
+	MaxConnAge time.Duration
+
+	// RecyclePolicy decides when connections are re-established.
+	// Default: DefaultRecyclePolicy configured with RecycleThreshold, MinReqsBeforeRecycle, and MaxConnAge
+	RecyclePolicy RecyclePolicy
+
+	// GlobalBucketBehavior controls whether the principal-scoped buckets, such as those of ARM's token-bucket
+	// throttling (X-Ms-Ratelimit-Remaining-Subscription-Global-Reads) or the tenant-level ones
+	// (X-Ms-Ratelimit-Remaining-Tenant-Reads), are considered by the recycle policy.
+	// Recycling doesn't replenish them, so they are only used for client-side features such as Balancer.Reserve by default.
+	// Default: GlobalBucketsIgnored
+	GlobalBucketBehavior GlobalBucketBehavior
+
+	// PrincipalScopedBuckets and InstanceScopedBuckets override which buckets are principal-scoped, given by their
+	// X-Ms-Ratelimit-Remaining-* header suffix, e.g. "Tenant-Writes". A noisy subscription depleting a principal-scoped
+	// bucket can't cause connections to be churned, since their values only feed Balancer.Reserve, caller budgets
+	// and ConnSnapshot.Global.
+	// Default: buckets containing "-Global-" or starting with "Tenant-" are principal-scoped
+	PrincipalScopedBuckets []string
+	InstanceScopedBuckets  []string
+
+	// QuotaHeaders lists additional headers holding a remaining quota, such as X-Ms-User-Quota-Remaining,
+	// that are tracked alongside the X-Ms-Ratelimit-Remaining-* headers. Their buckets are keyed by the canonical
+	// header name and are treated as principal-scoped, like the buckets covered by GlobalBucketBehavior.
+	QuotaHeaders []string
+
+	// IgnoreQuotaStatusCodes lists the response statuses whose rate limiting headers are ignored, neither updating
+	// the tracked quota nor consuming reservations, since ARM may omit or zero them misleadingly. An empty non-nil
+	// slice ignores none.
+	// Default: 401, 403
+	IgnoreQuotaStatusCodes []int
+
+	// AccountingExcludePathPrefixes lists URL path prefixes, compared ignoring case, of requests such as
+	// /metadata/endpoints that don't consume meaningful quota. They are served like any other request, but their
+	// rate limiting headers are ignored and they don't count towards MinReqsBeforeRecycle or TransportStats.Requests.
+	AccountingExcludePathPrefixes []string
+
+	// RequestWeight returns how much a request counts towards MinReqsBeforeRecycle, e.g. 0 for cheap HEAD existence
+	// checks and 5 for LIST calls, which is reported as ConnSnapshot.Requests. Quota is still tracked using the
+	// rate limiting headers of every response, and TransportStats.Requests still counts each request once.
+	// Negative weights count as 0.
+	// Default: 1 for every request
+	RequestWeight func(*http.Request) int64
+
+	// DrainTimeout bounds how long a recycled connection is given to complete its in-flight requests
+	// before its idle connections are closed.
+	// Default: 0 (wait for every in-flight request)
+	DrainTimeout time.Duration
+
+	// ForceCloseAfterDrainTimeout closes the connections of a recycled transport that are still open once
+	// DrainTimeout has passed, including those serving in-flight requests or long-lived HTTP/2 streams,
+	// which would otherwise keep the connection to the previous ARM instance open indefinitely.
+	// It's ignored unless DrainTimeout is set.
+	ForceCloseAfterDrainTimeout bool
+
+	// LingeringConnGracePeriod is how long the connections of a recycled transport may stay open once its last
+	// request has completed before they're closed, in case net/http still considers them in use, e.g. because of
+	// a half-closed HTTP/2 stream, and CloseIdleConnections left them open. See TransportStats.LingeringConnsClosed.
+	// Negative values disable it.
+	// Default: 1m
+	LingeringConnGracePeriod time.Duration
+
+	// SynchronousRecycle makes the response that triggers a recycle wait for the new connection to be swapped in
+	// before it's returned, so that the next request never uses the depleted connection. The previous connection
+	// still drains in the background. It makes recycles deterministic for clients sending few requests.
+	SynchronousRecycle bool
+
+	// OnRecycle is called from a background goroutine whenever a connection is recycled, or would have been in dry-run mode.
+	// It should return quickly since it delays the draining of the previous connection.
+	OnRecycle func(RecycleEvent)
+
+	// DryRun disables recycling while still evaluating the recycle policy, reporting would-be recycles
+	// through OnRecycle and Stats. It can be toggled at runtime using Balancer.SetDryRun.
+	DryRun bool
+
+	// ChaosRecycleProbability is the probability of recycling the serving connection after each request,
+	// regardless of the recycle policy. It's meant for testing how callers tolerate connection churn
+	// and is ignored unless EnableChaos is also set.
+	// Default: 0
+	ChaosRecycleProbability float64
+
+	// EnableChaos guards ChaosRecycleProbability against being applied by accident.
+	EnableChaos bool
+
+	// InjectAggregateHeaders sets an X-Armbalancer-Min-Remaining-* header on every response for each
+	// rate limiting bucket, holding the lowest value reported across all of the host's pooled connections.
+	InjectAggregateHeaders bool
+
+	// DefaultRequestTimeout bounds requests whose context has no deadline. The timeout covers reading the
+	// response body as well, and its resources are released once the body has been closed.
+	// Default: 0 (disabled)
+	DefaultRequestTimeout time.Duration
+
+	// MaxRequestBodyBytes rejects requests with a larger body with ErrBodyTooLarge. Bodies of known length are
+	// rejected before being sent, while those of unknown length are aborted once the limit has been exceeded.
+	// Default: 0 (disabled)
+	MaxRequestBodyBytes int64
+
+	// AnnotateResponses sets the X-Armbalancer-Transport-Id and X-Armbalancer-Generation headers on every response
+	// to identify the pooled transport and the generation of its connection that served it.
+	AnnotateResponses bool
+
+	// HedgeAfter enables hedging of idempotent reads: GET and HEAD requests that haven't received a response
+	// within this duration are sent again through a different pooled transport, and the first response wins.
+	// Requests with a body are only hedged when it can be recreated using GetBody.
+	// Default: 0 (disabled)
+	HedgeAfter time.Duration
+
+	// HedgeBudget is the max fraction of requests that can be hedged.
+	// Default: 0.05
+	HedgeBudget float64
+
+	// AllowedRedirectHostSuffixes lists hosts, along with their subdomains, that can be reached in addition to Host.
+	// It's meant for following the Location and Azure-AsyncOperation URLs of long running operations,
+	// which may point at regional endpoints. Requests to these hosts are served by a small shared pool
+	// of transports that are never recycled.
+	AllowedRedirectHostSuffixes []string
+
+	// SelectionStrategy decides which pooled transport serves each request.
+	// Default: RoundRobin
+	SelectionStrategy SelectionStrategy
+
+	// ReservedWriteSlots is the number of transports in each pool that only serve requests other than GET and HEAD,
+	// so that writes aren't queued behind long running reads. It's capped to leave at least one transport for reads.
+	// Default: 0
+	ReservedWriteSlots int
+
+	// TightDeadline makes requests whose context deadline, including DefaultRequestTimeout, is closer than it avoid
+	// the transports about to be recycled, since the recycle may delay them: those whose lowest bucket is within
+	// TightDeadlineMargin of the host's RecycleThreshold, and those being recycled. The transport picked by
+	// SelectionStrategy is kept when every transport of the pool is at risk.
+	// Default: 0 (disabled)
+	TightDeadline time.Duration
+
+	// TightDeadlineMargin is how far above the RecycleThreshold the lowest bucket of a transport must be for
+	// requests with a TightDeadline to be sent to it.
+	// Default: 10
+	TightDeadlineMargin int64
+
+	// HostWeights splits the traffic of equivalent hosts, such as the public and a private link ARM endpoint,
+	// across their pools. Requests for any host listed here are sent to one of the listed hosts picked
+	// proportionally to its weight, with the request URL rewritten to target it. Hosts must be added
+	// using Builder.AddHost, and weights can be changed at runtime using Balancer.SetHostWeights.
+	HostWeights map[string]int
+
+	// RedirectPoolSize is the number of transports serving AllowedRedirectHostSuffixes.
+	// Default: 2
+	RedirectPoolSize int
+
+	// CallerBudgets assigns callers named using WithCaller a fraction (greater than 0 and at most 1) of every rate limiting bucket.
+	// While a bucket is under pressure, requests of a caller that sent more than its fraction of the recent requests
+	// reporting the bucket fail with an error wrapping ErrCallerThrottled, leaving the remaining quota to other callers.
+	// Callers without a budget, including requests without a caller, are never throttled.
+	CallerBudgets map[string]float64
+
+	// CallerBudgetThreshold is the remaining quota at or below which a bucket is considered under pressure.
+	// Default: 1000
+	CallerBudgetThreshold int64
+
+	// CallerBudgetWindow is the period over which the usage of each caller is tracked. It must be at least 1s.
+	// Default: 1m
+	CallerBudgetWindow time.Duration
+
+	// ChurnBackoffGenerations is the number of consecutive replacement connections recycled within their first
+	// MinReqsBeforeRecycle+1 requests after which recycling of a transport is suspended, since the ARM instances
+	// are likely all depleted and recycling would only churn connections. Recycling resumes after ChurnBackoff,
+	// which doubles up to MaxChurnBackoff every time the next replacement is depleted as well, and is reset
+	// once a connection serves more requests before being recycled. Negative values disable the backoff.
+	// Default: 3
+	ChurnBackoffGenerations int
+
+	// ChurnBackoff is how long recycling is first suspended for, see ChurnBackoffGenerations.
+	// Default: 10s
+	ChurnBackoff time.Duration
+
+	// MaxChurnBackoff caps ChurnBackoff as it doubles.
+	// Default: 5m
+	MaxChurnBackoff time.Duration
+
+	// PostponeRecyclesAbove postpones recycles while more than this fraction (between 0 and 1) of a pool's other
+	// transports are serving requests, since a recycle momentarily reduces the pool's capacity. Recycles are only
+	// postponed while every bucket remains above RecyclePanicFloor, and are reconsidered with every response.
+	// Postponed recycles are reported through OnRecycle once per connection. Zero disables postponing.
+	PostponeRecyclesAbove float64
+
+	// RecyclePanicFloor is the remaining quota at or below which recycles are never postponed.
+	// Default: 10
+	RecyclePanicFloor int64
+
+	// MaxNewConnectionsPerMinute limits how many connections the balancer establishes per minute across all pools,
+	// to avoid connection storms. Recycles that would exceed it are delayed until the budget allows, which is
+	// reported through OnRecycle, and so are ForceRecycleAll and the reactivation of transports quiesced by
+	// ShrinkIdleTransports. Requests avoid quiesced transports while the budget is exhausted, and wait for it when
+	// every transport is quiesced. Zero means no limit.
+	MaxNewConnectionsPerMinute int
+
+	// ShrinkIdleTransports quiesces pooled transports that haven't served requests for IdleShrinkAfter,
+	// closing their connections until they're selected again. It avoids keeping and recycling connections
+	// that are only needed at peak.
+	ShrinkIdleTransports bool
+
+	// IdleShrinkAfter is how long a transport must be unused before it's quiesced, see ShrinkIdleTransports.
+	// It must be at least 10ms.
+	// Default: 10m
+	IdleShrinkAfter time.Duration
+
+	// RecentRecyclesSize is the number of records kept for Balancer.RecentRecycles.
+	// Default: 64
+	RecentRecyclesSize int
+
+	// MaxTrackedBuckets caps the number of rate limiting buckets tracked per connection, evicting the least recently
+	// reported ones, e.g. when a proxy reflects arbitrary headers. The buckets named by a SelectiveThrottledPolicy
+	// and QuotaHeaders are never evicted. Negative values remove the cap.
+	// Default: 64
+	MaxTrackedBuckets int
+
+	// TrackAttribution counts requests by method and normalized path prefix, such as
+	// "PUT /subscriptions/*/providers/Microsoft.Compute", to find out which operations consume a bucket.
+	// The counts are exposed by Stats.Attribution. Resource names, including subscription IDs, are replaced with "*".
+	TrackAttribution bool
+
+	// AttributionMaxKeys caps the number of distinct keys counted by TrackAttribution. Requests for further keys
+	// are counted under "other".
+	// Default: 50
+	AttributionMaxKeys int
+
+	// AttributionKeepSubscriptionIDs keeps subscription IDs in the keys counted by TrackAttribution.
+	AttributionKeepSubscriptionIDs bool
+
+	// StateStore persists what the balancer learned about the rate limiting quota across process restarts, to avoid
+	// a burst of throttled requests after a restart: the lowest remaining value of every bucket, used by Balancer.Reserve
+	// and caller budgets until connections report their own, and the churn backoffs suspending recycling.
+	// It's saved by Shutdown and loaded by New. Connection-level state isn't persisted, and state that can't be loaded
+	// is discarded. See FileStateStore.
+	StateStore StateStore
+
+	// StateTTL discards persisted state older than this.
+	// Default: 5m
+	StateTTL time.Duration
+
+	// RecyclerStallTimeout is how long the recycling goroutine of a transport can spend on a single decision or recycle,
+	// e.g. calling the recycle policy, OnRecycle or TransportFactory, before it's considered stalled. Stalls are reported
+	// through OnRecyclerStall and TransportStats.RecyclerStalled. Recycled connections drain in the background, so
+	// slow drains never stall it.
+	// Default: 1m
+	RecyclerStallTimeout time.Duration
+
+	// OnRecyclerStall is called from a background goroutine when a transport's recycling goroutine is stalled.
+	OnRecyclerStall func(RecyclerStallEvent)
+
+	// AdaptToDialPressure reduces the effective size of a pool, one slot per failed dial, while dials fail with errors
+	// indicating source port or address exhaustion, e.g. SNAT port exhaustion on nodes running many clients: the local
+	// address can't be assigned, or the dial timed out. Removed slots are quiesced and policy recycles are postponed
+	// until DialPressureRestoreAfter has elapsed since the latest change. Once dials succeed again, a slot is restored
+	// every DialPressureRestoreAfter. Slots reserved for writes are never removed, and at least one other slot is kept.
+	AdaptToDialPressure bool
+
+	// DialPressureRestoreAfter is how long dials must succeed before a slot removed by AdaptToDialPressure is restored.
+	// Default: 30s
+	DialPressureRestoreAfter time.Duration
+
+	// ValidateTransport checks the transport created by every recycle before it replaces the current one,
+	// e.g. DialValidator. Transports that fail validation are discarded, and the recycle is retried with exponential
+	// backoff from ValidationBackoff up to MaxValidationBackoff while the current connection keeps serving requests.
+	// Default: none
+	ValidateTransport TransportValidator
+
+	// ValidationBackoff is how long to wait before retrying a recycle whose transport failed ValidateTransport
+	// for the first time. It doubles with every consecutive failure.
+	// Default: 1s
+	ValidationBackoff time.Duration
+
+	// MaxValidationBackoff caps ValidationBackoff.
+	// Default: 1m
+	MaxValidationBackoff time.Duration
+
+	// OnValidationFailure is called from the recycling goroutine when a transport fails ValidateTransport.
+	OnValidationFailure func(ValidationFailureEvent)
+
+	// MaxRecycleThresholdMultiplier caps the thresholds set using WithRecycleThreshold at the host's
+	// RecycleThreshold times this multiplier.
+	// Default: 10
+	MaxRecycleThresholdMultiplier int
+
+	// OnCertificateChange is called from the request's goroutine when a pooled transport's new connection presents
+	// a leaf certificate with a different serial number than its previous connection. See TransportStats.TLS.
+	OnCertificateChange func(CertificateChangeEvent)
+
+	// RecycleVeto is called from the recycling goroutine right before a pooled transport's connection is replaced,
+	// except for manual recycles and in dry-run mode. Returning true cancels that recycle, which is counted in
+	// TransportStats.VetoedRecycles, while its trigger stays armed: the recycle is attempted again, and the veto
+	// consulted again, after the transport's next response. It's called without holding any lock of the request path.
+	// Default: none
+	RecycleVeto func(reason RecycleReason) bool
+
+	// MinBackendDiversity enables warnings through OnLowDiversity when the backend diversity of a host, i.e. the number
+	// of distinct remote IPs of its transports' current connections divided by the number of transports with an open
+	// connection, stays below it for LowDiversityAfter. Transports without connections, e.g. idle ones, aren't
+	// counted. Behind a proxy, the remote IP is the proxy's. See Stats.BackendDiversity and DiversitySink.
+	// Default: none
+	MinBackendDiversity float64
+
+	// LowDiversityAfter is how long the backend diversity must stay below MinBackendDiversity before OnLowDiversity
+	// is called. Diversity is sampled every fifth of it. It must be at least 10ms.
+	// Default: 5m
+	LowDiversityAfter time.Duration
+
+	// OnLowDiversity is called from a background goroutine, once per episode, when the backend diversity of a host
+	// stays below MinBackendDiversity.
+	OnLowDiversity func(LowDiversityEvent)
+
+	// HostAliases maps alias hosts, e.g. private DNS names fronting ARM such as "management.privatelink.azure.com",
+	// to an added host, given as host:port, so that requests to an alias share the pools of the host.
+	// Aliases are normalized like added hosts, so a missing port means 443. Requests to an alias are sent to the host,
+	// and their Host header is derived from it unless HostOptions.PreserveHostHeader is set. The balancer fails to
+	// build if a target hasn't been added, or an alias has. See MatchHostPortAliases.
+	HostAliases map[string]string
+
+	// ValidateOnStart makes Build fail with a *StartupValidationError, and New panic, unless a TLS handshake with
+	// every host succeeds using a clone of its parent transport, e.g. to catch a TLSClientConfig whose RootCAs don't
+	// include a proxy's CA at startup rather than through per-request errors. Hosts the parent transport reaches
+	// through a proxy are skipped. Leave it unset to construct a balancer offline. See NewWithValidation.
+	ValidateOnStart bool
+
+	// StartupValidationTimeout bounds the handshake with every host performed by ValidateOnStart.
+	// Default: 10s
+	StartupValidationTimeout time.Duration
+
+	// AllowSharedParent lets the balancer wrap a parent transport that another balancer, not yet shut down, already
+	// wraps for one of its hosts. Otherwise Build fails with a *SharedParentError, and New panics, since both would
+	// contend for the parent's idle connection limits, e.g. to build the replacement of a ReplaceableTransport.
+	// http.DefaultTransport, the default parent, can always be shared.
+	AllowSharedParent bool
+
+	// Recorder receives a JSON line, a RecordedResponse, for every response received by the pooled transports,
+	// with the rate limiting buckets they track, e.g. to tune RecycleThreshold offline using armbalancertest.Replay.
+	// Writes are serialized, happen on the request path, and their errors are ignored.
+	// Default: none
+	Recorder io.Writer
+
+	// OnPressureChange is called from the request's goroutine whenever the score of Balancer.Pressure crosses one of
+	// PressureBoundaries, in either direction. Scores are evaluated every time rate limiting headers are received.
+	OnPressureChange func(Pressure)
+
+	// PressureBoundaries are the scores at which OnPressureChange is called.
+	// Default: 0.7, 0.9
+	PressureBoundaries []float64
+
+	// OnDialPressure is called from the dialing or requesting goroutine whenever AdaptToDialPressure changes
+	// the effective size of a pool.
+	OnDialPressure func(DialPressureEvent)
+
+	// OnThrottleStorm is called from the recycling goroutine when recycling of a transport is suspended.
+	OnThrottleStorm func(ThrottleStormEvent)
+
+	// OnProtocolDowngrade is called once per pooled transport, from the request's goroutine, when it first receives
+	// an HTTP/1 response, e.g. because a middlebox strips ALPN. Each transport then opens a connection per concurrent
+	// request, which defeats recycling since the rate limiting headers no longer describe a single connection.
+	OnProtocolDowngrade func(ProtocolDowngradeEvent)
+
+	// RecycleOnProtocolDowngrade recycles connections that negotiated HTTP/1, so that a transient middlebox issue
+	// doesn't permanently degrade the pool.
+	RecycleOnProtocolDowngrade bool
+
+	// PerTransportMiddleware wraps the transport of every pooled connection, outermost first.
+	// Middleware sees requests after a pooled transport has been selected, and is applied again
+	// to the new transport every time a connection is recycled.
+	PerTransportMiddleware []func(http.RoundTripper) http.RoundTripper
+
+	// MetricsSink receives measurements such as the time requests wait for a connection.
+	MetricsSink MetricsSink
+
+	// ConnObserver is notified whenever a pooled connection is established or closed.
+	ConnObserver ConnObserver
+
 	// TransportFactory is a function that creates a new transport for a given connection.
+	// It replaces the recyclable transports of every host, so the options configuring recycles don't apply.
 	TransportFactory func(id int, parent *http.Transport, host string, port string, recycleThreshold, minReqsBeforeRecycle int64) http.RoundTripper
 }
 
 // New wraps a transport to provide smart connection pooling and client-side load balancing.
-func New(opts Options) http.RoundTripper {
-	if opts.Transport == nil {
-		opts.Transport = http.DefaultTransport.(*http.Transport)
-	}
-	if opts.Host == "" {
-		opts.Host = "management.azure.com"
+// It panics if opts.Host or any other option is invalid. Use NewBuilder to balance requests across several hosts.
+func New(opts Options) *Balancer {
+	b, err := NewBuilder(opts.Transport).WithOptions(opts).AddHost(opts.Host, HostOptions{}).Build()
+	if err != nil {
+		panic(err.Error())
 	}
-	if i := strings.Index(opts.Host, string(':')); i < 0 {
-		opts.Host += ":443"
+	return b
+}
+
+// Balancer is an http.RoundTripper that distributes requests across pools of recyclable transports, one per host.
+type Balancer struct {
+	hosts        []*hostPool // in registration order
+	dryRun       int32       // atomic
+	reservations *reservationLedger
+	redirects    *redirectPool // nil unless redirect hosts are allowed
+	weights      atomic.Value  // *weightTable
+	timeout      time.Duration
+	metrics      MetricsSink
+	maxBodyBytes int64
+	acquireWait  sampleWindow
+
+	callers *callerBudgets // nil unless caller budgets are configured
+	recent  *recycleLog
+	idle    chan struct{} // closed to stop shrinking idle transports, nil unless enabled
+	budget  *connBudget
+
+	diversity chan struct{} // closed to stop monitoring backend diversity, nil unless enabled
+
+	pressureWatch *pressureWatch // nil unless Options.OnPressureChange is set
+
+	aliases []hostAlias // sorted, see Options.HostAliases
+
+	recorder *responseRecorder // nil unless Options.Recorder is set
+
+	bypassed    int64             // atomic
+	passthrough http.RoundTripper // nil unless built by NewPassthrough
+
+	store    StateStore
+	restored *savedState // nil unless loaded from store
+
+	attribution *attribution // nil unless enabled
+
+	claims []parentClaim // released on shutdown, see Options.AllowSharedParent
+
+	closeLock sync.RWMutex
+	closed    bool
+	inflight  drainCounter
+}
+
+func (t *Balancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.acquire() {
+		return nil, ErrClosed
 	}
+	defer t.inflight.Add(-1)
 
-	host, port, err := net.SplitHostPort(opts.Host)
+	if t.passthrough != nil {
+		return t.passthrough.RoundTrip(req)
+	}
+	req, err := resolveHost(req)
 	if err != nil {
-		panic(fmt.Sprintf("invalid host %q: %s", host, err))
+		return nil, err
+	}
+	if bypassed(req.Context()) {
+		return t.bypass(req)
+	}
+	if t.maxBodyBytes > 0 {
+		var err error
+		if req, err = limitBody(req, t.maxBodyBytes); err != nil {
+			return nil, err
+		}
 	}
-	if host == "" {
-		host = "management.azure.com"
+	if t.callers != nil {
+		if err := t.callers.Check(req, t.minRemaining); err != nil {
+			return nil, err
+		}
 	}
-	if port == "" {
-		port = "443"
+	req = t.traceAcquireWait(req)
+	if _, ok := req.Context().Deadline(); !ok && t.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+		resp, err := t.dispatch(req.WithContext(ctx))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
 	}
-	if opts.PoolSize == 0 {
-		opts.PoolSize = 8
+	return t.dispatch(req)
+}
+
+func (t *Balancer) dispatch(req *http.Request) (*http.Response, error) {
+	t.attribution.Record(req)
+	if p, req := t.route(req); p != nil {
+		p, req = t.weighted(p, req)
+		if !p.Enabled() {
+			return nil, fmt.Errorf("%w: %s", ErrHostDisabled, net.JoinHostPort(p.host, p.port))
+		}
+		p.active.Add(1)
+		resp, err := p.RoundTrip(req)
+		// The pool stays active until the response body is closed, so that Shutdown doesn't close the connection
+		// while the body is still being streamed over it
+		if resp != nil && resp.Body != nil {
+			var once sync.Once
+			resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() { once.Do(func() { p.active.Add(-1) }) }}
+		} else {
+			p.active.Add(-1)
+		}
+		if resp != nil && t.callers != nil {
+			t.callers.Record(req, resp.Header)
+		}
+		return resp, err
 	}
-	if opts.RecycleThreshold == 0 {
-		opts.RecycleThreshold = 100
+	if audience := audienceFromContext(req.Context()); audience != "" {
+		return nil, fmt.Errorf("host %q is not supported by the configured ARM balancer for audience %q", req.URL.Host, audience)
 	}
-	if opts.MinReqsBeforeRecycle == 0 {
-		opts.MinReqsBeforeRecycle = 10
+	if t.redirects != nil && t.redirects.Allowed(req.URL) {
+		return t.redirects.RoundTrip(req)
 	}
+	return nil, t.notSupportedError(req.URL)
+}
 
-	if opts.TransportFactory == nil {
-		opts.TransportFactory = newRecyclableTransport
+// route returns the pool serving the request, along with the request rewritten for it, or nil if no pool serves it.
+func (t *Balancer) route(req *http.Request) (*hostPool, *http.Request) {
+	p := t.lookup(req.URL, audienceFromContext(req.Context()))
+	if p == nil {
+		return nil, req
 	}
+	req = p.withCanonicalHost(req)
+	return p, p.withDefaultPort(req)
+}
 
-	t := &transportPool{pool: make([]http.RoundTripper, opts.PoolSize)}
-	for i := range t.pool {
-		t.pool[i] = newRecyclableTransport(i, opts.Transport, host, port, opts.RecycleThreshold, opts.MinReqsBeforeRecycle)
+// lookup returns the pool serving the request's host and audience, preferring the first registered pool
+// when several match, and pools matching the host over those matching an alias.
+func (t *Balancer) lookup(u *url.URL, audience string) *hostPool {
+	for _, p := range t.hosts {
+		if p.audience == audience && matchHostPort(u, p.host, p.port, p.defaultPort) {
+			return p
+		}
+	}
+	return t.lookupAlias(u, audience)
+}
+
+func (t *Balancer) notSupportedError(u *url.URL) error {
+	err := &HostNotSupportedError{Host: u.Host, Suggestion: suggestHost(u, t.hosts)}
+	for _, p := range t.hosts {
+		err.Supported = append(err.Supported, net.JoinHostPort(p.host, p.port))
+	}
+	return err
+}
+
+// hostPool distributes requests for a single host across its transports.
+type hostPool struct {
+	host            string
+	port            string
+	pool            []http.RoundTripper
+	cursor          int64
+	hedgeAfter      time.Duration
+	hedgeBudget     float64
+	hedged          int64 // atomic
+	goAwayReplays   int64 // atomic
+	injectAggregate bool
+	reservedWrites  int   // the last reservedWrites transports of the pool only serve writes
+	writeCursor     int64 // atomic
+	strategy        SelectionStrategy
+	usage           []slotUsage // indexed like pool
+	disabled        int32       // atomic
+	preserveHost    bool
+	audience        string // canonical, empty for untagged requests
+	parent          *http.Transport
+	pressure        *dialPressure // nil unless Options.AdaptToDialPressure is set
+	defaultPort     string        // assumed for request URLs without a port, see HostOptions.DefaultPort
+	threshold       int64         // the host's RecycleThreshold, see Balancer.Pressure
+
+	latencySink LatencySink // nil unless the MetricsSink implements it
+	budget      *connBudget // delays reactivating quiesced transports, see Options.MaxNewConnectionsPerMinute
+
+	active drainCounter // requests in flight, see Balancer.Shutdown
+
+	tightDeadline time.Duration // zero when disabled, see Options.TightDeadline
+	riskMargin    int64
+	riskAvoided   int64 // atomic
+}
+
+func (t *hostPool) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	lo, n, cursor := t.slots(req)
+	i := t.pick(lo, n, cursor)
+	i = t.avoidQuiesced(lo, n, i)
+	if t.hasTightDeadline(req) {
+		i = t.avoidAtRisk(lo, n, i)
+	}
+	if t.hedgeAfter > 0 && n > 1 && hedgeable(req) {
+		resp, err = t.hedge(req, i, lo+(i-lo+1)%n)
+	} else {
+		resp, err = t.send(i, req)
+	}
+	if err != nil && n > 1 && isGoAway(err) && canReplay(req) {
+		// The transport is being recycled, replay on the next one
+		if replay, replayErr := replayRequest(req.Context(), req); replayErr == nil {
+			atomic.AddInt64(&t.goAwayReplays, 1)
+			resp, err = t.send(lo+(i-lo+1)%n, replay)
+		}
+	}
+	if resp != nil && t.injectAggregate {
+		for bucket, val := range t.minRemaining() {
+			resp.Header.Set(aggregateHeaderPrefix+bucket, strconv.FormatInt(val, 10))
+		}
 	}
-	return t
+	return resp, err
 }
 
-type transportPool struct {
-	pool   []http.RoundTripper
-	cursor int64
+// slots returns the range of transports that can serve the request, along with the cursor used to pick one of them.
+func (t *hostPool) slots(req *http.Request) (lo, n int, cursor *int64) {
+	if t.reservedWrites <= 0 {
+		return 0, t.activeSlots(len(t.pool)), &t.cursor
+	}
+	reads := len(t.pool) - t.reservedWrites
+	if isRead(req) {
+		return 0, t.activeSlots(reads), &t.cursor
+	}
+	return reads, t.reservedWrites, &t.writeCursor
 }
 
-func (t *transportPool) RoundTrip(req *http.Request) (*http.Response, error) {
-	i := int(atomic.AddInt64(&t.cursor, 1)) % len(t.pool)
-	return t.pool[i].RoundTrip(req)
+// minRemaining returns the lowest value of every bucket reported by the pool's transports.
+func (t *hostPool) minRemaining() map[string]int64 {
+	mins := map[string]int64{}
+	for _, rt := range t.pool {
+		r, ok := rt.(*recyclableTransport)
+		if !ok {
+			continue
+		}
+		for bucket, val := range r.state.Snapshot() {
+			if min, ok := mins[bucket]; !ok || val < min {
+				mins[bucket] = val
+			}
+		}
+	}
+	return mins
 }
 
 type recyclableTransport struct {
-	lock        sync.Mutex // only hold while copying pointer - not calling RoundTrip
-	host        string
-	port        string
-	current     *http.Transport
-	counter     int64 // atomic
-	activeCount *sync.WaitGroup
-	state       *connState
-	signal      chan struct{}
+	lock         sync.Mutex // only hold while copying pointer - not calling RoundTrip
+	id           int
+	host         string
+	port         string
+	newTransport transportFactory
+	current      *generation
+	state        *connState
+	errors       *errorState
+	methods      *methodCounter
+	conns        *connTracker
+	reservations *reservationLedger // shared by the balancer
+	policy       RecyclePolicy
+	onRecycle    func(RecycleEvent)
+	dryRun       *int32 // atomic, shared by the balancer
+	chaos        float64
+	chaosFired   int32 // atomic
+	connFailed   int32 // atomic
+	goAway       int32 // atomic
+	downgrade    int32 // atomic, set when an HTTP/1 response should trigger a recycle
+	downgraded   int32 // atomic, set once the first HTTP/1 response has been reported
+	quiesced     int32 // atomic
+	signal       chan struct{}
+	decided      chan chan struct{} // closed once the synchronous recycle decision has been applied
+	delayed      chan delayedRecycle
+	budgetWait   int32              // atomic, set while a recycle waits for the connection budget
+	manual       chan chan struct{} // closed once the requested recycle has drained
+	done         chan struct{}
+
+	recycles           int64 // atomic
+	suppressedRecycles int64 // atomic
+	lastGeneration     int64 // guarded by lock
+
+	globalBuckets GlobalBucketBehavior
+	annotate      bool
+	drainTimeout  time.Duration
+	forceClose    bool
+	lingerGrace   time.Duration // zero when disabled, see Options.LingeringConnGracePeriod
+	synchronous   bool
+	middleware    []func(http.RoundTripper) http.RoundTripper
+	churn         *churnDetector // nil when churn detection is disabled
+	postponer     *recyclePostponer
+	budget        *connBudget
+	ignoredStatus map[int]bool
+	onDowngrade   func(ProtocolDowngradeEvent)
+	recycleHTTP1  bool
+	excludedPaths []string // lowercase, see Options.AccountingExcludePathPrefixes
+	requestWeight func(*http.Request) int64
+
+	busySince  int64 // atomic, unix nanoseconds since the recycling goroutine started its current work, zero when idle
+	stallAfter time.Duration
+	onStall    func(RecyclerStallEvent)
+
+	pressure *dialPressure // shared by the pool, nil unless enabled
+
+	validate             TransportValidator // nil unless enabled
+	validationBackoff    time.Duration
+	maxValidationBackoff time.Duration
+	onValidationFailure  func(ValidationFailureEvent)
+	validationWait       int32 // atomic, set while a recycle waits to be retried after a validation failure
+	validationAttempts   int   // consecutive validation failures, only used by the recycling goroutine
+	validationFailures   int64 // atomic, over the transport's lifetime
+
+	lingeringCloses int64 // atomic, over the transport's lifetime
+
+	certSerial   atomic.Value // string, of the latest connection's leaf certificate
+	onCertChange func(CertificateChangeEvent)
+
+	maxRequestThreshold int64 // see WithRecycleThreshold
+	requestThreshold    int64 // atomic, of the latest response that crossed its request's threshold
+	thresholdCrossed    int32 // atomic, set once requestThreshold is stored, since any value is a valid threshold
+	appliedThreshold    int64 // of the latest recycle caused by a request's threshold, only used by the recycling goroutine
+
+	veto           func(RecycleReason) bool // nil unless Options.RecycleVeto is set
+	vetoedRecycles int64                    // atomic
+
+	onQuota func() // called after rate limiting headers have been applied, nil if not needed
+
+	recorder *responseRecorder // shared by the balancer, nil unless Options.Recorder is set
 }
 
-func newRecyclableTransport(id int, parent *http.Transport, host string, port string, recycleThreshold, minReqsBeforeRecycle int64) http.RoundTripper {
-	tx := parent.Clone()
-	tx.MaxConnsPerHost = 1
+// roundTripperCloser is the transport swapped out by every recycle.
+type roundTripperCloser interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// transportFactory creates the transport of a new generation.
+type transportFactory func(gen *generation) roundTripperCloser
+
+// generation is the transport serving requests between two recycles.
+type generation struct {
+	number      int64 // starts at 1 and increases by one with every recycle
+	tx          roundTripperCloser
+	rt          http.RoundTripper // tx wrapped by the per-transport middleware
+	born        time.Time
+	retired     time.Time // set when the generation is replaced
+	requests    int64     // atomic
+	weight      int64     // atomic, requests weighted by Options.RequestWeight
+	activeCount sync.WaitGroup
+	proto       atomic.Value // string, of the latest response
+	listeners   drainListeners
+	tls         atomic.Value // *tlsState, of the latest connection
+	proxy       atomic.Value // string, the redacted URL of the pinned proxy
+}
+
+// inactive returns a channel that is closed once the generation has no active requests left.
+func (g *generation) inactive() <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		g.activeCount.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+// transportConfig holds everything needed to construct a recyclableTransport.
+type transportConfig struct {
+	id     int
+	parent *http.Transport
+	host   string
+	port   string
+	policy RecyclePolicy
+
+	onRecycle    func(RecycleEvent)
+	dryRun       *int32
+	chaos        float64
+	reservations *reservationLedger
+	observer     ConnObserver
+
+	globalBuckets GlobalBucketBehavior
+	quotaHeaders  []string
+	annotate      bool
+	drainTimeout  time.Duration
+	forceClose    bool
+	lingerGrace   time.Duration
+	synchronous   bool
+	middleware    []func(http.RoundTripper) http.RoundTripper
+	churn         *churnDetector
+	postponer     *recyclePostponer
+	budget        *connBudget
+	maxBuckets    int
+	ignoredStatus map[int]bool
+	onDowngrade   func(ProtocolDowngradeEvent)
+	recycleHTTP1  bool
+	scopes        bucketScopes
+	excludedPaths []string // lowercase
+	requestWeight func(*http.Request) int64
+	stallAfter    time.Duration
+	onStall       func(RecyclerStallEvent)
+	pressure      *dialPressure
+
+	validate             TransportValidator
+	validationBackoff    time.Duration
+	maxValidationBackoff time.Duration
+	onValidationFailure  func(ValidationFailureEvent)
+
+	onCertChange func(CertificateChangeEvent)
+
+	maxRequestThreshold int64
+
+	veto func(RecycleReason) bool
+
+	onQuota  func()
+	recorder *responseRecorder
+
+	// newTransport replaces the clones of parent, e.g. with fakes in tests.
+	newTransport transportFactory
+}
+
+func buildRecyclableTransport(cfg transportConfig) *recyclableTransport {
+	if cfg.dryRun == nil {
+		cfg.dryRun = new(int32)
+	}
+	if cfg.reservations == nil {
+		cfg.reservations = newReservationLedger()
+	}
 
 	r := &recyclableTransport{
-		host:        host,
-		port:        port,
-		current:     tx.Clone(),
-		activeCount: &sync.WaitGroup{},
-		state:       newConnState(),
-		signal:      make(chan struct{}, 1),
+		id:           cfg.id,
+		host:         cfg.host,
+		port:         cfg.port,
+		newTransport: cfg.newTransport,
+		state:        newConnState(cfg.quotaHeaders, cfg.maxBuckets, protectedBuckets(cfg.policy), cfg.scopes),
+		errors:       &errorState{},
+		methods:      &methodCounter{},
+		conns:        newConnTracker(cfg.id, cfg.observer, cfg.budget),
+		reservations: cfg.reservations,
+		policy:       cfg.policy,
+		onRecycle:    cfg.onRecycle,
+		dryRun:       cfg.dryRun,
+		chaos:        cfg.chaos,
+		signal:       make(chan struct{}, 1),
+		decided:      make(chan chan struct{}),
+		delayed:      make(chan delayedRecycle),
+		manual:       make(chan chan struct{}),
+		done:         make(chan struct{}),
+
+		globalBuckets: cfg.globalBuckets,
+		annotate:      cfg.annotate,
+		drainTimeout:  cfg.drainTimeout,
+		forceClose:    cfg.forceClose,
+		lingerGrace:   cfg.lingerGrace,
+		synchronous:   cfg.synchronous,
+		middleware:    cfg.middleware,
+		churn:         cfg.churn,
+		postponer:     cfg.postponer,
+		budget:        cfg.budget,
+		ignoredStatus: cfg.ignoredStatus,
+		onDowngrade:   cfg.onDowngrade,
+		recycleHTTP1:  cfg.recycleHTTP1,
+		excludedPaths: cfg.excludedPaths,
+		requestWeight: cfg.requestWeight,
+		stallAfter:    cfg.stallAfter,
+		onStall:       cfg.onStall,
+		pressure:      cfg.pressure,
+
+		validate:             cfg.validate,
+		validationBackoff:    cfg.validationBackoff,
+		maxValidationBackoff: cfg.maxValidationBackoff,
+		onValidationFailure:  cfg.onValidationFailure,
+
+		onCertChange: cfg.onCertChange,
+
+		maxRequestThreshold: cfg.maxRequestThreshold,
+
+		veto: cfg.veto,
+
+		onQuota:  cfg.onQuota,
+		recorder: cfg.recorder,
 	}
+	r.conns.pressure = cfg.pressure
+	if r.newTransport == nil {
+		template := cfg.parent.Clone()
+		template.MaxConnsPerHost = 1
+		r.newTransport = func(gen *generation) roundTripperCloser {
+			tx := template.Clone()
+			pinProxy(tx, gen)
+			r.conns.Install(tx, gen)
+			return tx
+		}
+	}
+	r.current = r.newGeneration()
 	go func() {
-		for range r.signal {
-			if r.state.Min() > recycleThreshold || atomic.LoadInt64(&r.counter) < minReqsBeforeRecycle {
-				continue
+		for {
+			select {
+			case <-r.signal:
+				r.process(r.decide)
+			case applied := <-r.decided:
+				r.process(r.decide)
+				close(applied)
+			case d := <-r.delayed:
+				atomic.StoreInt32(&r.budgetWait, 0)
+				atomic.StoreInt32(&r.validationWait, 0)
+				r.process(func() { r.recycle(d.reason, d.snapshot, nil) })
+			case drained := <-r.manual:
+				r.process(func() { r.recycle(RecycleReasonManual, r.Snapshot(), drained) })
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// decide recycles the transport if needed after a response has been received.
+// It must only be called from the recycling goroutine.
+func (t *recyclableTransport) decide() {
+	snapshot := t.Snapshot()
+	if snapshot.sent == 0 {
+		return // stale signal sent before the last swap, wait for the new connection's first response
+	}
+	switch {
+	case atomic.CompareAndSwapInt32(&t.goAway, 1, 0):
+		t.recycle(RecycleReasonGoAway, snapshot, nil)
+	case atomic.CompareAndSwapInt32(&t.downgrade, 1, 0):
+		t.recycle(RecycleReasonProtocolDowngrade, snapshot, nil)
+	case atomic.CompareAndSwapInt32(&t.connFailed, 1, 0):
+		t.recycle(RecycleReasonConnFailure, snapshot, nil)
+	case atomic.CompareAndSwapInt32(&t.chaosFired, 1, 0):
+		t.recycle(RecycleReasonChaos, snapshot, nil)
+	case atomic.CompareAndSwapInt32(&t.thresholdCrossed, 1, 0):
+		t.appliedThreshold = atomic.LoadInt64(&t.requestThreshold)
+		if t.churn.Allow(snapshot) {
+			t.recycle(RecycleReasonRequestThreshold, snapshot, nil)
+		}
+	case t.policy.ShouldRecycle(snapshot):
+		if postpone, first := t.postponer.Postpone(snapshot); postpone {
+			if first {
+				t.emit(RecycleEvent{TransportID: t.id, Generation: snapshot.Generation, Reason: RecycleReasonPolicy, Postponed: true, Snapshot: snapshot})
 			}
+			return
+		}
+		if t.churn.Allow(snapshot) {
+			t.recycle(RecycleReasonPolicy, snapshot, nil)
+		}
+	}
+}
+
+// excludedPath returns true for the paths excluded from the quota accounting.
+func (t *recyclableTransport) excludedPath(path string) bool {
+	if len(t.excludedPaths) == 0 {
+		return false
+	}
+	path = strings.ToLower(path)
+	for _, prefix := range t.excludedPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// weigh returns how much the request counts towards ConnSnapshot.Requests, see Options.RequestWeight.
+func (t *recyclableTransport) weigh(req *http.Request) int64 {
+	if t.requestWeight == nil {
+		return 1
+	}
+	if w := t.requestWeight(req); w > 0 {
+		return w
+	}
+	return 0
+}
+
+// reportDowngrade handles a response that wasn't served over HTTP/2.
+func (t *recyclableTransport) reportDowngrade(gen *generation, proto string) {
+	if t.recycleHTTP1 {
+		atomic.StoreInt32(&t.downgrade, 1)
+	}
+	if atomic.CompareAndSwapInt32(&t.downgraded, 0, 1) && t.onDowngrade != nil {
+		t.onDowngrade(ProtocolDowngradeEvent{TransportID: t.id, Generation: gen.number, Proto: proto})
+	}
+}
 
-			// Swap a new transport in place while holding a pointer to the previous
-			r.lock.Lock()
-			previous := r.current
-			previousActiveCount := r.activeCount
-			r.current = tx.Clone()
-			atomic.StoreInt64(&r.counter, 0)
-			r.activeCount = &sync.WaitGroup{}
-			r.lock.Unlock()
+// newGeneration creates a new transport, by default a clone of the parent whose connections are tracked.
+// It must be called while holding the lock, or before the transport is used.
+func (t *recyclableTransport) newGeneration() *generation {
+	t.lastGeneration++
+	gen := &generation{number: t.lastGeneration, born: time.Now()}
+	gen.tx = t.newTransport(gen)
+	gen.rt = gen.tx
+	for i := len(t.middleware) - 1; i >= 0; i-- {
+		gen.rt = t.middleware[i](gen.rt)
+	}
+	return gen
+}
 
-			// Wait for all active requests against the previous transport to complete before closing its idle connections
-			previousActiveCount.Wait()
-			previous.CloseIdleConnections()
+// recycle replaces the current transport with a new one, or only reports that it would have in dry-run mode.
+// drained, if not nil, is closed once the previous transport has drained or right away if it wasn't replaced.
+// It must only be called from the recycling goroutine.
+func (t *recyclableTransport) recycle(reason RecycleReason, snapshot ConnSnapshot, drained chan struct{}) {
+	swapped := false
+	defer func() {
+		if !swapped && drained != nil {
+			close(drained)
+		}
+	}()
+
+	event := RecycleEvent{
+		TransportID: t.id,
+		Generation:  snapshot.Generation,
+		Reason:      reason,
+		DryRun:      reason != RecycleReasonManual && atomic.LoadInt32(t.dryRun) == 1,
+		Snapshot:    snapshot,
+	}
+	if reason == RecycleReasonRequestThreshold {
+		event.RequestThreshold = t.appliedThreshold
+	}
+	if reason != RecycleReasonManual && atomic.LoadInt32(&t.validationWait) == 1 {
+		return // the recycle will be retried once its validation backoff has passed
+	}
+	if !event.DryRun && reason != RecycleReasonManual && t.vetoed(reason) {
+		return
+	}
+	// Manual recycles waited for the churn backoff and reserved their connection in ForceRecycle
+	if !event.DryRun && reason != RecycleReasonManual && t.postponeForConnBudget(event) {
+		return
+	}
+	if event.DryRun {
+		// Reset the request counter so the min requests safeguard applies between would-be recycles
+		t.lock.Lock()
+		atomic.StoreInt64(&t.current.requests, 0)
+		atomic.StoreInt64(&t.current.weight, 0)
+		t.lock.Unlock()
+		atomic.AddInt64(&t.suppressedRecycles, 1)
+		t.emit(event)
+		return
+	}
+
+	// Create and validate the new transport first if required, so that a broken one never replaces the current one
+	var next *generation
+	if t.validate != nil {
+		if next = t.validatedGeneration(event); next == nil {
+			return
+		}
+	}
+
+	// Swap a new transport in place while holding a pointer to the previous
+	t.lock.Lock()
+	stale := t.current.number != snapshot.Generation // the decision was made for a generation that has already been replaced
+	select {
+	case <-t.done:
+		stale = true
+	default:
+	}
+	if stale {
+		if next != nil && t.lastGeneration == next.number {
+			t.lastGeneration--
+		}
+		t.lock.Unlock()
+		if next != nil {
+			next.tx.CloseIdleConnections()
+		}
+		return
+	}
+	if next == nil {
+		next = t.newGeneration()
+	}
+	previous := t.current
+	previous.retired = time.Now()
+	t.current = next
+	t.errors.Reset()
+	t.lock.Unlock()
+
+	atomic.AddInt64(&t.recycles, 1)
+	previous.listeners.Drain()
+	t.emit(event)
+
+	// Drain in the background, since the previous generation stays active for as long as the bodies of its
+	// responses are open, which must not hold up the next recycles
+	swapped = true
+	go func() {
+		t.drain(previous)
+		if drained != nil {
+			close(drained)
 		}
 	}()
-	return r
+}
+
+// drain waits for all active requests against the previous generation to complete, up to the drain timeout,
+// before closing its idle connections. Connections that are still open once the drain timeout has passed,
+// e.g. because of long-lived HTTP/2 streams, are then closed if forceClose is set.
+// Closing the transport ends the drain early, so that no background work on its connections outlives Close.
+func (t *recyclableTransport) drain(previous *generation) {
+	var deadline <-chan time.Time
+	if t.drainTimeout > 0 {
+		timer := time.NewTimer(t.drainTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case <-previous.inactive():
+	case <-deadline:
+	case <-t.done:
+	}
+	previous.tx.CloseIdleConnections()
+
+	if t.forceClose && t.drainTimeout > 0 {
+		time.AfterFunc(time.Until(previous.retired.Add(t.drainTimeout)), func() {
+			select {
+			case <-t.done:
+				return // Close already closed what it had to
+			default:
+			}
+			t.conns.CloseGeneration(previous)
+		})
+	}
+	if t.lingerGrace > 0 {
+		go t.closeLingering(previous)
+	}
+}
+
+// closeLingering closes the connections of the previous generation that are still open lingerGrace after its
+// last request has completed. net/http doesn't consider a connection idle while it has a stream it hasn't finished
+// with, e.g. a half-closed one, so CloseIdleConnections may leave it open to the previous ARM instance indefinitely.
+func (t *recyclableTransport) closeLingering(previous *generation) {
+	select {
+	case <-previous.inactive():
+	case <-t.done:
+		return
+	}
+	timer := time.NewTimer(t.lingerGrace)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-t.done:
+		return
+	}
+	if n := t.conns.CloseGeneration(previous); n > 0 {
+		atomic.AddInt64(&t.lingeringCloses, int64(n))
+	}
+}
+
+// ForceRecycle asks the recycling goroutine to recycle the transport regardless of its policy or dry-run mode,
+// once recycling isn't suspended by the churn backoff and the connection budget allows a new connection.
+// The returned channel is closed once the previous connection has drained, or right away if the transport is closed.
+func (t *recyclableTransport) ForceRecycle(ctx context.Context) (<-chan struct{}, error) {
+	if err := t.churn.Wait(ctx, t.done); err != nil {
+		return nil, err
+	}
+	if err := t.budget.Wait(ctx, t.done); err != nil {
+		return nil, err
+	}
+	drained := make(chan struct{})
+	select {
+	case t.manual <- drained:
+		return drained, nil
+	case <-t.done:
+		close(drained)
+		return drained, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *recyclableTransport) emit(event RecycleEvent) {
+	if t.onRecycle != nil {
+		t.onRecycle(event)
+	}
+}
+
+// Close stops the recycling goroutine and closes idle connections.
+// When force is true, connections serving in-flight requests are closed as well.
+func (t *recyclableTransport) Close(force bool) {
+	t.lock.Lock()
+	select {
+	case <-t.done:
+	default:
+		close(t.done)
+	}
+	gen := t.current
+	t.lock.Unlock()
+
+	gen.tx.CloseIdleConnections()
+	if force {
+		t.conns.CloseAll()
+	}
 }
 
 // return retrue if transport host matched with request host
 func (t *recyclableTransport) compareHost(request *url.URL) bool {
-	parsedHostName := request.Hostname()
-	if t.host != parsedHostName {
+	return MatchHostPort(request, t.host, t.port)
+}
+
+// MatchHostPort returns true if the request URL targets the given host and port, which is how the balancer
+// decides which pool serves a request:
+//   - host names are compared ignoring case and a trailing dot, and IPv6 addresses regardless of brackets
+//   - URLs without a port, or with an empty one, target their scheme's default port: 443 for https or no scheme,
+//     and 80 for http, unless the pool sets HostOptions.DefaultPort
+//   - URLs without a port and with another scheme match any port
+//   - otherwise the ports must be equal
+//
+// Opaque URLs without a host, such as https://management.azure.com/ given as Opaque "//management.azure.com/",
+// are matched using the host of their opaque part.
+func MatchHostPort(reqURL *url.URL, host, port string) bool {
+	return matchHostPort(reqURL, host, port, "")
+}
+
+// matchHostPort is MatchHostPort, assuming defaultPort for URLs without a port unless it's empty.
+func matchHostPort(reqURL *url.URL, host, port, defaultPort string) bool {
+	if reqURL.Host == "" {
+		if opaqueHost, _ := splitOpaque(reqURL.Opaque); opaqueHost != "" {
+			u := *reqURL
+			u.Host = opaqueHost
+			reqURL = &u
+		}
+	}
+	if !strings.EqualFold(canonicalHostName(reqURL.Hostname()), canonicalHostName(host)) {
 		return false
 	}
-	if len(request.Host) == len(parsedHostName) {
-		return true
+	reqPort := reqURL.Port()
+	if reqPort == "" {
+		reqPort = defaultPort
+	}
+	if reqPort == "" {
+		reqPort = schemePort(reqURL.Scheme)
+	}
+	return reqPort == "" || reqPort == port
+}
+
+// schemePort returns the default port of a URL scheme, or an empty string if it's unknown.
+// Requests without a scheme are assumed to use https.
+func schemePort(scheme string) string {
+	switch strings.ToLower(scheme) {
+	case "https", "":
+		return "443"
+	case "http":
+		return "80"
 	}
-	return t.port == request.Port()
+	return ""
+}
+
+func canonicalHostName(host string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ".")
 }
 
 func (t *recyclableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -156,56 +1279,399 @@ func (t *recyclableTransport) RoundTrip(req *http.Request) (*http.Response, erro
 		return nil, fmt.Errorf("host %q is not supported by the configured ARM balancer, supported host name is %q", req.URL.Host, t.host)
 	}
 
+	if atomic.LoadInt32(&t.quiesced) == 1 {
+		// Reactivating dials a new connection, which waits for the connection budget like recycles
+		if err := t.budget.Wait(req.Context(), t.done); err != nil {
+			return nil, err
+		}
+		if atomic.CompareAndSwapInt32(&t.quiesced, 1, 0) {
+			t.reactivate()
+		}
+	}
+
 	t.lock.Lock()
-	tx := t.current
-	wg := t.activeCount
-	wg.Add(1)
+	gen := t.current
+	gen.activeCount.Add(1)
 	t.lock.Unlock()
 
-	defer func() {
-		t.lock.Lock()
-		wg.Add(-1)
-		t.lock.Unlock()
-	}()
+	accounted := !t.excludedPath(req.URL.Path)
+	if accounted {
+		req = t.trace1xx(req)
+	}
+	listener := gen.listeners.Listen(req.Context())
+
+	// The generation stays active until the response body is closed, so that a recycle doesn't close
+	// the connection while the body is still being streamed over it
+	var once sync.Once
+	var resp *http.Response
+	release := func() {
+		once.Do(func() {
+			t.lock.Lock()
+			gen.activeCount.Add(-1)
+			t.lock.Unlock()
+			gen.listeners.Unlisten(listener)
+			if accounted && resp != nil && !t.ignoredStatus[resp.StatusCode] {
+				t.applyTrailer(resp.Trailer)
+			}
+		})
+	}
 
-	resp, err := tx.RoundTrip(req)
-	atomic.AddInt64(&t.counter, 1)
+	resp, err := gen.rt.RoundTrip(req)
+	if resp != nil && resp.Body != nil {
+		resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	} else {
+		release()
+	}
+	if accounted {
+		atomic.AddInt64(&gen.requests, 1)
+		atomic.AddInt64(&gen.weight, t.weigh(req))
+	}
+	t.methods.Record(req.Method)
+	t.errors.Record(resp, err)
 
 	if resp != nil {
-		t.state.ApplyHeader(resp.Header)
+		canonicalizeHeader(resp.Header)
+		if accounted && !t.ignoredStatus[resp.StatusCode] {
+			t.state.ApplyHeader(resp.Header)
+			t.reservations.ApplyHeader(resp.Header)
+			t.checkRequestThreshold(req)
+			t.quotaApplied()
+		}
+		if resp.Proto != "" {
+			gen.proto.Store(resp.Proto)
+		}
+		if resp.ProtoMajor == 1 {
+			t.reportDowngrade(gen, resp.Proto)
+		}
+		t.recordTLS(gen, resp.TLS)
+		t.record(gen, resp.StatusCode)
+		if t.annotate {
+			resp.Header.Set(transportIDHeader, strconv.Itoa(t.id))
+			resp.Header.Set(generationHeader, strconv.FormatInt(gen.number, 10))
+		}
+	}
+	if ClassifyError(err) == ErrorClassConnReset {
+		atomic.StoreInt32(&t.connFailed, 1)
+	}
+	if isGoAway(err) {
+		atomic.StoreInt32(&t.goAway, 1)
+	}
+	if err != nil {
+		err = &TransportError{Host: t.host, TransportID: t.id, Generation: gen.number, Err: err}
+	}
+	if t.chaos > 0 && rand.Float64() < t.chaos {
+		atomic.StoreInt32(&t.chaosFired, 1)
 	}
 
+	if t.synchronous {
+		// Only the decision and the swap are waited for: drains and recycles waiting for the connection budget
+		// happen in the background
+		applied := make(chan struct{})
+		select {
+		case t.decided <- applied:
+			select {
+			case <-applied:
+			case <-req.Context().Done():
+			}
+		case <-t.done:
+		case <-req.Context().Done():
+		}
+		return resp, err
+	}
+	t.notify()
+	return resp, err
+}
+
+// notify asks the recycling goroutine to reconsider recycling the connection, unless it has already been asked to.
+func (t *recyclableTransport) notify() {
 	select {
 	case t.signal <- struct{}{}:
 	default:
 	}
-	return resp, err
+}
+
+// trace1xx applies the rate limiting headers of the informational responses received for the request,
+// including those handled by net/http such as 100 Continue.
+func (t *recyclableTransport) trace1xx(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			t.state.ApplyHeader(http.Header(header))
+			t.quotaApplied()
+			return nil
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// applyTrailer applies the rate limiting headers sent as trailers, which are only known once the body has been
+// read, and asks for the recycle to be reconsidered. Unlike headers, trailers don't consume reservations.
+func (t *recyclableTransport) applyTrailer(trailer http.Header) {
+	if len(trailer) == 0 {
+		return
+	}
+	t.state.ApplyHeader(trailer)
+	t.quotaApplied()
+	t.notify()
+}
+
+func (t *recyclableTransport) quotaApplied() {
+	if t.onQuota != nil {
+		t.onQuota()
+	}
+}
+
+// releaseOnClose calls release once the body has been closed or fully read.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseOnClose) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil {
+		r.release()
+	}
+	return n, err
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
+}
+
+func (t *recyclableTransport) Snapshot() ConnSnapshot {
+	t.lock.Lock()
+	gen := t.current
+	t.lock.Unlock()
+
+	remaining, global, version := t.state.Scoped()
+	if t.globalBuckets == GlobalBucketsRecycle {
+		for bucket, val := range global {
+			remaining[bucket] = val
+		}
+	}
+	return ConnSnapshot{
+		TransportID: t.id,
+		Generation:  gen.number,
+		Remaining:   remaining,
+		Global:      global,
+		Version:     version,
+		Requests:    atomic.LoadInt64(&gen.weight),
+		Age:         time.Since(gen.born),
+		Errors:      t.errors.Snapshot(),
+		sent:        atomic.LoadInt64(&gen.requests),
+	}
+}
+
+func (t *recyclableTransport) Stats() TransportStats {
+	t.lock.Lock()
+	gen := t.current
+	t.lock.Unlock()
+	proto, _ := gen.proto.Load().(string)
+	proxy, _ := gen.proxy.Load().(string)
+
+	stats := TransportStats{
+		Host:     net.JoinHostPort(t.host, t.port),
+		ID:       t.id,
+		Requests: atomic.LoadInt64(&gen.requests),
+		Errors:   t.errors.Snapshot(),
+		Methods:  t.methods.Snapshot(),
+
+		Generation:         gen.number,
+		Recycles:           atomic.LoadInt64(&t.recycles),
+		SuppressedRecycles: atomic.LoadInt64(&t.suppressedRecycles),
+		Quiesced:           atomic.LoadInt32(&t.quiesced) == 1,
+		EvictedBuckets:     t.state.Evictions(),
+		Protocol:           proto,
+		RecyclerBusySince:  t.busyStart(),
+		RecyclerStalled:    t.stalled(),
+		ValidationFailures: atomic.LoadInt64(&t.validationFailures),
+		TLS:                gen.tlsInfo(),
+		Proxy:              proxy,
+	}
+	stats.LingeringConnsClosed = atomic.LoadInt64(&t.lingeringCloses)
+	stats.VetoedRecycles = atomic.LoadInt64(&t.vetoedRecycles)
+	return stats
 }
 
 type connState struct {
-	lock  sync.Mutex
-	types map[string]int64
+	lock   sync.Mutex
+	types  map[string]int64
+	global map[string]int64 // principal-scoped buckets, see bucketScopes
+	extra  []string         // canonical names of additional quota headers
+	scopes bucketScopes
+
+	version uint64 // incremented by every ApplyHeader call
+
+	maxBuckets int               // zero for no limit
+	protected  []string          // suffixes of the buckets that are never evicted
+	updated    map[string]uint64 // version of the last update of every bucket
+	evictions  int64
 }
 
-func newConnState() *connState {
-	return &connState{types: make(map[string]int64)}
+// ignoredStatuses returns the set of statuses whose rate limiting headers are ignored.
+func ignoredStatuses(codes []int) map[int]bool {
+	if codes == nil {
+		codes = []int{http.StatusUnauthorized, http.StatusForbidden}
+	}
+	set := make(map[int]bool, len(codes))
+	for _, code := range codes {
+		set[code] = true
+	}
+	return set
+}
+
+func newConnState(quotaHeaders []string, maxBuckets int, protected []string, scopes bucketScopes) *connState {
+	c := &connState{
+		scopes:     scopes,
+		types:      make(map[string]int64),
+		global:     make(map[string]int64),
+		maxBuckets: maxBuckets,
+		protected:  protected,
+		updated:    make(map[string]uint64),
+	}
+	for _, name := range quotaHeaders {
+		c.extra = append(c.extra, http.CanonicalHeaderKey(name))
+	}
+	return c
 }
 
 func (c *connState) ApplyHeader(h http.Header) {
 	c.lock.Lock()
 	for key, vals := range h {
-		if !strings.HasPrefix(key, "X-Ms-Ratelimit-Remaining-") {
+		bucket, ok := rateLimitBucket(key)
+		if !ok || len(vals) == 0 {
 			continue
 		}
 		n, err := strconv.ParseInt(vals[0], 10, 0)
 		if err != nil {
 			continue
 		}
-		c.types[key[len(rateLimitHeaderPrefix):]] = n
+		if c.scopes.IsPrincipal(bucket) {
+			c.global[bucket] = n
+		} else {
+			c.types[bucket] = n
+		}
+		c.updated[bucket] = c.version
 	}
+	for _, name := range c.extra {
+		vals := headerValues(h, name)
+		if len(vals) == 0 {
+			continue
+		}
+		if n, err := strconv.ParseInt(vals[0], 10, 0); err == nil {
+			c.global[name] = n
+		}
+	}
+	c.evict()
+	c.version++
 	c.lock.Unlock()
 }
 
+// evict removes the least recently updated buckets above the limit, skipping the protected ones.
+// Must hold the lock.
+func (c *connState) evict() {
+	if c.maxBuckets <= 0 {
+		return
+	}
+	for len(c.updated) > c.maxBuckets {
+		var oldest string
+		var found bool
+		for bucket, version := range c.updated {
+			if !c.isProtected(bucket) && (!found || version < c.updated[oldest]) {
+				oldest, found = bucket, true
+			}
+		}
+		if !found {
+			return
+		}
+		delete(c.types, oldest)
+		delete(c.global, oldest)
+		delete(c.updated, oldest)
+		c.evictions++
+	}
+}
+
+func (c *connState) isProtected(bucket string) bool {
+	for _, suffix := range c.protected {
+		if hasSuffixFold(bucket, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evictions returns the number of buckets evicted to stay within the limit.
+func (c *connState) Evictions() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.evictions
+}
+
+// Version returns the number of responses applied so far. Values read under the same version are consistent.
+func (c *connState) Version() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.version
+}
+
+// Snapshot returns the latest value of every bucket, regardless of its scope.
+func (c *connState) Snapshot() map[string]int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	values := make(map[string]int64, len(c.types)+len(c.global))
+	for key, val := range c.types {
+		values[key] = val
+	}
+	for key, val := range c.global {
+		values[key] = val
+	}
+	return values
+}
+
+// Scoped returns the latest value of the instance-scoped and principal-scoped buckets separately,
+// along with the version they were read at.
+func (c *connState) Scoped() (instance, global map[string]int64, version uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	instance = make(map[string]int64, len(c.types))
+	for key, val := range c.types {
+		instance[key] = val
+	}
+	global = make(map[string]int64, len(c.global))
+	for key, val := range c.global {
+		global[key] = val
+	}
+	return instance, global, c.version
+}
+
+func (c *connState) Get(bucket string) (int64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if val, ok := c.global[bucket]; ok {
+		return val, true
+	}
+	val, ok := c.types[bucket]
+	return val, ok
+}
+
+// Lowest returns the lowest value of any bucket, regardless of its scope, and false if none has been reported.
+func (c *connState) Lowest() (int64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var min int64 = math.MaxInt64
+	var found bool
+	for _, vals := range []map[string]int64{c.types, c.global} {
+		for _, val := range vals {
+			if val < min {
+				min, found = val, true
+			}
+		}
+	}
+	return min, found
+}
+
 func (c *connState) Min() int64 {
 	c.lock.Lock()
 	var min int64 = math.MaxInt64
@@ -217,3 +1683,11 @@ func (c *connState) Min() int64 {
 	c.lock.Unlock()
 	return min
 }
+
+// lingerGrace returns the grace period selected by Options.LingeringConnGracePeriod, zero when disabled.
+func lingerGrace(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(firstNonZero(int64(d), int64(time.Minute)))
+}
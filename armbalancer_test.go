@@ -1,51 +1,98 @@
 package armbalancer
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"math/rand"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
-func TestSoak(t *testing.T) {
-	limit := 20
+// newTestServer starts an HTTP/2 server for handler and a balancer for it, built with opts after setting their
+// Transport and Host. Both are closed at the end of the test.
+func newTestServer(t *testing.T, opts Options, handler http.HandlerFunc) (*httptest.Server, *Balancer) {
+	t.Helper()
+	svr := httptest.NewUnstartedServer(handler)
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	t.Cleanup(svr.Close)
+	u, _ := url.Parse(svr.URL)
+	opts.Transport = svr.Client().Transport.(*http.Transport)
+	opts.Host = u.Host
+	b := New(opts)
+	t.Cleanup(func() { b.Close() })
+	return svr, b
+}
 
+func TestSoakSynchronousRecycle(t *testing.T) {
+	const limit = 20
 	reqCountByAddr := map[string]int{}
 	var lock sync.Mutex
-	var totalRequests int
 	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		lock.Lock()
 		defer lock.Unlock()
+		reqCountByAddr[r.RemoteAddr]++
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Test", strconv.Itoa(limit-reqCountByAddr[r.RemoteAddr]))
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
 
-		if r.Proto != "HTTP/2.0" {
-			t.Errorf("received request with proto: %s", r.Proto)
-		}
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:            svr.Client().Transport.(*http.Transport),
+		Host:                 u.Host,
+		PoolSize:             2,
+		RecycleThreshold:     5,
+		MinReqsBeforeRecycle: 6,
+		SynchronousRecycle:   true,
+	})
+	defer b.Close()
+	client := &http.Client{Transport: b}
 
-		if r.Header.Get("Test") != "true" {
-			return // don't handle any requests from outside the test
+	const requests = 300
+	for i := 0; i < requests; i++ {
+		resp, err := client.Get(svr.URL)
+		if err != nil {
+			t.Fatal(err)
 		}
+		resp.Body.Close()
+	}
 
-		if _, ok := reqCountByAddr[r.RemoteAddr]; !ok && rand.Intn(100) == 1 {
-			// randomly start new connections with zero quota to test min reqs per connection configuration
-			reqCountByAddr[r.RemoteAddr] = limit
-		} else {
-			reqCountByAddr[r.RemoteAddr]++
+	// Without concurrent requests, every connection is recycled right after the response crossing the threshold
+	lock.Lock()
+	defer lock.Unlock()
+	var full int
+	for addr, count := range reqCountByAddr {
+		if count > limit-5 {
+			t.Errorf("connection %s served %d requests after crossing the threshold", addr, count-(limit-5))
+		}
+		if count == limit-5 {
+			full++
 		}
+	}
+	if want := requests/(limit-5) - 2; full < want {
+		t.Errorf("expected at least %d connections to be used until the threshold, got %d", want, full)
+	}
+}
 
-		totalRequests++
-		w.Header().Set("X-Ms-Ratelimit-Remaining-Test", strconv.Itoa(limit-reqCountByAddr[r.RemoteAddr]))
-		w.Header().Set("X-Ms-Ratelimit-Remaining-Dummy", "10")
-		w.Header().Set("X-Ms-Ratelimit-Remaining-Invalid", "not-a-number")
+func TestSoakShrinkIdle(t *testing.T) {
+	var closed int64
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Test", "1000")
 	}))
-	var closed int
 	svr.Config.ConnState = func(c net.Conn, cs http.ConnState) {
 		if cs == http.StateClosed {
-			closed++
+			atomic.AddInt64(&closed, 1)
 		}
 	}
 	svr.EnableHTTP2 = true
@@ -53,12 +100,94 @@ func TestSoak(t *testing.T) {
 	defer svr.Close()
 
 	u, _ := url.Parse(svr.URL)
-	client := &http.Client{Transport: New(Options{
+	b := New(Options{
 		Transport:            svr.Client().Transport.(*http.Transport),
 		Host:                 u.Host,
-		PoolSize:             8,
-		RecycleThreshold:     5,
-		MinReqsBeforeRecycle: 6,
+		PoolSize:             4,
+		ShrinkIdleTransports: true,
+		IdleShrinkAfter:      100 * time.Millisecond,
+	})
+	defer b.Close()
+	client := &http.Client{Transport: b}
+
+	burst := func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 12; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					resp, err := client.Get(svr.URL)
+					if err != nil {
+						t.Error(err)
+						continue
+					}
+					resp.Body.Close()
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	quiesced := func() (n int) {
+		for _, ts := range b.Stats().Transports {
+			if ts.Quiesced {
+				n++
+			}
+		}
+		return n
+	}
+
+	burst()
+	waitFor(t, "idle transports to be quiesced", func() bool { return quiesced() == 4 })
+	waitFor(t, "idle connections to be closed", func() bool { return atomic.LoadInt64(&closed) >= 4 })
+
+	// Traffic comes back
+	burst()
+	if n := quiesced(); n != 0 {
+		t.Errorf("expected every transport to be re-activated, got %d quiesced", n)
+	}
+	for _, ts := range b.Stats().Transports {
+		if ts.Generation != 2 || ts.Requests == 0 {
+			t.Errorf("expected every transport to serve requests over a new connection, got %+v", ts)
+		}
+	}
+}
+
+func TestShrinkIdleValidation(t *testing.T) {
+	for _, idleAfter := range []time.Duration{-time.Second, 1, time.Millisecond} {
+		_, err := NewBuilder(nil).WithOptions(Options{ShrinkIdleTransports: true, IdleShrinkAfter: idleAfter}).Build()
+		if err == nil {
+			t.Errorf("expected an idle shrink delay of %s to be rejected", idleAfter)
+		}
+	}
+}
+
+func TestSoakChaos(t *testing.T) {
+	reqCountByAddr := map[string]int{}
+	var lock sync.Mutex
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		reqCountByAddr[r.RemoteAddr]++
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Test", "1000")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	var chaosEvents int64
+	u, _ := url.Parse(svr.URL)
+	client := &http.Client{Transport: New(Options{
+		Transport:               svr.Client().Transport.(*http.Transport),
+		Host:                    u.Host,
+		PoolSize:                8,
+		EnableChaos:             true,
+		ChaosRecycleProbability: 0.1,
+		OnRecycle: func(e RecycleEvent) {
+			if e.Reason == RecycleReasonChaos {
+				atomic.AddInt64(&chaosEvents, 1)
+			}
+		},
 	})}
 
 	var wg sync.WaitGroup
@@ -66,10 +195,8 @@ func TestSoak(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Add(-1)
-			for j := 0; j < 500; j++ {
-				req, _ := http.NewRequest("GET", svr.URL, nil)
-				req.Header.Set("Test", "true")
-				resp, err := client.Do(req)
+			for j := 0; j < 200; j++ {
+				resp, err := client.Get(svr.URL)
 				if err != nil {
 					t.Error(err)
 					continue
@@ -80,37 +207,11 @@ func TestSoak(t *testing.T) {
 	}
 	wg.Wait()
 
-	_, err := client.Get("http://not-the-host")
-	if err == nil || err.Error() != fmt.Sprintf(`Get "http://not-the-host": host "not-the-host" is not supported by the configured ARM balancer, supported host name is %q`, u.Hostname()) {
-		t.Errorf("expected error when requesting host other than the one configured, got: %s", err)
-	}
-
-	if l := len(reqCountByAddr); l < 100 {
-		t.Errorf("pool couldn't be working correctly as only %d connections to the server were created", l)
+	if l := len(reqCountByAddr); l < 50 {
+		t.Errorf("expected chaos to cause elevated connection churn, but only %d connections were created", l)
 	}
-
-	if closed < len(reqCountByAddr)/4 {
-		t.Errorf("expected at least 25 percent of connections to be closed but only %d were closed", closed)
-	}
-
-	overLimit := []string{}
-	underMin := []string{}
-	for addr, count := range reqCountByAddr {
-		if count > limit {
-			overLimit = append(overLimit, addr)
-		}
-		if count < 6 {
-			underMin = append(underMin, addr)
-		}
-	}
-
-	// Since connection recycling is async, we can't expect 100% conformance to the configured limits
-	thres := len(reqCountByAddr) / 10
-	if l := len(overLimit); l > thres {
-		t.Errorf("%d clients exceeded the rate limit: %+s", l, overLimit)
-	}
-	if l := len(underMin); l > thres {
-		t.Errorf("%d clients undershot the configured min requests per connection: %+s", l, underMin)
+	if n := atomic.LoadInt64(&chaosEvents); n == 0 {
+		t.Errorf("expected chaos recycle events")
 	}
 }
 
@@ -198,10 +299,98 @@ func TestCompareHost(t *testing.T) {
 			if v != c.expected {
 				t.Errorf("expected %d result \"%t\" is not same as we get: %t", index, c.expected, v)
 			}
+			if m := MatchHostPort(&url.URL{Host: c.reqHost}, c.transHost, c.transPort); m != v {
+				t.Errorf("expected MatchHostPort to agree with compareHost, got %t", m)
+			}
 		})
 	}
 }
 
+func TestMatchHostPort(t *testing.T) {
+	tests := []struct {
+		reqHost string
+		host    string
+		port    string
+		want    bool
+	}{
+		{reqHost: "Management.Azure.Com", host: "management.azure.com", port: "443", want: true},
+		{reqHost: "management.azure.com.", host: "management.azure.com", port: "443", want: true},
+		{reqHost: "management.azure.com.:443", host: "management.azure.com", port: "443", want: true},
+		{reqHost: "management.azure.com:", host: "management.azure.com", port: "443", want: true},
+		{reqHost: "management.azure.com:", host: "management.azure.com", port: "8443", want: false},
+		{reqHost: "management.azure.com", host: "management.azure.com", port: "8443", want: false},
+		{reqHost: "management.azure.com:443", host: "management.azure.com", port: "8443", want: false},
+		{reqHost: "management.azure.com..", host: "management.azure.com", port: "443", want: false},
+		{reqHost: "[::1]", host: "::1", port: "443", want: true},
+		{reqHost: "[::1]:443", host: "::1", port: "443", want: true},
+		{reqHost: "[::1]:443", host: "[::1]", port: "443", want: true},
+		{reqHost: "[::1]:8443", host: "::1", port: "443", want: false},
+		{reqHost: "[::2]:443", host: "::1", port: "443", want: false},
+	}
+	for _, tt := range tests {
+		if got := MatchHostPort(&url.URL{Host: tt.reqHost}, tt.host, tt.port); got != tt.want {
+			t.Errorf("MatchHostPort(%q, %q, %q) = %t, want %t", tt.reqHost, tt.host, tt.port, got, tt.want)
+		}
+	}
+
+	// The balancer routes requests using the same rules
+	b, err := NewBuilder(nil).AddHost("a.com:8443", HostOptions{}).AddHost("[::1]:443", HostOptions{}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, raw := range []string{"https://A.com.:8443", "https://[::1]", "//[::1]", "//a.com:8443"} {
+		u, _ := url.Parse(raw)
+		if b.lookup(u, "") == nil {
+			t.Errorf("expected %q to be served by the balancer", raw)
+		}
+	}
+	for _, raw := range []string{"https://a.com:443", "https://a.com", "http://[::1]", "//a.com"} {
+		u, _ := url.Parse(raw)
+		if b.lookup(u, "") != nil {
+			t.Errorf("expected %q not to be served by the balancer", u)
+		}
+	}
+}
+
+func TestMatchHostPortSchemes(t *testing.T) {
+	tests := []struct {
+		url         string
+		port        string
+		defaultPort string
+		want        bool
+	}{
+		{url: "https://a.com/", port: "443", want: true},
+		{url: "https://a.com/", port: "8443", want: false},
+		{url: "HTTPS://a.com/", port: "443", want: true},
+		{url: "http://a.com/", port: "80", want: true},
+		{url: "http://a.com/", port: "443", want: false},
+		{url: "http://a.com/", port: "8080", want: false},
+		{url: "http://a.com:8080/", port: "8080", want: true},
+		{url: "http://a.com:/", port: "80", want: true},
+		{url: "ftp://a.com/", port: "8080", want: true},
+		{url: "//a.com/", port: "8080", want: false},
+		{url: "//a.com/", port: "443", want: true},
+		{url: "https:a.com", port: "443", want: false},
+		{url: "http://a.com/", port: "8080", defaultPort: "8080", want: true},
+		{url: "https://a.com/", port: "8080", defaultPort: "8080", want: true},
+		{url: "http://a.com:80/", port: "8080", defaultPort: "8080", want: false},
+		{url: "http://b.com/", port: "8080", defaultPort: "8080", want: false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := matchHostPort(u, "a.com", tt.port, tt.defaultPort); got != tt.want {
+			t.Errorf("matchHostPort(%q, %q, %q) = %t, want %t", tt.url, tt.port, tt.defaultPort, got, tt.want)
+		}
+		if tt.defaultPort == "" && MatchHostPort(u, "a.com", tt.port) != tt.want {
+			t.Errorf("expected MatchHostPort to agree for %q", tt.url)
+		}
+	}
+}
+
 func TestNew(t *testing.T) {
 	type args struct {
 		opts Options
@@ -258,6 +447,7 @@ func TestNew(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			var calls int
 			if tt.paniced {
 				defer func() {
 					if r := recover(); r != nil {
@@ -273,12 +463,414 @@ func TestNew(t *testing.T) {
 					if port != tt.wantPort {
 						t.Errorf("New() port = %v, want %v", port, tt.wantPort)
 					}
-					return nil
+					calls++
+					return &http.Transport{}
 				}
 			}
 			if got := New(tt.args.opts); got == nil {
 				t.Errorf("New() returned nil")
 			}
+			if calls != 8 {
+				t.Errorf("expected the transport factory to be called for every pooled transport, got %d calls", calls)
+			}
 		})
 	}
 }
+
+func TestInjectAggregateHeaders(t *testing.T) {
+	var lock sync.Mutex
+	var firstAddr string
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if firstAddr == "" {
+			firstAddr = r.RemoteAddr
+		}
+		if r.RemoteAddr == firstAddr {
+			w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "10")
+		} else {
+			w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "1000")
+		}
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	u, _ := url.Parse(svr.URL)
+	client := &http.Client{Transport: New(Options{
+		Transport:              svr.Client().Transport.(*http.Transport),
+		Host:                   u.Host,
+		PoolSize:               2,
+		InjectAggregateHeaders: true,
+	})}
+
+	var headers []http.Header
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(svr.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		headers = append(headers, resp.Header)
+	}
+
+	if v := headers[0].Get("X-Armbalancer-Min-Remaining-Subscription-Reads"); v != "10" {
+		t.Errorf("expected the first response's aggregate to match its own header, got %q", v)
+	}
+	if v := headers[1].Get("X-Ms-Ratelimit-Remaining-Subscription-Reads"); v != "1000" {
+		t.Fatalf("expected the second response to be served by another connection, got remaining %q", v)
+	}
+	if v := headers[1].Get("X-Armbalancer-Min-Remaining-Subscription-Reads"); v != "10" {
+		t.Errorf("expected the aggregate to be lower than the serving connection's header, got %q", v)
+	}
+}
+
+func TestReservedWriteSlots(t *testing.T) {
+	release := make(chan struct{})
+	var reads int64
+	svr, b := newTestServer(t, Options{PoolSize: 3, ReservedWriteSlots: 1}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt64(&reads, 1)
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+	})
+	client := &http.Client{Transport: b}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(svr.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	waitFor(t, "the reads to be blocked", func() bool { return atomic.LoadInt64(&reads) == 8 })
+
+	// The write completes while every read is blocked
+	req, _ := http.NewRequest(http.MethodPut, svr.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	close(release)
+	wg.Wait()
+
+	for _, s := range b.Stats().Transports {
+		if s.ReservedForWrites != (s.ID == 2) {
+			t.Errorf("unexpected reservation for transport %d", s.ID)
+		}
+		if s.ReservedForWrites && (s.Methods[http.MethodPut] != 1 || s.Methods[http.MethodGet] != 0) {
+			t.Errorf("expected the reserved transport to only serve the write, got %v", s.Methods)
+		}
+		if !s.ReservedForWrites && s.Methods[http.MethodPut] != 0 {
+			t.Errorf("expected transport %d to only serve reads, got %v", s.ID, s.Methods)
+		}
+	}
+}
+
+func TestDefaultRequestTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hang":
+			select {
+			case <-hang:
+			case <-r.Context().Done():
+			}
+		case "/stream":
+			for i := 0; i < 3; i++ {
+				w.Write([]byte("chunk"))
+				w.(http.Flusher).Flush()
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+	}))
+	defer svr.Close()
+	defer close(hang)
+
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:             svr.Client().Transport.(*http.Transport),
+		Host:                  u.Host,
+		PoolSize:              1,
+		DefaultRequestTimeout: 500 * time.Millisecond,
+	})
+	defer b.Close()
+	client := &http.Client{Transport: b}
+
+	t.Run("hung server", func(t *testing.T) {
+		start := time.Now()
+		_, err := client.Get(svr.URL + "/hang")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the request to time out, got: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("expected the default timeout to apply, took %s", elapsed)
+		}
+	})
+
+	t.Run("streaming body", func(t *testing.T) {
+		resp, err := client.Get(svr.URL + "/stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil || string(body) != "chunkchunkchunk" {
+			t.Errorf("expected the body to be streamed after RoundTrip returned, got %q: %v", body, err)
+		}
+	})
+
+	t.Run("existing deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", svr.URL+"/stream", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if _, ok := resp.Body.(*cancelOnClose); ok {
+			t.Errorf("expected requests with a deadline to be left untouched")
+		}
+	})
+}
+
+func TestPerTransportMiddleware(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Order")))
+	}))
+	defer svr.Close()
+
+	var lock sync.Mutex
+	var seen []int // requests observed by each application of the middleware
+	outer := func(next http.RoundTripper) http.RoundTripper {
+		lock.Lock()
+		i := len(seen)
+		seen = append(seen, 0)
+		lock.Unlock()
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			lock.Lock()
+			seen[i]++
+			lock.Unlock()
+			req.Header.Set("Order", req.Header.Get("Order")+"outer,")
+			return next.RoundTrip(req)
+		})
+	}
+	inner := func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req.Header.Set("Order", req.Header.Get("Order")+"inner")
+			return next.RoundTrip(req)
+		})
+	}
+
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:              svr.Client().Transport.(*http.Transport),
+		Host:                   u.Host,
+		PoolSize:               1,
+		PerTransportMiddleware: []func(http.RoundTripper) http.RoundTripper{outer, inner},
+	})
+	defer b.Close()
+	client := &http.Client{Transport: b}
+
+	get := func() {
+		resp, err := client.Get(svr.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if body, _ := io.ReadAll(resp.Body); string(body) != "outer,inner" {
+			t.Errorf("expected middleware to be applied outermost first, got %q", body)
+		}
+	}
+	get()
+	if err := b.ForceRecycleAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	get()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(seen) != 2 || seen[0] != 1 || seen[1] != 1 {
+		t.Errorf("expected the middleware to be applied to each generation and observe one request on each, got %v", seen)
+	}
+}
+
+func TestConnStateSnapshotConsistency(t *testing.T) {
+	c := newConnState(nil, 0, nil, bucketScopes{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				val := strconv.Itoa(i*1000 + j)
+				c.ApplyHeader(http.Header{
+					"X-Ms-Ratelimit-Remaining-Subscription-Reads":        {val},
+					"X-Ms-Ratelimit-Remaining-Subscription-Writes":       {val},
+					"X-Ms-Ratelimit-Remaining-Subscription-Global-Reads": {val},
+				})
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	var last uint64
+	for {
+		select {
+		case <-done:
+			if v := c.Version(); v != 4000 {
+				t.Errorf("expected a version per applied response, got %d", v)
+			}
+			return
+		default:
+		}
+		values := c.Snapshot()
+		if values["Subscription-Reads"] != values["Subscription-Writes"] || values["Subscription-Reads"] != values["Subscription-Global-Reads"] {
+			t.Fatalf("expected every bucket to be read from the same response, got %v", values)
+		}
+		instance, global, version := c.Scoped()
+		if instance["Subscription-Reads"] != global["Subscription-Global-Reads"] {
+			t.Fatalf("expected scoped buckets to be read from the same response, got %v and %v", instance, global)
+		}
+		if version < last {
+			t.Fatalf("expected versions to increase, got %d after %d", version, last)
+		}
+		last = version
+	}
+}
+
+func TestConnStateBucketLimit(t *testing.T) {
+	protected := protectedBuckets(CompositeRecyclePolicy{Policies: []RecyclePolicy{
+		SelectiveThrottledPolicy{Buckets: []string{"-Writes"}, Thresholds: map[string]int64{"Tenant-Reads": 10}},
+	}})
+	c := newConnState([]string{"X-Ms-User-Quota-Remaining"}, 3, protected, bucketScopes{})
+
+	h := http.Header{}
+	h.Set("X-Ms-Ratelimit-Remaining-Subscription-Writes", "10")
+	h.Set("X-Ms-Ratelimit-Remaining-Tenant-Reads", "10")
+	h.Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "10")
+	h.Set("X-Ms-User-Quota-Remaining", "10")
+	c.ApplyHeader(h)
+
+	// A proxy reflecting request headers
+	for i := 0; i < 100; i++ {
+		h := http.Header{}
+		h.Set(fmt.Sprintf("X-Ms-Ratelimit-Remaining-%d", i), "1")
+		c.ApplyHeader(h)
+	}
+
+	s := c.Snapshot()
+	for _, bucket := range []string{"Subscription-Writes", "Tenant-Reads", "X-Ms-User-Quota-Remaining", "99"} {
+		if _, ok := s[bucket]; !ok {
+			t.Errorf("expected bucket %s to be tracked, got %v", bucket, s)
+		}
+	}
+	if len(s) != 4 {
+		t.Errorf("expected 3 buckets and the quota header to be tracked, got %v", s)
+	}
+	if n := c.Evictions(); n != 100 {
+		t.Errorf("expected 100 evictions, got %d", n)
+	}
+}
+
+func TestAccountingExcludePathPrefixes(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/metadata/") {
+			w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "-1")
+			return
+		}
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "1000")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	b := New(Options{
+		Transport:                     svr.Client().Transport.(*http.Transport),
+		Host:                          u.Host,
+		PoolSize:                      1,
+		RecyclePolicy:                 DefaultRecyclePolicy{Threshold: 10, MinRequests: 2},
+		AccountingExcludePathPrefixes: []string{"/Metadata/"},
+	})
+	defer b.Close()
+
+	for _, path := range []string{"/subscriptions", "/metadata/endpoints", "/metadata/endpoints", "/subscriptions"} {
+		req, _ := http.NewRequest("GET", svr.URL+path, nil)
+		resp, err := b.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	s := b.Stats().Transports[0]
+	if s.Recycles != 0 || s.Requests != 2 || s.Methods["GET"] != 4 {
+		t.Errorf("expected excluded requests not to be accounted for, got %+v", s)
+	}
+	if remaining, _ := b.minRemaining("Subscription-Reads"); remaining != 1000 {
+		t.Errorf("expected the excluded responses' headers to be ignored, got %d", remaining)
+	}
+}
+
+func TestRequestWeight(t *testing.T) {
+	r, log := newFakeRecyclableTransport(DefaultRecyclePolicy{Threshold: 10, MinRequests: 5}, func(gen int64) http.Header {
+		return remainingReads("1")
+	})
+	defer r.Close(false)
+	r.synchronous = true
+	r.requestWeight = func(req *http.Request) int64 {
+		switch {
+		case req.Method == http.MethodHead:
+			return 0
+		case strings.HasSuffix(req.URL.Path, "/resourceGroups"):
+			return 5
+		}
+		return 1
+	}
+
+	send := func(method, path string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, "https://management.azure.com"+path, nil)
+		resp, err := r.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// Existence checks don't count towards MinRequests
+	for i := 0; i < 6; i++ {
+		send(http.MethodHead, "/subscriptions/sub/resourceGroups/rg")
+		log.expect(t, "decide 1: false")
+	}
+	send(http.MethodGet, "/subscriptions/sub/resourceGroups/rg")
+	log.expect(t, "decide 1: false")
+	if s := r.Snapshot(); s.Requests != 1 {
+		t.Errorf("expected a weighted request count of 1, got %d", s.Requests)
+	}
+	if s := r.Stats(); s.Requests != 7 {
+		t.Errorf("expected stats to count every request once, got %d", s.Requests)
+	}
+
+	// A LIST call is enough to reach MinRequests
+	send(http.MethodGet, "/subscriptions/sub/resourceGroups")
+	log.expect(t, "decide 1: true")
+	log.expect(t, "recycle 1")
+}
@@ -0,0 +1,177 @@
+// Package armbalancertest helps verifying that a deployment of the ARM balancer achieves connection diversity
+// and conforms to its configured limits, by analyzing what the server (or a proxy in front of it) observed.
+// It also replays recordings of the balancer's responses against candidate recycle policies, see Replay, and
+// simulates synthetic workloads for capacity planning, see Simulate.
+package armbalancertest
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Azure/go-armbalancer"
+)
+
+// Observation is what the server observed of a single connection.
+type Observation struct {
+	RemoteAddr string
+	Requests   int
+	Closed     bool
+}
+
+// Criteria configures the checks of ConformanceReport.
+type Criteria struct {
+	// Limit is the number of requests the server allows per connection.
+	Limit int
+
+	// MinConnections is the number of connections the balancer is expected to have opened.
+	// Default: 0 (not checked)
+	MinConnections int
+
+	// MinClosedRatio is the share of connections expected to have been closed by the balancer.
+	// Default: 0 (not checked)
+	MinClosedRatio float64
+
+	// Tolerance is the share of connections allowed to exceed Limit or to undershoot the configured
+	// MinReqsBeforeRecycle, since recycling happens asynchronously.
+	// Default: 0.1
+	Tolerance float64
+}
+
+// Violation is a check ConformanceReport found unsatisfied.
+type Violation struct {
+	Check   string   // "connections", "closed", "over-limit" or "under-min"
+	Count   int      // connections involved
+	Percent float64  // of all connections
+	Addrs   []string // sorted, only set for checks on individual connections
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %d connections (%.1f%%)", v.Check, v.Count, v.Percent)
+}
+
+// Report is the result of ConformanceReport.
+type Report struct {
+	Connections int
+	Closed      int
+	Requests    int
+	Violations  []Violation
+}
+
+// Err returns an error describing the violations, nil if there are none.
+func (r *Report) Err() error {
+	if len(r.Violations) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(r.Violations))
+	for i, v := range r.Violations {
+		msgs[i] = v.String()
+	}
+	return fmt.Errorf("balancer doesn't conform across %d connections: %s", r.Connections, strings.Join(msgs, ", "))
+}
+
+// ConformanceReport checks the observations against the balancer's options and the given criteria.
+// Requests are expected to have been sent to a single host configured by opts.
+func ConformanceReport(obs []Observation, opts armbalancer.Options, c Criteria) *Report {
+	minReqs := int(opts.MinReqsBeforeRecycle)
+	if minReqs == 0 {
+		minReqs = 10
+	}
+	tolerance := c.Tolerance
+	if tolerance == 0 {
+		tolerance = 0.1
+	}
+
+	r := &Report{Connections: len(obs)}
+	var overLimit, underMin []string
+	for _, o := range obs {
+		r.Requests += o.Requests
+		if o.Closed {
+			r.Closed++
+		}
+		if c.Limit > 0 && o.Requests > c.Limit {
+			overLimit = append(overLimit, o.RemoteAddr)
+		}
+		if o.Requests < minReqs {
+			underMin = append(underMin, o.RemoteAddr)
+		}
+	}
+
+	if r.Connections < c.MinConnections {
+		r.violate("connections", r.Connections, nil)
+	}
+	if float64(r.Closed) < float64(r.Connections)*c.MinClosedRatio {
+		r.violate("closed", r.Closed, nil)
+	}
+	thres := float64(r.Connections) * tolerance
+	if float64(len(overLimit)) > thres {
+		r.violate("over-limit", len(overLimit), overLimit)
+	}
+	if float64(len(underMin)) > thres {
+		r.violate("under-min", len(underMin), underMin)
+	}
+	return r
+}
+
+func (r *Report) violate(check string, count int, addrs []string) {
+	v := Violation{Check: check, Count: count, Addrs: addrs}
+	if r.Connections > 0 {
+		v.Percent = float64(count) * 100 / float64(r.Connections)
+	}
+	sort.Strings(v.Addrs)
+	r.Violations = append(r.Violations, v)
+}
+
+// Recorder collects observations on the server side. It's safe for concurrent use.
+type Recorder struct {
+	lock   sync.Mutex
+	byAddr map[string]*Observation
+}
+
+// Add records n requests received on the connection from addr and returns its total.
+func (r *Recorder) Add(addr string, n int) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	o := r.get(addr)
+	o.Requests += n
+	return o.Requests
+}
+
+// ConnState records closed connections when set as http.Server.ConnState.
+func (r *Recorder) ConnState(c net.Conn, cs http.ConnState) {
+	if cs != http.StateClosed {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if o, ok := r.byAddr[c.RemoteAddr().String()]; ok {
+		o.Closed = true
+	}
+}
+
+// Observations returns what was recorded so far.
+func (r *Recorder) Observations() []Observation {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	obs := make([]Observation, 0, len(r.byAddr))
+	for _, o := range r.byAddr {
+		obs = append(obs, *o)
+	}
+	sort.Slice(obs, func(i, j int) bool { return obs[i].RemoteAddr < obs[j].RemoteAddr })
+	return obs
+}
+
+func (r *Recorder) get(addr string) *Observation {
+	if r.byAddr == nil {
+		r.byAddr = map[string]*Observation{}
+	}
+	o, ok := r.byAddr[addr]
+	if !ok {
+		o = &Observation{RemoteAddr: addr}
+		r.byAddr[addr] = o
+	}
+	return o
+}
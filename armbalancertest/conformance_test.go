@@ -0,0 +1,54 @@
+package armbalancertest
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/go-armbalancer"
+)
+
+type fakeConn struct {
+	net.Conn
+	addr string
+}
+
+func (c fakeConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+func TestConformanceReport(t *testing.T) {
+	rec := &Recorder{}
+	for i, n := range []int{6, 8, 25, 2, 10} {
+		addr := net.JoinHostPort("127.0.0.1", string(rune('1'+i))+"000")
+		rec.Add(addr, n)
+		if i%2 == 0 {
+			rec.ConnState(fakeConn{addr: addr}, http.StateClosed)
+		}
+	}
+	opts := armbalancer.Options{MinReqsBeforeRecycle: 6}
+
+	report := ConformanceReport(rec.Observations(), opts, Criteria{Limit: 20, Tolerance: 0.3})
+	if err := report.Err(); err != nil {
+		t.Errorf("expected the observations to conform, got: %s", err)
+	}
+	if report.Connections != 5 || report.Closed != 3 || report.Requests != 51 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	report = ConformanceReport(rec.Observations(), opts, Criteria{Limit: 20, MinConnections: 10, MinClosedRatio: 0.8})
+	expected := []Violation{
+		{Check: "connections", Count: 5, Percent: 100},
+		{Check: "closed", Count: 3, Percent: 60},
+		{Check: "over-limit", Count: 1, Percent: 20, Addrs: []string{"127.0.0.1:3000"}},
+		{Check: "under-min", Count: 1, Percent: 20, Addrs: []string{"127.0.0.1:4000"}},
+	}
+	if !reflect.DeepEqual(report.Violations, expected) {
+		t.Errorf("expected violations %+v, got %+v", expected, report.Violations)
+	}
+	if report.Err() == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,180 @@
+package armbalancertest
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/Azure/go-armbalancer"
+)
+
+// ReplayReport is the result of Replay.
+type ReplayReport struct {
+	Responses  int
+	Transports int
+	Skipped    int // lines that couldn't be decoded
+
+	// Recycles counts the recycles the policy decided, and RecordedRecycles those of the recording.
+	Recycles          int
+	RecordedRecycles  int
+	RecyclesPerMinute float64 // simulated, over the recording's duration
+
+	// MeanRequestsPerConnection is the number of responses per simulated connection.
+	MeanRequestsPerConnection float64
+
+	// Throttled counts the responses the policy would have received with an exhausted bucket, and RecordedThrottled
+	// those of the recording with a 429 status.
+	Throttled         int
+	RecordedThrottled int
+
+	// MinRemaining is the lowest simulated value of any bucket, zero when no bucket was recorded.
+	MinRemaining int64
+}
+
+// replayedConn is the simulated connection of a recorded transport.
+type replayedConn struct {
+	remaining  map[string]int64 // simulated
+	recorded   map[string]int64 // of the previous line
+	generation int64            // of the previous line
+	simulated  int64
+	requests   int64
+	version    uint64
+	born       time.Time
+}
+
+// Replay simulates the recycle decisions of the policy over a recording written to armbalancer.Options.Recorder,
+// to compare candidate policies or thresholds offline.
+//
+// Every recorded transport is simulated independently. The quota consumed by each response is derived from
+// the changes of the recorded buckets, and a connection recycled by the policy is assumed to land on an instance
+// whose buckets are as full as the highest value recorded for its host. Responses following a recycle in the
+// recording don't consume simulated quota, since they describe another instance. Principal-scoped buckets aren't
+// affected by recycling, so they're passed to the policy as recorded.
+func Replay(r io.Reader, policy armbalancer.RecyclePolicy) ReplayReport {
+	var report ReplayReport
+	var lines []armbalancer.RecordedResponse
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var line armbalancer.RecordedResponse
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			report.Skipped++
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	full := map[string]map[string]int64{} // by host
+	for _, line := range lines {
+		if full[line.Host] == nil {
+			full[line.Host] = map[string]int64{}
+		}
+		for bucket, val := range line.Remaining {
+			if val > full[line.Host][bucket] {
+				full[line.Host][bucket] = val
+			}
+		}
+	}
+
+	type key struct {
+		host string
+		id   int
+	}
+	conns := map[key]*replayedConn{}
+	report.MinRemaining = math.MaxInt64
+	var connections int
+	for _, line := range lines {
+		report.Responses++
+		if line.Status == http.StatusTooManyRequests {
+			report.RecordedThrottled++
+		}
+		c := conns[key{line.Host, line.TransportID}]
+		if c == nil {
+			c = &replayedConn{remaining: copyBuckets(line.Remaining), generation: line.Generation, simulated: 1, born: line.Time}
+			conns[key{line.Host, line.TransportID}] = c
+			connections++
+		} else if line.Generation != c.generation {
+			report.RecordedRecycles++
+			for bucket, val := range line.Remaining {
+				if _, ok := c.remaining[bucket]; !ok {
+					c.remaining[bucket] = val
+				}
+			}
+		} else {
+			for bucket, val := range line.Remaining {
+				prev, ok := c.recorded[bucket]
+				if !ok {
+					c.remaining[bucket] = val
+					continue
+				}
+				c.remaining[bucket] += val - prev
+				if max := full[line.Host][bucket]; c.remaining[bucket] > max {
+					c.remaining[bucket] = max
+				}
+			}
+		}
+		c.recorded = line.Remaining
+		c.generation = line.Generation
+		c.requests++
+		c.version++
+
+		var exhausted bool
+		for _, val := range c.remaining {
+			if val <= 0 {
+				exhausted = true
+			}
+			if val < report.MinRemaining {
+				report.MinRemaining = val
+			}
+		}
+		if exhausted {
+			report.Throttled++
+		}
+
+		recycle := policy.ShouldRecycle(armbalancer.ConnSnapshot{
+			TransportID: line.TransportID,
+			Generation:  c.simulated,
+			Remaining:   copyBuckets(c.remaining),
+			Global:      copyBuckets(line.Global),
+			Version:     c.version,
+			Requests:    c.requests,
+			Age:         line.Time.Sub(c.born),
+		})
+		if recycle {
+			report.Recycles++
+			connections++
+			c.remaining = copyBuckets(full[line.Host])
+			c.simulated++
+			c.requests = 0
+			c.born = line.Time
+		}
+	}
+
+	report.Transports = len(conns)
+	if report.MinRemaining == math.MaxInt64 {
+		report.MinRemaining = 0
+	}
+	if connections > 0 {
+		report.MeanRequestsPerConnection = float64(report.Responses) / float64(connections)
+	}
+	if len(lines) > 1 {
+		if d := lines[len(lines)-1].Time.Sub(lines[0].Time); d > 0 {
+			report.RecyclesPerMinute = float64(report.Recycles) / d.Minutes()
+		}
+	}
+	return report
+}
+
+func copyBuckets(buckets map[string]int64) map[string]int64 {
+	copied := make(map[string]int64, len(buckets))
+	for bucket, val := range buckets {
+		copied[bucket] = val
+	}
+	return copied
+}
@@ -0,0 +1,105 @@
+package armbalancertest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-armbalancer"
+)
+
+// syntheticRecording returns a recording of a transport whose connection was never recycled: every response
+// consumes 10 reads out of 1000 until the last one is throttled.
+func syntheticRecording(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= 100; i++ {
+		line := armbalancer.RecordedResponse{
+			Time:       start.Add(time.Duration(i) * 600 * time.Millisecond),
+			Host:       "management.azure.com:443",
+			Generation: 1,
+			Status:     http.StatusOK,
+			Remaining:  map[string]int64{"Subscription-Reads": int64(1000 - 10*i)},
+			Global:     map[string]int64{"Tenant-Reads": 5000},
+		}
+		if i == 100 {
+			line.Status = http.StatusTooManyRequests
+		}
+		if err := enc.Encode(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.WriteString("not json\n")
+	return &buf
+}
+
+func TestReplay(t *testing.T) {
+	never := armbalancer.RecyclePolicyFunc(func(armbalancer.ConnSnapshot) bool { return false })
+	report := Replay(syntheticRecording(t), never)
+	want := ReplayReport{
+		Responses:                 100,
+		Transports:                1,
+		Skipped:                   1,
+		MeanRequestsPerConnection: 100,
+		Throttled:                 1,
+		RecordedThrottled:         1,
+	}
+	if report != want {
+		t.Errorf("expected %+v without recycling, got %+v", want, report)
+	}
+
+	// Recycling at 500 reads moves to a full instance after the 50th and the 99th responses
+	report = Replay(syntheticRecording(t), armbalancer.DefaultRecyclePolicy{Threshold: 500, MinRequests: 10})
+	want = ReplayReport{
+		Responses:                 100,
+		Transports:                1,
+		Skipped:                   1,
+		Recycles:                  2,
+		RecyclesPerMinute:         2 / (59.4 / 60),
+		MeanRequestsPerConnection: 100.0 / 3,
+		RecordedThrottled:         1,
+		MinRemaining:              500,
+	}
+	if report != want {
+		t.Errorf("expected %+v when recycling, got %+v", want, report)
+	}
+}
+
+func TestReplayRecordedRecycles(t *testing.T) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i, remaining := range []int64{300, 200, 900, 800} {
+		enc.Encode(armbalancer.RecordedResponse{
+			Generation: int64(1 + i/2),
+			Status:     http.StatusOK,
+			Remaining:  map[string]int64{"Subscription-Writes": remaining},
+		})
+	}
+	var snapshots []int64
+	report := Replay(&buf, armbalancer.RecyclePolicyFunc(func(s armbalancer.ConnSnapshot) bool {
+		snapshots = append(snapshots, s.Remaining["Subscription-Writes"])
+		return false
+	}))
+	if report.RecordedRecycles != 1 {
+		t.Errorf("expected a recorded recycle, got %+v", report)
+	}
+	// The recorded recycle doesn't refill the simulated connection
+	if got, want := snapshots, []int64{300, 200, 200, 100}; !equalInts(got, want) {
+		t.Errorf("expected simulated values %v, got %v", want, got)
+	}
+}
+
+func equalInts(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
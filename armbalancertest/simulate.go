@@ -0,0 +1,246 @@
+package armbalancertest
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/Azure/go-armbalancer"
+)
+
+// SimulationConfig describes the pool and the workload simulated by Simulate. Zero values select the defaults.
+type SimulationConfig struct {
+	// Connections is the number of pooled connections, like armbalancer.Options.PoolSize.
+	// Default: 8
+	Connections int
+
+	// Duration is the simulated time.
+	// Default: 1h
+	Duration time.Duration
+
+	// RequestsPerSecond is the mean arrival rate of requests, which are sent to the connections in turn.
+	// Default: 10
+	RequestsPerSecond float64
+
+	// BurstSize is the number of requests arriving at once. Bursts arrive as a Poisson process, so larger bursts
+	// make the workload burstier at the same rate.
+	// Default: 1
+	BurstSize int
+
+	// Quota is the capacity of every rate limiting bucket of an ARM instance, keyed like ConnSnapshot.Remaining.
+	// Buckets refill continuously, from empty to full over QuotaWindow.
+	// Default: {"Subscription-Reads": 12000}
+	Quota       map[string]int64
+	QuotaWindow time.Duration // Default: 1h
+
+	// Mix is the relative share of requests consuming each bucket of Quota. Buckets missing from Mix aren't consumed.
+	// Default: an equal share for every bucket
+	Mix map[string]float64
+
+	// Instances is the number of ARM instances a connection can land on, at random, when it's established.
+	// Connections landing on the same instance share its buckets.
+	// Default: 0 (every connection lands on an instance of its own)
+	Instances int
+
+	// Policy decides when connections are re-established, which is immediate in the simulation.
+	// Default: the balancer's default policy, with a threshold of 100 and 10 requests before recycling
+	Policy armbalancer.RecyclePolicy
+
+	// Seed seeds the arrival process and the choice of instances and buckets, so that simulations can be repeated.
+	Seed int64
+}
+
+// SimulationResult is the result of Simulate. Every request is either served or throttled.
+type SimulationResult struct {
+	Requests  int
+	Served    int
+	Throttled int // requests sent over a connection whose bucket was exhausted
+
+	Recycles        int
+	RecyclesPerHour float64
+
+	// Lifetimes holds the age of every recycled connection when it was recycled, in order. Connections still
+	// established at the end of the simulation aren't included.
+	Lifetimes    []time.Duration
+	MeanLifetime time.Duration
+
+	// MinRemaining is the lowest value of any bucket passed to the policy.
+	MinRemaining int64
+}
+
+// simInstance is a simulated ARM instance.
+type simInstance struct {
+	remaining map[string]float64
+	updated   time.Duration
+}
+
+// simConn is a simulated connection.
+type simConn struct {
+	instance   *simInstance
+	generation int64
+	born       time.Duration
+	requests   int64
+	version    uint64
+}
+
+// Simulate models a pool of connections to ARM serving a synthetic workload under a recycle policy, to estimate
+// how often a pool size and policy recycle, and how many requests remain throttled, before a rollout.
+//
+// Time is simulated, so hours of traffic are simulated in milliseconds. Responses are immediate and report
+// the remaining quota of the instance after the request, and the policy is consulted after every request,
+// including the throttled ones, like in the balancer.
+func Simulate(cfg SimulationConfig) SimulationResult {
+	if cfg.Connections <= 0 {
+		cfg.Connections = 8
+	}
+	if cfg.Duration <= 0 {
+		cfg.Duration = time.Hour
+	}
+	if cfg.RequestsPerSecond <= 0 {
+		cfg.RequestsPerSecond = 10
+	}
+	if cfg.BurstSize <= 0 {
+		cfg.BurstSize = 1
+	}
+	if len(cfg.Quota) == 0 {
+		cfg.Quota = map[string]int64{"Subscription-Reads": 12000}
+	}
+	if cfg.QuotaWindow <= 0 {
+		cfg.QuotaWindow = time.Hour
+	}
+	if cfg.Policy == nil {
+		cfg.Policy = armbalancer.DefaultRecyclePolicy{Threshold: 100, MinRequests: 10}
+	}
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	pickBucket := newBucketPicker(cfg.Quota, cfg.Mix)
+
+	instances := make([]*simInstance, cfg.Instances)
+	land := func(now time.Duration) *simInstance {
+		if cfg.Instances <= 0 {
+			return newSimInstance(cfg.Quota, now)
+		}
+		i := rng.Intn(cfg.Instances)
+		if instances[i] == nil {
+			instances[i] = newSimInstance(cfg.Quota, now)
+		}
+		return instances[i]
+	}
+	conns := make([]*simConn, cfg.Connections)
+	for i := range conns {
+		conns[i] = &simConn{instance: land(0), generation: 1}
+	}
+
+	result := SimulationResult{MinRemaining: math.MaxInt64}
+	burstsPerSecond := cfg.RequestsPerSecond / float64(cfg.BurstSize)
+	var now time.Duration
+	var cursor int
+	for {
+		now += time.Duration(rng.ExpFloat64() / burstsPerSecond * float64(time.Second))
+		if now > cfg.Duration {
+			break
+		}
+		for j := 0; j < cfg.BurstSize; j++ {
+			id := cursor % len(conns)
+			cursor++
+			c := conns[id]
+			c.instance.refill(cfg.Quota, cfg.QuotaWindow, now)
+
+			result.Requests++
+			if bucket, ok := pickBucket(rng); ok && c.instance.remaining[bucket] < 1 {
+				result.Throttled++
+			} else {
+				result.Served++
+				if ok {
+					c.instance.remaining[bucket]--
+				}
+			}
+			c.requests++
+			c.version++
+
+			snapshot := armbalancer.ConnSnapshot{
+				TransportID: id,
+				Generation:  c.generation,
+				Remaining:   make(map[string]int64, len(cfg.Quota)),
+				Global:      map[string]int64{},
+				Version:     c.version,
+				Requests:    c.requests,
+				Age:         now - c.born,
+			}
+			for bucket, val := range c.instance.remaining {
+				snapshot.Remaining[bucket] = int64(val)
+				if int64(val) < result.MinRemaining {
+					result.MinRemaining = int64(val)
+				}
+			}
+			if cfg.Policy.ShouldRecycle(snapshot) {
+				result.Recycles++
+				result.Lifetimes = append(result.Lifetimes, now-c.born)
+				conns[id] = &simConn{instance: land(now), generation: c.generation + 1, born: now}
+			}
+		}
+	}
+
+	if result.MinRemaining == math.MaxInt64 {
+		result.MinRemaining = 0
+	}
+	result.RecyclesPerHour = float64(result.Recycles) / cfg.Duration.Hours()
+	if len(result.Lifetimes) > 0 {
+		var total time.Duration
+		for _, lifetime := range result.Lifetimes {
+			total += lifetime
+		}
+		result.MeanLifetime = total / time.Duration(len(result.Lifetimes))
+	}
+	return result
+}
+
+func newSimInstance(quota map[string]int64, now time.Duration) *simInstance {
+	inst := &simInstance{remaining: make(map[string]float64, len(quota)), updated: now}
+	for bucket, capacity := range quota {
+		inst.remaining[bucket] = float64(capacity)
+	}
+	return inst
+}
+
+// refill adds the quota accrued since the instance was last used, up to the capacity of every bucket.
+func (s *simInstance) refill(quota map[string]int64, window, now time.Duration) {
+	elapsed := float64(now-s.updated) / float64(window)
+	s.updated = now
+	for bucket, capacity := range quota {
+		s.remaining[bucket] = math.Min(float64(capacity), s.remaining[bucket]+elapsed*float64(capacity))
+	}
+}
+
+// newBucketPicker returns a function choosing the bucket consumed by a request according to the mix, or false if
+// requests don't consume any bucket of the quota.
+func newBucketPicker(quota map[string]int64, mix map[string]float64) func(*rand.Rand) (string, bool) {
+	var buckets []string
+	for bucket := range quota {
+		if len(mix) == 0 || mix[bucket] > 0 {
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.Strings(buckets) // deterministic for a given seed
+	cumulative := make([]float64, len(buckets))
+	var total float64
+	for i, bucket := range buckets {
+		share := 1.0
+		if len(mix) > 0 {
+			share = mix[bucket]
+		}
+		total += share
+		cumulative[i] = total
+	}
+	return func(rng *rand.Rand) (string, bool) {
+		if len(buckets) == 0 {
+			return "", false
+		}
+		x := rng.Float64() * total
+		i := sort.SearchFloat64s(cumulative, x)
+		if i == len(buckets) {
+			i--
+		}
+		return buckets[i], true
+	}
+}
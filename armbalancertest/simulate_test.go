@@ -0,0 +1,85 @@
+package armbalancertest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-armbalancer"
+)
+
+func TestSimulate(t *testing.T) {
+	never := armbalancer.RecyclePolicyFunc(func(armbalancer.ConnSnapshot) bool { return false })
+	base := SimulationConfig{
+		Connections:       4,
+		Duration:          6 * time.Hour,
+		RequestsPerSecond: 5,
+		BurstSize:         10,
+		Quota:             map[string]int64{"Subscription-Reads": 2000, "Subscription-Writes": 500},
+		Mix:               map[string]float64{"Subscription-Reads": 4, "Subscription-Writes": 1},
+		Seed:              1,
+	}
+
+	tests := []struct {
+		name      string
+		policy    armbalancer.RecyclePolicy
+		instances int
+		recycles  bool
+	}{
+		{name: "never recycled", policy: never},
+		{name: "default policy", recycles: true},
+		{name: "single instance", instances: 1, recycles: true},
+	}
+	results := map[string]SimulationResult{}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := base
+			cfg.Policy = tc.policy
+			cfg.Instances = tc.instances
+			start := time.Now()
+			r := Simulate(cfg)
+			t.Logf("simulated %s in %s: %d requests, %d throttled, %d recycles", cfg.Duration, time.Since(start), r.Requests, r.Throttled, r.Recycles)
+			results[tc.name] = r
+
+			if r.Requests == 0 || r.Requests != r.Served+r.Throttled {
+				t.Errorf("expected every request to be served or throttled, got %+v", r)
+			}
+			if want := 5 * 6 * 3600; r.Requests < want*9/10 || r.Requests > want*11/10 {
+				t.Errorf("expected about %d requests, got %d", want, r.Requests)
+			}
+			if got := r.Recycles > 0; got != tc.recycles || len(r.Lifetimes) != r.Recycles {
+				t.Errorf("expected recycles %t with one lifetime each, got %d and %d", tc.recycles, r.Recycles, len(r.Lifetimes))
+			}
+			if r.Recycles > 0 && (r.MeanLifetime <= 0 || r.RecyclesPerHour != float64(r.Recycles)/6) {
+				t.Errorf("expected the lifetimes and rate of recycles to be reported, got %+v", r)
+			}
+		})
+	}
+
+	// Each connection consumes 750 requests an hour, 150 of them writes, more than its instance refills
+	if r := results["never recycled"]; r.Throttled == 0 || r.MinRemaining != 0 {
+		t.Errorf("expected connections that are never recycled to be throttled, got %+v", r)
+	}
+	if r := results["default policy"]; r.Throttled != 0 || r.MinRemaining > 100 {
+		t.Errorf("expected recycling to avoid throttling, got %+v", r)
+	}
+	// Connections can't move away from a single instance, which throttles the 3000 requests an hour exceeding its quota
+	if r := results["single instance"]; r.Throttled <= results["never recycled"].Throttled {
+		t.Errorf("expected a single shared instance to throttle more, got %+v", r)
+	}
+
+	cfg := base
+	if a, b := Simulate(cfg), Simulate(cfg); !reflect.DeepEqual(a, b) {
+		t.Errorf("expected simulations with the same seed to match, got %+v and %+v", a, b)
+	}
+}
+
+func TestSimulateDefaults(t *testing.T) {
+	r := Simulate(SimulationConfig{Mix: map[string]float64{"Subscription-Writes": 1}})
+	if r.Requests == 0 || r.Served != r.Requests || r.Recycles != 0 {
+		t.Errorf("expected requests that don't consume the default quota to be served without recycling, got %+v", r)
+	}
+	if r.MinRemaining != 12000 {
+		t.Errorf("expected the default quota to stay full, got %d", r.MinRemaining)
+	}
+}
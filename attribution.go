@@ -0,0 +1,73 @@
+package armbalancer
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// attributionOther counts the requests whose key isn't tracked once the cap has been reached.
+const attributionOther = "other"
+
+// attribution counts requests by method and normalized path prefix, see Options.TrackAttribution.
+type attribution struct {
+	lock    sync.Mutex
+	counts  map[string]int64
+	max     int
+	keepIDs bool
+}
+
+func newAttribution(max int, keepIDs bool) *attribution {
+	return &attribution{counts: make(map[string]int64), max: max, keepIDs: keepIDs}
+}
+
+func (a *attribution) Record(req *http.Request) {
+	if a == nil {
+		return
+	}
+	key := req.Method + " " + attributionPath(req.URL.Path, a.keepIDs)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.counts[key]; !ok && len(a.counts) >= a.max {
+		key = attributionOther
+	}
+	a.counts[key]++
+}
+
+func (a *attribution) Snapshot() map[string]int64 {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	counts := make(map[string]int64, len(a.counts))
+	for key, n := range a.counts {
+		counts[key] = n
+	}
+	return counts
+}
+
+// attributionPath returns the first two segments of the path, with the second one replaced by "*" unless it's
+// a provider namespace, followed by the namespace of the last provider the path targets, e.g.
+// "/subscriptions/*/providers/Microsoft.Compute" for a virtual machine. Subscription IDs are kept if keepIDs is set.
+func attributionPath(path string, keepIDs bool) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) > 1 {
+		keep := strings.EqualFold(segments[0], "providers") || (keepIDs && strings.EqualFold(segments[0], "subscriptions"))
+		if !keep {
+			segments[1] = "*"
+		}
+	}
+	head := segments
+	if len(head) > 2 {
+		head = head[:2]
+	}
+	prefix := "/" + strings.Join(head, "/")
+
+	for i := len(segments) - 2; i >= 2; i-- {
+		if strings.EqualFold(segments[i], "providers") {
+			return prefix + "/providers/" + segments[i+1]
+		}
+	}
+	return prefix
+}
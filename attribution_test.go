@@ -0,0 +1,71 @@
+package armbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestAttributionPath(t *testing.T) {
+	const vm = "/subscriptions/0b1f6471-1bf0-4dda-aec3-cb9272f09590/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm"
+	for _, c := range []struct {
+		path     string
+		keepIDs  bool
+		expected string
+	}{
+		{vm, false, "/subscriptions/*/providers/Microsoft.Compute"},
+		{vm, true, "/subscriptions/0b1f6471-1bf0-4dda-aec3-cb9272f09590/providers/Microsoft.Compute"},
+		{"/subscriptions/0b1f6471-1bf0-4dda-aec3-cb9272f09590/resourcegroups/rg", false, "/subscriptions/*"},
+		{"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/virtualNetworks/vnet/providers/Microsoft.Authorization/locks/l", false, "/subscriptions/*/providers/Microsoft.Authorization"},
+		{"/providers/Microsoft.Resources/operations", false, "/providers/Microsoft.Resources"},
+		{"/metadata/endpoints", false, "/metadata/*"},
+		{"/subscriptions", false, "/subscriptions"},
+		{"/", false, "/"},
+	} {
+		if got := attributionPath(c.path, c.keepIDs); got != c.expected {
+			t.Errorf("expected %s to be attributed to %s, got %s", c.path, c.expected, got)
+		}
+	}
+}
+
+func TestTrackAttribution(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	b := New(Options{
+		Transport:          svr.Client().Transport.(*http.Transport),
+		Host:               u.Host,
+		PoolSize:           1,
+		TrackAttribution:   true,
+		AttributionMaxKeys: 2,
+	})
+	defer b.Close()
+	untracked := New(Options{Transport: svr.Client().Transport.(*http.Transport), Host: u.Host, AllowSharedParent: true})
+	defer untracked.Close()
+	if s := untracked.Stats(); s.Attribution != nil {
+		t.Errorf("expected no attribution unless enabled, got %v", s.Attribution)
+	}
+
+	for _, r := range []struct{ method, path string }{
+		{"PUT", "/subscriptions/a/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm"},
+		{"PUT", "/subscriptions/b/resourceGroups/rg/providers/Microsoft.Compute/disks/disk"},
+		{"GET", "/subscriptions/a"},
+		{"DELETE", "/subscriptions/a/resourceGroups/rg"},
+	} {
+		req, _ := http.NewRequest(r.method, svr.URL+r.path, nil)
+		resp, err := b.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	expected := map[string]int64{"PUT /subscriptions/*/providers/Microsoft.Compute": 2, "GET /subscriptions/*": 1, "other": 1}
+	if got := b.Stats().Attribution; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected attribution %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,25 @@
+package armbalancer
+
+import (
+	"context"
+	"strings"
+)
+
+type audienceKey struct{}
+
+// WithAudience returns a context that tags the requests sent with it with the audience of their token,
+// such as "https://management.usgovcloudapi.net/". Tagged requests are only served by the hosts added
+// with the same HostOptions.Audience, so that connections are never shared across clouds.
+func WithAudience(ctx context.Context, audience string) context.Context {
+	return context.WithValue(ctx, audienceKey{}, canonicalAudience(audience))
+}
+
+func audienceFromContext(ctx context.Context) string {
+	audience, _ := ctx.Value(audienceKey{}).(string)
+	return audience
+}
+
+// canonicalAudience lowercases the audience and drops its trailing slash, which tokens may or may not include.
+func canonicalAudience(audience string) string {
+	return strings.TrimSuffix(strings.ToLower(audience), "/")
+}
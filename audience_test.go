@@ -0,0 +1,76 @@
+package armbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAudiencePools(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	const (
+		public = "https://management.core.windows.net/"
+		gov    = "https://management.usgovcloudapi.net/"
+	)
+	b, err := NewBuilder(svr.Client().Transport.(*http.Transport)).
+		WithOptions(Options{PoolSize: 2}).
+		AddHost(u.Host, HostOptions{Audience: public}).
+		AddHost(u.Host, HostOptions{Audience: gov}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	send := func(ctx context.Context, n int) error {
+		for i := 0; i < n; i++ {
+			req, _ := http.NewRequestWithContext(ctx, "GET", svr.URL, nil)
+			resp, err := b.RoundTrip(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+		}
+		return nil
+	}
+	if err := send(WithAudience(context.Background(), public), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(WithAudience(context.Background(), "HTTPS://management.usgovcloudapi.net"), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := map[string]int64{}
+	for _, ts := range b.Stats().Transports {
+		requests[ts.Audience] += ts.Requests
+	}
+	if requests["https://management.core.windows.net"] != 3 || requests["https://management.usgovcloudapi.net"] != 5 {
+		t.Errorf("expected each audience to be served by its own pool, got %v", requests)
+	}
+
+	if err := send(context.Background(), 1); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("expected untagged requests not to be served by the pools dedicated to an audience, got: %v", err)
+	}
+	if err := send(WithAudience(context.Background(), "https://management.chinacloudapi.cn/"), 1); err == nil || !strings.Contains(err.Error(), "for audience") {
+		t.Errorf("expected requests for another audience to be rejected, got: %v", err)
+	}
+	if hosts := b.SupportedHosts(); len(hosts) != 1 {
+		t.Errorf("expected the host to be listed once, got %q", hosts)
+	}
+
+	_, err = NewBuilder(nil).
+		AddHost("management.azure.com", HostOptions{Audience: gov}).
+		AddHost("management.azure.com", HostOptions{Audience: "https://management.usgovcloudapi.net"}).
+		Build()
+	if err == nil || !strings.Contains(err.Error(), "duplicate host") {
+		t.Errorf("expected the same host and audience to be rejected, got: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+// Package autorestsender adapts the ARM balancer to the track 1 Azure SDKs, whose clients send requests
+// through an autorest.Sender. The interface is satisfied structurally, so that the balancer doesn't depend
+// on go-autorest:
+//
+//	client := resources.NewGroupsClient(subscriptionID)
+//	client.Sender = autorestsender.NewSender(armbalancer.Options{})
+package autorestsender
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Azure/go-armbalancer"
+)
+
+// Sender implements autorest.Sender using a balancer.
+type Sender struct {
+	Balancer *armbalancer.Balancer
+}
+
+// NewSender returns a Sender backed by a balancer created with New, which panics if the options are invalid.
+func NewSender(opts armbalancer.Options) *Sender {
+	return &Sender{Balancer: armbalancer.New(opts)}
+}
+
+// Do sends the request through the balancer. Errors that retrying can't fix, such as requests to hosts the
+// balancer doesn't serve or sent after it has been closed, are wrapped in a net.Error whose Temporary method
+// returns false, which autorest's retry policies treat as terminal. Other errors are retried by autorest.
+func (s *Sender) Do(req *http.Request) (*http.Response, error) {
+	resp, err := s.Balancer.RoundTrip(req)
+	if err != nil && isTerminal(err) {
+		err = &TerminalError{Err: err}
+	}
+	return resp, err
+}
+
+// Close closes the balancer, see armbalancer.Balancer.Close.
+func (s *Sender) Close() error {
+	return s.Balancer.Close()
+}
+
+func isTerminal(err error) bool {
+	var notSupported *armbalancer.HostNotSupportedError
+	return errors.As(err, &notSupported) || errors.Is(err, armbalancer.ErrClosed) || errors.Is(err, armbalancer.ErrBodyTooLarge)
+}
+
+// TerminalError wraps the errors that autorest shouldn't retry.
+type TerminalError struct {
+	Err error
+}
+
+func (e *TerminalError) Error() string   { return e.Err.Error() }
+func (e *TerminalError) Unwrap() error   { return e.Err }
+func (e *TerminalError) Timeout() bool   { return false }
+func (e *TerminalError) Temporary() bool { return false }
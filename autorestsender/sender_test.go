@@ -0,0 +1,58 @@
+package autorestsender
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Azure/go-armbalancer"
+)
+
+// isTemporary mirrors autorest.IsTemporaryNetworkError, which decides whether autorest retries an error.
+func isTemporary(err error) bool {
+	netErr, ok := err.(net.Error)
+	return !ok || netErr.Temporary()
+}
+
+func TestSender(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "1000")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	s := NewSender(armbalancer.Options{Transport: svr.Client().Transport.(*http.Transport), Host: u.Host, PoolSize: 2})
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("GET", svr.URL+"/subscriptions", nil)
+		resp, err := s.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	var requests int64
+	for _, ts := range s.Balancer.Stats().Transports {
+		requests += ts.Requests
+	}
+	if requests != 4 {
+		t.Errorf("expected the requests to flow through the pool, got %d", requests)
+	}
+
+	req, _ := http.NewRequest("GET", "https://management.azure.com/subscriptions", nil)
+	_, err := s.Do(req)
+	var notSupported *armbalancer.HostNotSupportedError
+	if !errors.As(err, &notSupported) || isTemporary(err) {
+		t.Errorf("expected requests to other hosts to fail without being retried, got: %v", err)
+	}
+
+	s.Close()
+	req, _ = http.NewRequest("GET", svr.URL+"/subscriptions", nil)
+	if _, err := s.Do(req); !errors.Is(err, armbalancer.ErrClosed) || isTemporary(err) {
+		t.Errorf("expected requests after Close to fail without being retried, got: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package armbalancer
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Pressure describes how close the balancer is to exhausting its rate limiting quota, e.g. to slow down
+// a controller's work queue before requests get throttled. See Balancer.Pressure.
+type Pressure struct {
+	// Score is the score of the worst bucket, from 0 when no bucket has been reported to 1 once a bucket's
+	// remaining quota is at or below its host's RecycleThreshold.
+	Score float64
+
+	// Buckets describes every bucket reported by the pooled connections of every host, worst first.
+	Buckets []BucketPressure
+}
+
+// BucketPressure describes the pressure on a single rate limiting bucket of a host.
+type BucketPressure struct {
+	Host      string // host:port
+	Bucket    string // e.g. "Subscription-Reads"
+	Remaining int64  // lowest value reported by the host's pooled connections
+	Threshold int64  // the host's RecycleThreshold
+
+	// Score is Threshold divided by Remaining, capped at 1: it's 0.5 when twice the threshold remains,
+	// and 0.1 when ten times the threshold remains.
+	Score float64
+}
+
+// pressureScore returns the score of a bucket with the given remaining quota.
+func pressureScore(remaining, threshold int64) float64 {
+	if remaining <= threshold {
+		return 1
+	}
+	return float64(threshold) / float64(remaining)
+}
+
+// Pressure returns the pressure on the rate limiting buckets reported by the pooled connections.
+// Persisted state isn't taken into account.
+func (t *Balancer) Pressure() Pressure {
+	var p Pressure
+	for _, pool := range t.hosts {
+		hostport := net.JoinHostPort(pool.host, pool.port)
+		for bucket, remaining := range pool.minRemaining() {
+			score := pressureScore(remaining, pool.threshold)
+			p.Buckets = append(p.Buckets, BucketPressure{
+				Host:      hostport,
+				Bucket:    bucket,
+				Remaining: remaining,
+				Threshold: pool.threshold,
+				Score:     score,
+			})
+			if score > p.Score {
+				p.Score = score
+			}
+		}
+	}
+	sort.Slice(p.Buckets, func(i, j int) bool {
+		a, b := p.Buckets[i], p.Buckets[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Bucket < b.Bucket
+	})
+	return p
+}
+
+// pressureScore returns the score of the worst bucket without allocating, see Pressure.
+func (t *Balancer) pressureScore() float64 {
+	var score float64
+	for _, pool := range t.hosts {
+		for _, rt := range pool.pool {
+			r, ok := rt.(*recyclableTransport)
+			if !ok {
+				continue
+			}
+			if lowest, ok := r.state.Lowest(); ok {
+				if s := pressureScore(lowest, pool.threshold); s > score {
+					score = s
+				}
+			}
+		}
+	}
+	return score
+}
+
+// pressureWatch calls Options.OnPressureChange whenever the pressure score crosses one of its boundaries.
+type pressureWatch struct {
+	boundaries []float64 // ascending
+	onChange   func(Pressure)
+	level      int32      // atomic, number of boundaries at or below the latest score
+	lock       sync.Mutex // serializes the callbacks
+}
+
+func newPressureWatch(boundaries []float64, onChange func(Pressure)) *pressureWatch {
+	if boundaries == nil {
+		boundaries = []float64{0.7, 0.9}
+	}
+	sorted := append([]float64(nil), boundaries...)
+	sort.Float64s(sorted)
+	return &pressureWatch{boundaries: sorted, onChange: onChange}
+}
+
+func (w *pressureWatch) levelOf(score float64) int32 {
+	return int32(sort.Search(len(w.boundaries), func(i int) bool { return w.boundaries[i] > score }))
+}
+
+// checkPressure is called whenever a pooled transport applies rate limiting headers.
+func (t *Balancer) checkPressure() {
+	w := t.pressureWatch
+	if w == nil || w.levelOf(t.pressureScore()) == atomic.LoadInt32(&w.level) {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	p := t.Pressure()
+	level := w.levelOf(p.Score)
+	if level == atomic.LoadInt32(&w.level) {
+		return // raced with another response
+	}
+	atomic.StoreInt32(&w.level, level)
+	w.onChange(p)
+}
@@ -0,0 +1,69 @@
+package armbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPressure(t *testing.T) {
+	var reads int64 = 1000
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", strconv.FormatInt(atomic.LoadInt64(&reads), 10))
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Writes", "400")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	var scores []string
+	b := New(Options{
+		Transport:        svr.Client().Transport.(*http.Transport),
+		Host:             u.Host,
+		PoolSize:         1,
+		RecycleThreshold: 100,
+		RecyclePolicy:    RecyclePolicyFunc(func(ConnSnapshot) bool { return false }),
+		OnPressureChange: func(p Pressure) { scores = append(scores, fmt.Sprintf("%.2f", p.Score)) },
+	})
+	defer b.Close()
+
+	if p := b.Pressure(); p.Score != 0 || len(p.Buckets) != 0 {
+		t.Errorf("expected no pressure before the first response, got %+v", p)
+	}
+	for _, remaining := range []int64{1000, 130, 120, 105, 100, 20, 500, 1000} {
+		atomic.StoreInt64(&reads, remaining)
+		resp, err := b.RoundTrip(httptest.NewRequest(http.MethodGet, svr.URL, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if got, want := fmt.Sprint(scores), "[0.77 0.95 0.25]"; got != want {
+		t.Errorf("expected crossings %s, got %s", want, got)
+	}
+
+	p := b.Pressure()
+	if p.Score != 0.25 || len(p.Buckets) != 2 {
+		t.Fatalf("unexpected pressure %+v", p)
+	}
+	if worst := p.Buckets[0]; worst.Bucket != "Subscription-Writes" || worst.Remaining != 400 || worst.Threshold != 100 || worst.Host != u.Host {
+		t.Errorf("expected writes to be the worst bucket, got %+v", worst)
+	}
+	if reads := p.Buckets[1]; reads.Bucket != "Subscription-Reads" || reads.Score != 0.1 {
+		t.Errorf("unexpected reads pressure %+v", reads)
+	}
+}
+
+func TestPressureBoundariesValidation(t *testing.T) {
+	for _, boundary := range []float64{0, -0.5, 1.5} {
+		_, err := NewBuilder(nil).WithOptions(Options{PressureBoundaries: []float64{0.5, boundary}}).Build()
+		if err == nil {
+			t.Errorf("expected a pressure boundary of %g to be rejected", boundary)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package armbalancer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrBodyTooLarge is returned for requests whose body exceeds Options.MaxRequestBodyBytes.
+var ErrBodyTooLarge = errors.New("armbalancer: request body is too large")
+
+// limitBody rejects requests with a known body length above max, and wraps bodies of unknown length
+// to abort the request once more than max bytes have been read from them.
+func limitBody(req *http.Request, max int64) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.ContentLength > max {
+		return nil, fmt.Errorf("%w: %d bytes exceeds the limit of %d", ErrBodyTooLarge, req.ContentLength, max)
+	}
+	if req.ContentLength > 0 {
+		return req, nil
+	}
+
+	limited := *req
+	limited.Body = &limitedBody{ReadCloser: req.Body, remaining: max}
+	if getBody := req.GetBody; getBody != nil {
+		limited.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return &limitedBody{ReadCloser: body, remaining: max}, nil
+		}
+	}
+	return &limited, nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// Read one byte past the limit to detect bodies that exceed it
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	return n, err
+}
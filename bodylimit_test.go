@@ -0,0 +1,67 @@
+package armbalancer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMaxRequestBodyBytes(t *testing.T) {
+	var received int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		atomic.AddInt64(&received, 1)
+	}))
+	defer svr.Close()
+
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:           svr.Client().Transport.(*http.Transport),
+		Host:                u.Host,
+		PoolSize:            1,
+		MaxRequestBodyBytes: 10,
+	})
+	defer b.Close()
+	client := &http.Client{Transport: b}
+
+	tests := []struct {
+		name    string
+		body    io.Reader
+		wantErr bool
+		sent    bool
+	}{
+		{name: "known length under limit", body: bytes.NewReader(make([]byte, 5)), sent: true},
+		{name: "known length at limit", body: bytes.NewReader(make([]byte, 10)), sent: true},
+		{name: "known length over limit", body: bytes.NewReader(make([]byte, 11)), wantErr: true},
+		{name: "chunked at limit", body: io.MultiReader(bytes.NewReader(make([]byte, 10))), sent: true},
+		{name: "chunked over limit", body: io.MultiReader(bytes.NewReader(make([]byte, 1<<20))), wantErr: true},
+		{name: "no body", body: nil, sent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := atomic.LoadInt64(&received)
+			req, _ := http.NewRequest("PUT", svr.URL, tt.body)
+			resp, err := client.Do(req)
+			if tt.wantErr {
+				if !errors.Is(err, ErrBodyTooLarge) {
+					t.Errorf("expected ErrBodyTooLarge, got: %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				resp.Body.Close()
+			}
+			if tt.wantErr && req.ContentLength <= 0 {
+				return // the server may have seen the headers before the request was aborted
+			}
+			if sent := atomic.LoadInt64(&received) > before; sent != tt.sent {
+				t.Errorf("expected the request to be sent: %t, got %t", tt.sent, sent)
+			}
+		})
+	}
+}
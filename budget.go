@@ -0,0 +1,160 @@
+package armbalancer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clock abstracts time for the connection budget, so that tests can control it.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// connBudget counts the connections established by a balancer over a sliding window,
+// and limits recycles to max new connections per window unless max is zero.
+type connBudget struct {
+	max    int
+	window time.Duration
+	clock  clock
+
+	lock     sync.Mutex
+	dialed   []time.Time // oldest first, within the window
+	reserved int         // connections counted by Wait that haven't been dialed yet
+}
+
+func newConnBudget(max int) *connBudget {
+	return &connBudget{max: max, window: time.Minute, clock: realClock{}}
+}
+
+// Record counts a new connection, unless it was already counted by Wait.
+func (b *connBudget) Record() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.reserved > 0 {
+		b.reserved--
+		return
+	}
+	now := b.clock.Now()
+	b.prune(now)
+	b.dialed = append(b.dialed, now)
+}
+
+// Wait blocks until the budget allows a new connection, and reserves it. It returns ctx's error if ctx expires
+// first, or nil if done is closed first.
+func (b *connBudget) Wait(ctx context.Context, done <-chan struct{}) error {
+	if b == nil || b.max <= 0 {
+		return nil
+	}
+	for {
+		b.lock.Lock()
+		now := b.clock.Now()
+		b.prune(now)
+		if len(b.dialed) < b.max {
+			b.dialed = append(b.dialed, now)
+			b.reserved++
+			b.lock.Unlock()
+			return nil
+		}
+		delay := b.dialed[len(b.dialed)-b.max].Add(b.window).Sub(now)
+		b.lock.Unlock()
+
+		select {
+		case <-b.clock.After(delay):
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Count returns the number of connections established within the window.
+func (b *connBudget) Count() int {
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.prune(b.clock.Now())
+	return len(b.dialed)
+}
+
+// Delay returns how long to wait until the budget allows a new connection.
+func (b *connBudget) Delay() time.Duration {
+	if b == nil || b.max <= 0 {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := b.clock.Now()
+	b.prune(now)
+	if len(b.dialed) < b.max {
+		return 0
+	}
+	return b.dialed[len(b.dialed)-b.max].Add(b.window).Sub(now)
+}
+
+func (b *connBudget) prune(now time.Time) {
+	i := 0
+	for i < len(b.dialed) && now.Sub(b.dialed[i]) >= b.window {
+		i++
+	}
+	b.dialed = b.dialed[i:]
+}
+
+// delayedRecycle is a recycle postponed to stay within the connection budget.
+type delayedRecycle struct {
+	reason   RecycleReason
+	snapshot ConnSnapshot
+}
+
+// postponeForConnBudget reports the recycle as postponed if the connection budget doesn't allow a new
+// connection, or policy recycles are slowed down by dial pressure, and hands it back to the recycling goroutine
+// once they allow it, unless the transport is closed first.
+// Only one recycle is postponed at a time: the decisions made in the meantime are dropped.
+func (t *recyclableTransport) postponeForConnBudget(event RecycleEvent) bool {
+	event.ConnBudgetDelay = t.budget.Delay()
+	if event.Reason == RecycleReasonPolicy {
+		event.DialPressureDelay = t.pressure.RecycleDelay()
+	}
+	delay := event.ConnBudgetDelay
+	if event.DialPressureDelay > delay {
+		delay = event.DialPressureDelay
+	}
+	if delay <= 0 {
+		return false
+	}
+	if !atomic.CompareAndSwapInt32(&t.budgetWait, 0, 1) {
+		return true
+	}
+	event.Postponed = true
+	var clk clock = realClock{}
+	if t.budget != nil {
+		clk = t.budget.clock
+	}
+	timer := clk.After(delay)
+	t.emit(event)
+	go func() {
+		select {
+		case <-timer:
+		case <-t.done:
+			return
+		}
+		select {
+		case t.delayed <- delayedRecycle{reason: event.Reason, snapshot: event.Snapshot}:
+		case <-t.done:
+		}
+	}()
+	return true
+}
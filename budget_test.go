@@ -0,0 +1,327 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when advanced, firing the timers that expire.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// Timers returns the number of timers that haven't fired yet.
+func (c *fakeClock) Timers() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
+
+func TestConnBudgetWindow(t *testing.T) {
+	clock := newFakeClock()
+	b := newConnBudget(2)
+	b.clock = clock
+
+	b.Record()
+	clock.Advance(20 * time.Second)
+	b.Record()
+	if d := b.Delay(); d != 40*time.Second {
+		t.Errorf("expected to wait for the first connection to leave the window, got %s", d)
+	}
+	clock.Advance(40 * time.Second)
+	if n := b.Count(); n != 1 {
+		t.Errorf("expected 1 connection within the window, got %d", n)
+	}
+	if d := b.Delay(); d != 0 {
+		t.Errorf("expected no delay once a connection left the window, got %s", d)
+	}
+
+	unlimited := newConnBudget(0)
+	unlimited.Record()
+	if d := unlimited.Delay(); d != 0 {
+		t.Errorf("expected no delay without a limit, got %s", d)
+	}
+}
+
+func TestRecycleConnBudget(t *testing.T) {
+	clock := newFakeClock()
+	budget := newConnBudget(1)
+	budget.clock = clock
+	budget.Record() // the connection of the first generation
+
+	log := newEventLog()
+	r := buildRecyclableTransport(transportConfig{
+		host:   "management.azure.com",
+		port:   "443",
+		policy: RecyclePolicyFunc(func(s ConnSnapshot) bool { return s.Generation == 1 }),
+		budget: budget,
+		onRecycle: func(e RecycleEvent) {
+			if e.Postponed {
+				log.Add(fmt.Sprintf("postpone %d: %s", e.Generation, e.ConnBudgetDelay))
+				return
+			}
+			log.Add(fmt.Sprintf("recycle %d", e.Generation))
+		},
+		newTransport: func(gen *generation) roundTripperCloser {
+			return &fakeTransport{gen: gen.number, log: log, respond: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Header: remainingReads("1"), Body: http.NoBody}, nil
+			}}
+		},
+	})
+	defer r.Close(false)
+
+	sendFake(t, r)
+	log.expect(t, "postpone 1: 1m0s")
+	if gen := r.Snapshot().Generation; gen != 1 {
+		t.Fatalf("expected the recycle to wait for the budget, got generation %d", gen)
+	}
+
+	clock.Advance(time.Minute)
+	log.expect(t, "recycle 1")
+	log.expect(t, "close 1")
+	if gen := r.Snapshot().Generation; gen != 2 {
+		t.Errorf("expected the recycle to proceed once the budget allows, got generation %d", gen)
+	}
+}
+
+func TestSynchronousRecycleConnBudget(t *testing.T) {
+	clock := newFakeClock()
+	budget := newConnBudget(1)
+	budget.clock = clock
+	budget.Record()
+
+	log := newEventLog()
+	r := buildRecyclableTransport(transportConfig{
+		host:        "management.azure.com",
+		port:        "443",
+		policy:      RecyclePolicyFunc(func(s ConnSnapshot) bool { return true }),
+		budget:      budget,
+		synchronous: true,
+		onRecycle: func(e RecycleEvent) {
+			if e.Postponed {
+				log.Add(fmt.Sprintf("postpone %d", e.Generation))
+				return
+			}
+			log.Add(fmt.Sprintf("recycle %d", e.Generation))
+		},
+		newTransport: func(gen *generation) roundTripperCloser {
+			return &fakeTransport{gen: gen.number, log: log, respond: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			}}
+		},
+	})
+	defer r.Close(false)
+
+	// Responses don't wait for the budget, and the recycle is only reported as postponed once
+	sendFake(t, r)
+	sendFake(t, r)
+	log.expect(t, "postpone 1")
+
+	clock.Advance(time.Minute)
+	log.expect(t, "recycle 1")
+	log.expect(t, "close 1")
+	if events := log.Events(); len(events) != 3 {
+		t.Errorf("expected a single postponed recycle, got %q", events)
+	}
+}
+
+func TestForceRecycleAllPacing(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	b := New(Options{
+		Transport:                  svr.Client().Transport.(*http.Transport),
+		Host:                       u.Host,
+		PoolSize:                   2,
+		MaxNewConnectionsPerMinute: 1,
+	})
+	defer b.Close()
+	clock := newFakeClock()
+	b.budget.clock = clock
+	b.budget.Record() // saturate the budget
+	recycles := func() (counts []int64) {
+		for _, s := range b.Stats().Transports {
+			counts = append(counts, s.Recycles)
+		}
+		return counts
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.ForceRecycleAll(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected ForceRecycleAll to wait for the budget, got: %v", err)
+	}
+	if got := recycles(); got[0] != 0 || got[1] != 0 {
+		t.Fatalf("expected no recycle while the budget is saturated, got %v", got)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- b.ForceRecycleAll(context.Background()) }()
+	waitFor(t, "the first transport to wait", func() bool { return clock.Timers() == 2 })
+	clock.Advance(time.Minute)
+	waitFor(t, "the first transport to be recycled", func() bool { return recycles()[0] == 1 })
+	waitFor(t, "the second transport to wait", func() bool { return clock.Timers() == 1 })
+	if got := recycles()[1]; got != 0 {
+		t.Errorf("expected the second transport to wait for the budget, got %d recycles", got)
+	}
+
+	clock.Advance(time.Minute)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got := recycles(); got[0] != 1 || got[1] != 1 {
+		t.Errorf("expected every transport to be recycled once, got %v", got)
+	}
+}
+
+func TestForceRecycleAllChurnBackoff(t *testing.T) {
+	b := New(Options{Host: "management.azure.com", PoolSize: 2})
+	defer b.Close()
+	r := b.hosts[0].pool[1].(*recyclableTransport)
+	r.churn.lock.Lock()
+	r.churn.until = time.Now().Add(time.Hour)
+	r.churn.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.ForceRecycleAll(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected ForceRecycleAll to wait for the churn backoff, got: %v", err)
+	}
+	if s := b.Stats().Transports[1]; s.Recycles != 0 {
+		t.Errorf("expected the suspended transport not to be recycled, got %d recycles", s.Recycles)
+	}
+
+	r.churn.lock.Lock()
+	r.churn.until = time.Now().Add(50 * time.Millisecond)
+	r.churn.lock.Unlock()
+	if err := b.ForceRecycleAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.Stats().Transports[1]; s.Recycles != 1 {
+		t.Errorf("expected the transport to be recycled once the backoff passed, got %d recycles", s.Recycles)
+	}
+}
+
+func TestReactivateConnBudget(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	b := New(Options{
+		Transport:                  svr.Client().Transport.(*http.Transport),
+		Host:                       u.Host,
+		PoolSize:                   2,
+		MaxNewConnectionsPerMinute: 2,
+	})
+	defer b.Close()
+	clock := newFakeClock()
+	b.budget.clock = clock
+	send := func(ctx context.Context) error {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, svr.URL, nil)
+		resp, err := b.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := send(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := b.budget.Count(); n != 2 {
+		t.Fatalf("expected the budget to be exhausted by the first connections, got %d", n)
+	}
+	stats := func() []TransportStats { return b.Stats().Transports }
+
+	// Requests avoid the quiesced transport while another one is active
+	b.hosts[0].pool[0].(*recyclableTransport).Quiesce()
+	for i := 0; i < 2; i++ {
+		if err := send(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := stats(); !s[0].Quiesced || s[0].Generation != 1 || s[1].Requests != 3 {
+		t.Errorf("expected requests to avoid the quiesced transport, got %+v", s)
+	}
+
+	// Requests wait for the budget when every transport is quiesced
+	b.hosts[0].pool[1].(*recyclableTransport).Quiesce()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := send(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the reactivation to wait for the budget, got: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- send(context.Background()) }()
+	waitFor(t, "the reactivation to wait", func() bool { return clock.Timers() == 2 })
+	if s := stats(); !s[0].Quiesced || !s[1].Quiesced {
+		t.Errorf("expected both transports to remain quiesced, got %+v", s)
+	}
+
+	clock.Advance(time.Minute)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	reactivated := 0
+	for _, s := range stats() {
+		if !s.Quiesced && s.Generation == 2 {
+			reactivated++
+		}
+	}
+	if reactivated != 1 {
+		t.Errorf("expected one transport to be reactivated once the budget allows, got %+v", stats())
+	}
+}
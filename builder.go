@@ -0,0 +1,467 @@
+package armbalancer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHost is the host served when no other host has been configured.
+const DefaultHost = "management.azure.com"
+
+// HostOptions configures the connection pool of a single host registered with a Builder.
+// Zero values fall back to the Options given to Builder.WithOptions, and then to the defaults documented on Options.
+type HostOptions struct {
+	PoolSize             int
+	RecycleThreshold     int64
+	MinReqsBeforeRecycle int64
+	MaxConnAge           time.Duration
+	RecyclePolicy        RecyclePolicy
+
+	// PreserveHostHeader keeps the original Host header of requests redirected to this host by Options.HostWeights,
+	// for endpoints such as private links that expect the public host name.
+	PreserveHostHeader bool
+
+	// Transport is the parent of this host's pooled transports, e.g. to use a different TLS config or proxy.
+	// Default: Options.Transport
+	Transport *http.Transport
+
+	// TLSServerName overrides the name sent with SNI and used to verify this host's certificate,
+	// so that the balancer can dial one name while presenting another.
+	TLSServerName string
+
+	// DefaultPort is the port of a host added without one, and the port assumed for request URLs without one
+	// instead of their scheme's default port, e.g. "8080" so that requests to http://armproxy.corp/ are served by
+	// the pool of "armproxy.corp:8080" and sent to port 8080, keeping their Host header.
+	// Default: 443 for hosts, the scheme's default port for request URLs
+	DefaultPort string
+
+	// Audience dedicates this pool to the requests tagged with the same audience using WithAudience.
+	// The same host can be added once per audience. Untagged requests are served by the pool added without one,
+	// which is also the only one Options.HostWeights and the Balancer's weights apply to.
+	Audience string
+}
+
+// Builder constructs a Balancer serving one or more hosts, each with its own pool of connections.
+//
+//	b := armbalancer.NewBuilder(parent)
+//	b.AddHost("management.azure.com", armbalancer.HostOptions{})
+//	b.AddHost("eastus.management.azure.com:443", armbalancer.HostOptions{PoolSize: 4})
+//	rt, err := b.Build()
+//
+// Hosts are normalized when added: they are lowercased and default to port 443, or HostOptions.DefaultPort.
+// If no host is added, the balancer serves DefaultHost.
+type Builder struct {
+	parent *http.Transport
+	opts   Options
+	hosts  []builderHost
+}
+
+type builderHost struct {
+	raw  string
+	host string
+	port string
+	opts HostOptions
+	err  error
+}
+
+// NewBuilder returns a builder for balancers wrapping the given transport.
+// A nil parent falls back to Options.Transport, and then to http.DefaultTransport.
+func NewBuilder(parent *http.Transport) *Builder {
+	return &Builder{parent: parent}
+}
+
+// WithOptions sets the options shared by every host. Options.Host is ignored, use AddHost instead.
+func (b *Builder) WithOptions(opts Options) *Builder {
+	b.opts = opts
+	return b
+}
+
+// AddHost registers a host in "host" or "host:port" form. Invalid and duplicate hosts are reported by Build.
+func (b *Builder) AddHost(host string, opts HostOptions) *Builder {
+	h, port, err := normalizeHost(host)
+	if _, explicit, splitErr := net.SplitHostPort(host); opts.DefaultPort != "" && (splitErr != nil || explicit == "") {
+		port = opts.DefaultPort
+	}
+	b.hosts = append(b.hosts, builderHost{raw: host, host: h, port: port, opts: opts, err: err})
+	return b
+}
+
+// Build validates the registered hosts and the options, and constructs the balancer.
+func (b *Builder) Build() (*Balancer, error) {
+	hosts := b.hosts
+	if len(hosts) == 0 && b.opts.RequireExplicitHost {
+		return nil, fmt.Errorf("no host has been added and RequireExplicitHost prevents defaulting to %q", DefaultHost)
+	}
+	if len(hosts) == 0 {
+		hosts = []builderHost{{raw: DefaultHost, host: DefaultHost, port: "443"}}
+	}
+
+	seen := map[string]string{}
+	added := map[string]bool{}
+	for _, h := range hosts {
+		if h.err != nil {
+			return nil, h.err
+		}
+		if b.opts.RequireExplicitHost && (h.raw == "" || strings.HasPrefix(h.raw, ":")) {
+			return nil, fmt.Errorf("host %q has no host name and RequireExplicitHost prevents defaulting to %q", h.raw, DefaultHost)
+		}
+		key := net.JoinHostPort(h.host, h.port)
+		if audience := canonicalAudience(h.opts.Audience); audience != "" {
+			key += " for audience " + audience
+		}
+		if prev, ok := seen[key]; ok {
+			return nil, fmt.Errorf("duplicate host %q: %q was already added as %q", h.raw, prev, key)
+		}
+		seen[key] = h.raw
+		added[net.JoinHostPort(h.host, h.port)] = true
+		if h.opts.PoolSize < 0 {
+			return nil, fmt.Errorf("invalid pool size %d for host %q: must not be negative", h.opts.PoolSize, h.raw)
+		}
+		if n, err := strconv.Atoi(h.opts.DefaultPort); h.opts.DefaultPort != "" && (err != nil || n <= 0 || n > 65535) {
+			return nil, fmt.Errorf("invalid default port %q for host %q: must be a port number", h.opts.DefaultPort, h.raw)
+		}
+		if h.opts.DefaultPort != "" && h.opts.DefaultPort != h.port {
+			return nil, fmt.Errorf("invalid default port %q for host %q: conflicts with port %q", h.opts.DefaultPort, h.raw, h.port)
+		}
+	}
+	if err := validateOptions(b.opts); err != nil {
+		return nil, err
+	}
+	aliases, err := parseHostAliases(b.opts.HostAliases, added)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := b.opts
+	if b.parent != nil {
+		opts.Transport = b.parent
+	}
+	if opts.Transport == nil {
+		opts.Transport = http.DefaultTransport.(*http.Transport)
+	}
+	if opts.HedgeBudget == 0 {
+		opts.HedgeBudget = 0.05
+	}
+	if !opts.EnableChaos {
+		opts.ChaosRecycleProbability = 0
+	}
+	if opts.RedirectPoolSize == 0 {
+		opts.RedirectPoolSize = 2
+	}
+
+	t := &Balancer{
+		reservations: newReservationLedger(),
+		timeout:      opts.DefaultRequestTimeout,
+		metrics:      opts.MetricsSink,
+		maxBodyBytes: opts.MaxRequestBodyBytes,
+	}
+	if len(opts.CallerBudgets) > 0 {
+		if opts.CallerBudgetThreshold == 0 {
+			opts.CallerBudgetThreshold = 1000
+		}
+		if opts.CallerBudgetWindow == 0 {
+			opts.CallerBudgetWindow = time.Minute
+		}
+		t.callers = newCallerBudgets(opts.CallerBudgets, opts.CallerBudgetThreshold, opts.CallerBudgetWindow)
+	}
+	t.budget = newConnBudget(opts.MaxNewConnectionsPerMinute)
+	t.aliases = aliases
+	if opts.Recorder != nil {
+		t.recorder = newResponseRecorder(opts.Recorder)
+	}
+	if opts.OnPressureChange != nil {
+		t.pressureWatch = newPressureWatch(opts.PressureBoundaries, opts.OnPressureChange)
+	}
+	t.store = opts.StateStore
+	if opts.TrackAttribution {
+		t.attribution = newAttribution(int(firstNonZero(int64(opts.AttributionMaxKeys), 50)), opts.AttributionKeepSubscriptionIDs)
+	}
+	t.restored = loadState(opts.StateStore, time.Duration(firstNonZero(int64(opts.StateTTL), int64(5*time.Minute))))
+	t.recent = newRecycleLog(int(firstNonZero(int64(opts.RecentRecyclesSize), 64)))
+	t.SetDryRun(opts.DryRun)
+	if !opts.AllowSharedParent {
+		if err := t.claimParents(hosts, opts.Transport); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range hosts {
+		p, err := newHostPool(t, h, opts)
+		if err != nil {
+			t.Close() // stop the pools built so far
+			return nil, err
+		}
+		t.hosts = append(t.hosts, p)
+	}
+	if err := t.SetHostWeights(opts.HostWeights); err != nil {
+		t.Close()
+		return nil, err
+	}
+	if opts.ValidateOnStart {
+		if err := t.validateHosts(time.Duration(firstNonZero(int64(opts.StartupValidationTimeout), int64(10*time.Second)))); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	if len(opts.AllowedRedirectHostSuffixes) > 0 {
+		t.redirects = newRedirectPool(opts.Transport, opts.AllowedRedirectHostSuffixes, opts.RedirectPoolSize, t.budget)
+	}
+	if opts.ShrinkIdleTransports {
+		t.idle = make(chan struct{})
+		go t.shrinkIdle(time.Duration(firstNonZero(int64(opts.IdleShrinkAfter), int64(10*time.Minute))), t.idle)
+	}
+	if _, ok := opts.MetricsSink.(DiversitySink); ok || opts.MinBackendDiversity > 0 {
+		t.diversity = make(chan struct{})
+		lowAfter := time.Duration(firstNonZero(int64(opts.LowDiversityAfter), int64(5*time.Minute)))
+		go t.monitorDiversity(opts.MinBackendDiversity, lowAfter, opts.OnLowDiversity, t.diversity)
+	}
+	return t, nil
+}
+
+// validateOptions rejects the options that would make the balancer fail when serving requests.
+// Zero values are valid since they select the defaults.
+func validateOptions(opts Options) error {
+	switch {
+	case opts.PoolSize < 0:
+		return fmt.Errorf("invalid pool size %d: must not be negative", opts.PoolSize)
+	case opts.RedirectPoolSize < 0:
+		return fmt.Errorf("invalid redirect pool size %d: must not be negative", opts.RedirectPoolSize)
+	case opts.CallerBudgetWindow != 0 && opts.CallerBudgetWindow < minCallerBudgetWindow:
+		return fmt.Errorf("invalid caller budget window %s: must be at least %s", opts.CallerBudgetWindow, minCallerBudgetWindow)
+	case opts.ShrinkIdleTransports && opts.IdleShrinkAfter != 0 && opts.IdleShrinkAfter < minIdleShrinkAfter:
+		return fmt.Errorf("invalid idle shrink delay %s: must be at least %s", opts.IdleShrinkAfter, minIdleShrinkAfter)
+	case opts.MinBackendDiversity < 0:
+		return fmt.Errorf("invalid minimum backend diversity %g: must not be negative", opts.MinBackendDiversity)
+	case opts.LowDiversityAfter != 0 && opts.LowDiversityAfter < minLowDiversityAfter:
+		return fmt.Errorf("invalid low diversity period %s: must be at least %s", opts.LowDiversityAfter, minLowDiversityAfter)
+	case opts.RecentRecyclesSize < 0:
+		return fmt.Errorf("invalid recent recycles size %d: must not be negative", opts.RecentRecyclesSize)
+	case opts.AttributionMaxKeys < 0:
+		return fmt.Errorf("invalid attribution max keys %d: must not be negative", opts.AttributionMaxKeys)
+	case opts.TightDeadline < 0:
+		return fmt.Errorf("invalid tight deadline %s: must not be negative", opts.TightDeadline)
+	case opts.TightDeadlineMargin < 0:
+		return fmt.Errorf("invalid tight deadline margin %d: must not be negative", opts.TightDeadlineMargin)
+	case opts.MaxRecycleThresholdMultiplier < 0:
+		return fmt.Errorf("invalid max recycle threshold multiplier %d: must not be negative", opts.MaxRecycleThresholdMultiplier)
+	case opts.ValidationBackoff < 0:
+		return fmt.Errorf("invalid validation backoff %s: must not be negative", opts.ValidationBackoff)
+	case opts.MaxValidationBackoff < 0:
+		return fmt.Errorf("invalid max validation backoff %s: must not be negative", opts.MaxValidationBackoff)
+	case opts.StateTTL < 0:
+		return fmt.Errorf("invalid state TTL %s: must not be negative", opts.StateTTL)
+	case opts.DialPressureRestoreAfter < 0:
+		return fmt.Errorf("invalid dial pressure restore delay %s: must not be negative", opts.DialPressureRestoreAfter)
+	}
+	for caller, fraction := range opts.CallerBudgets {
+		if !(fraction > 0 && fraction <= 1) {
+			return fmt.Errorf("invalid budget %g for caller %q: must be greater than 0 and at most 1", fraction, caller)
+		}
+	}
+	for _, boundary := range opts.PressureBoundaries {
+		if !(boundary > 0 && boundary <= 1) {
+			return fmt.Errorf("invalid pressure boundary %g: must be greater than 0 and at most 1", boundary)
+		}
+	}
+	for i, m := range opts.PerTransportMiddleware {
+		if m == nil {
+			return fmt.Errorf("per-transport middleware %d is nil", i)
+		}
+	}
+	return nil
+}
+
+func newHostPool(t *Balancer, h builderHost, opts Options) (*hostPool, error) {
+	poolSize := firstNonZero(int64(h.opts.PoolSize), int64(opts.PoolSize), 8)
+	minReqs := firstNonZero(h.opts.MinReqsBeforeRecycle, opts.MinReqsBeforeRecycle, 10)
+	policy := h.opts.RecyclePolicy
+	if policy == nil {
+		policy = opts.RecyclePolicy
+	}
+	if policy == nil {
+		policy = DefaultRecyclePolicy{
+			Threshold:   firstNonZero(h.opts.RecycleThreshold, opts.RecycleThreshold, 100),
+			MinRequests: minReqs,
+			MaxAge:      time.Duration(firstNonZero(int64(h.opts.MaxConnAge), int64(opts.MaxConnAge), 0)),
+		}
+	}
+
+	churnLimit := int(firstNonZero(int64(opts.ChurnBackoffGenerations), 3))
+	ignored := ignoredStatuses(opts.IgnoreQuotaStatusCodes)
+	stallAfter := time.Duration(firstNonZero(int64(opts.RecyclerStallTimeout), int64(time.Minute)))
+	scopes := newBucketScopes(opts.PrincipalScopedBuckets, opts.InstanceScopedBuckets)
+	excludedPaths := make([]string, len(opts.AccountingExcludePathPrefixes))
+	for i, prefix := range opts.AccountingExcludePathPrefixes {
+		excludedPaths[i] = strings.ToLower(prefix)
+	}
+
+	p := &hostPool{
+		host:        h.host,
+		port:        h.port,
+		pool:        make([]http.RoundTripper, poolSize),
+		hedgeAfter:  opts.HedgeAfter,
+		hedgeBudget: opts.HedgeBudget,
+
+		injectAggregate: opts.InjectAggregateHeaders,
+		reservedWrites:  opts.ReservedWriteSlots,
+		strategy:        opts.SelectionStrategy,
+		usage:           make([]slotUsage, poolSize),
+		preserveHost:    h.opts.PreserveHostHeader,
+		audience:        canonicalAudience(h.opts.Audience),
+		defaultPort:     h.opts.DefaultPort,
+		threshold:       firstNonZero(h.opts.RecycleThreshold, opts.RecycleThreshold, 100),
+	}
+	if p.reservedWrites >= len(p.pool) {
+		p.reservedWrites = len(p.pool) - 1
+	}
+	p.latencySink, _ = opts.MetricsSink.(LatencySink)
+	p.budget = t.budget
+	p.tightDeadline = opts.TightDeadline
+	p.riskMargin = firstNonZero(opts.TightDeadlineMargin, 10)
+	hostport := net.JoinHostPort(h.host, h.port)
+	if opts.AdaptToDialPressure {
+		restoreAfter := time.Duration(firstNonZero(int64(opts.DialPressureRestoreAfter), int64(30*time.Second)))
+		p.pressure = newDialPressure(hostport, len(p.pool)-p.reservedWrites, restoreAfter, func(e DialPressureEvent) {
+			p.quiesceReduced(e)
+			if opts.OnDialPressure != nil {
+				opts.OnDialPressure(e)
+			}
+		})
+	}
+	onRecycle := func(e RecycleEvent) {
+		t.recent.Add(hostport, e)
+		if opts.OnRecycle != nil {
+			opts.OnRecycle(e)
+		}
+	}
+	parent := opts.Transport
+	if h.opts.Transport != nil {
+		parent = h.opts.Transport
+	}
+	if h.opts.TLSServerName != "" {
+		parent = parent.Clone()
+		if parent.TLSClientConfig == nil {
+			parent.TLSClientConfig = &tls.Config{}
+		}
+		parent.TLSClientConfig.ServerName = h.opts.TLSServerName
+	}
+	p.parent = parent
+	if opts.TransportFactory != nil {
+		threshold := firstNonZero(h.opts.RecycleThreshold, opts.RecycleThreshold, 100)
+		for i := range p.pool {
+			p.pool[i] = opts.TransportFactory(i, parent, h.host, h.port, threshold, minReqs)
+			if p.pool[i] == nil {
+				return nil, fmt.Errorf("transport factory returned a nil transport %d for host %q", i, h.raw)
+			}
+		}
+		return p, nil
+	}
+	for i := range p.pool {
+		cfg := transportConfig{
+			id:     i,
+			parent: parent,
+			host:   h.host,
+			port:   h.port,
+			policy: policy,
+
+			onRecycle:    onRecycle,
+			dryRun:       &t.dryRun,
+			chaos:        opts.ChaosRecycleProbability,
+			reservations: t.reservations,
+			observer:     opts.ConnObserver,
+
+			globalBuckets: opts.GlobalBucketBehavior,
+			quotaHeaders:  opts.QuotaHeaders,
+			annotate:      opts.AnnotateResponses,
+			drainTimeout:  opts.DrainTimeout,
+			forceClose:    opts.ForceCloseAfterDrainTimeout,
+			lingerGrace:   lingerGrace(opts.LingeringConnGracePeriod),
+			synchronous:   opts.SynchronousRecycle,
+			middleware:    opts.PerTransportMiddleware,
+			budget:        t.budget,
+			maxBuckets:    int(firstNonZero(int64(opts.MaxTrackedBuckets), 64)),
+			ignoredStatus: ignored,
+			onDowngrade:   opts.OnProtocolDowngrade,
+			recycleHTTP1:  opts.RecycleOnProtocolDowngrade,
+			scopes:        scopes,
+			excludedPaths: excludedPaths,
+			requestWeight: opts.RequestWeight,
+			stallAfter:    stallAfter,
+			onStall:       opts.OnRecyclerStall,
+			pressure:      p.pressure,
+
+			validate:             opts.ValidateTransport,
+			validationBackoff:    time.Duration(firstNonZero(int64(opts.ValidationBackoff), int64(time.Second))),
+			maxValidationBackoff: time.Duration(firstNonZero(int64(opts.MaxValidationBackoff), int64(time.Minute))),
+			onValidationFailure:  opts.OnValidationFailure,
+
+			onCertChange: opts.OnCertificateChange,
+
+			maxRequestThreshold: firstNonZero(h.opts.RecycleThreshold, opts.RecycleThreshold, 100) *
+				firstNonZero(int64(opts.MaxRecycleThresholdMultiplier), 10),
+
+			veto: opts.RecycleVeto,
+		}
+		if t.pressureWatch != nil {
+			cfg.onQuota = t.checkPressure
+		}
+		cfg.recorder = t.recorder
+		if churnLimit > 0 {
+			cfg.churn = &churnDetector{
+				requests: minReqs + 1,
+				limit:    churnLimit,
+				initial:  time.Duration(firstNonZero(int64(opts.ChurnBackoff), int64(10*time.Second))),
+				max:      time.Duration(firstNonZero(int64(opts.MaxChurnBackoff), int64(5*time.Minute))),
+				onStorm:  opts.OnThrottleStorm,
+			}
+			if b, ok := t.restored.backoff(h.host, h.port, p.audience, i); ok {
+				cfg.churn.backoff, cfg.churn.until = b.Backoff, b.Until
+			}
+		}
+		if opts.PostponeRecyclesAbove > 0 {
+			cfg.postponer = &recyclePostponer{
+				utilization: opts.PostponeRecyclesAbove,
+				floor:       firstNonZero(opts.RecyclePanicFloor, 10),
+				busy:        p.busy,
+			}
+		}
+		p.pool[i] = buildRecyclableTransport(cfg)
+	}
+	return p, nil
+}
+
+// normalizeHost splits a "host" or "host:port" string, lowercasing the host and applying defaults.
+func normalizeHost(raw string) (string, string, error) {
+	hostport := raw
+	if hostport == "" {
+		hostport = DefaultHost
+	}
+	if i := strings.Index(hostport, string(':')); i < 0 {
+		hostport += ":443"
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid host %q: %s", raw, err)
+	}
+	if host == "" {
+		host = DefaultHost
+	}
+	if port == "" {
+		port = "443"
+	}
+	return strings.ToLower(host), port, nil
+}
+
+func firstNonZero(vals ...int64) int64 {
+	for _, v := range vals {
+		if v != 0 {
+			return v
+		}
+	}
+	return 0
+}
@@ -0,0 +1,379 @@
+package armbalancer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		raw      string
+		wantHost string
+		wantPort string
+		wantErr  bool
+	}{
+		{raw: "", wantHost: "management.azure.com", wantPort: "443"},
+		{raw: "Management.Azure.Com", wantHost: "management.azure.com", wantPort: "443"},
+		{raw: "eastus.management.azure.com:8443", wantHost: "eastus.management.azure.com", wantPort: "8443"},
+		{raw: ":445", wantHost: "management.azure.com", wantPort: "445"},
+		{raw: "management.azure.com:", wantHost: "management.azure.com", wantPort: "443"},
+		{raw: "invalid:host:invalidport", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			host, port, err := normalizeHost(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeHost() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if host != tt.wantHost || port != tt.wantPort {
+				t.Errorf("normalizeHost() = %q, %q, want %q, %q", host, port, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestBuilderValidation(t *testing.T) {
+	_, err := NewBuilder(nil).
+		AddHost("management.azure.com", HostOptions{}).
+		AddHost("MANAGEMENT.azure.com:443", HostOptions{}).
+		Build()
+	if err == nil || !strings.Contains(err.Error(), `duplicate host "MANAGEMENT.azure.com:443"`) {
+		t.Errorf("expected duplicate host error, got: %v", err)
+	}
+
+	_, err = NewBuilder(nil).AddHost("invalid:host:invalidport", HostOptions{}).Build()
+	if err == nil || !strings.Contains(err.Error(), `invalid host "invalid:host:invalidport"`) {
+		t.Errorf("expected invalid host error, got: %v", err)
+	}
+
+	for _, opts := range []Options{
+		{PoolSize: -5},
+		{RedirectPoolSize: -1},
+		{PerTransportMiddleware: []func(http.RoundTripper) http.RoundTripper{nil}},
+		{TransportFactory: func(int, *http.Transport, string, string, int64, int64) http.RoundTripper { return nil }},
+		{ValidationBackoff: -time.Second},
+		{MaxValidationBackoff: -time.Second},
+		{StateTTL: -time.Hour},
+		{DialPressureRestoreAfter: -time.Second},
+	} {
+		if _, err := NewBuilder(nil).WithOptions(opts).Build(); err == nil {
+			t.Errorf("expected options %+v to be rejected", opts)
+		}
+	}
+	if _, err := NewBuilder(nil).AddHost("management.azure.com", HostOptions{PoolSize: -1}).Build(); err == nil {
+		t.Errorf("expected a negative host pool size to be rejected")
+	}
+
+	b, err := NewBuilder(nil).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.hosts) != 1 || b.hosts[0].host != DefaultHost || b.hosts[0].port != "443" {
+		t.Errorf("expected the default host to be served when no host was added")
+	}
+}
+
+func TestRequireExplicitHost(t *testing.T) {
+	for _, host := range []string{":445", ""} {
+		b, err := NewBuilder(nil).AddHost(host, HostOptions{PoolSize: 1}).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.hosts[0].host != DefaultHost {
+			t.Errorf("expected %q to default to %s, got %s", host, DefaultHost, b.hosts[0].host)
+		}
+		b.Close()
+
+		_, err = NewBuilder(nil).WithOptions(Options{RequireExplicitHost: true}).AddHost(host, HostOptions{}).Build()
+		if err == nil || !strings.Contains(err.Error(), "has no host name") {
+			t.Errorf("expected %q to be rejected, got: %v", host, err)
+		}
+	}
+	if _, err := NewBuilder(nil).WithOptions(Options{RequireExplicitHost: true}).Build(); err == nil {
+		t.Error("expected builders without any host to be rejected")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected New to panic")
+		}
+	}()
+	New(Options{Host: "", RequireExplicitHost: true})
+}
+
+func TestBuilderAdversarialOptions(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "1")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	rnd := mrand.New(mrand.NewSource(1))
+	ints := []int{-5, -1, 0, 1, 3}
+	durations := []time.Duration{-time.Second, -1, 0, 1, 5, time.Millisecond}
+	floats := []float64{math.NaN(), -1, 0, 0.5, 1, 2}
+	anyInt := func() int { return ints[rnd.Intn(len(ints))] }
+	anyDuration := func() time.Duration { return durations[rnd.Intn(len(durations))] }
+	anyFloat := func() float64 { return floats[rnd.Intn(len(floats))] }
+	var nilMiddleware func(http.RoundTripper) http.RoundTripper
+
+	for i := 0; i < 200; i++ {
+		opts := Options{
+			PoolSize:                    anyInt(),
+			RecycleThreshold:            int64(anyInt()),
+			MinReqsBeforeRecycle:        int64(anyInt()),
+			MaxConnAge:                  anyDuration(),
+			DrainTimeout:                anyDuration(),
+			ForceCloseAfterDrainTimeout: rnd.Intn(2) == 0,
+			SynchronousRecycle:          rnd.Intn(2) == 0,
+			DryRun:                      rnd.Intn(2) == 0,
+			ChaosRecycleProbability:     anyFloat(),
+			EnableChaos:                 rnd.Intn(2) == 0,
+			DefaultRequestTimeout:       anyDuration(),
+			MaxRequestBodyBytes:         int64(anyInt()),
+			HedgeAfter:                  anyDuration(),
+			HedgeBudget:                 anyFloat(),
+			SelectionStrategy:           SelectionStrategy(anyInt()),
+			ReservedWriteSlots:          anyInt(),
+			RedirectPoolSize:            anyInt(),
+			CallerBudgetThreshold:       int64(anyInt()),
+			CallerBudgetWindow:          anyDuration(),
+			ChurnBackoffGenerations:     anyInt(),
+			ChurnBackoff:                anyDuration(),
+			MaxChurnBackoff:             anyDuration(),
+			PostponeRecyclesAbove:       anyFloat(),
+			RecyclePanicFloor:           int64(anyInt()),
+			MaxNewConnectionsPerMinute:  anyInt(),
+			ShrinkIdleTransports:        rnd.Intn(2) == 0,
+			IdleShrinkAfter:             anyDuration(),
+			RecentRecyclesSize:          anyInt(),
+			MinBackendDiversity:         anyFloat(),
+			LowDiversityAfter:           anyDuration(),
+		}
+		if rnd.Intn(2) == 0 {
+			opts.CallerBudgets = map[string]float64{"": anyFloat()}
+		}
+		if rnd.Intn(2) == 0 {
+			opts.AllowedRedirectHostSuffixes = []string{".blob.core.windows.net"}
+		}
+		if rnd.Intn(4) == 0 {
+			opts.PerTransportMiddleware = []func(http.RoundTripper) http.RoundTripper{nilMiddleware}
+		}
+		if rnd.Intn(8) == 0 {
+			opts.TransportFactory = func(int, *http.Transport, string, string, int64, int64) http.RoundTripper { return nil }
+		}
+		hostOpts := HostOptions{PoolSize: anyInt(), MinReqsBeforeRecycle: int64(anyInt())}
+
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("panic with options %+v and host options %+v: %v", opts, hostOpts, r)
+				}
+			}()
+			b, err := NewBuilder(svr.Client().Transport.(*http.Transport)).WithOptions(opts).AddHost(u.Host, hostOpts).Build()
+			if err != nil {
+				return
+			}
+			defer b.Close()
+			client := &http.Client{Transport: b}
+			for j := 0; j < 3; j++ {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				req, _ := http.NewRequestWithContext(ctx, "GET", svr.URL, nil)
+				start := time.Now()
+				resp, err := client.Do(req)
+				if elapsed := time.Since(start); elapsed > 2*time.Second {
+					t.Errorf("request took %s with options %+v and host options %+v", elapsed, opts, hostOpts)
+				}
+				if err == nil {
+					resp.Body.Close()
+				} // errors such as negative timeouts are fine, as long as nothing panics or hangs
+				cancel()
+			}
+			_ = fmt.Sprint(b.Stats())
+		}()
+	}
+}
+
+func TestBuilderMultipleHosts(t *testing.T) {
+	var received [2]int64
+	servers := make([]*httptest.Server, 2)
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&received[i], 1)
+		}))
+		servers[i].EnableHTTP2 = true
+		servers[i].StartTLS()
+		defer servers[i].Close()
+	}
+	u0, _ := url.Parse(servers[0].URL)
+	u1, _ := url.Parse(servers[1].URL)
+
+	b, err := NewBuilder(servers[0].Client().Transport.(*http.Transport)).
+		WithOptions(Options{PoolSize: 2}).
+		AddHost(u0.Host, HostOptions{}).
+		AddHost(u1.Host, HostOptions{PoolSize: 3}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: b}
+	for i := 0; i < 10; i++ {
+		for _, svr := range servers {
+			resp, err := client.Get(svr.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	if received[0] != 10 || received[1] != 10 {
+		t.Errorf("expected each host to receive 10 requests, got %d and %d", received[0], received[1])
+	}
+
+	transportsByHost := map[string]int{}
+	for _, s := range b.Stats().Transports {
+		transportsByHost[s.Host]++
+	}
+	if transportsByHost[u0.Host] != 2 || transportsByHost[u1.Host] != 3 {
+		t.Errorf("expected per-host pool sizes to be applied, got %v", transportsByHost)
+	}
+
+	_, err = client.Get("https://not-the-host")
+	if err == nil || !strings.Contains(err.Error(), `supported host names are "`+u0.Host+`", "`+u1.Host+`"`) {
+		t.Errorf("expected error listing the supported hosts, got: %v", err)
+	}
+}
+
+func TestBuilderHostTransport(t *testing.T) {
+	newServer := func() (*httptest.Server, *x509.CertPool) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := x509.ParseCertificate(der)
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+
+		svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		svr.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+		svr.StartTLS()
+		return svr, roots
+	}
+	public, publicRoots := newServer()
+	defer public.Close()
+	private, privateRoots := newServer()
+	defer private.Close()
+
+	publicURL, _ := url.Parse(public.URL)
+	privateURL, _ := url.Parse(private.URL)
+	b, err := NewBuilder(&http.Transport{TLSClientConfig: &tls.Config{RootCAs: publicRoots}}).
+		AddHost(publicURL.Host, HostOptions{PoolSize: 1}).
+		AddHost(privateURL.Host, HostOptions{PoolSize: 1, Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: privateRoots}}}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for _, svr := range []*httptest.Server{public, private} {
+		req, _ := http.NewRequest("GET", svr.URL, nil)
+		resp, err := b.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("expected each host to be verified using its own parent transport, got: %s", err)
+		}
+		resp.Body.Close()
+	}
+
+	// The private host's certificate isn't trusted by the global parent
+	b, err = NewBuilder(&http.Transport{TLSClientConfig: &tls.Config{RootCAs: publicRoots}}).
+		AddHost(privateURL.Host, HostOptions{PoolSize: 1}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	req, _ := http.NewRequest("GET", private.URL, nil)
+	if _, err := b.RoundTrip(req); ClassifyError(err) != ErrorClassTLS {
+		t.Errorf("expected hosts without their own parent to use the global one, got: %v", err)
+	}
+}
+
+func TestHostDefaultPort(t *testing.T) {
+	var gotHost string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { gotHost = r.Host }))
+	defer svr.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(svr.URL, "http://"))
+
+	for _, raw := range []string{"127.0.0.1", "127.0.0.1:" + port} {
+		b, err := NewBuilder(nil).AddHost(raw, HostOptions{PoolSize: 1, DefaultPort: port}).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.hosts[0].port != port {
+			t.Errorf("expected %q to be served on port %s, got %s", raw, port, b.hosts[0].port)
+		}
+		req, _ := http.NewRequest("GET", "http://127.0.0.1/subscriptions", nil)
+		resp, err := b.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("expected requests without a port to be sent to the default port, got: %s", err)
+		}
+		resp.Body.Close()
+		if gotHost != "127.0.0.1" {
+			t.Errorf("expected the Host header to be kept, got %q", gotHost)
+		}
+		b.Close()
+	}
+
+	b, err := NewBuilder(nil).AddHost("127.0.0.1:"+port, HostOptions{PoolSize: 1}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	req, _ := http.NewRequest("GET", "http://127.0.0.1/subscriptions", nil)
+	if _, err := b.RoundTrip(req); err == nil {
+		t.Error("expected requests without a port to target the scheme's default port")
+	}
+
+	for _, opts := range []HostOptions{{DefaultPort: "http"}, {DefaultPort: "0"}, {DefaultPort: "65536"}} {
+		if _, err := NewBuilder(nil).AddHost("armproxy.corp", opts).Build(); err == nil {
+			t.Errorf("expected default port %q to be rejected", opts.DefaultPort)
+		}
+	}
+	if _, err := NewBuilder(nil).AddHost("armproxy.corp:8443", HostOptions{DefaultPort: "8080"}).Build(); err == nil {
+		t.Error("expected a default port conflicting with the host's port to be rejected")
+	}
+}
@@ -0,0 +1,34 @@
+package armbalancer
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+type bypassKey struct{}
+
+// WithBypass returns a context whose requests skip the balancer, e.g. for health probes with their own SLO.
+// They are sent using the parent transport of their host, without being subject to caller budgets, body limits
+// or the default timeout, and their responses don't update the quota tracked by the pooled transports.
+// They are counted in Stats.BypassedRequests.
+//
+// Bypassed requests still consume ARM quota server-side.
+func WithBypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, true)
+}
+
+func bypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(bypassKey{}).(bool)
+	return bypass
+}
+
+// bypass sends the request using the parent transport of its host.
+func (t *Balancer) bypass(req *http.Request) (*http.Response, error) {
+	p := t.lookup(req.URL, audienceFromContext(req.Context()))
+	if p == nil {
+		return nil, t.notSupportedError(req.URL)
+	}
+	atomic.AddInt64(&t.bypassed, 1)
+	return p.parent.RoundTrip(req)
+}
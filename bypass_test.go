@@ -0,0 +1,52 @@
+package armbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestBypass(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "1")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	b, err := NewBuilder(svr.Client().Transport.(*http.Transport)).
+		WithOptions(Options{PoolSize: 2}).
+		AddHost(u.Host, HostOptions{}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequestWithContext(WithBypass(context.Background()), "GET", svr.URL, nil)
+		resp, err := b.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	stats := b.Stats()
+	if stats.BypassedRequests != 3 {
+		t.Errorf("expected 3 bypassed requests, got %d", stats.BypassedRequests)
+	}
+	for _, ts := range stats.Transports {
+		if ts.Requests != 0 {
+			t.Errorf("expected the pooled transports not to see bypassed requests, got %d on %d", ts.Requests, ts.ID)
+		}
+	}
+
+	req, _ := http.NewRequestWithContext(WithBypass(context.Background()), "GET", "https://unknown.example.com", nil)
+	if _, err := b.RoundTrip(req); err == nil {
+		t.Error("expected bypassed requests to unsupported hosts to fail")
+	}
+}
@@ -0,0 +1,172 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCallerThrottled is returned for requests of a caller that has used more than its share of a rate limiting bucket
+// under pressure, as configured by Options.CallerBudgets.
+var ErrCallerThrottled = errors.New("armbalancer: caller exceeded its quota budget")
+
+// callerWindowSlots is the number of slots the usage window is divided in.
+const callerWindowSlots = 6
+
+// minCallerBudgetWindow is the shortest usage window accepted by the builder.
+const minCallerBudgetWindow = time.Second
+
+type callerKey struct{}
+
+// WithCaller returns a context that attributes the requests sent with it to the named caller, see Options.CallerBudgets.
+func WithCaller(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, callerKey{}, name)
+}
+
+func callerFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(callerKey{}).(string)
+	return name
+}
+
+// callerBudgets tracks the usage of every rate limiting bucket by each caller over a sliding window.
+type callerBudgets struct {
+	budgets   map[string]float64
+	threshold int64
+	window    time.Duration
+
+	lock  sync.Mutex
+	usage map[string]map[string]*slidingCounter // by bucket, then caller
+}
+
+func newCallerBudgets(budgets map[string]float64, threshold int64, window time.Duration) *callerBudgets {
+	return &callerBudgets{
+		budgets:   budgets,
+		threshold: threshold,
+		window:    window,
+		usage:     map[string]map[string]*slidingCounter{},
+	}
+}
+
+// Check returns an error if the request's caller has used more than its share of a bucket under pressure.
+// remaining returns the lowest value of a bucket reported across all connections.
+func (c *callerBudgets) Check(req *http.Request, remaining func(bucket string) (int64, bool)) error {
+	caller := callerFromContext(req.Context())
+	budget, ok := c.budgets[caller]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for bucket, callers := range c.usage {
+		if !bucketApplies(bucket, req) {
+			continue
+		}
+		used := callers[caller].Sum(now, c.window)
+		if used == 0 {
+			continue
+		}
+		if val, ok := remaining(bucket); !ok || val > c.threshold {
+			continue
+		}
+		var total int64
+		for _, counter := range callers {
+			total += counter.Sum(now, c.window)
+		}
+		if float64(used) > budget*float64(total) {
+			return fmt.Errorf("%w: %q used %d of the last %d requests reporting bucket %s", ErrCallerThrottled, caller, used, total, bucket)
+		}
+	}
+	return nil
+}
+
+// Record counts the response against every bucket it reports for the request's caller.
+func (c *callerBudgets) Record(req *http.Request, h http.Header) {
+	caller := callerFromContext(req.Context())
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key := range h {
+		bucket, ok := rateLimitBucket(key)
+		if !ok {
+			continue
+		}
+		callers, ok := c.usage[bucket]
+		if !ok {
+			callers = map[string]*slidingCounter{}
+			c.usage[bucket] = callers
+		}
+		counter, ok := callers[caller]
+		if !ok {
+			counter = &slidingCounter{}
+			callers[caller] = counter
+		}
+		counter.Add(now, c.window)
+	}
+}
+
+// Snapshot returns the usage of every bucket by each caller over the window.
+func (c *callerBudgets) Snapshot() map[string]map[string]int64 {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	snapshot := map[string]map[string]int64{}
+	for bucket, callers := range c.usage {
+		for caller, counter := range callers {
+			if n := counter.Sum(now, c.window); n > 0 {
+				if snapshot[caller] == nil {
+					snapshot[caller] = map[string]int64{}
+				}
+				snapshot[caller][bucket] = n
+			}
+		}
+	}
+	return snapshot
+}
+
+// bucketApplies returns false for read buckets when sending writes and vice versa.
+func bucketApplies(bucket string, req *http.Request) bool {
+	switch {
+	case strings.HasSuffix(bucket, "-Reads"):
+		return isRead(req)
+	case strings.HasSuffix(bucket, "-Writes"), strings.HasSuffix(bucket, "-Deletes"):
+		return !isRead(req)
+	default:
+		return true
+	}
+}
+
+// slidingCounter counts events over a sliding window divided in callerWindowSlots slots.
+type slidingCounter struct {
+	slots [callerWindowSlots]int64
+	epoch [callerWindowSlots]int64 // the slot number each count belongs to
+}
+
+func (s *slidingCounter) Add(now time.Time, window time.Duration) {
+	n := now.UnixNano() / int64(window/callerWindowSlots)
+	i := n % callerWindowSlots
+	if s.epoch[i] != n {
+		s.epoch[i] = n
+		s.slots[i] = 0
+	}
+	s.slots[i]++
+}
+
+func (s *slidingCounter) Sum(now time.Time, window time.Duration) int64 {
+	if s == nil {
+		return 0
+	}
+	n := now.UnixNano() / int64(window/callerWindowSlots)
+	var sum int64
+	for i, epoch := range s.epoch {
+		if n-epoch < callerWindowSlots {
+			sum += s.slots[i]
+		}
+	}
+	return sum
+}
@@ -0,0 +1,135 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCallerBudgets(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "10000")
+			return
+		}
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Writes", "500")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:     svr.Client().Transport.(*http.Transport),
+		Host:          u.Host,
+		PoolSize:      1,
+		CallerBudgets: map[string]float64{"noisy": 0.5, "quiet": 0.5},
+	})
+	defer b.Close()
+
+	send := func(caller, method string) error {
+		req, _ := http.NewRequestWithContext(WithCaller(context.Background(), caller), method, svr.URL, nil)
+		resp, err := b.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := send("quiet", "PUT"); err != nil {
+		t.Fatal(err)
+	}
+	if err := send("noisy", "PUT"); err != nil {
+		t.Fatal(err)
+	}
+	if err := send("noisy", "PUT"); err != nil {
+		t.Fatalf("expected the caller to be within its budget until it sends more than its share, got: %s", err)
+	}
+	if err := send("noisy", "PUT"); !errors.Is(err, ErrCallerThrottled) {
+		t.Errorf("expected the caller to be throttled after exceeding its budget, got: %v", err)
+	}
+	if err := send("quiet", "PUT"); err != nil {
+		t.Errorf("expected other callers to proceed, got: %s", err)
+	}
+	if err := send("noisy", "GET"); err != nil {
+		t.Errorf("expected reads not to be throttled by the write budget, got: %s", err)
+	}
+	if err := send("unbudgeted", "PUT"); err != nil {
+		t.Errorf("expected callers without a budget never to be throttled, got: %s", err)
+	}
+
+	s := b.Stats()
+	if n := s.Callers["noisy"]["Subscription-Writes"]; n != 2 {
+		t.Errorf("expected 2 writes to be counted for the noisy caller, got %d (%+v)", n, s.Callers)
+	}
+	if n := s.Callers["quiet"]["Subscription-Writes"]; n != 2 {
+		t.Errorf("expected 2 writes to be counted for the quiet caller, got %d (%+v)", n, s.Callers)
+	}
+}
+
+func TestCallerBudgetsNoPressure(t *testing.T) {
+	c := newCallerBudgets(map[string]float64{"noisy": 0.1}, 1000, time.Minute)
+	req, _ := http.NewRequestWithContext(WithCaller(context.Background(), "noisy"), "PUT", "https://management.azure.com", nil)
+	h := http.Header{}
+	h.Set("X-Ms-Ratelimit-Remaining-Subscription-Writes", "1000")
+	for i := 0; i < 10; i++ {
+		c.Record(req, h)
+	}
+
+	remaining := int64(1001)
+	lookup := func(string) (int64, bool) { return remaining, true }
+	if err := c.Check(req, lookup); err != nil {
+		t.Errorf("expected callers not to be throttled while the bucket isn't under pressure, got: %s", err)
+	}
+	remaining = 1000
+	if err := c.Check(req, lookup); !errors.Is(err, ErrCallerThrottled) {
+		t.Errorf("expected the caller to be throttled under pressure, got: %v", err)
+	}
+}
+
+func TestCallerBudgetWindowValidation(t *testing.T) {
+	for _, window := range []time.Duration{-time.Minute, 3, time.Millisecond} {
+		_, err := NewBuilder(nil).WithOptions(Options{
+			CallerBudgets:      map[string]float64{"noisy": 0.1},
+			CallerBudgetWindow: window,
+		}).Build()
+		if err == nil {
+			t.Errorf("expected a caller budget window of %s to be rejected", window)
+		}
+	}
+}
+
+func TestCallerBudgetsValidation(t *testing.T) {
+	for _, fraction := range []float64{0, -0.1, 1.5} {
+		_, err := NewBuilder(nil).WithOptions(Options{CallerBudgets: map[string]float64{"noisy": fraction}}).Build()
+		if err == nil {
+			t.Errorf("expected a caller budget of %g to be rejected", fraction)
+		}
+	}
+}
+
+func TestSlidingCounter(t *testing.T) {
+	const window = 6 * time.Second
+	start := time.Unix(1000, 0)
+	var c slidingCounter
+	for i := 0; i < 6; i++ {
+		c.Add(start.Add(time.Duration(i)*time.Second), window)
+	}
+	if n := c.Sum(start.Add(5*time.Second), window); n != 6 {
+		t.Errorf("expected all events within the window to be counted, got %d", n)
+	}
+	if n := c.Sum(start.Add(7*time.Second), window); n != 4 {
+		t.Errorf("expected events older than the window to expire, got %d", n)
+	}
+	c.Add(start.Add(7*time.Second), window)
+	if n := c.Sum(start.Add(7*time.Second), window); n != 5 {
+		t.Errorf("expected reused slots to be reset, got %d", n)
+	}
+	if n := c.Sum(start.Add(time.Minute), window); n != 0 {
+		t.Errorf("expected no events after the window has passed, got %d", n)
+	}
+}
@@ -0,0 +1,99 @@
+package armbalancer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// churnDetector suspends recycling of a transport when its replacement connections keep coming back depleted,
+// which happens when every ARM instance behind the load balancer has exhausted its quota.
+// It's used from the recycling goroutine, and its backoff is read when the balancer's state is saved.
+type churnDetector struct {
+	lock     sync.Mutex
+	requests int64 // connections recycled within this many requests are considered depleted
+	limit    int   // consecutive depleted connections before recycling is suspended
+	initial  time.Duration
+	max      time.Duration
+	onStorm  func(ThrottleStormEvent)
+
+	depleted  int
+	backoff   time.Duration
+	until     time.Time
+	suspended int64 // generation kept while recycling was suspended
+}
+
+// Allow is called when the policy decides to recycle and returns false while recycling is suspended.
+func (c *churnDetector) Allow(snapshot ConnSnapshot) bool {
+	if c == nil || c.limit <= 0 {
+		return true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if now.Before(c.until) {
+		return false
+	}
+
+	switch {
+	case snapshot.Generation == 1, snapshot.Generation == c.suspended:
+		// Neither a replacement nor representative of one, since it kept serving requests during the backoff
+		return true
+	case snapshot.Requests <= c.requests:
+		c.depleted++
+	default:
+		c.depleted = 0
+		c.backoff = 0
+	}
+	if c.depleted < c.limit {
+		return true
+	}
+
+	if c.backoff == 0 {
+		c.backoff = c.initial
+	} else if c.backoff *= 2; c.backoff > c.max {
+		c.backoff = c.max
+	}
+	c.until = now.Add(c.backoff)
+	c.suspended = snapshot.Generation
+	if c.onStorm != nil {
+		c.onStorm(ThrottleStormEvent{
+			TransportID: snapshot.TransportID,
+			Generation:  snapshot.Generation,
+			Backoff:     c.backoff,
+			Snapshot:    snapshot,
+		})
+	}
+	return false
+}
+
+// State returns the current backoff and when recycling resumes, which is in the past unless it's suspended.
+func (c *churnDetector) State() (backoff time.Duration, until time.Time) {
+	if c == nil {
+		return 0, time.Time{}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.backoff, c.until
+}
+
+// Wait blocks while recycling is suspended. It returns ctx's error if ctx expires first, or nil if done is closed.
+func (c *churnDetector) Wait(ctx context.Context, done <-chan struct{}) error {
+	for {
+		_, until := c.State()
+		delay := time.Until(until)
+		if delay <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
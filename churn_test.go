@@ -0,0 +1,131 @@
+package armbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThrottleStorm(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "0") // every instance is depleted
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	var recycles int64
+	storms := make(chan ThrottleStormEvent, 10)
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:               svr.Client().Transport.(*http.Transport),
+		Host:                    u.Host,
+		PoolSize:                1,
+		MinReqsBeforeRecycle:    1,
+		ChurnBackoffGenerations: 2,
+		ChurnBackoff:            200 * time.Millisecond,
+		MaxChurnBackoff:         300 * time.Millisecond,
+		OnRecycle:               func(RecycleEvent) { atomic.AddInt64(&recycles, 1) },
+		OnThrottleStorm:         func(e ThrottleStormEvent) { storms <- e },
+	})
+	defer b.Close()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			req, _ := http.NewRequest("GET", svr.URL, nil)
+			resp, err := b.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	next := func() ThrottleStormEvent {
+		select {
+		case e := <-storms:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a throttle storm")
+			return ThrottleStormEvent{}
+		}
+	}
+
+	// The first connection isn't a replacement, so the second and third ones trigger the backoff
+	e := next()
+	if e.Generation != 3 || e.Backoff != 200*time.Millisecond {
+		t.Errorf("expected the third connection to suspend recycling for the initial backoff, got %+v", e)
+	}
+	if n := atomic.LoadInt64(&recycles); n != 2 {
+		t.Errorf("expected 2 recycles before the backoff, got %d", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&recycles); n != 2 {
+		t.Errorf("expected recycling to be suspended, got %d recycles", n)
+	}
+
+	// The connection kept during the backoff is recycled once it expires, and its depleted replacement doubles the backoff
+	e = next()
+	if e.Generation != 4 || e.Backoff != 300*time.Millisecond {
+		t.Errorf("expected the next depleted replacement to double the backoff up to the max, got %+v", e)
+	}
+	if n := atomic.LoadInt64(&recycles); n != 3 {
+		t.Errorf("expected a single recycle between the backoffs, got %d", n)
+	}
+}
+
+func TestChurnDetectorReset(t *testing.T) {
+	var storms []ThrottleStormEvent
+	c := &churnDetector{requests: 2, limit: 1, initial: time.Millisecond, max: time.Second, onStorm: func(e ThrottleStormEvent) {
+		storms = append(storms, e)
+	}}
+	depleted := func(gen int64) ConnSnapshot { return ConnSnapshot{Generation: gen, Requests: 2} }
+
+	if !c.Allow(depleted(1)) {
+		t.Fatal("expected the first connection not to count as a replacement")
+	}
+	if c.Allow(depleted(2)) {
+		t.Fatal("expected a depleted replacement to suspend recycling")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if !c.Allow(ConnSnapshot{Generation: 2, Requests: 100}) {
+		t.Fatal("expected the connection kept during the backoff to be recycled once it expires")
+	}
+	if c.Allow(depleted(3)) {
+		t.Fatal("expected another depleted replacement to suspend recycling")
+	}
+	time.Sleep(3 * time.Millisecond)
+	c.Allow(ConnSnapshot{Generation: 3, Requests: 100})
+	if !c.Allow(ConnSnapshot{Generation: 4, Requests: 3}) {
+		t.Fatal("expected a healthy connection to be recycled")
+	}
+	if c.Allow(depleted(5)) {
+		t.Fatal("expected recycling to be suspended again")
+	}
+
+	if len(storms) != 3 {
+		t.Fatalf("expected 3 throttle storms, got %d", len(storms))
+	}
+	for i, want := range []time.Duration{time.Millisecond, 2 * time.Millisecond, time.Millisecond} {
+		if storms[i].Backoff != want {
+			t.Errorf("expected throttle storm %d to back off for %s, got %s", i, want, storms[i].Backoff)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package armbalancer
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrAlreadyBalanced is returned by WrapClient for clients whose transport already is a balancer.
+var ErrAlreadyBalanced = errors.New("armbalancer: the client's transport already is a balancer")
+
+// ClientTransport sends the requests served by its balancer through it, and every other request through Next.
+// It's installed by WrapClient.
+type ClientTransport struct {
+	Balancer *Balancer
+	Next     http.RoundTripper
+}
+
+// WrapClient returns a shallow copy of the client whose transport is a ClientTransport, so that ARM requests are
+// balanced while unrelated requests are still sent through the client's original transport, which defaults to
+// http.DefaultTransport. Unless opts.Transport is set, the original transport is also the balancer's parent
+// when it's an *http.Transport. The balancer is closed by closing ClientTransport.Balancer.
+//
+//	client, err := armbalancer.WrapClient(http.DefaultClient, armbalancer.Options{})
+func WrapClient(c *http.Client, opts Options) (*http.Client, error) {
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	switch next.(type) {
+	case *Balancer, *ClientTransport, *ReplaceableTransport, *RecyclableTransport:
+		return nil, ErrAlreadyBalanced
+	}
+	if parent, ok := next.(*http.Transport); ok && opts.Transport == nil {
+		opts.Transport = parent
+	}
+	b, err := NewBuilder(opts.Transport).WithOptions(opts).AddHost(opts.Host, HostOptions{}).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := *c
+	wrapped.Transport = &ClientTransport{Balancer: b, Next: next}
+	return &wrapped, nil
+}
+
+func (t *ClientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Balancer.Serves(req) {
+		return t.Balancer.RoundTrip(req)
+	}
+	return t.Next.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of Next, since http.Client.CloseIdleConnections
+// would otherwise not reach it. The balancer's connections are left to its recycling.
+func (t *ClientTransport) CloseIdleConnections() {
+	if c, ok := t.Next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// Serves reports whether the request's host is served by the balancer, including the redirect hosts allowed
+// by Options.AllowedRedirectHostSuffixes, regardless of whether the host is currently disabled.
+func (t *Balancer) Serves(req *http.Request) bool {
+	if t.passthrough != nil {
+		return true
+	}
+	req, err := resolveHost(req)
+	if err != nil {
+		return false
+	}
+	if t.lookup(req.URL, audienceFromContext(req.Context())) != nil {
+		return true
+	}
+	return t.redirects != nil && t.redirects.Allowed(req.URL)
+}
@@ -0,0 +1,54 @@
+package armbalancer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestWrapClient(t *testing.T) {
+	arm := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer arm.Close()
+	other := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+
+	original := arm.Client()
+	armURL, _ := url.Parse(arm.URL)
+	c, err := WrapClient(original, Options{Host: armURL.Host, PoolSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := c.Transport.(*ClientTransport)
+	defer ct.Balancer.Close()
+	if original.Transport == c.Transport || ct.Next != original.Transport {
+		t.Fatal("expected the original client to be copied and its transport to be kept for other requests")
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, target := range []string{arm.URL, other.URL} {
+			resp, err := c.Get(target + "/subscriptions")
+			if err != nil {
+				t.Fatalf("expected %s to be reachable through the wrapped client, got: %s", target, err)
+			}
+			resp.Body.Close()
+		}
+	}
+	var balanced int64
+	for _, ts := range ct.Balancer.Stats().Transports {
+		balanced += ts.Requests
+	}
+	if balanced != 3 {
+		t.Errorf("expected the 3 ARM requests to be balanced, got %d", balanced)
+	}
+
+	for _, rt := range []http.RoundTripper{ct, ct.Balancer, NewReplaceableTransport(ct.Balancer, 0)} {
+		if _, err := WrapClient(&http.Client{Transport: rt}, Options{}); !errors.Is(err, ErrAlreadyBalanced) {
+			t.Errorf("expected wrapping a %T to be refused, got: %v", rt, err)
+		}
+	}
+	if _, err := WrapClient(&http.Client{}, Options{Host: "invalid:host:port"}); err == nil {
+		t.Error("expected invalid options to be reported")
+	}
+}
@@ -0,0 +1,171 @@
+package armbalancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnObserver is notified of the lifecycle of every connection established by the balancer.
+// Its methods are called synchronously from the dialing and closing goroutines and should return quickly.
+type ConnObserver interface {
+	// Opened is called once a connection has been established.
+	Opened(transportID int, remoteAddr string)
+
+	// Closed is called once a connection has been closed, usually because its transport was recycled.
+	// requests is the number of requests served by the transport generation the connection belonged to.
+	Closed(transportID int, remoteAddr string, lifetime time.Duration, requests int64)
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// connTracker records the connections dialed by a transport so they can be closed even while in use,
+// which http.Transport.CloseIdleConnections doesn't do.
+type connTracker struct {
+	lock     sync.Mutex
+	conns    map[*trackedConn]struct{}
+	id       int
+	observer ConnObserver
+	budget   *connBudget // shared by the balancer, nil if not tracked
+
+	pressure *dialPressure // shared by the pool, nil unless enabled
+}
+
+func newConnTracker(id int, observer ConnObserver, budget *connBudget) *connTracker {
+	return &connTracker{conns: make(map[*trackedConn]struct{}), id: id, observer: observer, budget: budget}
+}
+
+// Install wraps the transport's dialers to track every connection they establish on behalf of the given generation.
+// HTTP/2 is still attempted if the transport would have attempted it before its dialers were replaced.
+func (c *connTracker) Install(tx *http.Transport, gen *generation) {
+	tx.ForceAttemptHTTP2 = tx.ForceAttemptHTTP2 ||
+		(tx.TLSClientConfig == nil && tx.Dial == nil && tx.DialContext == nil && tx.DialTLS == nil && tx.DialTLSContext == nil)
+
+	dial := tx.DialContext
+	if dial == nil && tx.Dial != nil {
+		legacyDial := tx.Dial
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) { return legacyDial(network, addr) }
+	}
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	tx.DialContext = c.wrap(dial, gen)
+	tx.Dial = nil
+
+	if tx.DialTLSContext == nil && tx.DialTLS != nil {
+		legacyDial := tx.DialTLS
+		tx.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) { return legacyDial(network, addr) }
+	}
+	if tx.DialTLSContext != nil {
+		tx.DialTLSContext = c.wrap(tx.DialTLSContext, gen)
+	}
+	tx.DialTLS = nil
+}
+
+func (c *connTracker) wrap(dial dialFunc, gen *generation) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		c.pressure.Record(err)
+		if err != nil {
+			return nil, err
+		}
+		tc := &trackedConn{Conn: conn, tracker: c, gen: gen, opened: time.Now()}
+		c.lock.Lock()
+		c.conns[tc] = struct{}{}
+		c.lock.Unlock()
+		c.budget.Record()
+		if c.observer != nil {
+			c.observer.Opened(c.id, remoteAddr(conn))
+		}
+		return tc, nil
+	}
+}
+
+// CloseAll closes every open connection and returns how many were closed.
+func (c *connTracker) CloseAll() int {
+	c.lock.Lock()
+	conns := make([]*trackedConn, 0, len(c.conns))
+	for conn := range c.conns {
+		conns = append(conns, conn)
+	}
+	c.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// CloseGeneration closes every open connection dialed on behalf of the given generation and returns how many were closed.
+func (c *connTracker) CloseGeneration(gen *generation) int {
+	c.lock.Lock()
+	var conns []*trackedConn
+	for conn := range c.conns {
+		if conn.gen == gen {
+			conns = append(conns, conn)
+		}
+	}
+	c.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// RemoteIPs returns the remote IP of every open connection dialed on behalf of the given generation, in no particular order.
+func (c *connTracker) RemoteIPs(gen *generation) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var ips []string
+	for conn := range c.conns {
+		if conn.gen != gen {
+			continue
+		}
+		ip := remoteAddr(conn.Conn)
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		if ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func (c *connTracker) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.conns)
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	gen     *generation
+	opened  time.Time
+	once    sync.Once
+}
+
+func (t *trackedConn) Close() error {
+	err := t.Conn.Close()
+	t.once.Do(func() {
+		t.tracker.lock.Lock()
+		delete(t.tracker.conns, t)
+		t.tracker.lock.Unlock()
+		if o := t.tracker.observer; o != nil {
+			o.Closed(t.tracker.id, remoteAddr(t.Conn), time.Since(t.opened), atomic.LoadInt64(&t.gen.requests))
+		}
+	})
+	return err
+}
+
+func remoteAddr(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
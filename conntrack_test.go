@@ -0,0 +1,201 @@
+package armbalancer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+type connEvent struct {
+	opened     bool
+	id         int
+	remoteAddr string
+	lifetime   time.Duration
+	requests   int64
+}
+
+type recordingObserver struct {
+	lock   sync.Mutex
+	events []connEvent
+}
+
+func (r *recordingObserver) Opened(id int, remoteAddr string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, connEvent{opened: true, id: id, remoteAddr: remoteAddr})
+}
+
+func (r *recordingObserver) Closed(id int, remoteAddr string, lifetime time.Duration, requests int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, connEvent{id: id, remoteAddr: remoteAddr, lifetime: lifetime, requests: requests})
+}
+
+func (r *recordingObserver) Events() []connEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]connEvent(nil), r.events...)
+}
+
+func TestConnObserver(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	observer := &recordingObserver{}
+	u, _ := url.Parse(svr.URL)
+	client := &http.Client{Transport: New(Options{
+		Transport:     svr.Client().Transport.(*http.Transport),
+		Host:          u.Host,
+		PoolSize:      1,
+		ConnObserver:  observer,
+		RecyclePolicy: RecyclePolicyFunc(func(s ConnSnapshot) bool { return s.Requests >= 3 }),
+	})}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(svr.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	waitFor(t, "the recycled connection to be closed", func() bool { return len(observer.Events()) >= 2 })
+	events := observer.Events()
+	opened, closed := events[0], events[1]
+	if !opened.opened || closed.opened {
+		t.Fatalf("expected an open followed by a close, got %+v", events)
+	}
+	if opened.remoteAddr != svr.Listener.Addr().String() || closed.remoteAddr != opened.remoteAddr {
+		t.Errorf("expected events to carry the server's address %s, got %+v", svr.Listener.Addr(), events)
+	}
+	if closed.requests != 3 {
+		t.Errorf("expected the closed connection to report 3 requests, got %d", closed.requests)
+	}
+	if closed.lifetime <= 0 {
+		t.Errorf("expected a positive lifetime, got %s", closed.lifetime)
+	}
+}
+
+func TestForceCloseAfterDrainTimeout(t *testing.T) {
+	stuck := make(chan struct{})
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stuck" {
+			return
+		}
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-stuck:
+		case <-r.Context().Done():
+		}
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	defer close(stuck)
+
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:                   svr.Client().Transport.(*http.Transport),
+		Host:                        u.Host,
+		PoolSize:                    1,
+		DrainTimeout:                100 * time.Millisecond,
+		ForceCloseAfterDrainTimeout: true,
+	})
+	defer b.Close()
+	client := &http.Client{Transport: b}
+
+	resp, err := client.Get(svr.URL + "/stuck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, len("partial"))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.ForceRecycleAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Errorf("expected the stuck stream to be closed")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the stuck stream to be closed after the drain timeout, took %s", elapsed)
+	}
+
+	// The current generation's connection must be left alone
+	r := b.hosts[0].pool[0].(*recyclableTransport)
+	resp, err = client.Get(svr.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	time.Sleep(150 * time.Millisecond)
+	if n := r.conns.Len(); n != 1 {
+		t.Errorf("expected the current generation's connection to remain open, got %d connections", n)
+	}
+}
+
+func TestCloseLingeringConns(t *testing.T) {
+	lingering := make(chan struct{})
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/lingering" {
+			return
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // never finishes the response
+		close(lingering)
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	// Detaching the body completes the request for the balancer while net/http keeps its stream open,
+	// so that CloseIdleConnections leaves the connection open
+	detach := func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if err == nil && req.URL.Path == "/lingering" {
+				resp.Body = http.NoBody
+			}
+			return resp, err
+		})
+	}
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:                svr.Client().Transport.(*http.Transport),
+		Host:                     u.Host,
+		PoolSize:                 1,
+		PerTransportMiddleware:   []func(http.RoundTripper) http.RoundTripper{detach},
+		LingeringConnGracePeriod: 50 * time.Millisecond,
+	})
+	defer b.Close()
+
+	resp, err := b.RoundTrip(httptest.NewRequest(http.MethodGet, svr.URL+"/lingering", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := b.ForceRecycleAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-lingering:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the lingering connection to be closed")
+	}
+	waitFor(t, "the close to be counted", func() bool {
+		return b.Stats().Transports[0].LingeringConnsClosed == 1
+	})
+}
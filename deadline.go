@@ -0,0 +1,44 @@
+package armbalancer
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// hasTightDeadline reports whether the request's deadline is closer than Options.TightDeadline.
+func (t *hostPool) hasTightDeadline(req *http.Request) bool {
+	if t.tightDeadline <= 0 {
+		return false
+	}
+	deadline, ok := req.Context().Deadline()
+	return ok && time.Until(deadline) < t.tightDeadline
+}
+
+// atRisk reports whether the transport of slot i is about to be recycled, or is being recycled: its lowest bucket
+// is within Options.TightDeadlineMargin of the host's RecycleThreshold, or its recycling goroutine is busy.
+func (t *hostPool) atRisk(i int) bool {
+	r, ok := t.pool[i].(*recyclableTransport)
+	if !ok {
+		return false
+	}
+	if atomic.LoadInt64(&r.busySince) != 0 {
+		return true
+	}
+	return r.state.Min() <= t.threshold+t.riskMargin
+}
+
+// avoidAtRisk returns i, or the next slot among pool[lo:lo+n] that isn't at risk if i is. It returns i when every
+// slot is at risk.
+func (t *hostPool) avoidAtRisk(lo, n, i int) int {
+	for j := 0; j < n; j++ {
+		k := lo + (i-lo+j)%n
+		if !t.atRisk(k) {
+			if k != i {
+				atomic.AddInt64(&t.riskAvoided, 1)
+			}
+			return k
+		}
+	}
+	return i
+}
@@ -0,0 +1,110 @@
+package armbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTightDeadline(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", r.Header.Get("X-Test-Remaining"))
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	b := New(Options{
+		Transport:        svr.Client().Transport.(*http.Transport),
+		Host:             u.Host,
+		PoolSize:         2,
+		RecycleThreshold: 100,
+		RecyclePolicy:    RecyclePolicyFunc(func(ConnSnapshot) bool { return false }),
+		TightDeadline:    time.Second,
+	})
+	defer b.Close()
+	send := func(ctx context.Context, remaining string) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, svr.URL, nil)
+		req.Header.Set("X-Test-Remaining", remaining)
+		resp, err := b.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	requests := func() (counts []int64) {
+		for _, ts := range b.Stats().Transports {
+			counts = append(counts, ts.Requests)
+		}
+		return counts
+	}
+
+	// Round robin starts with the second transport, leaving the first one 5 requests away from its threshold
+	send(context.Background(), "1000")
+	send(context.Background(), "105")
+
+	tight, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	for i := 0; i < 4; i++ {
+		send(tight, "1000")
+	}
+	if got := requests(); got[0] != 1 || got[1] != 5 {
+		t.Errorf("expected requests with a tight deadline to avoid the transport at risk, got %v", got)
+	}
+	if s := b.Stats(); s.TightDeadlineRedirects != 2 {
+		t.Errorf("expected 2 redirected requests, got %d", s.TightDeadlineRedirects)
+	}
+
+	loose, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	send(loose, "1000")
+	send(loose, "1000")
+	if got := requests(); got[0] != 2 || got[1] != 6 {
+		t.Errorf("expected requests with a loose deadline to follow round robin, got %v", got)
+	}
+}
+
+func TestAvoidAtRisk(t *testing.T) {
+	p := &hostPool{pool: make([]http.RoundTripper, 3), threshold: 100, riskMargin: 10}
+	for i := range p.pool {
+		p.pool[i] = &recyclableTransport{state: newConnState(nil, 0, nil, bucketScopes{})}
+	}
+	report := func(i int, remaining int64) {
+		p.pool[i].(*recyclableTransport).state.ApplyHeader(http.Header{
+			"X-Ms-Ratelimit-Remaining-Subscription-Reads": {strconv.FormatInt(remaining, 10)},
+		})
+	}
+	report(0, 110)
+	report(1, 111)
+	report(2, 500)
+
+	if i := p.avoidAtRisk(0, 3, 0); i != 1 {
+		t.Errorf("expected the next transport comfortably above the threshold, got %d", i)
+	}
+	if i := p.avoidAtRisk(0, 3, 2); i != 2 {
+		t.Errorf("expected the picked transport to be kept, got %d", i)
+	}
+
+	// Transports being recycled are at risk regardless of their buckets
+	atomic.StoreInt64(&p.pool[1].(*recyclableTransport).busySince, time.Now().UnixNano())
+	if i := p.avoidAtRisk(0, 3, 0); i != 2 {
+		t.Errorf("expected the transport being recycled to be avoided, got %d", i)
+	}
+	if i := p.avoidAtRisk(0, 2, 0); i != 0 {
+		t.Errorf("expected the picked transport to be kept when every transport is at risk, got %d", i)
+	}
+}
+
+func TestTightDeadlineValidation(t *testing.T) {
+	for _, opts := range []Options{{TightDeadline: -time.Second}, {TightDeadline: time.Second, TightDeadlineMargin: -1}} {
+		if _, err := NewBuilder(nil).WithOptions(opts).Build(); err == nil {
+			t.Errorf("expected options %+v to be rejected", opts)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package armbalancer
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// minLowDiversityAfter is the shortest period accepted for Options.LowDiversityAfter, which keeps the ticker's interval positive.
+const minLowDiversityAfter = 10 * time.Millisecond
+
+// DiversitySink is implemented by MetricsSinks that also record the backend diversity of every host as a gauge.
+// ObserveBackendDiversity is called periodically from a background goroutine, see Options.LowDiversityAfter.
+type DiversitySink interface {
+	ObserveBackendDiversity(hostport string, diversity float64)
+}
+
+// backendDiversity describes the remote IPs the connected transports of a host are currently connected to.
+type backendDiversity struct {
+	ips       map[string]struct{}
+	connected int // transports whose current generation has an open connection
+}
+
+// Diversity returns the number of distinct remote IPs divided by the number of connected transports.
+func (d *backendDiversity) Diversity() float64 {
+	if d.connected == 0 {
+		return 0
+	}
+	return float64(len(d.ips)) / float64(d.connected)
+}
+
+// backendDiversity returns the diversity of every host:port with at least one connected transport.
+// Pools dedicated to audiences of the same host are counted together.
+func (t *Balancer) backendDiversity() map[string]*backendDiversity {
+	hosts := make(map[string]*backendDiversity)
+	for _, p := range t.hosts {
+		for _, rt := range p.pool {
+			r, ok := rt.(*recyclableTransport)
+			if !ok {
+				continue
+			}
+			r.lock.Lock()
+			gen := r.current
+			r.lock.Unlock()
+			ips := r.conns.RemoteIPs(gen)
+			if len(ips) == 0 {
+				continue
+			}
+			hostport := net.JoinHostPort(p.host, p.port)
+			d := hosts[hostport]
+			if d == nil {
+				d = &backendDiversity{ips: make(map[string]struct{})}
+				hosts[hostport] = d
+			}
+			d.connected++
+			for _, ip := range ips {
+				d.ips[ip] = struct{}{}
+			}
+		}
+	}
+	return hosts
+}
+
+// monitorDiversity samples the backend diversity of every host every fifth of lowAfter, until done is closed.
+// Samples are reported to the metrics sink if it implements DiversitySink, and onLow is called once per host
+// whenever its diversity has stayed below min for lowAfter.
+func (t *Balancer) monitorDiversity(min float64, lowAfter time.Duration, onLow func(LowDiversityEvent), done <-chan struct{}) {
+	sink, _ := t.metrics.(DiversitySink)
+	lowSince := make(map[string]time.Time)
+	reported := make(map[string]bool)
+	ticker := time.NewTicker(lowAfter / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			hosts := t.backendDiversity()
+			for hostport := range lowSince {
+				if hosts[hostport] == nil { // no longer connected
+					delete(lowSince, hostport)
+					delete(reported, hostport)
+				}
+			}
+			for hostport, d := range hosts {
+				diversity := d.Diversity()
+				if sink != nil {
+					sink.ObserveBackendDiversity(hostport, diversity)
+				}
+				if diversity >= min {
+					delete(lowSince, hostport)
+					delete(reported, hostport)
+					continue
+				}
+				since, ok := lowSince[hostport]
+				if !ok {
+					lowSince[hostport] = now
+					continue
+				}
+				if now.Sub(since) < lowAfter || reported[hostport] || onLow == nil {
+					continue
+				}
+				reported[hostport] = true
+				ips := make([]string, 0, len(d.ips))
+				for ip := range d.ips {
+					ips = append(ips, ip)
+				}
+				sort.Strings(ips)
+				onLow(LowDiversityEvent{Host: hostport, Diversity: diversity, Since: since, RemoteIPs: ips})
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package armbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type diversitySink struct {
+	lock    sync.Mutex
+	samples map[string]float64
+}
+
+func (s *diversitySink) ObserveAcquireWait(d time.Duration) {}
+
+func (s *diversitySink) ObserveBackendDiversity(hostport string, diversity float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.samples[hostport] = diversity
+}
+
+func (s *diversitySink) Sample(hostport string) (float64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	d, ok := s.samples[hostport]
+	return d, ok
+}
+
+// newResolvingTransport returns a parent transport resolving every host to the next of the given IPs in turn,
+// reaching the server listening on all interfaces at port.
+func newResolvingTransport(port string, ips ...string) *http.Transport {
+	var lock sync.Mutex
+	var next int
+	parent := http.DefaultTransport.(*http.Transport).Clone()
+	parent.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	parent.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		lock.Lock()
+		ip := ips[next%len(ips)]
+		next++
+		lock.Unlock()
+		return (&net.Dialer{}).DialContext(ctx, network, net.JoinHostPort(ip, port))
+	}
+	return parent
+}
+
+func TestLowDiversityValidation(t *testing.T) {
+	for _, opts := range []Options{{MinBackendDiversity: -0.5}, {MinBackendDiversity: 0.5, LowDiversityAfter: time.Millisecond}} {
+		if _, err := NewBuilder(nil).WithOptions(opts).Build(); err == nil {
+			t.Errorf("expected options %+v to be rejected", opts)
+		}
+	}
+}
+
+func TestBackendDiversity(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Listener.Close()
+	server.Listener = listener
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	tests := []struct {
+		name string
+		ips  []string
+		want float64
+		low  bool
+	}{
+		{"single address", []string{"127.0.0.1"}, 0.25, true},
+		{"many addresses", []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "127.0.0.4"}, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := make(chan LowDiversityEvent, 1)
+			sink := &diversitySink{samples: make(map[string]float64)}
+			b := New(Options{
+				Host:                "management.azure.com",
+				Transport:           newResolvingTransport(port, tt.ips...),
+				PoolSize:            4,
+				MetricsSink:         sink,
+				MinBackendDiversity: 0.5,
+				LowDiversityAfter:   50 * time.Millisecond,
+				OnLowDiversity:      func(e LowDiversityEvent) { events <- e },
+			})
+			defer b.Close()
+
+			for i := 0; i < 4; i++ {
+				req, _ := http.NewRequest(http.MethodGet, "https://management.azure.com/subscriptions", nil)
+				resp, err := b.RoundTrip(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+			if got := b.Stats().BackendDiversity["management.azure.com:443"]; got != tt.want {
+				t.Errorf("expected a diversity of %g, got %g", tt.want, got)
+			}
+			waitFor(t, "a diversity sample", func() bool {
+				d, ok := sink.Sample("management.azure.com:443")
+				return ok && d == tt.want
+			})
+
+			select {
+			case e := <-events:
+				if !tt.low {
+					t.Fatalf("unexpected event %+v", e)
+				}
+				if e.Host != "management.azure.com:443" || e.Diversity != 0.25 || fmt.Sprint(e.RemoteIPs) != "[127.0.0.1]" {
+					t.Errorf("unexpected event %+v", e)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.low {
+					t.Fatal("expected low diversity to be reported")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package armbalancer
+
+import (
+	"context"
+	"sync"
+)
+
+type drainNotifyKey struct{}
+
+// WithDrainNotify returns a context whose requests receive a notification on ch when the connection serving them
+// starts draining because it's being recycled, while their response body is still open. Streaming consumers can
+// then abort and re-issue the request on a new connection instead of holding up the drain.
+// Each request is notified at most once, and the notification is dropped if ch isn't ready to receive it,
+// so ch should be buffered.
+func WithDrainNotify(ctx context.Context, ch chan<- struct{}) context.Context {
+	return context.WithValue(ctx, drainNotifyKey{}, ch)
+}
+
+// drainListeners holds the notification channels of the requests served by a generation until their response
+// bodies are closed.
+type drainListeners struct {
+	lock     sync.Mutex
+	chans    map[*drainListener]struct{}
+	draining bool
+}
+
+type drainListener struct {
+	ch chan<- struct{}
+}
+
+// Listen registers the request's notification channel, if any, and returns the listener to pass to Unlisten.
+// Requests that raced with the generation's retirement are notified right away.
+func (d *drainListeners) Listen(ctx context.Context) *drainListener {
+	ch, _ := ctx.Value(drainNotifyKey{}).(chan<- struct{})
+	if ch == nil {
+		return nil
+	}
+	l := &drainListener{ch: ch}
+	d.lock.Lock()
+	if d.draining {
+		d.lock.Unlock()
+		l.notify()
+		return nil
+	}
+	if d.chans == nil {
+		d.chans = make(map[*drainListener]struct{})
+	}
+	d.chans[l] = struct{}{}
+	d.lock.Unlock()
+	return l
+}
+
+func (d *drainListeners) Unlisten(l *drainListener) {
+	if l == nil {
+		return
+	}
+	d.lock.Lock()
+	delete(d.chans, l)
+	d.lock.Unlock()
+}
+
+// Drain notifies every registered listener, without blocking.
+func (d *drainListeners) Drain() {
+	d.lock.Lock()
+	d.draining = true
+	chans := d.chans
+	d.chans = nil
+	d.lock.Unlock()
+	for l := range chans {
+		l.notify()
+	}
+}
+
+func (l *drainListener) notify() {
+	select {
+	case l.ch <- struct{}{}:
+	default:
+	}
+}
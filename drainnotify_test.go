@@ -0,0 +1,123 @@
+package armbalancer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestWithDrainNotify(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/watch" {
+			return
+		}
+		// Stream slowly until the client goes away
+		for {
+			if _, err := w.Write([]byte("event\n")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	b := New(Options{
+		Transport:    svr.Client().Transport.(*http.Transport),
+		Host:         u.Host,
+		PoolSize:     1,
+		DrainTimeout: time.Minute,
+	})
+	defer b.Close()
+
+	notify := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(WithDrainNotify(context.Background(), notify))
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", svr.URL+"/watch", nil)
+	resp, err := b.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The consumer reads slowly, and aborts once notified that its connection is draining
+	aborted := make(chan struct{})
+	go func() {
+		defer close(aborted)
+		buf := make([]byte, 6)
+		for {
+			select {
+			case <-notify:
+				resp.Body.Close()
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			if _, err := io.ReadFull(resp.Body, buf); err != nil {
+				t.Errorf("unexpected read error: %s", err)
+				return
+			}
+		}
+	}()
+
+	recycled := make(chan error, 1)
+	go func() { recycled <- b.ForceRecycleAll(context.Background()) }()
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the consumer to be notified")
+	}
+	select {
+	case err := <-recycled:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the drain to complete once the consumer aborted")
+	}
+	if len(notify) != 0 {
+		t.Error("expected a single notification")
+	}
+
+	// The consumer re-issues its request on the new connection
+	resp, err = b.RoundTrip(req.Clone(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if g := b.Stats().Transports[0].Generation; g != 2 {
+		t.Errorf("expected the request to be re-issued on generation 2, got %d", g)
+	}
+}
+
+func TestDrainListeners(t *testing.T) {
+	var d drainListeners
+	full := make(chan struct{}) // never ready, the notification must not block
+	ready := make(chan struct{}, 2)
+	if l := d.Listen(context.Background()); l != nil {
+		t.Error("expected requests without a channel not to be registered")
+	}
+	d.Listen(WithDrainNotify(context.Background(), full))
+	done := d.Listen(WithDrainNotify(context.Background(), ready))
+	d.Listen(WithDrainNotify(context.Background(), ready))
+	d.Unlisten(done)
+
+	d.Drain()
+	d.Drain()
+	if len(ready) != 1 {
+		t.Errorf("expected one notification for the open request, got %d", len(ready))
+	}
+	d.Listen(WithDrainNotify(context.Background(), ready))
+	if len(ready) != 2 {
+		t.Error("expected requests racing with the drain to be notified right away")
+	}
+}
@@ -0,0 +1,82 @@
+package armbalancer
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// OptionsFromEnv builds Options from environment variables named after the given prefix
+// (ARMBALANCER when empty), for example ARMBALANCER_POOL_SIZE:
+//
+//	<prefix>_HOST                     Options.Host
+//	<prefix>_POOL_SIZE                Options.PoolSize (integer >= 1)
+//	<prefix>_RECYCLE_THRESHOLD        Options.RecycleThreshold (integer >= 1)
+//	<prefix>_MIN_REQS_BEFORE_RECYCLE  Options.MinReqsBeforeRecycle (integer >= 1)
+//	<prefix>_MAX_CONN_AGE             Options.MaxConnAge (duration > 0, e.g. "10m")
+//
+// Unset or empty variables are left at their zero value so New applies the usual defaults.
+func OptionsFromEnv(prefix string) (Options, error) {
+	if prefix == "" {
+		prefix = "ARMBALANCER"
+	}
+	env := envReader{prefix: prefix}
+
+	opts := Options{Host: env.lookup("HOST")}
+	opts.PoolSize = int(env.int("POOL_SIZE"))
+	opts.RecycleThreshold = env.int("RECYCLE_THRESHOLD")
+	opts.MinReqsBeforeRecycle = env.int("MIN_REQS_BEFORE_RECYCLE")
+	opts.MaxConnAge = env.duration("MAX_CONN_AGE")
+	return opts, env.err
+}
+
+// envReader parses environment variables, keeping the first error encountered.
+type envReader struct {
+	prefix string
+	err    error
+}
+
+func (e *envReader) lookup(name string) string {
+	return os.Getenv(e.prefix + "_" + name)
+}
+
+func (e *envReader) fail(name, val, reason string) {
+	if e.err == nil {
+		e.err = fmt.Errorf("invalid value %q for environment variable %s_%s: %s", val, e.prefix, name, reason)
+	}
+}
+
+func (e *envReader) int(name string) int64 {
+	val := e.lookup(name)
+	if val == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(val, 10, 32)
+	if err != nil {
+		e.fail(name, val, "expected an integer")
+		return 0
+	}
+	if n < 1 {
+		e.fail(name, val, "must be at least 1")
+		return 0
+	}
+	return n
+}
+
+func (e *envReader) duration(name string) time.Duration {
+	val := e.lookup(name)
+	if val == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		e.fail(name, val, "expected a duration such as \"10m\"")
+		return 0
+	}
+	if d <= 0 {
+		e.fail(name, val, "must be positive")
+		return 0
+	}
+	return d
+}
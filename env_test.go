@@ -0,0 +1,84 @@
+package armbalancer
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOptionsFromEnv(t *testing.T) {
+	t.Setenv("ARMBALANCER_HOST", "eastus.management.azure.com:443")
+	t.Setenv("ARMBALANCER_POOL_SIZE", "16")
+	t.Setenv("ARMBALANCER_RECYCLE_THRESHOLD", "50")
+	t.Setenv("ARMBALANCER_MIN_REQS_BEFORE_RECYCLE", "20")
+	t.Setenv("ARMBALANCER_MAX_CONN_AGE", "10m")
+
+	opts, err := OptionsFromEnv("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Host != "eastus.management.azure.com:443" || opts.PoolSize != 16 || opts.RecycleThreshold != 50 ||
+		opts.MinReqsBeforeRecycle != 20 || opts.MaxConnAge != 10*time.Minute {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+}
+
+func TestOptionsFromEnvDefaults(t *testing.T) {
+	t.Setenv("CUSTOM_POOL_SIZE", "4")
+
+	opts, err := OptionsFromEnv("CUSTOM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Host != "" || opts.PoolSize != 4 || opts.RecycleThreshold != 0 || opts.MinReqsBeforeRecycle != 0 || opts.MaxConnAge != 0 {
+		t.Errorf("expected unset variables to be left at their zero value, got: %+v", opts)
+	}
+}
+
+func TestOptionsFromEnvInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{
+			name:    "POOL_SIZE",
+			value:   "eight",
+			wantErr: `invalid value "eight" for environment variable ARMBALANCER_POOL_SIZE: expected an integer`,
+		},
+		{
+			name:    "POOL_SIZE",
+			value:   "0",
+			wantErr: `invalid value "0" for environment variable ARMBALANCER_POOL_SIZE: must be at least 1`,
+		},
+		{
+			name:    "RECYCLE_THRESHOLD",
+			value:   "-5",
+			wantErr: `invalid value "-5" for environment variable ARMBALANCER_RECYCLE_THRESHOLD: must be at least 1`,
+		},
+		{
+			name:    "MIN_REQS_BEFORE_RECYCLE",
+			value:   "99999999999",
+			wantErr: `invalid value "99999999999" for environment variable ARMBALANCER_MIN_REQS_BEFORE_RECYCLE: expected an integer`,
+		},
+		{
+			name:    "MAX_CONN_AGE",
+			value:   "10",
+			wantErr: `ARMBALANCER_MAX_CONN_AGE: expected a duration`,
+		},
+		{
+			name:    "MAX_CONN_AGE",
+			value:   "-1m",
+			wantErr: `invalid value "-1m" for environment variable ARMBALANCER_MAX_CONN_AGE: must be positive`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			t.Setenv("ARMBALANCER_"+tt.name, tt.value)
+			_, err := OptionsFromEnv("ARMBALANCER")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package armbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// TransportError is returned for requests that failed in a pooled transport, attributing the failure to the
+// transport and the generation of its connection, as reported in RecycleEvent.
+// Its message leaves out the query strings of the URLs reported by the wrapped error, e.g. by middleware returning
+// a *url.Error, since they may contain secrets such as SAS tokens.
+type TransportError struct {
+	Host        string
+	TransportID int
+	Generation  int64
+	Err         error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("armbalancer: transport %d (generation %d) for host %s: %s",
+		e.TransportID, e.Generation, e.Host, redactedError(e.Err))
+}
+
+// redactedError returns the message of err without the query strings of the *url.Error values in its chain.
+func redactedError(err error) string {
+	msg := err.Error()
+	for ; err != nil; err = errors.Unwrap(err) {
+		urlErr, ok := err.(*url.Error)
+		if !ok {
+			continue
+		}
+		if u, parseErr := url.Parse(urlErr.URL); parseErr == nil && (u.RawQuery != "" || u.ForceQuery) {
+			u.RawQuery, u.ForceQuery = "", false
+			msg = strings.ReplaceAll(msg, urlErr.URL, u.String())
+		}
+	}
+	return msg
+}
+
+func (e *TransportError) Unwrap() error { return e.Err }
+
+// isGoAway returns true for the error returned by HTTP/2 connections closed by the server after sending GOAWAY,
+// for the requests the server had started processing. The error type isn't exported by net/http.
+func isGoAway(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "server sent GOAWAY and closed the connection")
+}
+
+// Timeout reports whether the wrapped error is a timeout, so that url.Error.Timeout keeps working.
+func (e *TransportError) Timeout() bool {
+	var netErr net.Error
+	return errors.Is(e.Err, context.DeadlineExceeded) || (errors.As(e.Err, &netErr) && netErr.Timeout())
+}
+
+// ErrorClass categorizes errors returned by a round tripper.
+type ErrorClass int
+
+const (
+	ErrorClassNone ErrorClass = iota
+	ErrorClassOther
+	ErrorClassTimeout
+	ErrorClassConnReset
+	ErrorClassTLS
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassNone:
+		return "none"
+	case ErrorClassTimeout:
+		return "timeout"
+	case ErrorClassConnReset:
+		return "conn-reset"
+	case ErrorClassTLS:
+		return "tls"
+	default:
+		return "other"
+	}
+}
+
+// ClassifyError categorizes an error returned by a round tripper, inspecting the whole chain of wrapped errors.
+// TLS and certificate failures take precedence over connection resets, which take precedence over timeouts.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassNone
+	}
+
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		invalidCert      x509.CertificateInvalidError
+		hostname         x509.HostnameError
+		recordHeader     tls.RecordHeaderError
+	)
+	if errors.As(err, &unknownAuthority) || errors.As(err, &invalidCert) || errors.As(err, &hostname) || errors.As(err, &recordHeader) {
+		return ErrorClassTLS
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) && (errno == syscall.ECONNRESET || errno == syscall.ECONNABORTED) {
+		return ErrorClassConnReset
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrorClassTimeout
+	}
+	return ErrorClassOther
+}
+
+// HostNotSupportedError is returned for requests to a host that hasn't been added to the balancer.
+type HostNotSupportedError struct {
+	Host       string   // of the request URL
+	Supported  []string // the hosts added to the balancer, in host:port form
+	Suggestion string   // the added host the request was likely meant for, in host:port form, if any
+}
+
+func (e *HostNotSupportedError) Error() string {
+	var msg string
+	if len(e.Supported) == 1 {
+		name, _, _ := net.SplitHostPort(e.Supported[0])
+		msg = fmt.Sprintf("host %q is not supported by the configured ARM balancer, supported host name is %q", e.Host, name)
+	} else {
+		names := make([]string, len(e.Supported))
+		for i, hostport := range e.Supported {
+			names[i] = strconv.Quote(hostport)
+		}
+		msg = fmt.Sprintf("host %q is not supported by the configured ARM balancer, supported host names are %s", e.Host, strings.Join(names, ", "))
+	}
+	if e.Suggestion != "" {
+		msg += fmt.Sprintf(" (did you mean %q?)", e.Suggestion)
+	}
+	return msg
+}
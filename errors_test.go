@@ -0,0 +1,156 @@
+package armbalancer
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{
+			name: "nil",
+			err:  nil,
+			want: ErrorClassNone,
+		},
+		{
+			name: "net timeout",
+			err:  &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}},
+			want: ErrorClassTimeout,
+		},
+		{
+			name: "context deadline",
+			err:  &url.Error{Op: "Get", URL: "https://management.azure.com", Err: context.DeadlineExceeded},
+			want: ErrorClassTimeout,
+		},
+		{
+			name: "connection reset",
+			err:  fmt.Errorf("reading response: %w", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}),
+			want: ErrorClassConnReset,
+		},
+		{
+			name: "unknown certificate authority",
+			err:  &url.Error{Op: "Get", URL: "https://management.azure.com", Err: x509.UnknownAuthorityError{}},
+			want: ErrorClassTLS,
+		},
+		{
+			name: "hostname mismatch",
+			err:  fmt.Errorf("handshake: %w", x509.HostnameError{Host: "management.azure.com", Certificate: &x509.Certificate{}}),
+			want: ErrorClassTLS,
+		},
+		{
+			name: "other",
+			err:  errors.New("something went wrong"),
+			want: ErrorClassOther,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("ClassifyError() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransportError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close() // refuse connections
+	host, port, _ := net.SplitHostPort(addr)
+
+	r := buildRecyclableTransport(transportConfig{
+		parent: &http.Transport{},
+		host:   host,
+		port:   port,
+		policy: DefaultRecyclePolicy{},
+	})
+	defer r.Close(false)
+
+	req, _ := http.NewRequest("GET", "http://"+addr+"/subscriptions?sig=secret", nil)
+	_, err = r.RoundTrip(req)
+
+	var transportErr *TransportError
+	if !errors.As(err, &transportErr) || transportErr.TransportID != 0 || transportErr.Generation != 1 || transportErr.Host != host {
+		t.Fatalf("expected the error to be attributed to the transport, got: %#v", err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("expected the wrapped error to be unwrappable, got: %s", err)
+	}
+	want := fmt.Sprintf("armbalancer: transport 0 (generation 1) for host %s: ", host)
+	if !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("expected error to start with %q, got %q", want, err.Error())
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected the query string to be kept out of the error, got %q", err.Error())
+	}
+	if last := r.Stats().Errors.LastError; last == "" || strings.Contains(last, "secret") {
+		t.Errorf("expected the last error to be recorded without the query string, got %q", last)
+	}
+
+	client := &http.Client{Transport: r}
+	_, err = client.Get("http://" + addr + "/subscriptions?sig=secret")
+	if !errors.As(err, &transportErr) {
+		t.Errorf("expected the error to be attributed to the transport through http.Client, got: %s", err)
+	}
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		t.Errorf("expected http.Client to report the error as a url.Error, got: %s", err)
+	}
+
+	timeout := &url.Error{Op: "Get", URL: "https://management.azure.com", Err: &TransportError{Err: context.DeadlineExceeded}}
+	if !timeout.Timeout() || !errors.Is(timeout, context.DeadlineExceeded) {
+		t.Errorf("expected wrapped timeouts to be reported as such")
+	}
+}
+
+func TestTransportErrorRedactsQuery(t *testing.T) {
+	const secretURL = "https://management.azure.com/subscriptions?$skiptoken=secret&sig=secret"
+	b := New(Options{
+		Host: "management.azure.com",
+		PerTransportMiddleware: []func(http.RoundTripper) http.RoundTripper{
+			func(http.RoundTripper) http.RoundTripper {
+				return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					return nil, fmt.Errorf("middleware: %w", &url.Error{Op: "Get", URL: secretURL, Err: context.DeadlineExceeded})
+				})
+			},
+		},
+	})
+	defer b.Close()
+
+	req, _ := http.NewRequest("GET", secretURL, nil)
+	_, err := b.RoundTrip(req)
+	want := `armbalancer: transport 1 (generation 1) for host management.azure.com: ` +
+		`middleware: Get "https://management.azure.com/subscriptions": context deadline exceeded`
+	if err == nil || err.Error() != want {
+		t.Errorf("expected error %q, got %v", want, err)
+	}
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) || urlErr.URL != secretURL {
+		t.Errorf("expected the wrapped url.Error to be left intact, got: %#v", urlErr)
+	}
+	if last := b.Stats().Transports[1].Errors.LastError; !strings.HasPrefix(last, "middleware: ") || strings.Contains(last, "secret") {
+		t.Errorf("expected the last error to be recorded without the query string, got %q", last)
+	}
+}
@@ -0,0 +1,166 @@
+package armbalancer
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// RecycleReason describes what caused a connection to be recycled.
+type RecycleReason string
+
+const (
+	// RecycleReasonPolicy is used when the configured RecyclePolicy decided to recycle.
+	RecycleReasonPolicy RecycleReason = "policy"
+
+	// RecycleReasonChaos is used for random recycles enabled by Options.ChaosRecycleProbability.
+	RecycleReasonChaos RecycleReason = "chaos"
+
+	// RecycleReasonManual is used for recycles requested using Balancer.ForceRecycleAll.
+	RecycleReasonManual RecycleReason = "manual"
+
+	// RecycleReasonConnFailure is used when a request failed because its connection was reset.
+	// The connection is recycled regardless of the recycle policy.
+	RecycleReasonConnFailure RecycleReason = "conn-failure"
+
+	// RecycleReasonGoAway is used when the server sent an HTTP/2 GOAWAY and closed the connection while
+	// a request was in flight, e.g. because the ARM instance is draining.
+	RecycleReasonGoAway RecycleReason = "goaway"
+
+	// RecycleReasonProtocolDowngrade is used when the connection negotiated HTTP/1 and
+	// Options.RecycleOnProtocolDowngrade is set.
+	RecycleReasonProtocolDowngrade RecycleReason = "protocol-downgrade"
+
+	// RecycleReasonRequestThreshold is used when a response crossed the threshold of its request, see
+	// WithRecycleThreshold.
+	RecycleReasonRequestThreshold RecycleReason = "request-threshold"
+)
+
+// RecycleEvent is reported through Options.OnRecycle.
+type RecycleEvent struct {
+	TransportID int
+	Generation  int64 // of the connection being recycled
+	Reason      RecycleReason
+
+	// DryRun is true when the connection wasn't actually recycled because dry-run mode is enabled.
+	DryRun bool
+
+	// Postponed is true when the recycle was held back because the pool is busy, see Options.PostponeRecyclesAbove,
+	// or for ConnBudgetDelay or DialPressureDelay.
+	Postponed bool
+
+	// ConnBudgetDelay is how long the recycle is postponed for to stay within Options.MaxNewConnectionsPerMinute.
+	ConnBudgetDelay time.Duration
+
+	// DialPressureDelay is how long the recycle is postponed for while the pool is reduced, see Options.AdaptToDialPressure.
+	DialPressureDelay time.Duration
+
+	// RequestThreshold is the threshold, after capping, of the request that caused a RecycleReasonRequestThreshold
+	// recycle.
+	RequestThreshold int64
+
+	// Snapshot is the connection state that led to the recycle.
+	Snapshot ConnSnapshot
+}
+
+// ProtocolDowngradeEvent is reported through Options.OnProtocolDowngrade.
+type ProtocolDowngradeEvent struct {
+	TransportID int
+	Generation  int64  // of the connection that received the response
+	Proto       string // of the response, e.g. "HTTP/1.1"
+}
+
+// RecyclerStallEvent is reported through Options.OnRecyclerStall when a transport's recycling goroutine
+// has been busy with a single decision or recycle for longer than Options.RecyclerStallTimeout.
+type RecyclerStallEvent struct {
+	TransportID int
+	BusySince   time.Time
+}
+
+// DialPressureEvent is reported through Options.OnDialPressure when a pool is reduced because dials fail
+// with errors indicating port or address exhaustion, or when a slot is restored once dials succeed again.
+type DialPressureEvent struct {
+	Host   string // host:port
+	Shrunk bool   // false when a slot was restored
+	Active int    // number of slots serving reads after the change
+
+	// Err is the dial error that caused the pool to shrink, nil when restoring.
+	Err error
+}
+
+// LowDiversityEvent is reported through Options.OnLowDiversity when the connected transports of a host have been
+// spread over too few distinct remote IPs for Options.LowDiversityAfter, which usually means DNS returns a single
+// address, e.g. a VIP, and recycling connections doesn't reach other backends.
+type LowDiversityEvent struct {
+	Host      string    // host:port
+	Diversity float64   // distinct remote IPs per connected transport
+	Since     time.Time // when the diversity was first sampled below Options.MinBackendDiversity
+	RemoteIPs []string  // sorted
+}
+
+// ValidationFailureEvent is reported through Options.OnValidationFailure when the transport created by a recycle
+// fails Options.ValidateTransport. The current connection keeps serving requests until a retry succeeds.
+type ValidationFailureEvent struct {
+	TransportID int
+	Generation  int64         // of the connection kept serving requests
+	Reason      RecycleReason // of the recycle being retried
+	Attempt     int           // consecutive failures, starting at 1
+	Err         error
+	RetryIn     time.Duration
+}
+
+// ThrottleStormEvent is reported through Options.OnThrottleStorm when recycling of a transport is suspended
+// because its replacement connections keep coming back depleted.
+type ThrottleStormEvent struct {
+	TransportID int
+	Generation  int64 // of the connection kept while recycling is suspended
+
+	// Backoff is how long recycling is suspended for.
+	Backoff time.Duration
+
+	// Snapshot is the connection state that would otherwise have led to a recycle.
+	Snapshot ConnSnapshot
+}
+
+// SetDryRun enables or disables dry-run mode at runtime. See Options.DryRun.
+func (t *Balancer) SetDryRun(enabled bool) {
+	var val int32
+	if enabled {
+		val = 1
+	}
+	atomic.StoreInt32(&t.dryRun, val)
+}
+
+// ForceRecycleAll recycles every pooled transport of every host, regardless of the recycle policy and dry-run mode.
+// It's meant for incident response, e.g. to move away from a suspected bad set of ARM instances.
+// Transports are recycled one at a time, each once its churn backoff has passed and Options.MaxNewConnectionsPerMinute
+// allows a new connection. It returns once the previous connections have drained, or with the context's error if ctx expires first.
+func (t *Balancer) ForceRecycleAll(ctx context.Context) error {
+	if !t.acquire() {
+		return ErrClosed
+	}
+	defer t.inflight.Add(-1)
+
+	var pending []<-chan struct{}
+	for _, p := range t.hosts {
+		for _, rt := range p.pool {
+			r, ok := rt.(*recyclableTransport)
+			if !ok {
+				continue
+			}
+			drained, err := r.ForceRecycle(ctx)
+			if err != nil {
+				return err
+			}
+			pending = append(pending, drained)
+		}
+	}
+	for _, drained := range pending {
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,459 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, msg string, fn func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var lock sync.Mutex
+	addrs := map[string]struct{}{}
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		addrs[r.RemoteAddr] = struct{}{}
+		lock.Unlock()
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "0")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	var events []RecycleEvent
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:            svr.Client().Transport.(*http.Transport),
+		Host:                 u.Host,
+		PoolSize:             1,
+		MinReqsBeforeRecycle: 2,
+		DryRun:               true,
+		OnRecycle: func(e RecycleEvent) {
+			lock.Lock()
+			defer lock.Unlock()
+			events = append(events, e)
+		},
+	})
+	client := &http.Client{Transport: b}
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			resp, err := client.Get(svr.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	send(10)
+	waitFor(t, "suppressed recycle", func() bool { return b.Stats().Transports[0].SuppressedRecycles > 0 })
+
+	lock.Lock()
+	if len(addrs) != 1 {
+		t.Errorf("expected dry-run mode to keep using a single connection, got %d", len(addrs))
+	}
+	for _, e := range events {
+		if !e.DryRun || e.Reason != RecycleReasonPolicy || e.Snapshot.Remaining["Subscription-Reads"] != 0 {
+			t.Errorf("unexpected event in dry-run mode: %+v", e)
+		}
+	}
+	lock.Unlock()
+	if s := b.Stats().Transports[0]; s.Recycles != 0 {
+		t.Errorf("expected no recycles in dry-run mode, got %d", s.Recycles)
+	}
+
+	b.SetDryRun(false)
+	send(10)
+	waitFor(t, "recycle", func() bool { return b.Stats().Transports[0].Recycles > 0 })
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(addrs) < 2 {
+		t.Errorf("expected connections to be recycled once dry-run mode was disabled")
+	}
+	if e := events[len(events)-1]; e.DryRun {
+		t.Errorf("expected the last event to be a real recycle: %+v", e)
+	}
+}
+
+func TestForceRecycleAll(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	var lock sync.Mutex
+	reasons := map[RecycleReason]int{}
+	u, _ := url.Parse(svr.URL)
+	b, err := NewBuilder(svr.Client().Transport.(*http.Transport)).
+		WithOptions(Options{
+			DryRun: true,
+			OnRecycle: func(e RecycleEvent) {
+				lock.Lock()
+				defer lock.Unlock()
+				if !e.DryRun {
+					reasons[e.Reason]++
+				}
+			},
+		}).
+		AddHost(u.Host, HostOptions{PoolSize: 3}).
+		AddHost("management.azure.com", HostOptions{PoolSize: 2}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	resp, err := (&http.Client{Transport: b}).Get(svr.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if err := b.ForceRecycleAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range b.Stats().Transports {
+		if s.Recycles != 1 {
+			t.Errorf("expected transport %d of %s to be recycled once, got %d", s.ID, s.Host, s.Recycles)
+		}
+	}
+	lock.Lock()
+	if reasons[RecycleReasonManual] != 5 || len(reasons) != 1 {
+		t.Errorf("expected 5 manual recycle events, got %v", reasons)
+	}
+	lock.Unlock()
+
+	b.Close()
+	if err := b.ForceRecycleAll(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed after closing the balancer, got: %v", err)
+	}
+}
+
+func TestGenerations(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	var lock sync.Mutex
+	var generations []int64
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:         svr.Client().Transport.(*http.Transport),
+		Host:              u.Host,
+		PoolSize:          1,
+		AnnotateResponses: true,
+		RecyclePolicy:     RecyclePolicyFunc(func(ConnSnapshot) bool { return true }),
+		OnRecycle: func(e RecycleEvent) {
+			lock.Lock()
+			defer lock.Unlock()
+			generations = append(generations, e.Generation)
+		},
+	})
+	defer b.Close()
+	client := &http.Client{Transport: b}
+	r := b.hosts[0].pool[0].(*recyclableTransport)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				resp, err := client.Get(svr.URL)
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				resp.Body.Close()
+				if resp.Header.Get("X-Armbalancer-Transport-Id") != "0" || resp.Header.Get("X-Armbalancer-Generation") == "" {
+					t.Errorf("expected responses to be annotated, got %v", resp.Header)
+				}
+				select {
+				case r.signal <- struct{}{}:
+				default:
+				}
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := b.ForceRecycleAll(context.Background()); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := b.ForceRecycleAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for i := range generations {
+		if generations[i] != int64(i+1) {
+			t.Fatalf("expected generations to increase by one with every recycle, got %v", generations)
+		}
+	}
+	if s := b.Stats().Transports[0]; s.Generation != int64(len(generations)+1) {
+		t.Errorf("expected the current generation to follow the last recycled one, got %d after %d recycles", s.Generation, len(generations))
+	}
+
+	// Connections of previous generations must have been closed
+	r.lock.Lock()
+	current := r.current
+	r.lock.Unlock()
+	r.conns.lock.Lock()
+	for conn := range r.conns.conns {
+		if conn.gen != current {
+			t.Errorf("connection of generation %d is still open, current is %d", conn.gen.number, current.number)
+		}
+	}
+	r.conns.lock.Unlock()
+}
+
+func TestRecycleDedup(t *testing.T) {
+	var recycles int64
+	r := buildRecyclableTransport(transportConfig{
+		parent: &http.Transport{},
+		host:   "management.azure.com",
+		port:   "443",
+		policy: RecyclePolicyFunc(func(ConnSnapshot) bool { return true }),
+		onRecycle: func(RecycleEvent) {
+			atomic.AddInt64(&recycles, 1)
+		},
+	})
+	defer r.Close(true)
+
+	// A decision made for a generation that has since been replaced is dropped
+	stale := r.Snapshot()
+	r.lock.Lock()
+	atomic.AddInt64(&r.current.requests, 1)
+	r.lock.Unlock()
+	r.recycle(RecycleReasonPolicy, r.Snapshot(), nil)
+	r.recycle(RecycleReasonPolicy, stale, nil)
+	if n := atomic.LoadInt64(&recycles); n != 1 {
+		t.Errorf("expected a single recycle, got %d", n)
+	}
+
+	// Signals received before the new generation has served a response are ignored
+	r.signal <- struct{}{}
+	r.signal <- struct{}{}
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt64(&recycles); n != 1 {
+		t.Errorf("expected signals to be ignored until the new generation has served a response, got %d recycles", n)
+	}
+	if s := r.Stats(); s.Generation != 2 || s.Recycles != 1 {
+		t.Errorf("expected exactly one replacement, got generation %d after %d recycles", s.Generation, s.Recycles)
+	}
+}
+
+func TestRecycleOnConnReset(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Read(make([]byte, 1024))
+			conn.(*net.TCPConn).SetLinger(0) // reset rather than close the connection
+			conn.Close()
+		}
+	}()
+
+	events := make(chan RecycleEvent, 10)
+	b := New(Options{
+		Transport: &http.Transport{},
+		Host:      ln.Addr().String(),
+		PoolSize:  1,
+		OnRecycle: func(e RecycleEvent) { events <- e },
+	})
+	defer b.Close()
+
+	req, _ := http.NewRequest("GET", "http://"+ln.Addr().String(), nil)
+	if _, err := b.RoundTrip(req); ClassifyError(err) != ErrorClassConnReset {
+		t.Fatalf("expected the connection to be reset, got: %v", err)
+	}
+	select {
+	case e := <-events:
+		if e.Reason != RecycleReasonConnFailure || e.Snapshot.Errors.ConnResets != 1 {
+			t.Errorf("expected the reset connection to be recycled, got %+v", e)
+		}
+		if e.Snapshot.Remaining == nil || e.Snapshot.Global == nil {
+			t.Errorf("expected snapshots never to have nil maps, got %+v", e.Snapshot)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the reset connection to be recycled")
+	}
+}
+
+func TestGoAwayReplay(t *testing.T) {
+	var lock sync.Mutex
+	conns := map[string]net.Conn{}
+	slowStarted := make(chan string, 1)
+	var slowCalls int32
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			if atomic.AddInt32(&slowCalls, 1) == 1 {
+				slowStarted <- r.RemoteAddr
+				<-r.Context().Done() // until the connection is closed
+			}
+		case "/goaway":
+			// Gracefully shuts down the connection, which keeps serving the slow request
+			w.Header().Set("Connection", "close")
+		}
+	}))
+	svr.Config.ConnState = func(c net.Conn, cs http.ConnState) {
+		if cs == http.StateNew {
+			lock.Lock()
+			conns[c.RemoteAddr().String()] = c
+			lock.Unlock()
+		}
+	}
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	var recycles []RecycleEvent
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport: svr.Client().Transport.(*http.Transport),
+		Host:      u.Host,
+		PoolSize:  2,
+		OnRecycle: func(e RecycleEvent) {
+			lock.Lock()
+			recycles = append(recycles, e)
+			lock.Unlock()
+		},
+	})
+	defer b.Close()
+	client := &http.Client{Transport: b}
+	get := func(path string) error {
+		resp, err := client.Get(svr.URL + path)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// Requests alternate between the 2 transports: the slow request and the GOAWAY share a connection
+	slow := make(chan error, 1)
+	go func() { slow <- get("/slow") }()
+	addr := <-slowStarted
+	if err := get("/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := get("/goaway"); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	conns[addr].Close()
+	lock.Unlock()
+
+	if err := <-slow; err != nil {
+		t.Errorf("expected the request to be replayed on the other transport, got: %s", err)
+	}
+	if n := b.Stats().GoAwayReplays; n != 1 {
+		t.Errorf("expected 1 replay, got %d", n)
+	}
+	waitFor(t, "the transport to be recycled", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(recycles) > 0
+	})
+	lock.Lock()
+	defer lock.Unlock()
+	if len(recycles) != 1 || recycles[0].Reason != RecycleReasonGoAway {
+		t.Errorf("expected the transport to be recycled, got %+v", recycles)
+	}
+}
+
+func TestProtocolDowngrade(t *testing.T) {
+	h1 := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer h1.Close()
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	var lock sync.Mutex
+	var events []ProtocolDowngradeEvent
+	newBalancer := func(svr *httptest.Server, recycle bool) *Balancer {
+		u, _ := url.Parse(svr.URL)
+		return New(Options{
+			Transport:     svr.Client().Transport.(*http.Transport),
+			Host:          u.Host,
+			PoolSize:      1,
+			RecyclePolicy: RecyclePolicyFunc(func(ConnSnapshot) bool { return false }),
+			OnProtocolDowngrade: func(e ProtocolDowngradeEvent) {
+				lock.Lock()
+				defer lock.Unlock()
+				events = append(events, e)
+			},
+			RecycleOnProtocolDowngrade: recycle,
+			AllowSharedParent:          true,
+		})
+	}
+	send := func(b *Balancer, svr *httptest.Server) {
+		for i := 0; i < 3; i++ {
+			req, _ := http.NewRequest("GET", svr.URL, nil)
+			resp, err := b.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	downgraded := newBalancer(h1, false)
+	defer downgraded.Close()
+	send(downgraded, h1)
+	if s := downgraded.Stats().Transports[0]; s.Protocol != "HTTP/1.1" || s.Recycles != 0 {
+		t.Errorf("expected the downgrade to be reported without recycling, got %+v", s)
+	}
+
+	recycled := newBalancer(h1, true)
+	defer recycled.Close()
+	send(recycled, h1)
+	waitFor(t, "the downgraded connection to be recycled", func() bool { return recycled.Stats().Transports[0].Recycles > 0 })
+
+	negotiated := newBalancer(h2, true)
+	defer negotiated.Close()
+	send(negotiated, h2)
+	if s := negotiated.Stats().Transports[0]; s.Protocol != "HTTP/2.0" || s.Recycles != 0 {
+		t.Errorf("expected HTTP/2 connections not to be recycled, got %+v", s)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(events) != 2 || events[0].Proto != "HTTP/1.1" || events[0].Generation != 1 {
+		t.Errorf("expected a single downgrade event per HTTP/1 transport, got %+v", events)
+	}
+}
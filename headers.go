@@ -0,0 +1,40 @@
+package armbalancer
+
+import (
+	"net/http"
+	"strings"
+)
+
+// canonicalizeHeader rewrites the keys of the header that aren't canonical, e.g. because a proxy forwarded
+// HTTP/2 header names in lowercase without them being canonicalized, so that lookups don't miss them.
+func canonicalizeHeader(h http.Header) {
+	for key, vals := range h {
+		canonical := http.CanonicalHeaderKey(key)
+		if canonical == key {
+			continue
+		}
+		delete(h, key)
+		h[canonical] = append(h[canonical], vals...)
+	}
+}
+
+// rateLimitBucket returns the canonical bucket of an X-Ms-Ratelimit-Remaining-* header key, regardless of its case.
+func rateLimitBucket(key string) (string, bool) {
+	if len(key) <= len(rateLimitHeaderPrefix) || !strings.EqualFold(key[:len(rateLimitHeaderPrefix)], rateLimitHeaderPrefix) {
+		return "", false
+	}
+	return http.CanonicalHeaderKey(key)[len(rateLimitHeaderPrefix):], true
+}
+
+// headerValues returns the values of the header, whose keys may not be canonical.
+func headerValues(h http.Header, canonicalKey string) []string {
+	if vals, ok := h[canonicalKey]; ok {
+		return vals
+	}
+	for key, vals := range h {
+		if strings.EqualFold(key, canonicalKey) {
+			return vals
+		}
+	}
+	return nil
+}
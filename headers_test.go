@@ -0,0 +1,34 @@
+package armbalancer
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestLowercaseRateLimitHeaders(t *testing.T) {
+	c := newConnState([]string{"X-Ms-User-Quota-Remaining"}, 0, nil, bucketScopes{})
+	c.ApplyHeader(http.Header{
+		"x-ms-ratelimit-remaining-subscription-reads":        {"5"},
+		"X-MS-RATELIMIT-REMAINING-SUBSCRIPTION-GLOBAL-READS": {"6"},
+		"x-ms-user-quota-remaining":                          {"7"},
+	})
+	expected := map[string]int64{"Subscription-Reads": 5, "Subscription-Global-Reads": 6, "X-Ms-User-Quota-Remaining": 7}
+	if got := c.Snapshot(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected lowercase header keys to be tracked like canonical ones, got %v", got)
+	}
+
+	r, log := newFakeRecyclableTransport(DefaultRecyclePolicy{Threshold: 10}, func(int64) http.Header {
+		return http.Header{"x-ms-ratelimit-remaining-subscription-writes": {"1"}}
+	})
+	defer r.Close(false)
+	sendFake(t, r)
+	log.expect(t, "decide 1: true")
+	log.expect(t, "recycle 1")
+
+	h := http.Header{"x-ms-ratelimit-remaining-subscription-writes": {"1"}, "Content-Type": {"application/json"}}
+	canonicalizeHeader(h)
+	if h.Get("X-Ms-Ratelimit-Remaining-Subscription-Writes") != "1" || len(h) != 2 {
+		t.Errorf("expected the header keys to be canonicalized, got %v", h)
+	}
+}
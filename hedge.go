@@ -0,0 +1,114 @@
+package armbalancer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
+}
+
+// hedge sends the request through transport i and, if no response has been received after hedgeAfter,
+// sends it a second time through transport next. The first successful response wins
+// and the other attempt is canceled.
+//
+// Each pooled transport applies the rate limit headers of the responses it receives to its own connection state,
+// so accounting is correct regardless of which attempt wins.
+func (t *hostPool) hedge(req *http.Request, i, next int) (*http.Response, error) {
+	results := make(chan hedgeResult, 2)
+	var cancels [2]context.CancelFunc
+	send := func(attempt int, slot int, r *http.Request) {
+		resp, err := t.send(slot, r)
+		results <- hedgeResult{attempt: attempt, resp: resp, err: err}
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	cancels[0] = cancel
+	go send(0, i, req.WithContext(ctx))
+	pending := 1
+
+	timer := time.NewTimer(t.hedgeAfter)
+	defer timer.Stop()
+	timerC := timer.C
+
+	for {
+		select {
+		case <-timerC:
+			timerC = nil
+			if !t.allowHedge() {
+				continue
+			}
+			ctx, cancel := context.WithCancel(req.Context())
+			hedgeReq, err := replayRequest(ctx, req)
+			if err != nil {
+				cancel()
+				continue
+			}
+			cancels[1] = cancel
+			go send(1, next, hedgeReq)
+			pending++
+
+		case res := <-results:
+			pending--
+			if res.err != nil && pending > 0 {
+				cancels[res.attempt]()
+				continue // wait for the other attempt
+			}
+
+			for attempt, cancel := range cancels {
+				if attempt != res.attempt && cancel != nil {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go func() {
+					if loser := <-results; loser.resp != nil {
+						loser.resp.Body.Close()
+					}
+				}()
+			}
+
+			if res.err != nil {
+				cancels[res.attempt]()
+				return nil, res.err
+			}
+			res.resp.Body = &cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[res.attempt]}
+			return res.resp, nil
+		}
+	}
+}
+
+func (t *hostPool) allowHedge() bool {
+	hedged := atomic.AddInt64(&t.hedged, 1)
+	if float64(hedged) > t.hedgeBudget*float64(atomic.LoadInt64(&t.cursor)) {
+		atomic.AddInt64(&t.hedged, -1)
+		return false
+	}
+	return true
+}
+
+func hedgeable(req *http.Request) bool {
+	return isRead(req) && canReplay(req)
+}
+
+func isRead(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == ""
+}
+
+// cancelOnClose releases the context of a request once its response body has been consumed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,136 @@
+package armbalancer
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler returns a handler delaying the requests for which slow returns true until their context is done
+// or delay has elapsed, and a func reporting the number of requests received.
+func countingHandler(slow func(n int) bool, delay time.Duration) (http.HandlerFunc, func() int) {
+	var received int64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if slow(int(atomic.AddInt64(&received, 1))) {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Test", "1000")
+		w.Write([]byte("ok"))
+	}
+	return handler, func() int { return int(atomic.LoadInt64(&received)) }
+}
+
+func TestHedgeStalledRequest(t *testing.T) {
+	handler, received := countingHandler(func(n int) bool { return n == 1 }, time.Hour)
+	opts := Options{PoolSize: 4, HedgeAfter: 10 * time.Millisecond, HedgeBudget: 1, AnnotateResponses: true}
+	svr, b := newTestServer(t, opts, handler)
+
+	resp, err := (&http.Client{Transport: b}).Get(svr.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("expected the hedged attempt to be served, got %q", body)
+	}
+	if n := atomic.LoadInt64(&b.hosts[0].hedged); n != 1 || received() != 2 {
+		t.Errorf("expected the stalled request to be hedged once, got %d hedges and %d requests", n, received())
+	}
+
+	// The stalled attempt was sent through the first transport picked, and the hedge through the next one
+	waitFor(t, "the stalled attempt to be canceled", func() bool {
+		var total int64
+		for _, s := range b.Stats().Transports {
+			total += s.Methods[http.MethodGet]
+		}
+		return total == 2
+	})
+	stats := b.Stats().Transports
+	served, _ := strconv.Atoi(resp.Header.Get(transportIDHeader))
+	stalled := (served + len(stats) - 1) % len(stats)
+	if stats[stalled].Methods[http.MethodGet] != 1 || stats[served].Methods[http.MethodGet] != 1 {
+		t.Errorf("expected the hedge to be sent through the transport after the stalled one, got %+v", stats)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	handler, received := countingHandler(func(int) bool { return true }, 50*time.Millisecond)
+	svr, b := newTestServer(t, Options{PoolSize: 4, HedgeAfter: time.Millisecond, HedgeBudget: 0.05}, handler)
+	client := &http.Client{Transport: b}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				resp, err := client.Get(svr.URL)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	hedged := int(atomic.LoadInt64(&b.hosts[0].hedged))
+	if hedged == 0 || hedged > 5 {
+		t.Errorf("expected between 1 and 5 hedged requests, got %d", hedged)
+	}
+	if n := received(); n < 100 || n > 100+hedged {
+		t.Errorf("expected only the requests and their hedges to reach the server, got %d requests", n)
+	}
+}
+
+func TestHedgeSkipsWrites(t *testing.T) {
+	handler, received := countingHandler(func(int) bool { return true }, 50*time.Millisecond)
+	svr, b := newTestServer(t, Options{PoolSize: 4, HedgeAfter: time.Millisecond, HedgeBudget: 1}, handler)
+	client := &http.Client{Transport: b}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Post(svr.URL, "text/plain", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if n := received(); n != 3 || atomic.LoadInt64(&b.hosts[0].hedged) != 0 {
+		t.Errorf("expected writes not to be hedged, server received %d requests", n)
+	}
+}
+
+func TestHedgeable(t *testing.T) {
+	get, _ := http.NewRequest("GET", "https://management.azure.com", nil)
+	head, _ := http.NewRequest("HEAD", "https://management.azure.com", nil)
+	post, _ := http.NewRequest("POST", "https://management.azure.com", nil)
+	getWithBody, _ := http.NewRequest("GET", "https://management.azure.com", strings.NewReader("body"))
+	getWithStream, _ := http.NewRequest("GET", "https://management.azure.com", io.NopCloser(strings.NewReader("body")))
+
+	for _, c := range []struct {
+		name string
+		req  *http.Request
+		want bool
+	}{
+		{name: "get", req: get, want: true},
+		{name: "head", req: head, want: true},
+		{name: "post", req: post, want: false},
+		{name: "get with replayable body", req: getWithBody, want: true},
+		{name: "get with streaming body", req: getWithStream, want: false},
+	} {
+		if got := hedgeable(c.req); got != c.want {
+			t.Errorf("%s: hedgeable() = %t, want %t", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package armbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrNoHost is returned for requests whose host can't be determined from their URL, including its opaque part,
+// or their Host field.
+var ErrNoHost = errors.New("armbalancer: request has no resolvable host")
+
+// ErrHostDisabled is returned for requests to a host that has been disabled using Balancer.SetHostEnabled.
+var ErrHostDisabled = errors.New("armbalancer: host is disabled")
+
+// SetHostEnabled stops or resumes routing requests to a host, given in the form passed to Builder.AddHost,
+// for every audience it was added for. Requests to a disabled host fail with an error wrapping ErrHostDisabled,
+// unless HostWeights allows them to be sent to another host.
+func (t *Balancer) SetHostEnabled(hostport string, enabled bool) error {
+	host, port, err := normalizeHost(hostport)
+	if err != nil {
+		return err
+	}
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+	var found bool
+	for _, p := range t.hosts {
+		if p.host == host && p.port == port {
+			atomic.StoreInt32(&p.disabled, disabled)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("host %q has not been added to the balancer", hostport)
+	}
+	return nil
+}
+
+// SupportedHosts returns the enabled hosts in host:port form, in registration order, followed by the aliases
+// of enabled hosts set by Options.HostAliases. Hosts added for several audiences are only listed once.
+func (t *Balancer) SupportedHosts() []string {
+	var hosts []string
+	seen := map[string]bool{}
+	for _, p := range t.hosts {
+		hostport := net.JoinHostPort(p.host, p.port)
+		if p.Enabled() && !seen[hostport] {
+			hosts = append(hosts, hostport)
+			seen[hostport] = true
+		}
+	}
+	for _, a := range t.aliases {
+		hostport := net.JoinHostPort(a.host, a.port)
+		if t.aliasEnabled(a) && !seen[hostport] {
+			hosts = append(hosts, hostport)
+			seen[hostport] = true
+		}
+	}
+	return hosts
+}
+
+func (t *hostPool) Enabled() bool {
+	return atomic.LoadInt32(&t.disabled) == 0
+}
+
+// ValidateRequestURL checks that requests to the given URL, e.g. one built by the Azure SDK, would be served
+// by the balancer, resolving and routing it like RoundTrip does for requests without an audience. It's meant to catch
+// mismatches with the configured hosts at startup: requests to other hosts fail with a *HostNotSupportedError,
+// which suggests the configured host the URL was likely meant for.
+func (t *Balancer) ValidateRequestURL(raw string) error {
+	req, err := http.NewRequest(http.MethodGet, raw, nil)
+	if err != nil {
+		return err
+	}
+	if t.passthrough != nil {
+		return nil
+	}
+	if req, err = resolveHost(req); err != nil {
+		return fmt.Errorf("URL %q: %w", raw, err)
+	}
+	if p, _ := t.route(req); p != nil || (t.redirects != nil && t.redirects.Allowed(req.URL)) {
+		return nil
+	}
+	return t.notSupportedError(req.URL)
+}
+
+// suggestHost returns the host, in host:port form, the URL was likely meant for: one with the same name but
+// another port, the closest one whose name is a parent or a subdomain of the URL's, or one whose name is off by a typo.
+func suggestHost(u *url.URL, hosts []*hostPool) string {
+	name := strings.ToLower(canonicalHostName(u.Hostname()))
+	var best string
+	var bestRelated bool // parents and subdomains are preferred over typos
+	bestDistance := 3    // more than 2 edits isn't a typo
+	for _, p := range hosts {
+		candidate := canonicalHostName(p.host)
+		if name == candidate {
+			return net.JoinHostPort(p.host, p.port)
+		}
+		related := strings.HasSuffix(name, "."+candidate) || strings.HasSuffix(candidate, "."+name)
+		if !related && bestRelated {
+			continue
+		}
+		if d := editDistance(name, candidate); (related && !bestRelated) || d < bestDistance {
+			best, bestRelated, bestDistance = net.JoinHostPort(p.host, p.port), related, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// withDefaultPort rewrites requests without a port to target the pool's port when it sets HostOptions.DefaultPort,
+// since their scheme's default port would otherwise be dialed.
+func (t *hostPool) withDefaultPort(req *http.Request) *http.Request {
+	if t.defaultPort == "" || req.URL.Port() != "" {
+		return req
+	}
+	u := *req.URL
+	u.Host = net.JoinHostPort(u.Hostname(), t.port)
+	rewritten := *req
+	rewritten.URL = &u
+	if rewritten.Host == "" {
+		rewritten.Host = req.URL.Host
+	}
+	return &rewritten
+}
+
+// resolveHost returns the request rewritten to have a URL with a host and a scheme, as generated clients may send
+// opaque URLs, omit the scheme, or only set the Host field. The host is taken from the opaque part of the URL, or
+// else from the Host field, and the scheme defaults to https.
+func resolveHost(req *http.Request) (*http.Request, error) {
+	if req.URL == nil {
+		return nil, ErrNoHost
+	}
+	if req.URL.Host != "" && req.URL.Scheme != "" {
+		return req, nil
+	}
+	u := *req.URL
+	if u.Host == "" {
+		host, path := splitOpaque(u.Opaque)
+		if host != "" {
+			u.Host, u.Opaque = host, path
+		}
+	}
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+	if u.Host == "" {
+		return nil, ErrNoHost
+	}
+	if u.Scheme == "" {
+		u.Scheme = "https"
+	}
+	resolved := *req
+	resolved.URL = &u
+	return &resolved, nil
+}
+
+// splitOpaque splits the opaque part of a URL of the form "//host/path" into its host and path.
+func splitOpaque(opaque string) (host, path string) {
+	if !strings.HasPrefix(opaque, "//") {
+		return "", opaque
+	}
+	rest := opaque[2:]
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		return rest[:i], rest[i:]
+	}
+	return rest, ""
+}
@@ -0,0 +1,234 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSetHostEnabled(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	primary := httptest.NewServer(handler)
+	defer primary.Close()
+	regional := httptest.NewServer(handler)
+	defer regional.Close()
+
+	primaryURL, _ := url.Parse(primary.URL)
+	regionalURL, _ := url.Parse(regional.URL)
+	b, err := NewBuilder(primary.Client().Transport.(*http.Transport)).
+		AddHost(primaryURL.Host, HostOptions{PoolSize: 2}).
+		AddHost(regionalURL.Host, HostOptions{PoolSize: 2}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	client := &http.Client{Transport: b}
+
+	var disabledErrors int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, err := client.Get(regional.URL)
+				switch {
+				case errors.Is(err, ErrHostDisabled):
+					atomic.AddInt64(&disabledErrors, 1)
+				case err != nil:
+					t.Error(err)
+				default:
+					resp.Body.Close()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := b.SetHostEnabled(regionalURL.Host, i%2 == 1); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		if i == 0 {
+			if hosts := b.SupportedHosts(); !reflect.DeepEqual(hosts, []string{primaryURL.Host}) {
+				t.Errorf("expected only the primary host to be supported, got %v", hosts)
+			}
+			for _, s := range b.Stats().Transports {
+				if s.HostDisabled != (s.Host == regionalURL.Host) {
+					t.Errorf("unexpected HostDisabled for %s", s.Host)
+				}
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if atomic.LoadInt64(&disabledErrors) == 0 {
+		t.Errorf("expected requests to fail while the host was disabled")
+	}
+	if hosts := b.SupportedHosts(); len(hosts) != 2 {
+		t.Errorf("expected both hosts to be supported after re-enabling, got %v", hosts)
+	}
+	resp, err := client.Get(primary.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if err := b.SetHostEnabled("unknown.com", false); err == nil {
+		t.Errorf("expected an error for a host that hasn't been added")
+	}
+}
+
+func TestValidateRequestURL(t *testing.T) {
+	b, err := NewBuilder(nil).
+		AddHost("management.azure.com:8443", HostOptions{PoolSize: 1}).
+		AddHost("eastus.management.azure.com", HostOptions{PoolSize: 1}).
+		WithOptions(Options{AllowedRedirectHostSuffixes: []string{"operations.azure.com"}}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for raw, suggestion := range map[string]string{
+		"https://management.azure.com:8443/subscriptions":     "",
+		"https://Management.Azure.com.:8443/subscriptions":    "",
+		"https://Management.Azure.com./subscriptions":         "management.azure.com:8443",
+		"https://EASTUS.management.azure.com/subscriptions":   "",
+		"https://westus.operations.azure.com/operations/1":    "",
+		"https://management.azure.com:443/subscriptions":      "management.azure.com:8443",
+		"https://managment.azure.com/subscriptions":           "management.azure.com:8443",
+		"https://westus.eastus.management.azure.com/":         "eastus.management.azure.com:443",
+		"https://azure.com/":                                  "management.azure.com:8443",
+		"https://graph.microsoft.com/v1.0/me":                 "-",
+		"https://eastus2euap.management.azure.com/providers/": "management.azure.com:8443",
+	} {
+		err := b.ValidateRequestURL(raw)
+		var notSupported *HostNotSupportedError
+		switch {
+		case suggestion == "" && err != nil:
+			t.Errorf("expected %s to be served, got: %s", raw, err)
+		case suggestion == "":
+		case !errors.As(err, &notSupported):
+			t.Errorf("expected %s not to be supported, got: %v", raw, err)
+		case suggestion == "-" && notSupported.Suggestion != "":
+			t.Errorf("expected no suggestion for %s, got %q", raw, notSupported.Suggestion)
+		case suggestion != "-" && notSupported.Suggestion != suggestion:
+			t.Errorf("expected %q to be suggested for %s, got: %s", suggestion, raw, err)
+		}
+	}
+	if err := b.ValidateRequestURL("/subscriptions"); err == nil {
+		t.Error("expected URLs without a host to be rejected")
+	}
+}
+
+func TestValidateRequestURLMatchesRoundTrip(t *testing.T) {
+	refused := &http.Transport{DialContext: func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("dialing is disabled")
+	}}
+	b, err := NewBuilder(refused).
+		AddHost("management.azure.com:8443", HostOptions{PoolSize: 1}).
+		AddHost("eastus.management.azure.com:8443", HostOptions{PoolSize: 1, DefaultPort: "8443"}).
+		WithOptions(Options{AllowedRedirectHostSuffixes: []string{"operations.azure.com"}}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	for _, raw := range []string{
+		"https://management.azure.com:8443/subscriptions",
+		"https://Management.Azure.com.:8443/subscriptions",
+		"https://management.azure.com/subscriptions",
+		"https://eastus.management.azure.com/subscriptions",
+		"https://eastus.management.azure.com:443/subscriptions",
+		"http://eastus.management.azure.com/subscriptions",
+		"//management.azure.com:8443/subscriptions",
+		"https://westus.operations.azure.com/operations/1",
+		"https://graph.microsoft.com/v1.0/me",
+		"/subscriptions",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, raw, nil)
+		_, rtErr := b.RoundTrip(req)
+		served := rtErr != nil && strings.Contains(rtErr.Error(), "dialing is disabled")
+		if err := b.ValidateRequestURL(raw); (err == nil) != served {
+			t.Errorf("expected the validation of %s to match RoundTrip, got %v and RoundTrip returned %v", raw, err, rtErr)
+		}
+	}
+}
+
+func TestResolveHost(t *testing.T) {
+	var sent *url.URL
+	b, err := NewBuilder(nil).
+		WithOptions(Options{TransportFactory: func(int, *http.Transport, string, string, int64, int64) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				sent = req.URL
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			})
+		}}).
+		AddHost("management.azure.com", HostOptions{}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		err  error
+	}{
+		{"absolute", &http.Request{URL: &url.URL{Scheme: "https", Host: "management.azure.com", Path: "/subscriptions"}}, nil},
+		{"opaque", &http.Request{URL: &url.URL{Scheme: "https", Opaque: "//management.azure.com/subscriptions"}}, nil},
+		{"opaque without scheme", &http.Request{URL: &url.URL{Opaque: "//Management.Azure.com:443/subscriptions"}}, nil},
+		{"empty scheme", &http.Request{URL: &url.URL{Host: "management.azure.com", Path: "/subscriptions"}}, nil},
+		{"host only", &http.Request{URL: &url.URL{Path: "/subscriptions"}, Host: "management.azure.com"}, nil},
+		{"empty scheme on another port", &http.Request{URL: &url.URL{Host: "management.azure.com:8443", Path: "/subscriptions"}}, &HostNotSupportedError{}},
+		{"no host", &http.Request{URL: &url.URL{Path: "/subscriptions"}}, ErrNoHost},
+		{"opaque without host", &http.Request{URL: &url.URL{Scheme: "https", Opaque: "/subscriptions"}}, ErrNoHost},
+		{"no URL", &http.Request{Host: "management.azure.com"}, ErrNoHost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent = nil
+			_, err := b.RoundTrip(tt.req)
+			switch target := tt.err.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("expected the request to be served, got: %s", err)
+				}
+				if sent.Scheme != "https" || !strings.EqualFold(sent.Hostname(), "management.azure.com") || sent.RequestURI() != "/subscriptions" {
+					t.Errorf("expected https://management.azure.com/subscriptions to be requested, got %#v", sent)
+				}
+			case *HostNotSupportedError:
+				if !errors.As(err, &target) {
+					t.Errorf("expected the host not to be supported, got: %v", err)
+				}
+			default:
+				if !errors.Is(err, tt.err) {
+					t.Errorf("expected %v, got: %v", tt.err, err)
+				}
+			}
+			if served := b.Serves(tt.req); served != (tt.err == nil) {
+				t.Errorf("expected Serves to return %t, got %t", tt.err == nil, served)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package armbalancer
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// minIdleShrinkAfter is the shortest idle period accepted by the builder, which keeps the ticker's interval positive.
+const minIdleShrinkAfter = 10 * time.Millisecond
+
+// shrinkIdle periodically quiesces the transports that haven't been used for idleAfter, until done is closed.
+func (t *Balancer) shrinkIdle(idleAfter time.Duration, done <-chan struct{}) {
+	start := time.Now().UnixNano()
+	ticker := time.NewTicker(idleAfter / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			for _, p := range t.hosts {
+				for i, rt := range p.pool {
+					r, ok := rt.(*recyclableTransport)
+					if !ok {
+						continue
+					}
+					lastUsed := atomic.LoadInt64(&p.usage[i].lastUsed)
+					if lastUsed == 0 {
+						lastUsed = start
+					}
+					if atomic.LoadInt64(&p.usage[i].inflight) == 0 && now.UnixNano()-lastUsed >= int64(idleAfter) {
+						r.Quiesce()
+					}
+				}
+			}
+		}
+	}
+}
+
+// Quiesce closes the idle connections of the transport until it's used again.
+func (t *recyclableTransport) Quiesce() {
+	if !atomic.CompareAndSwapInt32(&t.quiesced, 0, 1) {
+		return
+	}
+	t.lock.Lock()
+	gen := t.current
+	t.lock.Unlock()
+	gen.tx.CloseIdleConnections()
+}
+
+// avoidQuiesced returns i, or the next slot among pool[lo:lo+n] that isn't quiesced if i is and the connection
+// budget doesn't allow reactivating it. It returns i when every slot is quiesced.
+func (t *hostPool) avoidQuiesced(lo, n, i int) int {
+	if !quiescedSlot(t.pool[i]) || t.budget.Delay() <= 0 {
+		return i
+	}
+	for j := 1; j < n; j++ {
+		if k := lo + (i-lo+j)%n; !quiescedSlot(t.pool[k]) {
+			return k
+		}
+	}
+	return i
+}
+
+func quiescedSlot(rt http.RoundTripper) bool {
+	r, ok := rt.(*recyclableTransport)
+	return ok && atomic.LoadInt32(&r.quiesced) == 1
+}
+
+// reactivate replaces the generation of a quiesced transport with a new one, so that its age and counters
+// don't carry over the idle period. The previous generation is closed once requests that raced with
+// quiescing it have completed.
+func (t *recyclableTransport) reactivate() {
+	t.lock.Lock()
+	select {
+	case <-t.done:
+		t.lock.Unlock()
+		return
+	default:
+	}
+	previous := t.current
+	previous.retired = time.Now()
+	t.current = t.newGeneration()
+	t.errors.Reset()
+	t.lock.Unlock()
+	previous.listeners.Drain()
+
+	go func() {
+		select {
+		case <-previous.inactive():
+		case <-t.done:
+		}
+		previous.tx.CloseIdleConnections()
+	}()
+}
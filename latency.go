@@ -0,0 +1,102 @@
+package armbalancer
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencySink is implemented by MetricsSinks that also record the latency of every pooled transport.
+// ObserveTransportLatency is called once a response's body has been closed or fully read, with the time to its
+// first byte and the total duration of the request.
+type LatencySink interface {
+	ObserveTransportLatency(hostport string, transportID int, ttfb, total time.Duration)
+}
+
+// ewmaWeight is the weight of every new sample of a latencyEstimate.
+const ewmaWeight = 0.2
+
+// latencyEstimate is an exponentially weighted moving average of durations, safe for concurrent use.
+type latencyEstimate struct {
+	nanos int64 // atomic, zero until the first sample
+}
+
+func (e *latencyEstimate) Observe(d time.Duration) {
+	if d <= 0 {
+		d = 1
+	}
+	for {
+		old := atomic.LoadInt64(&e.nanos)
+		next := int64(d)
+		if old != 0 {
+			next = old + int64(ewmaWeight*float64(int64(d)-old))
+		}
+		if atomic.CompareAndSwapInt64(&e.nanos, old, next) {
+			return
+		}
+	}
+}
+
+func (e *latencyEstimate) Value() time.Duration {
+	return time.Duration(atomic.LoadInt64(&e.nanos))
+}
+
+// traceLatency returns the request with a trace recording the time to its first response byte, and a function
+// recording both estimates of the slot once the request is complete, to be called with successful responses.
+// Transports that don't report the first response byte, such as custom ones, are measured until their response
+// is returned instead.
+func (t *hostPool) traceLatency(i int, req *http.Request) (*http.Request, func(resp *http.Response)) {
+	start := time.Now()
+	var firstByte int64 // atomic, unix nanos
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			atomic.CompareAndSwapInt64(&firstByte, 0, time.Now().UnixNano())
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	return req, func(resp *http.Response) {
+		atomic.CompareAndSwapInt64(&firstByte, 0, time.Now().UnixNano())
+		ttfb := time.Duration(atomic.LoadInt64(&firstByte) - start.UnixNano())
+		usage := &t.usage[i]
+		usage.ttfb.Observe(ttfb)
+
+		done := func() {
+			total := time.Since(start)
+			usage.duration.Observe(total)
+			if t.latencySink != nil {
+				t.latencySink.ObserveTransportLatency(net.JoinHostPort(t.host, t.port), i, ttfb, total)
+			}
+		}
+		if resp.Body == nil {
+			done()
+			return
+		}
+		resp.Body = &observeOnClose{ReadCloser: resp.Body, done: done}
+	}
+}
+
+// observeOnClose calls done once the body has been closed or fully read, like releaseOnClose.
+type observeOnClose struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (b *observeOnClose) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *observeOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
@@ -0,0 +1,158 @@
+package armbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+type latencySink struct {
+	recordingSink
+	lock    sync.Mutex
+	samples []time.Duration // ttfb, total pairs
+}
+
+func (s *latencySink) ObserveTransportLatency(hostport string, transportID int, ttfb, total time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.samples = append(s.samples, ttfb, total)
+}
+
+func TestTransportLatency(t *testing.T) {
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-headers" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/slow-body" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		io.WriteString(w, "done")
+	}))
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	tests := []struct {
+		path         string
+		slowTTFB     bool
+		slowDuration bool
+	}{
+		{path: "/slow-headers", slowTTFB: true, slowDuration: true},
+		{path: "/slow-body", slowDuration: true},
+		{path: "/"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			sink := &latencySink{}
+			b := New(Options{
+				Transport:   svr.Client().Transport.(*http.Transport),
+				Host:        u.Host,
+				PoolSize:    1,
+				MetricsSink: sink,
+			})
+			defer b.Close()
+
+			resp, err := b.RoundTrip(httptest.NewRequest(http.MethodGet, svr.URL+tc.path, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			ts := b.Stats().Transports[0]
+			if slow := ts.TTFB >= 100*time.Millisecond; slow != tc.slowTTFB {
+				t.Errorf("expected slow TTFB %t, got %s", tc.slowTTFB, ts.TTFB)
+			}
+			if slow := ts.Duration >= 100*time.Millisecond; slow != tc.slowDuration {
+				t.Errorf("expected slow duration %t, got %s", tc.slowDuration, ts.Duration)
+			}
+			if ts.Duration < ts.TTFB {
+				t.Errorf("expected the duration %s to include the TTFB %s", ts.Duration, ts.TTFB)
+			}
+			if len(sink.samples) != 2 || sink.samples[0] != ts.TTFB || sink.samples[1] != ts.Duration {
+				t.Errorf("expected the sink to observe %s and %s, got %v", ts.TTFB, ts.Duration, sink.samples)
+			}
+		})
+	}
+}
+
+func TestLatencyEstimate(t *testing.T) {
+	var e latencyEstimate
+	if e.Value() != 0 {
+		t.Fatalf("expected no estimate before the first sample, got %s", e.Value())
+	}
+	e.Observe(100 * time.Millisecond)
+	if e.Value() != 100*time.Millisecond {
+		t.Errorf("expected the first sample to be the estimate, got %s", e.Value())
+	}
+	e.Observe(200 * time.Millisecond)
+	if e.Value() != 120*time.Millisecond {
+		t.Errorf("expected the estimate to move by a fifth of the difference, got %s", e.Value())
+	}
+}
+
+func TestLowestLatencyPick(t *testing.T) {
+	p := &hostPool{pool: make([]http.RoundTripper, 3), strategy: LowestLatency, usage: make([]slotUsage, 3)}
+	p.usage[0].ttfb.Observe(50 * time.Millisecond)
+	p.usage[2].ttfb.Observe(10 * time.Millisecond)
+	if i := p.pick(0, 3, &p.cursor); i != 1 {
+		t.Errorf("expected the transport without an estimate to be tried first, got %d", i)
+	}
+
+	p.usage[1].ttfb.Observe(20 * time.Millisecond)
+	if i := p.pick(0, 3, &p.cursor); i != 2 {
+		t.Errorf("expected the transport with the lowest TTFB to be picked, got %d", i)
+	}
+	p.usage[2].inflight = 2
+	if i := p.pick(0, 3, &p.cursor); i != 1 {
+		t.Errorf("expected busy transports to be penalized, got %d", i)
+	}
+	if i := p.pick(0, 1, &p.cursor); i != 0 {
+		t.Errorf("expected the pick to stay within the given range, got %d", i)
+	}
+}
+
+func TestLowestLatencySelection(t *testing.T) {
+	slow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer slow.Close()
+	fast := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	u, _ := url.Parse(fast.URL)
+
+	servers := []*httptest.Server{slow, fast, fast}
+	served := make([]int, len(servers))
+	b := New(Options{
+		Host:              u.Host,
+		PoolSize:          len(servers),
+		SelectionStrategy: LowestLatency,
+		TransportFactory: func(id int, parent *http.Transport, host, port string, threshold, minReqs int64) http.RoundTripper {
+			svr := servers[id]
+			tx := svr.Client().Transport
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				served[id]++
+				req = req.Clone(req.Context())
+				req.URL.Host = svr.Listener.Addr().String()
+				return tx.RoundTrip(req)
+			})
+		},
+	})
+	defer b.Close()
+
+	for i := 0; i < 20; i++ {
+		resp, err := b.RoundTrip(httptest.NewRequest(http.MethodGet, fast.URL, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if served[0] != 1 {
+		t.Errorf("expected the slow transport to only be tried once, got %v", served)
+	}
+}
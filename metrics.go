@@ -0,0 +1,80 @@
+package armbalancer
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sampleWindowSize is the number of recent samples quantiles are computed over.
+const sampleWindowSize = 1024
+
+// MetricsSink receives measurements taken by the balancer.
+// Its methods are called synchronously from the request path and must be safe for concurrent use.
+type MetricsSink interface {
+	// ObserveAcquireWait is called with the time a request spent between entering the balancer
+	// and being dispatched on a connection, which includes waiting for a busy connection.
+	ObserveAcquireWait(d time.Duration)
+}
+
+// traceAcquireWait returns the request with a trace that records its acquire wait once it's dispatched.
+// Only the first connection counts when a request is hedged.
+func (t *Balancer) traceAcquireWait(req *http.Request) *http.Request {
+	start := time.Now()
+	var once sync.Once
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			once.Do(func() {
+				d := time.Since(start)
+				t.acquireWait.Add(d)
+				if t.metrics != nil {
+					t.metrics.ObserveAcquireWait(d)
+				}
+			})
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// sampleWindow keeps the most recent samples to estimate quantiles without a histogram.
+type sampleWindow struct {
+	lock    sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (w *sampleWindow) Add(d time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.samples) < sampleWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % sampleWindowSize
+}
+
+// Quantile returns the sample at the given quantile (between 0 and 1), or zero if there are no samples.
+func (w *sampleWindow) Quantile(q float64) time.Duration {
+	w.lock.Lock()
+	sorted := make([]time.Duration, len(w.samples))
+	copy(sorted, w.samples)
+	w.lock.Unlock()
+
+	if len(sorted) == 0 {
+		return 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// Nearest-rank method
+	rank := int(math.Ceil(q * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
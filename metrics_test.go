@@ -0,0 +1,90 @@
+package armbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingSink struct {
+	lock  sync.Mutex
+	waits []time.Duration
+}
+
+func (r *recordingSink) ObserveAcquireWait(d time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.waits = append(r.waits, d)
+}
+
+func TestAcquireWait(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer svr.Close()
+
+	sink := &recordingSink{}
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:   svr.Client().Transport.(*http.Transport),
+		Host:        u.Host,
+		PoolSize:    1,
+		MetricsSink: sink,
+	})
+	defer b.Close()
+	client := &http.Client{Transport: b}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(svr.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	// The pooled transport has a single HTTP/1 connection, so requests queue behind each other
+	if len(sink.waits) != 4 {
+		t.Fatalf("expected 4 observations, got %d", len(sink.waits))
+	}
+	stats := b.Stats()
+	if stats.AcquireWaitP99 < 250*time.Millisecond {
+		t.Errorf("expected the last request to have waited for the previous ones, got p99 %s", stats.AcquireWaitP99)
+	}
+	if stats.AcquireWaitP50 > stats.AcquireWaitP99 {
+		t.Errorf("expected p50 %s to be lower than p99 %s", stats.AcquireWaitP50, stats.AcquireWaitP99)
+	}
+}
+
+func TestSampleWindow(t *testing.T) {
+	var w sampleWindow
+	if q := w.Quantile(0.5); q != 0 {
+		t.Errorf("expected zero for an empty window, got %s", q)
+	}
+	for i := 1; i <= 100; i++ {
+		w.Add(time.Duration(i))
+	}
+	if q := w.Quantile(0.5); q != 50 {
+		t.Errorf("expected p50 of 50, got %d", q)
+	}
+	if q := w.Quantile(0.99); q != 99 {
+		t.Errorf("expected p99 of 99, got %d", q)
+	}
+
+	// Older samples are evicted once the window is full
+	for i := 0; i < sampleWindowSize; i++ {
+		w.Add(time.Second)
+	}
+	if q := w.Quantile(0); q != time.Second {
+		t.Errorf("expected old samples to be evicted, got min %s", q)
+	}
+}
@@ -0,0 +1,99 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// PaginationThrottledError is returned by Paginate when the remaining quota falls below PageOptions.Floor and
+// PageOptions.Delay is zero. Paging can be resumed later by passing Next as the first request.
+type PaginationThrottledError struct {
+	Bucket    string
+	Remaining int64
+	Next      *http.Request
+}
+
+func (e *PaginationThrottledError) Error() string {
+	return fmt.Sprintf("armbalancer: pagination stopped since %d requests remain in bucket %q", e.Remaining, e.Bucket)
+}
+
+// PageOptions configures how Paginate reacts to quota depletion between pages.
+type PageOptions struct {
+	// Bucket is the rate limiting bucket consulted between pages.
+	// Default: Subscription-Reads
+	Bucket string
+
+	// Floor is the remaining quota below which paging is slowed down by Delay, or stopped.
+	// Default: 100
+	Floor int64
+
+	// Delay is how long to wait before each page while the remaining quota is below Floor.
+	// Zero stops paging with a *PaginationThrottledError instead.
+	Delay time.Duration
+}
+
+// Paginate sends firstReq and then every request returned by next, until it returns a nil request, using
+// the default PageOptions. See PageOptions.Paginate.
+func Paginate(ctx context.Context, client *http.Client, firstReq *http.Request, next func(resp *http.Response) (*http.Request, error)) error {
+	return PageOptions{}.Paginate(ctx, client, firstReq, next)
+}
+
+// Paginate sends firstReq and then every request returned by next, until it returns a nil request or an error.
+// next is given the response of every page, whose body is closed once it returns. Between pages, the remaining
+// quota of Bucket tracked by the balancer serving the client is compared to Floor. The client's transport must be
+// a Balancer, ClientTransport or ReplaceableTransport.
+func (o PageOptions) Paginate(ctx context.Context, client *http.Client, firstReq *http.Request, next func(resp *http.Response) (*http.Request, error)) error {
+	b := clientBalancer(client)
+	if b == nil {
+		return errors.New("armbalancer: the client's transport isn't a balancer")
+	}
+	if o.Bucket == "" {
+		o.Bucket = "Subscription-Reads"
+	}
+	if o.Floor == 0 {
+		o.Floor = 100
+	}
+
+	req := firstReq
+	for page := 0; req != nil; page++ {
+		if page > 0 {
+			if remaining, ok := b.Remaining(o.Bucket); ok && remaining < o.Floor {
+				if o.Delay <= 0 {
+					return &PaginationThrottledError{Bucket: o.Bucket, Remaining: remaining, Next: req}
+				}
+				select {
+				case <-time.After(o.Delay):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		req, err = next(resp)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clientBalancer returns the balancer serving the client's requests, or nil if there's none.
+func clientBalancer(client *http.Client) *Balancer {
+	switch rt := client.Transport.(type) {
+	case *Balancer:
+		return rt
+	case *ClientTransport:
+		return rt.Balancer
+	case *ReplaceableTransport:
+		return rt.Load()
+	}
+	return nil
+}
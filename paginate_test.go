@@ -0,0 +1,95 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPaginate(t *testing.T) {
+	// Every page costs a read, and links to the next one until page 8
+	var remaining int64 = 104
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", strconv.FormatInt(atomic.AddInt64(&remaining, -1), 10))
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 8 {
+			fmt.Fprintf(w, "%s/vms?page=%d", "https://"+r.Host, page+1)
+		}
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	b := New(Options{
+		Transport:     svr.Client().Transport.(*http.Transport),
+		Host:          u.Host,
+		PoolSize:      1,
+		RecyclePolicy: RecyclePolicyFunc(func(ConnSnapshot) bool { return false }),
+	})
+	defer b.Close()
+	client := &http.Client{Transport: b}
+
+	var pages []string
+	next := func(resp *http.Response) (*http.Request, error) {
+		pages = append(pages, resp.Request.URL.Query().Get("page"))
+		link, err := io.ReadAll(resp.Body)
+		if err != nil || len(link) == 0 {
+			return nil, err
+		}
+		return http.NewRequest("GET", string(link), nil)
+	}
+
+	first, _ := http.NewRequest("GET", svr.URL+"/vms?page=1", nil)
+	err := Paginate(context.Background(), client, first, next)
+	var throttled *PaginationThrottledError
+	if !errors.As(err, &throttled) {
+		t.Fatalf("expected paging to stop once below the floor, got: %v", err)
+	}
+	if throttled.Remaining != 99 || throttled.Bucket != "Subscription-Reads" || throttled.Next.URL.Query().Get("page") != "6" {
+		t.Errorf("unexpected error %+v", throttled)
+	}
+	if fmt.Sprint(pages) != "[1 2 3 4 5]" {
+		t.Errorf("expected pages 1 to 5, got %v", pages)
+	}
+	if remaining, _ := b.Remaining("subscription-reads"); remaining != 99 {
+		t.Errorf("expected the tracked quota to be 99, got %d", remaining)
+	}
+
+	// Resume from the continuation, slowing down instead of stopping
+	pages = nil
+	start := time.Now()
+	if err := (PageOptions{Delay: 20 * time.Millisecond}).Paginate(context.Background(), client, throttled.Next, next); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(pages) != "[6 7 8]" {
+		t.Errorf("expected pages 6 to 8, got %v", pages)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected the pages after the first to be delayed, took %s", elapsed)
+	}
+
+	// Above the floor, pages aren't delayed
+	pages = nil
+	err = (PageOptions{Floor: 50, Delay: time.Hour}).Paginate(context.Background(), client, first, next)
+	if err != nil || len(pages) != 8 {
+		t.Errorf("expected all pages to be fetched right away, got %v: %v", pages, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := (PageOptions{Delay: time.Hour}).Paginate(ctx, client, first, next); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the context's error, got: %v", err)
+	}
+	if err := Paginate(context.Background(), http.DefaultClient, first, next); err == nil {
+		t.Error("expected clients without a balancer to be rejected")
+	}
+}
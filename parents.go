@@ -0,0 +1,70 @@
+package armbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// SharedParentError is returned by Build when another balancer that hasn't been shut down already wraps the
+// same parent transport for one of the hosts. The pooled transports are clones of their parent, but the
+// balancers would still contend for its idle connection limits, which is hard to debug.
+type SharedParentError struct {
+	Host string // host:port
+}
+
+func (e *SharedParentError) Error() string {
+	return fmt.Sprintf("armbalancer: the parent transport of host %s is already wrapped by another balancer, "+
+		"share that balancer, clone the transport or set Options.AllowSharedParent", e.Host)
+}
+
+// parentClaim is a parent transport wrapped by a balancer for a host:port.
+type parentClaim struct {
+	parent   *http.Transport
+	hostport string
+}
+
+// parentClaims holds the claims of every balancer of the process that hasn't been shut down.
+var parentClaims = struct {
+	sync.Mutex
+	claimed map[parentClaim]bool
+}{claimed: make(map[parentClaim]bool)}
+
+// claimParents records the parent transport of every host, failing if one is already claimed by another balancer.
+// http.DefaultTransport, the default parent, is never claimed.
+func (t *Balancer) claimParents(hosts []builderHost, parent *http.Transport) error {
+	claims := make(map[parentClaim]bool)
+	for _, h := range hosts {
+		c := parentClaim{parent: parent, hostport: net.JoinHostPort(h.host, h.port)}
+		if h.opts.Transport != nil {
+			c.parent = h.opts.Transport
+		}
+		if c.parent != http.DefaultTransport {
+			claims[c] = true
+		}
+	}
+
+	parentClaims.Lock()
+	defer parentClaims.Unlock()
+	for c := range claims {
+		if parentClaims.claimed[c] {
+			return &SharedParentError{Host: c.hostport}
+		}
+	}
+	for c := range claims {
+		parentClaims.claimed[c] = true
+		t.claims = append(t.claims, c)
+	}
+	return nil
+}
+
+// releaseParents releases the claims of the balancer, once it's shut down.
+func (t *Balancer) releaseParents() {
+	parentClaims.Lock()
+	defer parentClaims.Unlock()
+	for _, c := range t.claims {
+		delete(parentClaims.claimed, c)
+	}
+	t.claims = nil
+}
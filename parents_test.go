@@ -0,0 +1,73 @@
+package armbalancer
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestSharedParent(t *testing.T) {
+	parent := &http.Transport{}
+	build := func(opts Options, hosts ...string) (*Balancer, error) {
+		b := NewBuilder(parent).WithOptions(opts)
+		for _, host := range hosts {
+			b.AddHost(host, HostOptions{})
+		}
+		return b.Build()
+	}
+
+	first, err := build(Options{}, "management.azure.com", "eastus.management.azure.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = build(Options{}, "westus.management.azure.com", "eastus.management.azure.com:443")
+	var shared *SharedParentError
+	if !errors.As(err, &shared) || shared.Host != "eastus.management.azure.com:443" {
+		t.Fatalf("expected the overlapping host to be reported, got: %v", err)
+	}
+
+	// The failed build didn't claim its other host
+	other, err := build(Options{}, "westus.management.azure.com")
+	if err != nil {
+		t.Fatalf("expected a host that doesn't overlap to be allowed, got: %s", err)
+	}
+	other.Close()
+
+	allowed, err := build(Options{AllowSharedParent: true}, "management.azure.com")
+	if err != nil {
+		t.Fatalf("expected AllowSharedParent to allow the overlap, got: %s", err)
+	}
+	allowed.Close()
+
+	first.Close()
+	second, err := build(Options{}, "management.azure.com")
+	if err != nil {
+		t.Fatalf("expected the parent to be released by shutdown, got: %s", err)
+	}
+	second.Close()
+}
+
+func TestSharedParentPerHost(t *testing.T) {
+	parent := &http.Transport{}
+	first, err := NewBuilder(nil).
+		AddHost("management.azure.com", HostOptions{Transport: parent}).
+		AddHost("management.azure.com", HostOptions{Transport: parent, Audience: "https://management.core.windows.net/"}).
+		Build()
+	if err != nil {
+		t.Fatalf("expected pools of the same balancer to share their parent, got: %s", err)
+	}
+	defer first.Close()
+
+	if _, err := NewBuilder(parent).Build(); !errors.As(err, new(*SharedParentError)) {
+		t.Errorf("expected the host transport to be claimed, got: %v", err)
+	}
+
+	// The default parent is shared by every balancer built without one
+	for i := 0; i < 2; i++ {
+		b, err := NewBuilder(nil).Build()
+		if err != nil {
+			t.Fatalf("expected http.DefaultTransport to be shared, got: %s", err)
+		}
+		defer b.Close()
+	}
+}
@@ -0,0 +1,24 @@
+package armbalancer
+
+import "net/http"
+
+// NewPassthrough returns a balancer that forwards every request to parent unmodified, e.g. to disable balancing
+// against a local emulator without changing the code wiring the balancer. It has no pools: Stats returns zeroed data,
+// OnRecycle is never called, and Close only closes the parent's idle connections. Requests still fail with ErrClosed
+// once it has been closed. A nil parent defaults to http.DefaultTransport.
+func NewPassthrough(parent http.RoundTripper) *Balancer {
+	if parent == nil {
+		parent = http.DefaultTransport
+	}
+	return &Balancer{
+		reservations: newReservationLedger(),
+		recent:       newRecycleLog(1),
+		passthrough:  parent,
+	}
+}
+
+func (t *Balancer) closePassthrough() {
+	if c, ok := t.passthrough.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,74 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type countingTransport struct {
+	requests []*http.Request
+	closed   int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.requests = append(c.requests, req)
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+}
+
+func (c *countingTransport) CloseIdleConnections() {
+	c.closed++
+}
+
+func TestPassthrough(t *testing.T) {
+	parent := &countingTransport{}
+	b := NewPassthrough(parent)
+
+	req, _ := http.NewRequestWithContext(WithBypass(context.Background()), "GET", "https://emulator.local:8443/subscriptions", nil)
+	resp, err := b.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(parent.requests) != 1 || parent.requests[0] != req {
+		t.Errorf("expected the request to be forwarded unmodified, got %v", parent.requests)
+	}
+
+	// every other method behaves like a balancer without pools
+	if s := b.Stats(); len(s.Transports) != 0 || s.BypassedRequests != 0 {
+		t.Errorf("expected zeroed stats, got %+v", s)
+	}
+	if hosts := b.SupportedHosts(); len(hosts) != 0 {
+		t.Errorf("expected no supported hosts, got %v", hosts)
+	}
+	if records := b.RecentRecycles(); len(records) != 0 {
+		t.Errorf("expected no recycles, got %v", records)
+	}
+	if _, err := b.Reserve("Subscription-Reads", 1); !errors.Is(err, ErrInsufficientQuota) {
+		t.Errorf("expected reservations to fail with ErrInsufficientQuota, got: %v", err)
+	}
+	b.SetDryRun(true)
+	if err := b.SetHostWeights(nil); err != nil {
+		t.Error(err)
+	}
+	if err := b.SetHostEnabled("emulator.local:8443", false); err == nil {
+		t.Error("expected disabling an unknown host to fail")
+	}
+	if err := b.ForceRecycleAll(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Error(err)
+	}
+	if parent.closed != 1 {
+		t.Errorf("expected the parent's idle connections to be closed once, got %d", parent.closed)
+	}
+	if _, err := b.RoundTrip(req); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed once closed, got: %v", err)
+	}
+	if err := b.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,185 @@
+package armbalancer
+
+import (
+	"strings"
+	"time"
+)
+
+// ConnSnapshot describes the state of a pooled transport's current connection at the time a recycle is considered.
+type ConnSnapshot struct {
+	TransportID int
+	Generation  int64
+
+	// Remaining holds the latest value of every X-Ms-Ratelimit-Remaining-* header seen, keyed by the header suffix.
+	// Principal-scoped buckets are excluded unless Options.GlobalBucketBehavior is GlobalBucketsRecycle.
+	Remaining map[string]int64
+
+	// Global holds the latest value of the principal-scoped buckets, such as Subscription-Global-Reads or Tenant-Reads.
+	Global map[string]int64
+
+	// Version counts the responses applied to Remaining and Global over the transport's lifetime.
+	// Both maps are read together, so they always reflect the same responses.
+	Version uint64
+
+	// Requests is the number of requests sent over the connection, weighted by Options.RequestWeight.
+	Requests int64
+
+	// Age is the time since the connection's transport was created.
+	Age time.Duration
+
+	Errors ErrorCounters
+
+	sent int64 // unweighted Requests
+}
+
+// GlobalBucketBehavior controls how the principal-scoped buckets of ARM's token-bucket throttling are treated.
+type GlobalBucketBehavior int
+
+const (
+	// GlobalBucketsIgnored excludes principal-scoped buckets from ConnSnapshot.Remaining.
+	GlobalBucketsIgnored GlobalBucketBehavior = iota
+
+	// GlobalBucketsRecycle includes principal-scoped buckets in ConnSnapshot.Remaining,
+	// so that the recycle policy treats them like any other bucket.
+	GlobalBucketsRecycle
+)
+
+// RecyclePolicy decides when a pooled transport's connection should be re-established.
+// ShouldRecycle is called after every response or failed request and must be safe for concurrent use.
+// The maps of the snapshot are never nil. Connections that are reset are recycled without consulting the policy.
+type RecyclePolicy interface {
+	ShouldRecycle(s ConnSnapshot) bool
+}
+
+// RecyclePolicyFunc adapts an ordinary function to the RecyclePolicy interface.
+type RecyclePolicyFunc func(s ConnSnapshot) bool
+
+func (f RecyclePolicyFunc) ShouldRecycle(s ConnSnapshot) bool { return f(s) }
+
+// reachedThreshold reports whether a remaining quota calls for a recycle. Thresholds are inclusive everywhere:
+// a bucket reporting exactly the threshold recycles its connection.
+func reachedThreshold(remaining, threshold int64) bool {
+	return remaining <= threshold
+}
+
+// DefaultRecyclePolicy is the policy used when Options.RecyclePolicy is nil.
+// It recycles once any rate limit bucket drops to Threshold or below,
+// as long as at least MinRequests have been sent over the connection.
+// Connections older than MaxAge are recycled regardless, unless MaxAge is zero.
+type DefaultRecyclePolicy struct {
+	Threshold   int64
+	MinRequests int64
+	MaxAge      time.Duration
+}
+
+func (p DefaultRecyclePolicy) ShouldRecycle(s ConnSnapshot) bool {
+	if p.MaxAge > 0 && s.Age >= p.MaxAge {
+		return true
+	}
+	if s.Requests < p.MinRequests {
+		return false
+	}
+	for _, val := range s.Remaining {
+		if reachedThreshold(val, p.Threshold) {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectiveThrottledPolicy is like DefaultRecyclePolicy, but only considers some of the rate limit buckets
+// and supports a threshold per bucket. It prevents small buckets, such as the -Resource-Requests ones,
+// from dominating recycle decisions.
+type SelectiveThrottledPolicy struct {
+	// Buckets lists the suffixes of the buckets considered, such as "Subscription-Writes" or "-Writes", ignoring case.
+	// Every bucket is considered when empty.
+	Buckets []string
+
+	// Thresholds overrides Threshold for the buckets ending with each key, ignoring case.
+	// The longest matching key applies.
+	Thresholds map[string]int64
+
+	Threshold   int64
+	MinRequests int64
+}
+
+func (p SelectiveThrottledPolicy) ShouldRecycle(s ConnSnapshot) bool {
+	if s.Requests < p.MinRequests {
+		return false
+	}
+	for bucket, val := range s.Remaining {
+		if p.selected(bucket) && reachedThreshold(val, p.threshold(bucket)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p SelectiveThrottledPolicy) selected(bucket string) bool {
+	if len(p.Buckets) == 0 {
+		return true
+	}
+	for _, suffix := range p.Buckets {
+		if hasSuffixFold(bucket, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p SelectiveThrottledPolicy) threshold(bucket string) int64 {
+	threshold, longest := p.Threshold, -1
+	for suffix, val := range p.Thresholds {
+		if len(suffix) > longest && hasSuffixFold(bucket, suffix) {
+			threshold, longest = val, len(suffix)
+		}
+	}
+	return threshold
+}
+
+// protectedBuckets returns the suffixes of the buckets a policy explicitly relies on.
+func protectedBuckets(policy RecyclePolicy) []string {
+	switch p := policy.(type) {
+	case SelectiveThrottledPolicy:
+		suffixes := append([]string(nil), p.Buckets...)
+		for suffix := range p.Thresholds {
+			suffixes = append(suffixes, suffix)
+		}
+		return suffixes
+	case *SelectiveThrottledPolicy:
+		return protectedBuckets(*p)
+	case CompositeRecyclePolicy:
+		var suffixes []string
+		for _, child := range p.Policies {
+			suffixes = append(suffixes, protectedBuckets(child)...)
+		}
+		return suffixes
+	case *CompositeRecyclePolicy:
+		return protectedBuckets(*p)
+	default:
+		return nil
+	}
+}
+
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+// CompositeRecyclePolicy combines several policies. By default it recycles when any of them would,
+// or only when all of them agree if RequireAll is set.
+type CompositeRecyclePolicy struct {
+	Policies   []RecyclePolicy
+	RequireAll bool
+}
+
+func (p CompositeRecyclePolicy) ShouldRecycle(s ConnSnapshot) bool {
+	if len(p.Policies) == 0 {
+		return false
+	}
+	for _, policy := range p.Policies {
+		if policy.ShouldRecycle(s) != p.RequireAll {
+			return !p.RequireAll
+		}
+	}
+	return p.RequireAll
+}
@@ -0,0 +1,268 @@
+package armbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDefaultRecyclePolicy(t *testing.T) {
+	policy := DefaultRecyclePolicy{Threshold: 100, MinRequests: 10}
+	tests := []struct {
+		name     string
+		policy   DefaultRecyclePolicy
+		snapshot ConnSnapshot
+		want     bool
+	}{
+		{
+			name:     "no headers",
+			snapshot: ConnSnapshot{Requests: 20},
+			want:     false,
+		},
+		{
+			name:     "above threshold",
+			snapshot: ConnSnapshot{Requests: 20, Remaining: map[string]int64{"Subscription-Reads": 101}},
+			want:     false,
+		},
+		{
+			name:     "at threshold",
+			snapshot: ConnSnapshot{Requests: 20, Remaining: map[string]int64{"Subscription-Reads": 101, "Subscription-Writes": 100}},
+			want:     true,
+		},
+		{
+			name:     "below min requests",
+			snapshot: ConnSnapshot{Requests: 9, Remaining: map[string]int64{"Subscription-Reads": 0}},
+			want:     false,
+		},
+		{
+			name:     "max age disabled",
+			snapshot: ConnSnapshot{Requests: 1, Age: time.Hour},
+			want:     false,
+		},
+		{
+			name:     "max age exceeded",
+			policy:   DefaultRecyclePolicy{Threshold: 100, MinRequests: 10, MaxAge: time.Minute},
+			snapshot: ConnSnapshot{Requests: 1, Age: time.Hour},
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := policy
+			if tt.policy != (DefaultRecyclePolicy{}) {
+				policy = tt.policy
+			}
+			if got := policy.ShouldRecycle(tt.snapshot); got != tt.want {
+				t.Errorf("ShouldRecycle() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectiveThrottledPolicy(t *testing.T) {
+	policy := SelectiveThrottledPolicy{
+		Buckets:     []string{"-Reads", "subscription-writes"},
+		Thresholds:  map[string]int64{"Writes": 10, "Subscription-Writes": 5},
+		Threshold:   100,
+		MinRequests: 10,
+	}
+	tests := []struct {
+		name      string
+		remaining map[string]int64
+		requests  int64
+		want      bool
+	}{
+		{name: "ignored bucket depleted", remaining: map[string]int64{"Subscription-Resource-Requests": 0, "Subscription-Reads": 1000}, want: false},
+		{name: "selected bucket at default threshold", remaining: map[string]int64{"Subscription-Reads": 100}, want: true},
+		{name: "selected bucket above its threshold", remaining: map[string]int64{"Subscription-Writes": 6}, want: false},
+		{name: "selected bucket at longest matching threshold", remaining: map[string]int64{"Subscription-Writes": 5}, want: true},
+		{name: "below min requests", remaining: map[string]int64{"Subscription-Reads": 0}, requests: 9, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := tt.requests
+			if requests == 0 {
+				requests = 20
+			}
+			if got := policy.ShouldRecycle(ConnSnapshot{Requests: requests, Remaining: tt.remaining}); got != tt.want {
+				t.Errorf("ShouldRecycle() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectiveThrottledPolicyRetainsTransport(t *testing.T) {
+	policy := SelectiveThrottledPolicy{Buckets: []string{"Subscription-Writes"}, Threshold: 10}
+	r, log := newFakeRecyclableTransport(policy, func(int64) http.Header {
+		h := http.Header{}
+		h.Set("X-Ms-Ratelimit-Remaining-Subscription-Resource-Requests", "0")
+		h.Set("X-Ms-Ratelimit-Remaining-Subscription-Writes", "1000")
+		return h
+	})
+	defer r.Close(false)
+
+	for i := 0; i < 3; i++ {
+		sendFake(t, r)
+		log.expect(t, "decide 1: false")
+	}
+	if s := r.Stats(); s.Generation != 1 || s.Recycles != 0 {
+		t.Errorf("expected the transport to be retained while only an ignored bucket is depleted, got %+v", s)
+	}
+}
+
+func TestCompositeRecyclePolicy(t *testing.T) {
+	yes := RecyclePolicyFunc(func(ConnSnapshot) bool { return true })
+	no := RecyclePolicyFunc(func(ConnSnapshot) bool { return false })
+
+	tests := []struct {
+		name   string
+		policy CompositeRecyclePolicy
+		want   bool
+	}{
+		{name: "empty", policy: CompositeRecyclePolicy{}, want: false},
+		{name: "any with one match", policy: CompositeRecyclePolicy{Policies: []RecyclePolicy{no, yes}}, want: true},
+		{name: "any without match", policy: CompositeRecyclePolicy{Policies: []RecyclePolicy{no, no}}, want: false},
+		{name: "all with one match", policy: CompositeRecyclePolicy{Policies: []RecyclePolicy{no, yes}, RequireAll: true}, want: false},
+		{name: "all with all matching", policy: CompositeRecyclePolicy{Policies: []RecyclePolicy{yes, yes}, RequireAll: true}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.ShouldRecycle(ConnSnapshot{}); got != tt.want {
+				t.Errorf("ShouldRecycle() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCustomRecyclePolicy(t *testing.T) {
+	var lock sync.Mutex
+	reqCountByAddr := map[string]int{}
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		reqCountByAddr[r.RemoteAddr]++
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Writes", "1000")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	var snapshots []ConnSnapshot
+	u, _ := url.Parse(svr.URL)
+	client := &http.Client{Transport: New(Options{
+		Transport: svr.Client().Transport.(*http.Transport),
+		Host:      u.Host,
+		PoolSize:  1,
+		RecyclePolicy: RecyclePolicyFunc(func(s ConnSnapshot) bool {
+			lock.Lock()
+			defer lock.Unlock()
+			snapshots = append(snapshots, s)
+			return s.Requests >= 3
+		}),
+	})}
+
+	for i := 0; i < 30; i++ {
+		resp, err := client.Get(svr.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(reqCountByAddr) < 3 {
+		t.Errorf("expected the custom policy to recycle connections, only %d were created", len(reqCountByAddr))
+	}
+	if len(snapshots) == 0 {
+		t.Fatal("expected the custom policy to be consulted")
+	}
+	last := snapshots[len(snapshots)-1]
+	if last.Remaining["Subscription-Writes"] != 1000 || last.Age <= 0 {
+		t.Errorf("unexpected snapshot: %+v", last)
+	}
+}
+
+func TestGlobalBuckets(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "1000")
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Global-Reads", "5")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	for _, behavior := range []GlobalBucketBehavior{GlobalBucketsIgnored, GlobalBucketsRecycle} {
+		var lock sync.Mutex
+		var events []RecycleEvent
+		u, _ := url.Parse(svr.URL)
+		b := New(Options{
+			Transport:            svr.Client().Transport.(*http.Transport),
+			Host:                 u.Host,
+			PoolSize:             1,
+			MinReqsBeforeRecycle: 1,
+			GlobalBucketBehavior: behavior,
+			OnRecycle: func(e RecycleEvent) {
+				lock.Lock()
+				defer lock.Unlock()
+				events = append(events, e)
+			},
+		})
+		for i := 0; i < 3; i++ {
+			resp, err := (&http.Client{Transport: b}).Get(svr.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+
+		s := b.hosts[0].pool[0].(*recyclableTransport).Snapshot()
+		if s.Global["Subscription-Global-Reads"] != 5 || s.Remaining["Subscription-Reads"] != 1000 {
+			t.Errorf("expected both bucket families to be tracked, got %+v", s)
+		}
+		if r, err := b.Reserve("subscription-global-reads", 5); err != nil {
+			t.Errorf("expected global buckets to be available for reservations, got: %s", err)
+		} else {
+			r.Release()
+		}
+
+		switch behavior {
+		case GlobalBucketsIgnored:
+			if _, ok := s.Remaining["Subscription-Global-Reads"]; ok {
+				t.Errorf("expected global buckets to be excluded from the recycle policy's view, got %+v", s.Remaining)
+			}
+			time.Sleep(50 * time.Millisecond)
+			lock.Lock()
+			if len(events) != 0 {
+				t.Errorf("expected no recycles, got %d", len(events))
+			}
+			lock.Unlock()
+		case GlobalBucketsRecycle:
+			waitFor(t, "a recycle caused by the global bucket", func() bool {
+				lock.Lock()
+				defer lock.Unlock()
+				return len(events) > 0
+			})
+		}
+		b.Close()
+	}
+}
+
+func TestThresholdBoundaries(t *testing.T) {
+	policies := map[string]RecyclePolicy{
+		"default":            DefaultRecyclePolicy{Threshold: 100},
+		"selective":          SelectiveThrottledPolicy{Threshold: 100},
+		"selective override": SelectiveThrottledPolicy{Threshold: 5, Thresholds: map[string]int64{"Reads": 100}},
+	}
+	for name, policy := range policies {
+		for remaining, want := range map[int64]bool{99: true, 100: true, 101: false} {
+			s := ConnSnapshot{Requests: 1, Remaining: map[string]int64{"Subscription-Reads": remaining}}
+			if got := policy.ShouldRecycle(s); got != want {
+				t.Errorf("%s policy: expected a recycle %t with %d remaining, got %t", name, want, remaining, got)
+			}
+		}
+	}
+}
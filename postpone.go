@@ -0,0 +1,46 @@
+package armbalancer
+
+import "sync/atomic"
+
+// recyclePostponer holds back non-urgent recycles while most of the pool is busy, since a recycle
+// momentarily reduces its capacity.
+type recyclePostponer struct {
+	utilization float64
+	floor       int64
+	busy        func(id int) float64 // fraction of the pool's other transports with requests in flight
+
+	reported int64 // last generation a postponed recycle was reported for, only used from the recycling goroutine
+}
+
+// Postpone returns true if the recycle of the snapshot's connection should be postponed,
+// and whether it's the first time it is for that connection.
+func (p *recyclePostponer) Postpone(s ConnSnapshot) (postpone, first bool) {
+	if p == nil {
+		return false, false
+	}
+	for _, val := range s.Remaining {
+		if val <= p.floor {
+			return false, false
+		}
+	}
+	if p.busy(s.TransportID) <= p.utilization {
+		return false, false
+	}
+	first = p.reported != s.Generation
+	p.reported = s.Generation
+	return true, first
+}
+
+// busy returns the fraction of the pool's transports other than id that have requests in flight.
+func (t *hostPool) busy(id int) float64 {
+	if len(t.usage) < 2 {
+		return 0
+	}
+	var n int
+	for i := range t.usage {
+		if i != id && atomic.LoadInt64(&t.usage[i].inflight) > 0 {
+			n++
+		}
+	}
+	return float64(n) / float64(len(t.usage)-1)
+}
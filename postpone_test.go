@@ -0,0 +1,88 @@
+package armbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPostponeRecycles(t *testing.T) {
+	slow := make(chan struct{})
+	release := make(chan struct{})
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			close(slow)
+			<-release
+		case "/panic":
+			w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "5")
+			return
+		}
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "50")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	events := make(chan RecycleEvent, 100)
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:               svr.Client().Transport.(*http.Transport),
+		Host:                    u.Host,
+		PoolSize:                3,
+		MinReqsBeforeRecycle:    1,
+		PostponeRecyclesAbove:   0.3,
+		RecyclePanicFloor:       10,
+		ChurnBackoffGenerations: -1,
+		OnRecycle:               func(e RecycleEvent) { events <- e },
+	})
+	defer b.Close()
+
+	send := func(path string) {
+		req, _ := http.NewRequest("GET", svr.URL+path, nil)
+		resp, err := b.RoundTrip(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	}
+	next := func() RecycleEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a recycle event")
+			return RecycleEvent{}
+		}
+	}
+
+	// Round robin sends the requests to transports 1, 2, 0, 1, 2
+	go send("/slow")
+	<-slow
+
+	send("/")
+	if e := next(); e.TransportID != 2 || !e.Postponed {
+		t.Errorf("expected the recycle to be postponed while another transport is busy, got %+v", e)
+	}
+
+	send("/panic")
+	if e := next(); e.TransportID != 0 || e.Postponed {
+		t.Errorf("expected the recycle not to be postponed below the panic floor, got %+v", e)
+	}
+
+	close(release)
+	if e := next(); e.TransportID != 1 || e.Postponed {
+		t.Errorf("expected the slow request's transport to be recycled once the pool is idle, got %+v", e)
+	}
+	send("/")
+	if e := next(); e.TransportID != 1 {
+		t.Errorf("expected transport 1 to be recycled again, got %+v", e)
+	}
+	send("/")
+	if e := next(); e.TransportID != 2 || e.Postponed {
+		t.Errorf("expected the postponed recycle to happen once load subsided, got %+v", e)
+	}
+}
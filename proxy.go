@@ -0,0 +1,39 @@
+package armbalancer
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// pinProxy makes the transport's Proxy function, if any, resolve the proxy once per generation, using the first
+// request it's called for. A pooled transport holds a single connection, whose rate limiting headers would otherwise
+// describe a mix of backends when requests resolve to different proxies, e.g. based on their context.
+// Proxy errors aren't pinned, so that the next request resolves the proxy again.
+func pinProxy(tx *http.Transport, gen *generation) {
+	if tx.Proxy == nil {
+		return
+	}
+	resolve := tx.Proxy
+	var (
+		lock   sync.Mutex
+		pinned bool
+		proxy  *url.URL
+	)
+	tx.Proxy = func(req *http.Request) (*url.URL, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if pinned {
+			return proxy, nil
+		}
+		u, err := resolve(req)
+		if err != nil {
+			return nil, err
+		}
+		pinned, proxy = true, u
+		if u != nil {
+			gen.proxy.Store(u.Redacted())
+		}
+		return u, nil
+	}
+}
@@ -0,0 +1,79 @@
+package armbalancer
+
+import (
+	"sync"
+	"time"
+)
+
+// RecycleRecord describes a recent recycle, see Balancer.RecentRecycles.
+type RecycleRecord struct {
+	Time        time.Time
+	Host        string // host:port
+	TransportID int
+	Generation  int64 // of the connection that was recycled
+	Reason      RecycleReason
+	DryRun      bool
+	Postponed   bool
+
+	// Bucket and Remaining identify the bucket with the lowest remaining quota at the time of the recycle.
+	// Bucket is empty if no quota had been reported.
+	Bucket    string
+	Remaining int64
+
+	// Requests is the number of requests served by the recycled connection.
+	Requests int64
+}
+
+// recycleLog keeps the most recent recycle records in a fixed-size ring buffer.
+type recycleLog struct {
+	lock    sync.Mutex
+	records []RecycleRecord
+	next    int
+	size    int
+}
+
+func newRecycleLog(size int) *recycleLog {
+	return &recycleLog{size: size}
+}
+
+func (l *recycleLog) Add(host string, e RecycleEvent) {
+	record := RecycleRecord{
+		Time:        time.Now(),
+		Host:        host,
+		TransportID: e.TransportID,
+		Generation:  e.Generation,
+		Reason:      e.Reason,
+		DryRun:      e.DryRun,
+		Postponed:   e.Postponed,
+		Requests:    e.Snapshot.Requests,
+	}
+	for bucket, val := range e.Snapshot.Remaining {
+		if record.Bucket == "" || val < record.Remaining || (val == record.Remaining && bucket < record.Bucket) {
+			record.Bucket, record.Remaining = bucket, val
+		}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.records) < l.size {
+		l.records = append(l.records, record)
+		return
+	}
+	l.records[l.next] = record
+	l.next = (l.next + 1) % l.size
+}
+
+// Records returns the records from oldest to newest.
+func (l *recycleLog) Records() []RecycleRecord {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	records := make([]RecycleRecord, 0, len(l.records))
+	records = append(records, l.records[l.next:]...)
+	return append(records, l.records[:l.next]...)
+}
+
+// RecentRecycles returns the most recent recycles of every pooled transport, including those skipped
+// in dry-run mode, from oldest to newest. The number of records kept is set by Options.RecentRecyclesSize.
+func (t *Balancer) RecentRecycles() []RecycleRecord {
+	return t.recent.Records()
+}
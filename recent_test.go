@@ -0,0 +1,78 @@
+package armbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRecycleLog(t *testing.T) {
+	l := newRecycleLog(3)
+	for i := int64(1); i <= 5; i++ {
+		l.Add("management.azure.com:443", RecycleEvent{Generation: i, Reason: RecycleReasonPolicy, Snapshot: ConnSnapshot{
+			Requests:  i * 10,
+			Remaining: map[string]int64{"Subscription-Reads": 100, "Subscription-Writes": i},
+		}})
+	}
+
+	records := l.Records()
+	if len(records) != 3 {
+		t.Fatalf("expected the log to be bounded to 3 records, got %d", len(records))
+	}
+	for i, r := range records {
+		gen := int64(i + 3)
+		if r.Generation != gen || r.Requests != gen*10 || r.Bucket != "Subscription-Writes" || r.Remaining != gen {
+			t.Errorf("expected record %d to describe generation %d, got %+v", i, gen, r)
+		}
+	}
+}
+
+func TestRecentRecycles(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "1")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:               svr.Client().Transport.(*http.Transport),
+		Host:                    u.Host,
+		PoolSize:                1,
+		MinReqsBeforeRecycle:    1,
+		RecentRecyclesSize:      2,
+		ChurnBackoffGenerations: -1,
+	})
+	defer b.Close()
+
+	waitFor(t, "recycles to be recorded", func() bool {
+		req, _ := http.NewRequest("GET", svr.URL, nil)
+		resp, err := b.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return b.Stats().Transports[0].Recycles >= 3
+	})
+
+	records := b.RecentRecycles()
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	for _, r := range records {
+		if r.Host != u.Host || r.Reason != RecycleReasonPolicy || r.Bucket != "Subscription-Reads" || r.Remaining != 1 || r.Requests == 0 {
+			t.Errorf("unexpected record %+v", r)
+		}
+	}
+	if records[0].Generation >= records[1].Generation || records[0].Time.After(records[1].Time) {
+		t.Errorf("expected records from oldest to newest, got %+v", records)
+	}
+}
+
+func TestRecentRecyclesSizeValidation(t *testing.T) {
+	if _, err := NewBuilder(nil).WithOptions(Options{RecentRecyclesSize: -1}).Build(); err == nil {
+		t.Errorf("expected a negative recent recycles size to be rejected")
+	}
+}
@@ -0,0 +1,54 @@
+package armbalancer
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// RecordedResponse is a line written to Options.Recorder. It holds no URL, header or authentication data.
+type RecordedResponse struct {
+	Time        time.Time `json:"t"`
+	Host        string    `json:"host"` // host:port
+	TransportID int       `json:"id"`
+	Generation  int64     `json:"gen"`
+	Status      int       `json:"status"`
+
+	// Remaining and Global hold the tracked instance-scoped and principal-scoped buckets once the response
+	// has been applied, like ConnSnapshot.
+	Remaining map[string]int64 `json:"remaining,omitempty"`
+	Global    map[string]int64 `json:"global,omitempty"`
+}
+
+// responseRecorder serializes the lines written to Options.Recorder by every pooled transport.
+type responseRecorder struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func newResponseRecorder(w io.Writer) *responseRecorder {
+	return &responseRecorder{enc: json.NewEncoder(w)}
+}
+
+// record appends a line for a response served by the transport's generation. Write errors are ignored,
+// since recording must never fail requests.
+func (t *recyclableTransport) record(gen *generation, status int) {
+	if t.recorder == nil {
+		return
+	}
+	remaining, global, _ := t.state.Scoped()
+	line := RecordedResponse{
+		Time:        time.Now().UTC(),
+		Host:        net.JoinHostPort(t.host, t.port),
+		TransportID: t.id,
+		Generation:  gen.number,
+		Status:      status,
+		Remaining:   remaining,
+		Global:      global,
+	}
+	t.recorder.lock.Lock()
+	defer t.recorder.lock.Unlock()
+	t.recorder.enc.Encode(line)
+}
@@ -0,0 +1,75 @@
+package armbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	var reads int64 = 1000
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reads -= 10
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", strconv.FormatInt(reads, 10))
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Tenant-Reads", "5000")
+		if reads < 980 {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	var recording bytes.Buffer
+	b := New(Options{
+		Transport: svr.Client().Transport.(*http.Transport),
+		Host:      u.Host,
+		PoolSize:  1,
+		Recorder:  &recording,
+	})
+	defer b.Close()
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, svr.URL+"/subscriptions/secret-subscription", nil)
+		req.Header.Set("Authorization", "Bearer secret-token")
+		resp, err := b.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if strings.Contains(recording.String(), "secret") {
+		t.Fatalf("expected no URL or authentication data to be recorded, got %s", recording.String())
+	}
+	var lines []RecordedResponse
+	scanner := bufio.NewScanner(&recording)
+	for scanner.Scan() {
+		var line RecordedResponse
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("expected a JSON line, got %q: %s", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("expected a line per response, got %d", len(lines))
+	}
+	for i, line := range lines {
+		if line.Host != u.Host || line.TransportID != 0 || line.Generation != 1 || line.Time.IsZero() {
+			t.Errorf("unexpected line %+v", line)
+		}
+		if want := int64(990 - 10*i); line.Remaining["Subscription-Reads"] != want || line.Global["Tenant-Reads"] != 5000 {
+			t.Errorf("expected %d remaining reads and the tenant bucket, got %+v", want, line)
+		}
+	}
+	if lines[0].Status != http.StatusOK || lines[2].Status != http.StatusTooManyRequests {
+		t.Errorf("expected statuses to be recorded, got %d and %d", lines[0].Status, lines[2].Status)
+	}
+}
@@ -0,0 +1,91 @@
+package armbalancer
+
+import (
+	"net/http"
+	"time"
+)
+
+// TransportConfig configures a standalone RecyclableTransport.
+type TransportConfig struct {
+	// Transport is cloned to create each connection's transport.
+	// Default: http.DefaultTransport
+	Transport *http.Transport
+
+	// Host is the only host requests can be sent to, with an optional port.
+	// Default: management.azure.com:443
+	Host string
+
+	// RecyclePolicy decides when the connection is re-established.
+	// Default: DefaultRecyclePolicy{Threshold: 100, MinRequests: 10}
+	RecyclePolicy RecyclePolicy
+
+	// QuotaHeaders, GlobalBucketBehavior, PrincipalScopedBuckets, InstanceScopedBuckets, DrainTimeout,
+	// ForceCloseAfterDrainTimeout, LingeringConnGracePeriod and OnRecycle behave like their counterparts in Options.
+	QuotaHeaders                []string
+	GlobalBucketBehavior        GlobalBucketBehavior
+	PrincipalScopedBuckets      []string
+	InstanceScopedBuckets       []string
+	DrainTimeout                time.Duration
+	ForceCloseAfterDrainTimeout bool
+	LingeringConnGracePeriod    time.Duration
+	OnRecycle                   func(RecycleEvent)
+
+	// IgnoreQuotaStatusCodes behaves like its counterpart in Options.
+	// Default: 401, 403
+	IgnoreQuotaStatusCodes []int
+}
+
+// RecyclableTransport sends every request over a single connection, which is re-established once the
+// X-Ms-Ratelimit-Remaining-* headers returned by the server indicate that its quota is running low.
+// It's the building block of the balancer's pools, and is safe for concurrent use.
+type RecyclableTransport struct {
+	t *recyclableTransport
+}
+
+// NewRecyclableTransport returns a single self-recycling transport, for endpoints that report
+// their quota like ARM but don't need a pool of connections. It fails if cfg.Host is invalid.
+func NewRecyclableTransport(cfg TransportConfig) (*RecyclableTransport, error) {
+	host, port, err := normalizeHost(cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Transport == nil {
+		cfg.Transport = http.DefaultTransport.(*http.Transport)
+	}
+	if cfg.RecyclePolicy == nil {
+		cfg.RecyclePolicy = DefaultRecyclePolicy{Threshold: 100, MinRequests: 10}
+	}
+	return &RecyclableTransport{t: buildRecyclableTransport(transportConfig{
+		parent:        cfg.Transport,
+		host:          host,
+		port:          port,
+		policy:        cfg.RecyclePolicy,
+		onRecycle:     cfg.OnRecycle,
+		globalBuckets: cfg.GlobalBucketBehavior,
+		quotaHeaders:  cfg.QuotaHeaders,
+		drainTimeout:  cfg.DrainTimeout,
+		forceClose:    cfg.ForceCloseAfterDrainTimeout,
+		lingerGrace:   lingerGrace(cfg.LingeringConnGracePeriod),
+		ignoredStatus: ignoredStatuses(cfg.IgnoreQuotaStatusCodes),
+		scopes:        newBucketScopes(cfg.PrincipalScopedBuckets, cfg.InstanceScopedBuckets),
+	})}, nil
+}
+
+func (r *RecyclableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, err := resolveHost(req)
+	if err != nil {
+		return nil, err
+	}
+	return r.t.RoundTrip(req)
+}
+
+// Stats returns a snapshot of the transport's counters.
+func (r *RecyclableTransport) Stats() TransportStats {
+	return r.t.Stats()
+}
+
+// Close stops the recycling goroutine and closes all connections, including those serving in-flight requests.
+func (r *RecyclableTransport) Close() error {
+	r.t.Close(true)
+	return nil
+}
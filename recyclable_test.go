@@ -0,0 +1,648 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTransport serves scripted responses in place of a generation's *http.Transport.
+type fakeTransport struct {
+	gen     int64
+	respond func(req *http.Request) (*http.Response, error)
+	log     *eventLog
+}
+
+func (f *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f.respond(req)
+}
+
+func (f *fakeTransport) CloseIdleConnections() {
+	f.log.Add(fmt.Sprintf("close %d", f.gen))
+}
+
+// eventLog records what happened to the fakes, in order.
+type eventLog struct {
+	lock   sync.Mutex
+	events []string
+	added  chan string
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{added: make(chan string, 100)}
+}
+
+func (l *eventLog) Add(event string) {
+	l.lock.Lock()
+	l.events = append(l.events, event)
+	l.lock.Unlock()
+	l.added <- event
+}
+
+func (l *eventLog) Events() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+// expect waits for the next event and fails the test unless it's the given one.
+func (l *eventLog) expect(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case got := <-l.added:
+		if got != want {
+			t.Fatalf("expected event %q, got %q (all events: %q)", want, got, l.Events())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for event %q (all events: %q)", want, l.Events())
+	}
+}
+
+// newFakeRecyclableTransport returns a transport whose generations are fakes that respond with the given
+// headers. Every policy decision and recycle is added to the log.
+func newFakeRecyclableTransport(policy RecyclePolicy, header func(gen int64) http.Header) (*recyclableTransport, *eventLog) {
+	log := newEventLog()
+	r := buildRecyclableTransport(transportConfig{
+		id:   0,
+		host: "management.azure.com",
+		port: "443",
+		policy: RecyclePolicyFunc(func(s ConnSnapshot) bool {
+			ok := policy.ShouldRecycle(s)
+			log.Add(fmt.Sprintf("decide %d: %t", s.Generation, ok))
+			return ok
+		}),
+		onRecycle: func(e RecycleEvent) { log.Add(fmt.Sprintf("recycle %d", e.Generation)) },
+		newTransport: func(gen *generation) roundTripperCloser {
+			return &fakeTransport{gen: gen.number, log: log, respond: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Header: header(gen.number), Body: http.NoBody}, nil
+			}}
+		},
+	})
+	return r, log
+}
+
+func remainingReads(val string) http.Header {
+	h := http.Header{}
+	h.Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", val)
+	return h
+}
+
+func sendFake(t *testing.T, r *recyclableTransport) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", "https://management.azure.com/subscriptions", nil)
+	resp, err := r.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestRecycleThresholdCrossing(t *testing.T) {
+	remaining := map[int64]string{1: "11"}
+	var lock sync.Mutex
+	r, log := newFakeRecyclableTransport(DefaultRecyclePolicy{Threshold: 10}, func(gen int64) http.Header {
+		lock.Lock()
+		defer lock.Unlock()
+		return remainingReads(remaining[gen])
+	})
+	defer r.Close(false)
+
+	sendFake(t, r)
+	log.expect(t, "decide 1: false")
+
+	lock.Lock()
+	remaining[1] = "10"
+	remaining[2] = "1000"
+	lock.Unlock()
+	sendFake(t, r)
+	log.expect(t, "decide 1: true")
+	log.expect(t, "recycle 1")
+	log.expect(t, "close 1")
+
+	sendFake(t, r)
+	log.expect(t, "decide 2: false")
+	if s := r.Snapshot(); s.Generation != 2 || s.Remaining["Subscription-Reads"] != 1000 {
+		t.Errorf("expected the new generation's quota to be tracked, got %+v", s)
+	}
+}
+
+func TestRecycleMinRequests(t *testing.T) {
+	r, log := newFakeRecyclableTransport(DefaultRecyclePolicy{Threshold: 10, MinRequests: 3}, func(int64) http.Header { return remainingReads("0") })
+	defer r.Close(false)
+
+	for i := 0; i < 2; i++ {
+		sendFake(t, r)
+		log.expect(t, "decide 1: false")
+	}
+	sendFake(t, r)
+	log.expect(t, "decide 1: true")
+	log.expect(t, "recycle 1")
+	log.expect(t, "close 1")
+
+	sendFake(t, r)
+	log.expect(t, "decide 2: false")
+}
+
+func TestRecycleDrainOrdering(t *testing.T) {
+	log := newEventLog()
+	release := make(chan struct{})
+	r := buildRecyclableTransport(transportConfig{
+		host:      "management.azure.com",
+		port:      "443",
+		policy:    RecyclePolicyFunc(func(s ConnSnapshot) bool { return s.Generation == 1 }),
+		onRecycle: func(e RecycleEvent) { log.Add(fmt.Sprintf("recycle %d", e.Generation)) },
+		newTransport: func(gen *generation) roundTripperCloser {
+			return &fakeTransport{gen: gen.number, log: log, respond: func(req *http.Request) (*http.Response, error) {
+				if req.Method == "PUT" {
+					log.Add(fmt.Sprintf("blocked %d", gen.number))
+					<-release
+					log.Add(fmt.Sprintf("released %d", gen.number))
+				}
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			}}
+		},
+	})
+	defer r.Close(false)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, _ := http.NewRequest("PUT", "https://management.azure.com/subscriptions", nil)
+		if resp, err := r.RoundTrip(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	log.expect(t, "blocked 1")
+
+	sendFake(t, r)
+	log.expect(t, "recycle 1")
+	sendFake(t, r) // served by the new generation while the previous one drains
+
+	close(release)
+	log.expect(t, "released 1")
+	log.expect(t, "close 1")
+	<-done
+	if s := r.Snapshot(); s.Generation != 2 || s.Requests != 1 {
+		t.Errorf("expected the request sent during the drain to be served by generation 2, got %+v", s)
+	}
+}
+
+func TestRecycleStateReset(t *testing.T) {
+	log := newEventLog()
+	r := buildRecyclableTransport(transportConfig{
+		host:      "management.azure.com",
+		port:      "443",
+		policy:    RecyclePolicyFunc(func(s ConnSnapshot) bool { return s.Requests >= 2 }),
+		onRecycle: func(e RecycleEvent) { log.Add(fmt.Sprintf("recycle %d", e.Generation)) },
+		newTransport: func(gen *generation) roundTripperCloser {
+			return &fakeTransport{gen: gen.number, log: log, respond: func(req *http.Request) (*http.Response, error) {
+				return nil, errors.New("connection refused")
+			}}
+		},
+	})
+	defer r.Close(false)
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "https://management.azure.com/subscriptions", nil)
+		r.RoundTrip(req)
+	}
+	log.expect(t, "recycle 1")
+	log.expect(t, "close 1")
+
+	s := r.Stats()
+	if s.Generation != 2 || s.Requests != 0 || s.Errors.OtherErrors != 0 || s.Errors.LastError != "" {
+		t.Errorf("expected the request and error counters to be reset, got %+v", s)
+	}
+	if s.Recycles != 1 || s.Methods["GET"] != 2 {
+		t.Errorf("expected lifetime counters to be kept, got %+v", s)
+	}
+}
+
+func TestRecycleDrainWaitsForBody(t *testing.T) {
+	log := newEventLog()
+	r := buildRecyclableTransport(transportConfig{
+		host:      "management.azure.com",
+		port:      "443",
+		policy:    RecyclePolicyFunc(func(s ConnSnapshot) bool { return s.Generation == 1 && s.Requests == 2 }),
+		onRecycle: func(e RecycleEvent) { log.Add(fmt.Sprintf("recycle %d", e.Generation)) },
+		newTransport: func(gen *generation) roundTripperCloser {
+			return &fakeTransport{gen: gen.number, log: log, respond: func(req *http.Request) (*http.Response, error) {
+				body := io.NopCloser(strings.NewReader(strings.Repeat("x", 1024)))
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: body}, nil
+			}}
+		},
+	})
+	defer r.Close(false)
+
+	req, _ := http.NewRequest("GET", "https://management.azure.com/subscriptions", nil)
+	streaming, err := r.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(streaming.Body, make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+
+	sendFake(t, r)
+	log.expect(t, "recycle 1")
+	select {
+	case event := <-log.added:
+		t.Fatalf("expected the previous generation to be kept while a response body is open, got event %q", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if n, err := io.Copy(io.Discard, streaming.Body); err != nil || n != 512 {
+		t.Fatalf("expected to read the rest of the body, got %d bytes: %v", n, err)
+	}
+	log.expect(t, "close 1")
+	streaming.Body.Close()
+}
+
+func TestRecycleLeakedBody(t *testing.T) {
+	log := newEventLog()
+	r := buildRecyclableTransport(transportConfig{
+		host:      "management.azure.com",
+		port:      "443",
+		policy:    RecyclePolicyFunc(func(s ConnSnapshot) bool { return true }),
+		onRecycle: func(e RecycleEvent) { log.Add(fmt.Sprintf("recycle %d", e.Generation)) },
+		newTransport: func(gen *generation) roundTripperCloser {
+			return &fakeTransport{gen: gen.number, log: log, respond: func(req *http.Request) (*http.Response, error) {
+				body := io.NopCloser(strings.NewReader("x"))
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: body}, nil
+			}}
+		},
+	})
+	defer r.Close(false)
+
+	// The body is never closed, so the first generation never drains
+	req, _ := http.NewRequest("GET", "https://management.azure.com/subscriptions", nil)
+	if _, err := r.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	log.expect(t, "recycle 1")
+
+	for gen := 2; gen <= 4; gen++ {
+		sendFake(t, r)
+		log.expect(t, fmt.Sprintf("recycle %d", gen))
+		log.expect(t, fmt.Sprintf("close %d", gen))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := r.ForceRecycle(ctx); err != nil {
+		t.Fatalf("expected manual recycles not to be held up by the leaked body: %s", err)
+	}
+	log.expect(t, "recycle 5")
+	if gen := r.Snapshot().Generation; gen != 6 {
+		t.Errorf("expected generation 6, got %d", gen)
+	}
+}
+
+func TestRecycleDrainEndsOnClose(t *testing.T) {
+	log := newEventLog()
+	r := buildRecyclableTransport(transportConfig{
+		host:         "management.azure.com",
+		port:         "443",
+		policy:       RecyclePolicyFunc(func(s ConnSnapshot) bool { return s.Generation == 1 }),
+		onRecycle:    func(e RecycleEvent) { log.Add(fmt.Sprintf("recycle %d", e.Generation)) },
+		drainTimeout: time.Hour,
+		forceClose:   true,
+		newTransport: func(gen *generation) roundTripperCloser {
+			return &fakeTransport{gen: gen.number, log: log, respond: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("x"))}, nil
+			}}
+		},
+	})
+
+	// The body is never closed, so the first generation would drain for the whole drain timeout
+	req, _ := http.NewRequest("GET", "https://management.azure.com/subscriptions", nil)
+	if _, err := r.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	log.expect(t, "recycle 1")
+
+	r.Close(false)
+	closed := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-log.added:
+			closed[event] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the connections to be closed (all events: %q)", log.Events())
+		}
+	}
+	if !closed["close 1"] || !closed["close 2"] {
+		t.Errorf("expected the draining and current generations to be closed, got %q", log.Events())
+	}
+}
+
+func TestSynchronousRecycleContext(t *testing.T) {
+	release := make(chan struct{})
+	r := buildRecyclableTransport(transportConfig{
+		host:        "management.azure.com",
+		port:        "443",
+		policy:      RecyclePolicyFunc(func(s ConnSnapshot) bool { return false }),
+		synchronous: true,
+		onRecycle:   func(RecycleEvent) { <-release },
+		newTransport: func(gen *generation) roundTripperCloser {
+			return &fakeTransport{gen: gen.number, log: newEventLog(), respond: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			}}
+		},
+	})
+	defer r.Close(false)
+	defer close(release)
+
+	// Keep the recycling goroutine busy reporting a manual recycle
+	if _, err := r.ForceRecycle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://management.azure.com/subscriptions", nil)
+	start := time.Now()
+	resp, err := r.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the response to stop waiting for the recycle decision once its context is done, took %s", elapsed)
+	}
+}
+
+func TestRecycleConcurrentStreaming(t *testing.T) {
+	const size = 1 << 20
+	payload := strings.Repeat("x", size)
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "0")
+		for i := 0; i < size; i += size / 16 {
+			io.WriteString(w, payload[i:i+size/16])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	var recycles int64
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:               svr.Client().Transport.(*http.Transport),
+		Host:                    u.Host,
+		PoolSize:                2,
+		MinReqsBeforeRecycle:    1,
+		ChurnBackoffGenerations: -1,
+		OnRecycle:               func(RecycleEvent) { atomic.AddInt64(&recycles, 1) },
+	})
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				req, _ := http.NewRequest("GET", svr.URL, nil)
+				resp, err := b.RoundTrip(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil || n != size {
+					t.Errorf("expected the whole body to be streamed despite recycles, got %d bytes: %v", n, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if atomic.LoadInt64(&recycles) == 0 {
+		t.Error("expected connections to be recycled while streaming")
+	}
+}
+
+func TestNewRecyclableTransport(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "5")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	events := make(chan RecycleEvent, 10)
+	u, _ := url.Parse(svr.URL)
+	rt, err := NewRecyclableTransport(TransportConfig{
+		Transport:     svr.Client().Transport.(*http.Transport),
+		Host:          u.Host,
+		RecyclePolicy: DefaultRecyclePolicy{Threshold: 10, MinRequests: 2},
+		OnRecycle:     func(e RecycleEvent) { events <- e },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", svr.URL, nil)
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case e := <-events:
+		if e.Generation != 1 || e.Snapshot.Remaining["Subscription-Reads"] != 5 {
+			t.Errorf("unexpected recycle event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the connection to be recycled")
+	}
+	if s := rt.Stats(); s.Host != u.Host || s.Methods["GET"] != 4 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	req, _ := http.NewRequest("GET", "https://management.azure.com", nil)
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Error("expected requests for other hosts to fail")
+	}
+	if _, err := NewRecyclableTransport(TransportConfig{Host: "invalid:host:invalidport"}); err == nil {
+		t.Error("expected invalid hosts to be rejected")
+	}
+}
+
+func TestIgnoreQuotaStatusCodes(t *testing.T) {
+	var status int32 = http.StatusUnauthorized
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "0")
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	send := func(rt http.RoundTripper, n int) {
+		for i := 0; i < n; i++ {
+			req, _ := http.NewRequest("GET", svr.URL, nil)
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+	policy := DefaultRecyclePolicy{Threshold: 10, MinRequests: 1}
+
+	standalone, err := NewRecyclableTransport(TransportConfig{
+		Transport:     svr.Client().Transport.(*http.Transport),
+		Host:          u.Host,
+		RecyclePolicy: policy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standalone.Close()
+	pooled := New(Options{Transport: svr.Client().Transport.(*http.Transport), Host: u.Host, PoolSize: 1, RecyclePolicy: policy})
+	defer pooled.Close()
+	notIgnored := New(Options{Transport: svr.Client().Transport.(*http.Transport), Host: u.Host, PoolSize: 1, RecyclePolicy: policy, IgnoreQuotaStatusCodes: []int{}, AllowSharedParent: true})
+	defer notIgnored.Close()
+
+	send(standalone, 20)
+	send(pooled, 20)
+	send(notIgnored, 5)
+	time.Sleep(50 * time.Millisecond)
+	if s := standalone.t.Snapshot(); standalone.Stats().Recycles != 0 || len(s.Remaining) != 0 {
+		t.Errorf("expected a burst of 401s not to be accounted for by the standalone transport, got %+v", s)
+	}
+	if s := pooled.hosts[0].pool[0].(*recyclableTransport).Snapshot(); pooled.Stats().Transports[0].Recycles != 0 || len(s.Remaining) != 0 {
+		t.Errorf("expected a burst of 401s not to be accounted for by the pooled transport, got %+v", s)
+	}
+	waitFor(t, "401s to be accounted for when no status is ignored", func() bool { return notIgnored.Stats().Transports[0].Recycles > 0 })
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	send(standalone, 1)
+	send(pooled, 1)
+	waitFor(t, "the standalone transport to recycle", func() bool { return standalone.Stats().Recycles == 1 })
+	waitFor(t, "the pooled transport to recycle", func() bool { return pooled.Stats().Transports[0].Recycles == 1 })
+}
+
+func TestTrailerAndInformationalHeaders(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/early-hints" {
+			w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Writes", "5")
+			w.WriteHeader(http.StatusEarlyHints)
+			w.Header().Del("X-Ms-Ratelimit-Remaining-Subscription-Writes")
+			return
+		}
+		w.Header().Set("Trailer", "X-Ms-Ratelimit-Remaining-Subscription-Reads")
+		io.WriteString(w, "body")
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "3")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	events := make(chan RecycleEvent, 10)
+	rt, err := NewRecyclableTransport(TransportConfig{
+		Transport:     svr.Client().Transport.(*http.Transport),
+		Host:          u.Host,
+		RecyclePolicy: DefaultRecyclePolicy{Threshold: 4},
+		OnRecycle:     func(e RecycleEvent) { events <- e },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Close()
+
+	req, _ := http.NewRequest("GET", svr.URL+"/early-hints", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if s := rt.t.Snapshot(); s.Remaining["Subscription-Writes"] != 5 {
+		t.Errorf("expected the informational response's headers to be applied, got %+v", s.Remaining)
+	}
+
+	req, _ = http.NewRequest("GET", svr.URL+"/trailers", nil)
+	resp, err = rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case e := <-events:
+		if e.Snapshot.Remaining["Subscription-Reads"] != 3 {
+			t.Errorf("expected the recycle to be caused by the trailer, got %+v", e.Snapshot.Remaining)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the trailer to cause a recycle")
+	}
+}
+
+func TestRecyclerStall(t *testing.T) {
+	unblock := make(chan struct{})
+	stalls := make(chan RecyclerStallEvent, 10)
+	r := buildRecyclableTransport(transportConfig{
+		id:         3,
+		host:       "management.azure.com",
+		port:       "443",
+		policy:     RecyclePolicyFunc(func(s ConnSnapshot) bool { return s.Generation == 1 }),
+		onRecycle:  func(RecycleEvent) { <-unblock },
+		stallAfter: 20 * time.Millisecond,
+		onStall:    func(e RecyclerStallEvent) { stalls <- e },
+		newTransport: func(gen *generation) roundTripperCloser {
+			return &fakeTransport{gen: gen.number, log: newEventLog(), respond: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			}}
+		},
+	})
+	defer r.Close(false)
+
+	if s := r.Stats(); !s.RecyclerBusySince.IsZero() || s.RecyclerStalled {
+		t.Errorf("expected an idle recycler, got %+v", s)
+	}
+	sendFake(t, r)
+	select {
+	case e := <-stalls:
+		if e.TransportID != 3 || e.BusySince.IsZero() {
+			t.Errorf("unexpected stall event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watchdog to report the stall")
+	}
+	if s := r.Stats(); !s.RecyclerStalled {
+		t.Errorf("expected the stall to be reported in the stats, got %+v", s)
+	}
+
+	close(unblock)
+	waitFor(t, "the recycler to be idle again", func() bool { return r.Stats().RecyclerBusySince.IsZero() })
+	if s := r.Stats(); s.RecyclerStalled || s.Recycles != 1 {
+		t.Errorf("expected the recycle to complete, got %+v", s)
+	}
+}
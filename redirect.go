@@ -0,0 +1,63 @@
+package armbalancer
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// redirectPool serves requests for hosts that aren't balanced but are allowed by Options.AllowedRedirectHostSuffixes,
+// such as the regional endpoints returned in the Location and Azure-AsyncOperation headers of long running operations.
+// Its transports are shared by every allowed host and are never recycled.
+type redirectPool struct {
+	suffixes []string
+	pool     []*http.Transport
+	conns    *connTracker
+	cursor   int64
+}
+
+// newRedirectPool returns a pool of size transports whose connections count against budget, if not nil.
+func newRedirectPool(parent *http.Transport, suffixes []string, size int, budget *connBudget) *redirectPool {
+	r := &redirectPool{conns: newConnTracker(-1, nil, budget)}
+	for _, suffix := range suffixes {
+		suffix = strings.ToLower(strings.TrimPrefix(suffix, "."))
+		if suffix != "" {
+			r.suffixes = append(r.suffixes, suffix)
+		}
+	}
+	for i := 0; i < size; i++ {
+		tx := parent.Clone()
+		gen := &generation{tx: tx, born: time.Now()}
+		r.conns.Install(tx, gen)
+		r.pool = append(r.pool, tx)
+	}
+	return r
+}
+
+// Allowed returns true if the request's host is one of the suffixes or a subdomain of one.
+func (r *redirectPool) Allowed(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	for _, suffix := range r.suffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *redirectPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	i := int(atomic.AddInt64(&r.cursor, 1)) % len(r.pool)
+	return r.pool[i].RoundTrip(req)
+}
+
+// Close closes idle connections, and connections serving in-flight requests as well when force is true.
+func (r *redirectPool) Close(force bool) {
+	for _, tx := range r.pool {
+		tx.CloseIdleConnections()
+	}
+	if force {
+		r.conns.CloseAll()
+	}
+}
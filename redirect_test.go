@@ -0,0 +1,100 @@
+package armbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedirectPolling(t *testing.T) {
+	var lock sync.Mutex
+	var polls int
+	regional := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		polls++
+		if polls < 3 {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Write([]byte("done"))
+	}))
+	defer regional.Close()
+
+	regionalURL, _ := url.Parse(regional.URL)
+	regionalURL.Host = "localhost:" + regionalURL.Port()
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", regionalURL.String()+"/operations/1")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer primary.Close()
+
+	u, _ := url.Parse(primary.URL)
+	b := New(Options{
+		Transport:                   primary.Client().Transport.(*http.Transport),
+		Host:                        u.Host,
+		AllowedRedirectHostSuffixes: []string{"localhost"},
+	})
+	defer b.Close()
+	client := &http.Client{Transport: b}
+
+	resp, err := client.Post(primary.URL, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202 from the primary host, got %d", resp.StatusCode)
+	}
+
+	location := resp.Header.Get("Location")
+	for i := 0; ; i++ {
+		if i == 5 {
+			t.Fatal("operation didn't complete")
+		}
+		resp, err := client.Get(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+	}
+	if polls != 3 {
+		t.Errorf("expected 3 polls, got %d", polls)
+	}
+	// One connection to the primary host, and one for each of the 2 redirect transports polling the regional host
+	if n := b.Stats().NewConnectionsLastMinute; n != 3 {
+		t.Errorf("expected the connections to both hosts to be counted, got %d", n)
+	}
+
+	if _, err := client.Get("http://notlocalhost:" + regionalURL.Port()); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("expected hosts outside of the allowed suffixes to be rejected, got: %v", err)
+	}
+}
+
+func TestRedirectPoolAllowed(t *testing.T) {
+	r := newRedirectPool(&http.Transport{}, []string{".Management.Azure.com", "", "example.com"}, 1, nil)
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "management.azure.com", want: true},
+		{host: "eastus.management.azure.com:443", want: true},
+		{host: "EASTUS.MANAGEMENT.AZURE.COM", want: true},
+		{host: "evilmanagement.azure.com", want: false},
+		{host: "management.azure.com.evil.com", want: false},
+		{host: "sub.example.com", want: true},
+		{host: "azure.com", want: false},
+	}
+	for _, tt := range tests {
+		if got := r.Allowed(&url.URL{Host: tt.host}); got != tt.want {
+			t.Errorf("Allowed(%q) = %t, want %t", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry keeps track of the balancers of a process, e.g. one per cloud or tenant, by name.
+// It's safe for concurrent use, and its zero value is ready to use.
+type Registry struct {
+	// MaxConcurrentShutdowns bounds how many balancers ShutdownAll shuts down at once.
+	// Default: 4
+	MaxConcurrentShutdowns int
+
+	lock      sync.RWMutex
+	balancers map[string]*Balancer
+}
+
+// Register adds a balancer under the given name, replacing the one previously registered under it, if any,
+// without shutting it down.
+func (r *Registry) Register(name string, b *Balancer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.balancers == nil {
+		r.balancers = make(map[string]*Balancer)
+	}
+	r.balancers[name] = b
+}
+
+// Get returns the balancer registered under the given name.
+func (r *Registry) Get(name string) (*Balancer, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	b, ok := r.balancers[name]
+	return b, ok
+}
+
+// StatsAll returns the stats of every registered balancer, keyed by name.
+func (r *Registry) StatsAll() map[string]Stats {
+	stats := make(map[string]Stats)
+	for name, b := range r.snapshot() {
+		stats[name] = b.Stats()
+	}
+	return stats
+}
+
+// Publish exposes StatsAll as an expvar under the given name, e.g. on /debug/vars.
+// Like expvar.Publish, it panics if the name is already in use.
+func (r *Registry) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return r.StatsAll() }))
+}
+
+// ShutdownAll shuts down every registered balancer, see Balancer.Shutdown, with at most MaxConcurrentShutdowns
+// at once. The deadline of ctx is shared, so balancers still waiting for their turn once it expires are closed
+// right away. Balancers stay registered. The failures are returned as a *ShutdownError.
+func (r *Registry) ShutdownAll(ctx context.Context) error {
+	limit := r.MaxConcurrentShutdowns
+	if limit <= 0 {
+		limit = 4
+	}
+
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		errs = make(map[string]error)
+		sem  = make(chan struct{}, limit)
+	)
+	for name, b := range r.snapshot() {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string, b *Balancer) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := b.Shutdown(ctx); err != nil {
+				lock.Lock()
+				errs[name] = err
+				lock.Unlock()
+			}
+		}(name, b)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return &ShutdownError{Errors: errs}
+	}
+	return nil
+}
+
+func (r *Registry) snapshot() map[string]*Balancer {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	balancers := make(map[string]*Balancer, len(r.balancers))
+	for name, b := range r.balancers {
+		balancers[name] = b
+	}
+	return balancers
+}
+
+// ShutdownError is returned by Registry.ShutdownAll when some balancers failed to shut down gracefully, and by
+// Balancer.Shutdown when the pools of some hosts didn't drain in time.
+type ShutdownError struct {
+	Errors map[string]error // keyed by balancer name, or by host:port
+}
+
+func (e *ShutdownError) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %s", name, e.Errors[name])
+	}
+	return "armbalancer: failed to shut down " + strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of the shutdown errors matches target, e.g. context.DeadlineExceeded.
+func (e *ShutdownError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	unblock := make(chan struct{})
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-unblock }))
+	defer svr.Close()
+	defer close(unblock)
+	u, _ := url.Parse(svr.URL)
+
+	var r Registry
+	if _, ok := r.Get("public"); ok {
+		t.Error("expected an empty registry")
+	}
+	var wg sync.WaitGroup
+	for _, name := range []string{"public", "china", "usgov"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			r.Register(name, New(Options{Host: u.Host, Transport: svr.Client().Transport.(*http.Transport), PoolSize: 1, AllowSharedParent: true}))
+		}(name)
+	}
+	wg.Wait()
+	public, ok := r.Get("public")
+	if !ok {
+		t.Fatal("expected the public balancer to be registered")
+	}
+
+	stats := r.StatsAll()
+	if len(stats) != 3 || len(stats["china"].Transports) != 1 {
+		t.Errorf("expected stats for every balancer, got %+v", stats)
+	}
+	published := fmt.Sprintf("armbalancer_test_registry_%d", time.Now().UnixNano()) // unique across -count runs
+	r.Publish(published)
+	if vars := expvar.Get(published).String(); !strings.Contains(vars, `"usgov":`) {
+		t.Errorf("expected the published stats to be keyed by name, got %s", vars)
+	}
+
+	// A request in flight holds up the shutdown of its balancer only
+	go func() {
+		req, _ := http.NewRequest("GET", svr.URL, nil)
+		if resp, err := public.RoundTrip(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	waitFor(t, "the request to be in flight", func() bool { return public.Stats().Transports[0].InFlight == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := r.ShutdownAll(ctx)
+	var shutdownErr *ShutdownError
+	if !errors.As(err, &shutdownErr) || len(shutdownErr.Errors) != 1 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the public balancer's shutdown to time out, got: %v", err)
+	}
+	want := fmt.Sprintf("armbalancer: failed to shut down public: armbalancer: failed to shut down %s: %s", u.Host, context.DeadlineExceeded)
+	if got := err.Error(); got != want {
+		t.Errorf("unexpected message %q", got)
+	}
+	for name := range stats {
+		b, _ := r.Get(name)
+		req, _ := http.NewRequest("GET", svr.URL, nil)
+		if _, err := b.RoundTrip(req); !errors.Is(err, ErrClosed) {
+			t.Errorf("expected the %s balancer to be shut down, got: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ReplaceableTransport sends requests through a balancer that can be replaced at runtime, e.g. to apply a new set
+// of hosts, without failing the requests in flight on the previous one. Replacements wrapping the parent transport
+// of the current balancer must set Options.AllowSharedParent, since both serve requests while it drains.
+type ReplaceableTransport struct {
+	current      atomic.Value // *Balancer
+	drainTimeout time.Duration
+}
+
+// NewReplaceableTransport returns a transport sending requests through b until it's replaced. Replaced balancers
+// are given drainTimeout to complete their in-flight requests before being closed.
+func NewReplaceableTransport(b *Balancer, drainTimeout time.Duration) *ReplaceableTransport {
+	r := &ReplaceableTransport{drainTimeout: drainTimeout}
+	r.current.Store(b)
+	return r
+}
+
+// Load returns the balancer serving new requests.
+func (r *ReplaceableTransport) Load() *Balancer {
+	return r.current.Load().(*Balancer)
+}
+
+// Store makes b serve new requests, and shuts down the previous balancer in the background once its in-flight
+// requests have completed, or drainTimeout has passed. The returned channel receives the result of Shutdown.
+func (r *ReplaceableTransport) Store(b *Balancer) <-chan error {
+	previous := r.current.Swap(b).(*Balancer)
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), r.drainTimeout)
+		defer cancel()
+		done <- previous.Shutdown(ctx)
+	}()
+	return done
+}
+
+// RoundTrip sends the request through the current balancer. Requests that lost the race with Store and reached
+// the previous balancer after its shutdown started are sent again through the new one, which is safe since
+// closed balancers reject requests before sending them.
+func (r *ReplaceableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for {
+		b := r.Load()
+		resp, err := b.RoundTrip(req)
+		if errors.Is(err, ErrClosed) && r.Load() != b {
+			continue
+		}
+		return resp, err
+	}
+}
@@ -0,0 +1,83 @@
+package armbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplaceableTransport(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+	newBalancer := func() *Balancer {
+		return New(Options{Transport: svr.Client().Transport.(*http.Transport), Host: u.Host, PoolSize: 2, AllowSharedParent: true})
+	}
+
+	first, second := newBalancer(), newBalancer()
+	defer second.Close()
+	rt := NewReplaceableTransport(first, 5*time.Second)
+
+	var sent, failed int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req, _ := http.NewRequest("GET", svr.URL, nil)
+				resp, err := rt.RoundTrip(req)
+				atomic.AddInt64(&sent, 1)
+				if err != nil {
+					atomic.AddInt64(&failed, 1)
+					t.Error(err)
+					continue
+				}
+				resp.Body.Close()
+			}
+		}()
+	}
+
+	waitFor(t, "requests to be sent through the first balancer", func() bool { return atomic.LoadInt64(&sent) > 50 })
+	done := rt.Store(second)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the first balancer to drain, got: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the first balancer to drain")
+	}
+	switched := atomic.LoadInt64(&sent)
+	waitFor(t, "requests to be sent through the second balancer", func() bool { return atomic.LoadInt64(&sent) > switched+50 })
+	close(stop)
+	wg.Wait()
+
+	if failed != 0 {
+		t.Errorf("expected no request to fail across the swap, %d of %d failed", failed, sent)
+	}
+	if rt.Load() != second {
+		t.Error("expected the second balancer to serve new requests")
+	}
+	var requests int64
+	for _, ts := range second.Stats().Transports {
+		requests += ts.Requests
+	}
+	if requests == 0 {
+		t.Error("expected the second balancer to serve requests")
+	}
+}
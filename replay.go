@@ -0,0 +1,37 @@
+package armbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// canReplay returns true when the request can be sent again after a previous attempt consumed its body.
+// This is the case for requests without a body and for requests whose body can be recreated using GetBody,
+// which http.NewRequest sets automatically for *bytes.Buffer, *bytes.Reader, and *strings.Reader bodies.
+//
+// Note that replaying is only safe for idempotent requests. ARM PUT, DELETE, and GET operations are
+// idempotent, but some POST actions are not.
+func canReplay(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// replayRequest clones the request for another attempt, recreating its body using GetBody.
+// It must only be called for requests that satisfy canReplay.
+func replayRequest(ctx context.Context, req *http.Request) (*http.Request, error) {
+	next := req.Clone(ctx)
+	if req.GetBody == nil {
+		return next, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("recreating request body: %w", err)
+	}
+	next.Body = body
+	return next, nil
+}
+
+// notReplayableError explains why an error was returned to the caller instead of being retried.
+func notReplayableError(err error) error {
+	return fmt.Errorf("not retrying request because its body can't be sent again (GetBody is nil): %w", err)
+}
@@ -0,0 +1,78 @@
+package armbalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestCanReplay(t *testing.T) {
+	noBody, _ := http.NewRequest("GET", "https://management.azure.com", nil)
+	bytesBody, _ := http.NewRequest("PUT", "https://management.azure.com", bytes.NewReader([]byte("payload")))
+	streamingBody, _ := http.NewRequest("PUT", "https://management.azure.com", io.NopCloser(strings.NewReader("payload")))
+
+	consumedBytesBody, _ := http.NewRequest("PUT", "https://management.azure.com", bytes.NewReader([]byte("payload")))
+	io.ReadAll(consumedBytesBody.Body)
+	consumedStreamingBody, _ := http.NewRequest("PUT", "https://management.azure.com", io.NopCloser(strings.NewReader("payload")))
+	io.ReadAll(consumedStreamingBody.Body)
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want bool
+	}{
+		{name: "no body", req: noBody, want: true},
+		{name: "bytes.Reader body", req: bytesBody, want: true},
+		{name: "streaming body", req: streamingBody, want: false},
+		{name: "consumed bytes.Reader body", req: consumedBytesBody, want: true},
+		{name: "consumed streaming body", req: consumedStreamingBody, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canReplay(tt.req); got != tt.want {
+				t.Errorf("canReplay() = %t, want %t", got, tt.want)
+			}
+			if !tt.want || tt.req.Body == nil {
+				return
+			}
+			next, err := replayRequest(context.Background(), tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, _ := io.ReadAll(next.Body); string(body) != "payload" {
+				t.Errorf("expected the replayed request to carry the full body, got %q", body)
+			}
+		})
+	}
+}
+
+func TestRetryNotReplayableError(t *testing.T) {
+	var attempts int
+	rt := WithRetry(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		io.ReadAll(req.Body)
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}), RetryOptions{})
+
+	req, _ := http.NewRequest("PUT", "https://management.azure.com", io.NopCloser(strings.NewReader("payload")))
+	_, err := rt.RoundTrip(req)
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+	if err == nil || !strings.Contains(err.Error(), "GetBody is nil") {
+		t.Errorf("expected error to explain why the request wasn't retried, got: %s", err)
+	}
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("expected error to wrap the underlying cause, got: %s", err)
+	}
+}
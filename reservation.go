@@ -0,0 +1,170 @@
+package armbalancer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrInsufficientQuota is returned by Balancer.Reserve when not enough quota remains to satisfy a reservation.
+var ErrInsufficientQuota = errors.New("armbalancer: insufficient quota")
+
+// Reservation is a claim on part of a rate limiting bucket's remaining quota, created by Balancer.Reserve.
+// It's consumed by one for every response that reports the bucket, and the unused part can be returned using Release.
+type Reservation struct {
+	r *reservation
+}
+
+type reservation struct {
+	ledger    *reservationLedger
+	bucket    string
+	remaining int64 // guarded by ledger.lock
+}
+
+// Remaining returns the part of the reservation that hasn't been consumed or released.
+// It's zero for the Reservation returned along with an error.
+func (r Reservation) Remaining() int64 {
+	if r.r == nil {
+		return 0
+	}
+	r.r.ledger.lock.Lock()
+	defer r.r.ledger.lock.Unlock()
+	return r.r.remaining
+}
+
+// Release returns the unconsumed part of the reservation. It's safe to call more than once,
+// and on the Reservation returned along with an error.
+func (r Reservation) Release() {
+	if r.r == nil {
+		return
+	}
+	r.r.ledger.release(r.r)
+}
+
+// Reserve claims n units of a rate limiting bucket's remaining quota, e.g. "Subscription-Writes" for the
+// X-Ms-Ratelimit-Remaining-Subscription-Writes header, before starting a batch of requests.
+// The quota is the lowest value of the bucket reported across all pooled connections, minus outstanding reservations.
+//
+// Reservations are purely client-side bookkeeping: they don't prevent other requests from being sent,
+// but they allow cooperating callers to avoid collectively exceeding the quota.
+func (t *Balancer) Reserve(bucket string, n int64) (Reservation, error) {
+	if n <= 0 {
+		return Reservation{}, fmt.Errorf("invalid reservation of %d units: must be positive", n)
+	}
+	bucket = canonicalBucket(bucket)
+	remaining, ok := t.minRemaining(bucket)
+	if !ok {
+		return Reservation{}, fmt.Errorf("%w: no quota has been reported for bucket %q yet", ErrInsufficientQuota, bucket)
+	}
+	return t.reservations.reserve(bucket, n, remaining)
+}
+
+// Remaining returns the remaining quota of a rate limiting bucket, e.g. "Subscription-Reads", which is the lowest value
+// reported across all pooled connections, ignoring reservations. It returns false until the bucket has been reported.
+func (t *Balancer) Remaining(bucket string) (int64, bool) {
+	return t.minRemaining(canonicalBucket(bucket))
+}
+
+// minRemaining returns the lowest value of the bucket reported by any pooled transport,
+// or the persisted one until a transport reports it.
+func (t *Balancer) minRemaining(bucket string) (int64, bool) {
+	var min int64 = math.MaxInt64
+	var found bool
+	for _, p := range t.hosts {
+		for _, rt := range p.pool {
+			r, ok := rt.(*recyclableTransport)
+			if !ok {
+				continue
+			}
+			if val, ok := r.state.Get(bucket); ok && val < min {
+				min = val
+				found = true
+			}
+		}
+	}
+	if !found {
+		return t.restored.bucket(bucket)
+	}
+	return min, found
+}
+
+// canonicalBucket returns the bucket name as it's tracked by connState, i.e. the canonical header key suffix.
+func canonicalBucket(bucket string) string {
+	return http.CanonicalHeaderKey(rateLimitHeaderPrefix + bucket)[len(rateLimitHeaderPrefix):]
+}
+
+type reservationLedger struct {
+	lock        sync.Mutex
+	outstanding int64 // atomic, total across buckets to skip locking when there are no reservations
+	byBucket    map[string][]*reservation
+}
+
+func newReservationLedger() *reservationLedger {
+	return &reservationLedger{byBucket: make(map[string][]*reservation)}
+}
+
+func (l *reservationLedger) reserve(bucket string, n, remaining int64) (Reservation, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	available := remaining
+	for _, r := range l.byBucket[bucket] {
+		available -= r.remaining
+	}
+	if available < n {
+		return Reservation{}, fmt.Errorf("%w: requested %d from bucket %q but only %d is available", ErrInsufficientQuota, n, bucket, available)
+	}
+
+	r := &reservation{ledger: l, bucket: bucket, remaining: n}
+	l.byBucket[bucket] = append(l.byBucket[bucket], r)
+	atomic.AddInt64(&l.outstanding, n)
+	return Reservation{r: r}, nil
+}
+
+func (l *reservationLedger) release(r *reservation) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.consume(r.bucket, r, r.remaining)
+}
+
+// ApplyHeader consumes one unit of the oldest reservation of every bucket reported by the response.
+func (l *reservationLedger) ApplyHeader(h http.Header) {
+	if atomic.LoadInt64(&l.outstanding) == 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for bucket, reservations := range l.byBucket {
+		if vals := headerValues(h, rateLimitHeaderPrefix+bucket); vals != nil {
+			l.consume(bucket, reservations[0], 1)
+		}
+	}
+}
+
+// consume reduces the reservation by n, removing it from the ledger once it reaches zero. Must hold the lock.
+func (l *reservationLedger) consume(bucket string, r *reservation, n int64) {
+	if n > r.remaining {
+		n = r.remaining
+	}
+	r.remaining -= n
+	atomic.AddInt64(&l.outstanding, -n)
+	if r.remaining > 0 {
+		return
+	}
+
+	reservations := l.byBucket[bucket]
+	for i, existing := range reservations {
+		if existing == r {
+			reservations = append(reservations[:i], reservations[i+1:]...)
+			break
+		}
+	}
+	if len(reservations) == 0 {
+		delete(l.byBucket, bucket)
+	} else {
+		l.byBucket[bucket] = reservations
+	}
+}
@@ -0,0 +1,84 @@
+package armbalancer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestReserve(t *testing.T) {
+	var lock sync.Mutex
+	remaining := 100
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		remaining--
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Writes", strconv.Itoa(remaining))
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport: svr.Client().Transport.(*http.Transport),
+		Host:      u.Host,
+		PoolSize:  1,
+	})
+	client := &http.Client{Transport: b}
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			resp, err := client.Get(svr.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	if _, err := b.Reserve("Subscription-Writes", 1); !errors.Is(err, ErrInsufficientQuota) {
+		t.Errorf("expected reservations to fail before any quota is reported, got: %v", err)
+	}
+
+	send(1) // 99 remaining
+	first, err := b.Reserve("subscription-writes", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Reserve("Subscription-Writes", 60); !errors.Is(err, ErrInsufficientQuota) {
+		t.Errorf("expected outstanding reservations to reduce the available quota, got: %v", err)
+	}
+
+	first.Release()
+	first.Release()
+	second, err := b.Reserve("Subscription-Writes", 60)
+	if err != nil {
+		t.Fatalf("expected released quota to be available again: %s", err)
+	}
+
+	send(10) // 89 remaining, 50 still reserved
+	if n := second.Remaining(); n != 50 {
+		t.Errorf("expected responses to consume the reservation, %d remain", n)
+	}
+	if _, err := b.Reserve("Subscription-Writes", 40); !errors.Is(err, ErrInsufficientQuota) {
+		t.Errorf("expected 39 units to be available, got: %v", err)
+	}
+	if _, err := b.Reserve("Subscription-Writes", 39); err != nil {
+		t.Errorf("expected 39 units to be available, got: %v", err)
+	}
+
+	for _, n := range []int64{0, -10} {
+		res, err := b.Reserve("Subscription-Writes", n)
+		if err == nil || errors.Is(err, ErrInsufficientQuota) {
+			t.Errorf("expected reserving %d units to be rejected, got: %v", n, err)
+		}
+		res.Release()
+		if n := res.Remaining(); n != 0 {
+			t.Errorf("expected failed reservations to have nothing remaining, got %d", n)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package armbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	resourceGraphPathPrefix     = "/providers/microsoft.resourcegraph/"
+	resourceGraphRemainingQuota = "X-Ms-User-Quota-Remaining"
+	resourceGraphQuotaResets    = "X-Ms-User-Quota-Resets-After"
+)
+
+// ResourceGraphQuotaPolicy configures WithResourceGraphQuota.
+type ResourceGraphQuotaPolicy struct {
+	// MaxDelay is the longest a Resource Graph query will be held back while waiting for the quota to reset.
+	// Queries that would have to wait longer fail immediately with an error wrapping ErrInsufficientQuota.
+	// Default: 30s
+	MaxDelay time.Duration
+}
+
+// WithResourceGraphQuota wraps a round tripper (usually one returned by New) to pace Azure Resource Graph queries.
+//
+// Resource Graph reports its per-user quota in the x-ms-user-quota-remaining and x-ms-user-quota-resets-after
+// headers rather than X-Ms-Ratelimit-Remaining-*. The quota follows the user and not the connection,
+// so instead of recycling connections, queries are delayed until the quota resets once it's been exhausted.
+// Requests for other paths are passed through as-is.
+func WithResourceGraphQuota(rt http.RoundTripper, policy ResourceGraphQuotaPolicy) http.RoundTripper {
+	if policy.MaxDelay == 0 {
+		policy.MaxDelay = 30 * time.Second
+	}
+	return &resourceGraphTransport{next: rt, policy: policy}
+}
+
+type resourceGraphTransport struct {
+	next   http.RoundTripper
+	policy ResourceGraphQuotaPolicy
+
+	lock    sync.Mutex
+	resetAt time.Time // zero unless the quota has been exhausted
+}
+
+func (r *resourceGraphTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(strings.ToLower(req.URL.Path), resourceGraphPathPrefix) {
+		return r.next.RoundTrip(req)
+	}
+
+	r.lock.Lock()
+	delay := time.Until(r.resetAt)
+	r.lock.Unlock()
+	if delay > r.policy.MaxDelay {
+		return nil, fmt.Errorf("%w: resource graph quota resets in %s", ErrInsufficientQuota, delay)
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+
+	resp, err := r.next.RoundTrip(req)
+	if resp != nil {
+		r.apply(resp.Header)
+	}
+	return resp, err
+}
+
+func (r *resourceGraphTransport) apply(h http.Header) {
+	remaining, err := strconv.ParseInt(h.Get(resourceGraphRemainingQuota), 10, 64)
+	if err != nil {
+		return
+	}
+	resetsAfter, ok := parseQuotaResetsAfter(h.Get(resourceGraphQuotaResets))
+	if !ok {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if remaining > 0 {
+		r.resetAt = time.Time{}
+		return
+	}
+	r.resetAt = time.Now().Add(resetsAfter)
+}
+
+// parseQuotaResetsAfter parses durations in the hh:mm:ss form used by x-ms-user-quota-resets-after.
+// Seconds may have a fractional part.
+func parseQuotaResetsAfter(v string) (time.Duration, bool) {
+	parts := strings.Split(v, ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	hours, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	minutes, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil || minutes > 59 {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || !(seconds >= 0 && seconds < 60) {
+		return 0, false
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), true
+}
@@ -0,0 +1,121 @@
+package armbalancer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResourceGraphQuota(t *testing.T) {
+	const quota = 2
+	var lock sync.Mutex
+	var used int
+	var windowStart time.Time
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if time.Since(windowStart) >= time.Second {
+			windowStart = time.Now()
+			used = 0
+		}
+		if used == quota {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		used++
+		w.Header().Set("X-Ms-User-Quota-Remaining", strconv.Itoa(quota-used))
+		w.Header().Set("X-Ms-User-Quota-Resets-After", "00:00:01")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	var recycles int64
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:            svr.Client().Transport.(*http.Transport),
+		Host:                 u.Host,
+		PoolSize:             1,
+		MinReqsBeforeRecycle: 1,
+		QuotaHeaders:         []string{"x-ms-user-quota-remaining"},
+		OnRecycle:            func(RecycleEvent) { atomic.AddInt64(&recycles, 1) },
+	})
+	defer b.Close()
+	client := &http.Client{Transport: WithResourceGraphQuota(b, ResourceGraphQuotaPolicy{})}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := client.Post(svr.URL+"/providers/Microsoft.ResourceGraph/resources", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected request %d to be delayed until the quota reset, got status %d", i, resp.StatusCode)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("expected the third request to wait for the quota to reset, took %s", elapsed)
+	}
+	if n := atomic.LoadInt64(&recycles); n != 0 {
+		t.Errorf("expected the exhausted quota not to cause recycles, got %d", n)
+	}
+	s := b.hosts[0].pool[0].(*recyclableTransport).Snapshot()
+	if _, ok := s.Global["X-Ms-User-Quota-Remaining"]; !ok {
+		t.Errorf("expected the user quota to be tracked, got %+v", s.Global)
+	}
+}
+
+func TestResourceGraphQuotaMaxDelay(t *testing.T) {
+	var calls int
+	rt := WithResourceGraphQuota(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		h := http.Header{}
+		h.Set("X-Ms-User-Quota-Remaining", "0")
+		h.Set("X-Ms-User-Quota-Resets-After", "00:01:00")
+		return &http.Response{StatusCode: http.StatusOK, Header: h, Body: http.NoBody}, nil
+	}), ResourceGraphQuotaPolicy{})
+
+	req, _ := http.NewRequest("POST", "https://management.azure.com/providers/Microsoft.ResourceGraph/resources", nil)
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.RoundTrip(req); !errors.Is(err, ErrInsufficientQuota) {
+		t.Errorf("expected requests that would wait longer than MaxDelay to fail, got: %v", err)
+	}
+	other, _ := http.NewRequest("GET", "https://management.azure.com/subscriptions", nil)
+	if _, err := rt.RoundTrip(other); err != nil {
+		t.Errorf("expected requests outside of Resource Graph to be passed through, got: %s", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 requests to be sent, got %d", calls)
+	}
+}
+
+func TestParseQuotaResetsAfter(t *testing.T) {
+	tests := []struct {
+		val  string
+		want time.Duration
+		ok   bool
+	}{
+		{val: "00:00:05", want: 5 * time.Second, ok: true},
+		{val: "01:02:03", want: time.Hour + 2*time.Minute + 3*time.Second, ok: true},
+		{val: "00:00:00.5", want: 500 * time.Millisecond, ok: true},
+		{val: "5", ok: false},
+		{val: "00:60:00", ok: false},
+		{val: "00:00:NaN", ok: false},
+		{val: "", ok: false},
+	}
+	for _, tt := range tests {
+		got, ok := parseQuotaResetsAfter(tt.val)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseQuotaResetsAfter(%q) = %s, %t, want %s, %t", tt.val, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type RetryOptions struct {
+	// MaxAttempts is the max number of times a request will be sent, including the first attempt.
+	// Default: 3
+	MaxAttempts int
+
+	// BaseDelay is the backoff before the first retry. It doubles with every subsequent attempt.
+	// Default: 500ms
+	BaseDelay time.Duration
+
+	// MaxDelay is the longest the retry layer will wait between two attempts.
+	// Responses asking for a longer wait via Retry-After are returned to the caller as-is.
+	// Default: 30s
+	MaxDelay time.Duration
+
+	// RespectRetryAfter causes the Retry-After and x-ms-retry-after-ms response headers
+	// to take precedence over the computed backoff.
+	RespectRetryAfter bool
+}
+
+// WithRetry wraps a round tripper (usually one returned by New) to retry throttled (429) and
+// server error (5xx) responses as well as transient network errors using exponential backoff with jitter.
+//
+// Every attempt is passed to rt again, so when rt is a balancer each retry goes through transport
+// selection and will usually land on a different connection than the attempt that failed.
+//
+// Requests with a body are only retried when it can be recreated using req.GetBody. Otherwise the
+// response is returned as-is, and network errors are wrapped to explain why they weren't retried.
+// Callers are responsible for only sending idempotent requests through the retry layer.
+func WithRetry(rt http.RoundTripper, opts RetryOptions) http.RoundTripper {
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = 3
+	}
+	if opts.BaseDelay == 0 {
+		opts.BaseDelay = 500 * time.Millisecond
+	}
+	if opts.MaxDelay == 0 {
+		opts.MaxDelay = 30 * time.Second
+	}
+	return &retryTransport{next: rt, opts: opts}
+}
+
+type retryTransport struct {
+	next http.RoundTripper
+	opts RetryOptions
+}
+
+func (r *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	attemptReq := req
+	for attempt := 1; ; attempt++ {
+		resp, err := r.next.RoundTrip(attemptReq)
+		if attempt >= r.opts.MaxAttempts || !shouldRetry(ctx, resp, err) {
+			return resp, err
+		}
+		if !canReplay(req) {
+			if err != nil {
+				err = notReplayableError(err)
+			}
+			return resp, err
+		}
+
+		delay, ok := r.backoff(attempt, resp)
+		if !ok {
+			return resp, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return resp, err
+		}
+
+		next, replayErr := replayRequest(ctx, req)
+		if replayErr != nil {
+			return resp, err
+		}
+		if resp != nil {
+			drainBody(resp.Body)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		attemptReq = next
+	}
+}
+
+// backoff returns the delay before the next attempt, or false if the server asked for a longer delay than allowed.
+func (r *retryTransport) backoff(attempt int, resp *http.Response) (time.Duration, bool) {
+	if r.opts.RespectRetryAfter && resp != nil {
+		if d, ok := parseRetryAfter(resp.Header); ok {
+			return d, d <= r.opts.MaxDelay
+		}
+	}
+
+	d := r.opts.BaseDelay << (attempt - 1)
+	if d <= 0 || d > r.opts.MaxDelay {
+		d = r.opts.MaxDelay
+	}
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1)), true
+}
+
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return isTransientError(err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode == http.StatusNotImplemented, resp.StatusCode == http.StatusHTTPVersionNotSupported:
+		return false
+	default:
+		return resp.StatusCode >= 500
+	}
+}
+
+func isTransientError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// parseRetryAfter reads the delay requested by the server, preferring ARM's millisecond precision header.
+func parseRetryAfter(h http.Header) (time.Duration, bool) {
+	if v := h.Get("X-Ms-Retry-After-Ms"); v != "" {
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+	}
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.ParseInt(v, 10, 64); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// drainBody reads a bounded amount of a discarded response body so its connection can be reused.
+func drainBody(body io.ReadCloser) {
+	if body == nil {
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(body, 4096))
+	body.Close()
+}
@@ -0,0 +1,221 @@
+package armbalancer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// attempts records the remote address of every request received by a test server.
+type attempts struct {
+	lock  sync.Mutex
+	addrs []string
+}
+
+// handler returns a handler recording the attempts before calling fn with the number of the attempt, from 1.
+func (a *attempts) handler(fn func(attempt int, w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.lock.Lock()
+		a.addrs = append(a.addrs, r.RemoteAddr)
+		attempt := len(a.addrs)
+		a.lock.Unlock()
+		fn(attempt, w, r)
+	}
+}
+
+func (a *attempts) Addrs() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]string(nil), a.addrs...)
+}
+
+func TestRetryThrottled(t *testing.T) {
+	var addrs attempts
+	svr, b := newTestServer(t, Options{PoolSize: 4}, addrs.handler(func(attempt int, w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "payload" {
+			t.Errorf("attempt %d received body %q", attempt, body)
+		}
+		if attempt < 3 {
+			w.Header().Set("X-Ms-Retry-After-Ms", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	client := &http.Client{Transport: WithRetry(b, RetryOptions{MaxAttempts: 5, RespectRetryAfter: true})}
+
+	resp, err := client.Post(svr.URL, "text/plain", bytes.NewReader([]byte("payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+	got := addrs.Addrs()
+	if len(got) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(got))
+	}
+	if got[0] == got[1] || got[1] == got[2] {
+		t.Errorf("expected retries to be sent through different pooled connections, got %+s", got)
+	}
+}
+
+func TestRetryServerErrors(t *testing.T) {
+	var addrs attempts
+	svr, b := newTestServer(t, Options{PoolSize: 4}, addrs.handler(func(attempt int, w http.ResponseWriter, r *http.Request) {
+		switch attempt {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	client := &http.Client{Transport: WithRetry(b, RetryOptions{MaxAttempts: 5, BaseDelay: time.Millisecond})}
+
+	resp, err := client.Get(svr.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("expected status 501, got %d", resp.StatusCode)
+	}
+	if len(addrs.Addrs()) != 2 {
+		t.Errorf("expected 2 attempts, got %d", len(addrs.Addrs()))
+	}
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	var addrs attempts
+	svr, b := newTestServer(t, Options{PoolSize: 4}, addrs.handler(func(attempt int, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	client := &http.Client{Transport: WithRetry(b, RetryOptions{MaxAttempts: 3, BaseDelay: time.Millisecond})}
+
+	resp, err := client.Get(svr.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", resp.StatusCode)
+	}
+	if len(addrs.Addrs()) != 3 {
+		t.Errorf("expected 3 attempts, got %d", len(addrs.Addrs()))
+	}
+}
+
+func TestRetryAfterExceedsMaxDelay(t *testing.T) {
+	var addrs attempts
+	svr, b := newTestServer(t, Options{PoolSize: 4}, addrs.handler(func(attempt int, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	client := &http.Client{Transport: WithRetry(b, RetryOptions{MaxDelay: time.Second, RespectRetryAfter: true})}
+
+	resp, err := client.Get(svr.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(addrs.Addrs()) != 1 {
+		t.Errorf("expected 1 attempt, got %d", len(addrs.Addrs()))
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	var addrs attempts
+	svr, b := newTestServer(t, Options{PoolSize: 4}, addrs.handler(func(attempt int, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	client := &http.Client{Transport: WithRetry(b, RetryOptions{RespectRetryAfter: true})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", svr.URL, nil)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", resp.StatusCode)
+	}
+	if len(addrs.Addrs()) != 1 {
+		t.Errorf("expected 1 attempt, got %d", len(addrs.Addrs()))
+	}
+	if ctx.Err() != nil {
+		t.Errorf("expected the throttled response to be returned without waiting for the deadline")
+	}
+}
+
+func TestRetryNonReplayableBody(t *testing.T) {
+	var addrs attempts
+	svr, b := newTestServer(t, Options{PoolSize: 4}, addrs.handler(func(attempt int, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	client := &http.Client{Transport: WithRetry(b, RetryOptions{BaseDelay: time.Millisecond})}
+
+	req, _ := http.NewRequest("PUT", svr.URL, io.NopCloser(strings.NewReader("payload")))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(addrs.Addrs()) != 1 {
+		t.Errorf("expected 1 attempt, got %d", len(addrs.Addrs()))
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		wantOk bool
+	}{
+		{
+			name:   "no header",
+			header: http.Header{},
+		},
+		{
+			name:   "seconds",
+			header: http.Header{"Retry-After": {"3"}},
+			want:   3 * time.Second,
+			wantOk: true,
+		},
+		{
+			name:   "milliseconds take precedence",
+			header: http.Header{"Retry-After": {"3"}, "X-Ms-Retry-After-Ms": {"250"}},
+			want:   250 * time.Millisecond,
+			wantOk: true,
+		},
+		{
+			name:   "date in the past",
+			header: http.Header{"Retry-After": {"Mon, 02 Jan 2006 15:04:05 GMT"}},
+			want:   0,
+			wantOk: true,
+		},
+		{
+			name:   "invalid",
+			header: http.Header{"Retry-After": {"soon"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.header)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("parseRetryAfter() = %s, %t, want %s, %t", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package armbalancer
+
+import "strings"
+
+// bucketScopes classifies rate limiting buckets as instance-scoped, i.e. replenished by recycling the connection
+// to land on another ARM instance, or principal-scoped, i.e. shared by every instance for the tenant or principal.
+type bucketScopes struct {
+	principal map[string]bool // canonical bucket names overriding the default classification
+	instance  map[string]bool
+}
+
+func newBucketScopes(principal, instance []string) bucketScopes {
+	s := bucketScopes{principal: make(map[string]bool), instance: make(map[string]bool)}
+	for _, bucket := range principal {
+		s.principal[canonicalBucket(bucket)] = true
+	}
+	for _, bucket := range instance {
+		s.instance[canonicalBucket(bucket)] = true
+	}
+	return s
+}
+
+// IsPrincipal returns true for principal-scoped buckets.
+func (s bucketScopes) IsPrincipal(bucket string) bool {
+	switch {
+	case s.instance[bucket]:
+		return false
+	case s.principal[bucket]:
+		return true
+	default:
+		return isGlobalBucket(bucket)
+	}
+}
+
+// isGlobalBucket returns true for the buckets known to be tracked per principal rather than per ARM instance,
+// so that recycling connections doesn't replenish them: those of ARM's token-bucket throttling, such as
+// Subscription-Global-Reads, and the tenant-level ones, such as Tenant-Reads.
+func isGlobalBucket(bucket string) bool {
+	return strings.Contains("-"+bucket+"-", "-Global-") || strings.HasPrefix(bucket, "Tenant-")
+}
@@ -0,0 +1,46 @@
+package armbalancer
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBucketScopes(t *testing.T) {
+	s := newBucketScopes([]string{"subscription-writes"}, []string{"tenant-deletes"})
+	for bucket, principal := range map[string]bool{
+		"Subscription-Reads":        false,
+		"Subscription-Global-Reads": true,
+		"Tenant-Reads":              true,
+		"Subscription-Writes":       true,
+		"Tenant-Deletes":            false,
+	} {
+		if s.IsPrincipal(bucket) != principal {
+			t.Errorf("expected %s to be principal-scoped: %t", bucket, principal)
+		}
+	}
+}
+
+func TestTenantBucketDepleted(t *testing.T) {
+	header := func(int64) http.Header {
+		h := remainingReads("1000")
+		h.Set("X-Ms-Ratelimit-Remaining-Tenant-Reads", "0")
+		return h
+	}
+
+	r, log := newFakeRecyclableTransport(DefaultRecyclePolicy{Threshold: 10}, header)
+	defer r.Close(false)
+	for i := 0; i < 3; i++ {
+		sendFake(t, r)
+		log.expect(t, "decide 1: false")
+	}
+	if s := r.Snapshot(); s.Global["Tenant-Reads"] != 0 || len(s.Remaining) != 1 {
+		t.Errorf("expected the tenant bucket to only be tracked as principal-scoped, got %+v", s)
+	}
+
+	r, log = newFakeRecyclableTransport(DefaultRecyclePolicy{Threshold: 10}, header)
+	defer r.Close(false)
+	r.state.scopes = newBucketScopes(nil, []string{"Tenant-Reads"})
+	sendFake(t, r)
+	log.expect(t, "decide 1: true")
+	log.expect(t, "recycle 1")
+}
@@ -0,0 +1,97 @@
+package armbalancer
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// SelectionStrategy decides which pooled transport serves each request.
+type SelectionStrategy int
+
+const (
+	// RoundRobin sends requests to every transport in turn.
+	RoundRobin SelectionStrategy = iota
+
+	// LeastRecentlyUsed sends requests to the idle transport that was used longest ago, or to the transport
+	// with the fewest in-flight requests when none are idle. It keeps the load even when request durations vary,
+	// since transports stuck serving slow requests don't receive more of them.
+	LeastRecentlyUsed
+
+	// LowestLatency sends requests to the transport with the lowest estimated time to first byte, multiplied by its
+	// number of in-flight requests plus one, trying every transport first. Since it ignores the time spent reading
+	// bodies, large responses don't penalize a healthy connection. See TransportStats.TTFB.
+	LowestLatency
+)
+
+// slotUsage tracks how a pooled transport is being used by the selection strategy.
+type slotUsage struct {
+	inflight int64 // atomic
+	lastUsed int64 // atomic, unix nanos of the last dispatch or completion
+
+	ttfb     latencyEstimate // of successful requests
+	duration latencyEstimate // until their body was closed
+}
+
+// pick returns the index of the transport that should serve the next request among pool[lo:lo+n].
+func (t *hostPool) pick(lo, n int, cursor *int64) int {
+	next := atomic.AddInt64(cursor, 1)
+	if t.strategy == LowestLatency {
+		return t.pickLowestLatency(lo, n, int(next))
+	}
+	if t.strategy != LeastRecentlyUsed {
+		return lo + int(next)%n
+	}
+
+	best, bestIdle := -1, false
+	var bestLastUsed, bestInflight int64
+	for i := lo; i < lo+n; i++ {
+		inflight := atomic.LoadInt64(&t.usage[i].inflight)
+		lastUsed := atomic.LoadInt64(&t.usage[i].lastUsed)
+		idle := inflight == 0
+		switch {
+		case best < 0,
+			idle && !bestIdle,
+			idle && bestIdle && lastUsed < bestLastUsed,
+			!idle && !bestIdle && inflight < bestInflight:
+			best, bestIdle, bestLastUsed, bestInflight = i, idle, lastUsed, inflight
+		}
+	}
+	return best
+}
+
+// pickLowestLatency returns the index of the transport with the lowest TTFB estimate weighted by its in-flight
+// requests among pool[lo:lo+n], preferring transports without an estimate. Ties are broken starting from next.
+func (t *hostPool) pickLowestLatency(lo, n, next int) int {
+	best := -1
+	var bestScore float64
+	for j := 0; j < n; j++ {
+		i := lo + (next+j)%n
+		ttfb := t.usage[i].ttfb.Value()
+		if ttfb == 0 {
+			return i
+		}
+		score := float64(ttfb) * float64(atomic.LoadInt64(&t.usage[i].inflight)+1)
+		if best < 0 || score < bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// send dispatches the request to transport i, keeping track of its usage.
+func (t *hostPool) send(i int, req *http.Request) (*http.Response, error) {
+	usage := &t.usage[i]
+	atomic.AddInt64(&usage.inflight, 1)
+	atomic.StoreInt64(&usage.lastUsed, time.Now().UnixNano())
+	defer func() {
+		atomic.StoreInt64(&usage.lastUsed, time.Now().UnixNano())
+		atomic.AddInt64(&usage.inflight, -1)
+	}()
+	req, observe := t.traceLatency(i, req)
+	resp, err := t.pool[i].RoundTrip(req)
+	if err == nil {
+		observe(resp)
+	}
+	return resp, err
+}
@@ -0,0 +1,97 @@
+package armbalancer
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// simulatePool sends requests through a pool of fake transports that serve one request at a time,
+// like HTTP/1 connections. It returns how long the callers sending fast requests took to complete,
+// along with the number of requests served by each transport.
+func simulatePool(t *testing.T, strategy SelectionStrategy) (time.Duration, []int64) {
+	const size = 4
+	served := make([]int64, size)
+	locks := make([]sync.Mutex, size)
+	p := &hostPool{pool: make([]http.RoundTripper, size), strategy: strategy, usage: make([]slotUsage, size)}
+	for i := range p.pool {
+		i := i
+		p.pool[i] = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			locks[i].Lock()
+			defer locks[i].Unlock()
+			atomic.AddInt64(&served[i], 1)
+			if req.URL.Path == "/slow" {
+				time.Sleep(40 * time.Millisecond)
+			} else {
+				time.Sleep(time.Millisecond)
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+		})
+	}
+
+	start := time.Now()
+	var fastElapsed int64
+	var wg sync.WaitGroup
+	for g := 0; g < 3; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for j := 0; j < 30; j++ {
+				path := "/fast"
+				if g == 0 {
+					path = "/slow" // one caller is listing large collections
+				}
+				req, _ := http.NewRequest("GET", "https://management.azure.com"+path, nil)
+				if _, err := p.RoundTrip(req); err != nil {
+					t.Error(err)
+				}
+			}
+			if g != 0 {
+				atomic.AddInt64(&fastElapsed, int64(time.Since(start)))
+			}
+		}(g)
+	}
+	wg.Wait()
+	return time.Duration(fastElapsed), served
+}
+
+func TestLeastRecentlyUsedSelection(t *testing.T) {
+	rrElapsed, rrServed := simulatePool(t, RoundRobin)
+	lruElapsed, lruServed := simulatePool(t, LeastRecentlyUsed)
+	t.Logf("round robin: %s %v, least recently used: %s %v", rrElapsed, rrServed, lruElapsed, lruServed)
+
+	if lruElapsed >= rrElapsed {
+		t.Errorf("expected least recently used selection to keep fast requests from queueing behind slow ones, took %s vs %s", lruElapsed, rrElapsed)
+	}
+	var total int64
+	for _, n := range lruServed {
+		total += n
+		if n == 0 {
+			t.Errorf("expected every transport to serve requests, got %v", lruServed)
+		}
+	}
+	if total != 90 {
+		t.Errorf("expected 90 requests to be served, got %d", total)
+	}
+}
+
+func TestLeastRecentlyUsedPick(t *testing.T) {
+	p := &hostPool{pool: make([]http.RoundTripper, 3), strategy: LeastRecentlyUsed, usage: make([]slotUsage, 3)}
+	p.usage[0] = slotUsage{lastUsed: 10}
+	p.usage[1] = slotUsage{lastUsed: 5, inflight: 1}
+	p.usage[2] = slotUsage{lastUsed: 20}
+	if i := p.pick(0, 3, &p.cursor); i != 0 {
+		t.Errorf("expected the idle transport used longest ago to be picked, got %d", i)
+	}
+
+	p.usage[0].inflight = 2
+	p.usage[2].inflight = 3
+	if i := p.pick(0, 3, &p.cursor); i != 1 {
+		t.Errorf("expected the transport with the fewest in-flight requests to be picked, got %d", i)
+	}
+	if i := p.pick(2, 1, &p.cursor); i != 2 {
+		t.Errorf("expected the pick to stay within the given range, got %d", i)
+	}
+}
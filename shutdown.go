@@ -0,0 +1,146 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrClosed is returned for requests sent through a balancer after Shutdown or Close has been called.
+var ErrClosed = errors.New("armbalancer: balancer is closed")
+
+// Shutdown gracefully shuts down the balancer. New requests immediately fail with ErrClosed,
+// while requests already in flight are given until ctx expires to complete, including reading their response bodies.
+// Once they have, idle connections are closed and background goroutines are stopped.
+//
+// The pools of every host are drained concurrently, sharing the deadline of ctx. If it expires first,
+// the connections of the pools that didn't drain are closed underneath the lingering requests, while
+// the other pools are closed gracefully, and a *ShutdownError keyed by the host:port of the lagging pools
+// is returned. It matches the context's error, which is returned as is when the lingering requests aren't
+// served by a pool, e.g. redirects. The state is then saved to Options.StateStore, if set,
+// and the error of saving it is returned otherwise.
+func (t *Balancer) Shutdown(ctx context.Context) error {
+	return t.shutdown(ctx, false)
+}
+
+// shutdown implements Shutdown, closing the connections of every pool instead of only the lagging ones when force
+// is true.
+func (t *Balancer) shutdown(ctx context.Context, force bool) error {
+	t.closeLock.Lock()
+	if !t.closed && t.idle != nil {
+		close(t.idle)
+	}
+	if !t.closed && t.diversity != nil {
+		close(t.diversity)
+	}
+	if !t.closed {
+		t.releaseParents()
+	}
+	t.closed = true
+	t.closeLock.Unlock()
+
+	lagging := make([]bool, len(t.hosts))
+	var wg sync.WaitGroup
+	for i, p := range t.hosts {
+		wg.Add(1)
+		go func(i int, p *hostPool) {
+			defer wg.Done()
+			lagging[i] = p.active.Wait(ctx) != nil
+		}(i, p)
+	}
+	wg.Wait()
+
+	// Requests that aren't served by a pool, or haven't reached theirs yet
+	err := t.inflight.Wait(ctx)
+
+	errs := make(map[string]error)
+	for i, p := range t.hosts {
+		if lagging[i] {
+			key := net.JoinHostPort(p.host, p.port)
+			if p.audience != "" {
+				key += " for audience " + p.audience
+			}
+			errs[key] = ctx.Err()
+		}
+		for _, rt := range p.pool {
+			if r, ok := rt.(*recyclableTransport); ok {
+				r.Close(force || lagging[i])
+			}
+		}
+	}
+	if len(errs) > 0 {
+		err = &ShutdownError{Errors: errs}
+	}
+	if t.redirects != nil {
+		t.redirects.Close(force || err != nil)
+	}
+	if t.passthrough != nil {
+		t.closePassthrough()
+	}
+	if t.store != nil {
+		if saveErr := t.saveState(); err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// Close immediately shuts down the balancer, closing all connections including those serving in-flight requests.
+// It returns the same errors as Shutdown with a canceled context: a *ShutdownError if requests were in flight,
+// or the error of saving the state.
+func (t *Balancer) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return t.shutdown(ctx, true)
+}
+
+// drainCounter counts the requests in flight through a balancer or a host pool, so that Shutdown can wait for them.
+// Host pools count them until their response bodies are closed.
+type drainCounter struct {
+	lock    sync.Mutex
+	n       int
+	drained chan struct{} // closed once n drops to zero, nil unless Wait is waiting
+}
+
+func (c *drainCounter) Add(delta int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.n += delta
+	if c.n == 0 && c.drained != nil {
+		close(c.drained)
+		c.drained = nil
+	}
+}
+
+// Wait returns once no requests are in flight, or the context's error if it expires first.
+func (c *drainCounter) Wait(ctx context.Context) error {
+	c.lock.Lock()
+	if c.n == 0 {
+		c.lock.Unlock()
+		return nil
+	}
+	if c.drained == nil {
+		c.drained = make(chan struct{})
+	}
+	drained := c.drained
+	c.lock.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// acquire registers an in-flight request, returning false if the balancer has been closed.
+func (t *Balancer) acquire() bool {
+	t.closeLock.RLock()
+	defer t.closeLock.RUnlock()
+	if t.closed {
+		return false
+	}
+	t.inflight.Add(1)
+	return true
+}
@@ -0,0 +1,293 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// slowHandler returns a handler blocking requests to /slow until release is closed, and a channel receiving a value
+// whenever such a request is received.
+func slowHandler(release <-chan struct{}) (http.HandlerFunc, <-chan struct{}) {
+	started := make(chan struct{}, 1)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slow" {
+			return
+		}
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}, started
+}
+
+func TestShutdownDrain(t *testing.T) {
+	release := make(chan struct{})
+	handler, started := slowHandler(release)
+	svr, b := newTestServer(t, Options{PoolSize: 2}, handler)
+	client := &http.Client{Transport: b}
+
+	reqErr := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(svr.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		reqErr <- err
+	}()
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdownErr <- b.Shutdown(ctx)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := client.Get(svr.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if errors.Is(err, ErrClosed) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected new requests to fail with ErrClosed during shutdown, got: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("shutdown returned before the in-flight request completed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-reqErr; err != nil {
+		t.Errorf("expected in-flight request to complete, got: %s", err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("expected clean shutdown, got: %s", err)
+	}
+}
+
+func TestShutdownDeadlineExceeded(t *testing.T) {
+	handler, started := slowHandler(nil)
+	svr, b := newTestServer(t, Options{PoolSize: 2}, handler)
+	client := &http.Client{Transport: b}
+
+	reqErr := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(svr.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		reqErr <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := b.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected shutdown to exceed its deadline, got: %v", err)
+	}
+
+	select {
+	case err := <-reqErr:
+		if err == nil {
+			t.Error("expected the lingering request to fail when its connection was closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lingering request wasn't interrupted by shutdown")
+	}
+}
+
+func TestClose(t *testing.T) {
+	handler, _ := slowHandler(nil)
+	svr, b := newTestServer(t, Options{PoolSize: 2}, handler)
+	client := &http.Client{Transport: b}
+
+	resp, err := client.Get(svr.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(svr.URL); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got: %v", err)
+	}
+	for _, rt := range b.hosts[0].pool {
+		if n := rt.(*recyclableTransport).conns.Len(); n != 0 {
+			t.Errorf("expected all connections to be closed, %d remain open", n)
+		}
+	}
+}
+
+func TestCloseInFlight(t *testing.T) {
+	handler, started := slowHandler(nil)
+	svr, b := newTestServer(t, Options{PoolSize: 2}, handler)
+	client := &http.Client{Transport: b}
+
+	reqErr := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(svr.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		reqErr <- err
+	}()
+	<-started
+
+	err := b.Close()
+	if !errors.As(err, new(*ShutdownError)) || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the pool serving the in-flight request to be reported, got: %v", err)
+	}
+	if err := <-reqErr; err == nil {
+		t.Error("expected the in-flight request to fail when its connection was closed")
+	}
+}
+
+func TestShutdownHostPools(t *testing.T) {
+	hang, release := make(chan struct{}), make(chan struct{})
+	defer close(hang)
+	var servers []*httptest.Server
+	var started []<-chan struct{}
+	for i := 0; i < 3; i++ {
+		unblock := release
+		if i == 0 {
+			unblock = hang
+		}
+		handler, s := slowHandler(unblock)
+		svr := httptest.NewUnstartedServer(handler)
+		svr.EnableHTTP2 = true
+		svr.StartTLS()
+		defer svr.Close()
+		servers = append(servers, svr)
+		started = append(started, s)
+	}
+	builder := NewBuilder(servers[0].Client().Transport.(*http.Transport)).WithOptions(Options{PoolSize: 1})
+	for _, svr := range servers {
+		u, _ := url.Parse(svr.URL)
+		builder.AddHost(u.Host, HostOptions{})
+	}
+	b, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: b}
+
+	reqErrs := make([]chan error, len(servers))
+	for i, svr := range servers {
+		reqErrs[i] = make(chan error, 1)
+		go func(svr *httptest.Server, reqErr chan<- error) {
+			resp, err := client.Get(svr.URL + "/slow")
+			if err == nil {
+				resp.Body.Close()
+			}
+			reqErr <- err
+		}(svr, reqErrs[i])
+		<-started[i]
+	}
+
+	// The first host's request hangs, while the others complete during the shutdown
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = b.Shutdown(ctx)
+	var shutdownErr *ShutdownError
+	laggard, _ := url.Parse(servers[0].URL)
+	if !errors.As(err, &shutdownErr) || len(shutdownErr.Errors) != 1 || shutdownErr.Errors[laggard.Host] == nil {
+		t.Fatalf("expected only the lagging host to be reported, got: %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the error to match the deadline, got: %v", err)
+	}
+	for i := 1; i < len(servers); i++ {
+		if err := <-reqErrs[i]; err != nil {
+			t.Errorf("expected the other hosts to drain cleanly, got: %s", err)
+		}
+	}
+	select {
+	case err := <-reqErrs[0]:
+		if err == nil {
+			t.Error("expected the hung request to fail when its connection was closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hung request wasn't interrupted by shutdown")
+	}
+}
+
+func TestShutdownStreamingBody(t *testing.T) {
+	release := make(chan struct{})
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first,"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte("last"))
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	for _, graceful := range []bool{true, false} {
+		b := New(Options{Transport: svr.Client().Transport.(*http.Transport), Host: u.Host, PoolSize: 1})
+		resp, err := (&http.Client{Transport: b}).Get(svr.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		shutdownErr := make(chan error, 1)
+		go func() { shutdownErr <- b.Shutdown(ctx) }()
+		p := &b.hosts[0].active
+		waitFor(t, "shutdown to wait for the body", func() bool {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			return p.drained != nil
+		})
+		select {
+		case err := <-shutdownErr:
+			t.Fatalf("expected shutdown to wait for the response body, got: %v", err)
+		default:
+		}
+
+		if graceful {
+			release <- struct{}{}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || string(body) != "first,last" {
+				t.Errorf("expected the body to be streamed across shutdown, got %q: %v", body, err)
+			}
+			if err := <-shutdownErr; err != nil {
+				t.Errorf("expected clean shutdown, got: %s", err)
+			}
+		} else {
+			cancel()
+			if err := <-shutdownErr; !errors.As(err, new(*ShutdownError)) {
+				t.Errorf("expected the pool streaming the body to be reported, got: %v", err)
+			}
+			if _, err := io.ReadAll(resp.Body); err == nil {
+				t.Error("expected the body to be interrupted once shutdown exceeded its deadline")
+			}
+			resp.Body.Close()
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,144 @@
+package armbalancer
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// isDialExhaustion reports whether a dial error indicates that the node is running out of source ports or
+// addresses, e.g. SNAT port exhaustion: the local address can't be assigned, or the dial timed out.
+func isDialExhaustion(err error) bool {
+	if errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout()
+}
+
+// dialPressure reduces the effective size of a pool while its dials fail with exhaustion errors,
+// and restores it one slot at a time once dials succeed again.
+type dialPressure struct {
+	host         string // host:port
+	size         int    // slots that can be removed, i.e. excluding those reserved for writes
+	restoreAfter time.Duration
+	clock        clock
+	onChange     func(DialPressureEvent)
+
+	reduced int32 // atomic, slots removed from the pool, only written with the lock held
+
+	lock       sync.Mutex
+	changed    time.Time // of the latest shrink or restore
+	recovering bool      // a dial succeeded since the latest exhaustion error
+	shrinks    int64
+	restores   int64
+}
+
+func newDialPressure(host string, size int, restoreAfter time.Duration, onChange func(DialPressureEvent)) *dialPressure {
+	return &dialPressure{host: host, size: size, restoreAfter: restoreAfter, clock: realClock{}, onChange: onChange}
+}
+
+// Record accounts for the outcome of a dial.
+func (d *dialPressure) Record(err error) {
+	if d == nil || (err != nil && !isDialExhaustion(err)) {
+		return
+	}
+	d.lock.Lock()
+	var event *DialPressureEvent
+	if err != nil {
+		d.recovering = false
+		if reduced := atomic.LoadInt32(&d.reduced); int(reduced) < d.size-1 {
+			atomic.StoreInt32(&d.reduced, reduced+1)
+			d.changed = d.clock.Now()
+			d.shrinks++
+			event = &DialPressureEvent{Host: d.host, Shrunk: true, Active: d.size - int(reduced) - 1, Err: err}
+		}
+	} else {
+		d.recovering = true
+		event = d.restore()
+	}
+	d.lock.Unlock()
+	if event != nil && d.onChange != nil {
+		d.onChange(*event)
+	}
+}
+
+// Reduced returns how many slots are currently removed from the pool.
+func (d *dialPressure) Reduced() int {
+	if d == nil || atomic.LoadInt32(&d.reduced) == 0 {
+		return 0
+	}
+	d.lock.Lock()
+	event := d.restore()
+	reduced := int(atomic.LoadInt32(&d.reduced))
+	d.lock.Unlock()
+	if event != nil && d.onChange != nil {
+		d.onChange(*event)
+	}
+	return reduced
+}
+
+// restore gives back a slot if dials have been succeeding for restoreAfter. It must be called with the lock held.
+func (d *dialPressure) restore() *DialPressureEvent {
+	now := d.clock.Now()
+	reduced := atomic.LoadInt32(&d.reduced)
+	if reduced == 0 || !d.recovering || now.Sub(d.changed) < d.restoreAfter {
+		return nil
+	}
+	atomic.StoreInt32(&d.reduced, reduced-1)
+	d.changed = now
+	d.restores++
+	return &DialPressureEvent{Host: d.host, Active: d.size - int(reduced) + 1}
+}
+
+// RecycleDelay returns how long recycles should be held back, which is until the pool would next be restored.
+func (d *dialPressure) RecycleDelay() time.Duration {
+	if d == nil || atomic.LoadInt32(&d.reduced) == 0 {
+		return 0
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if delay := d.changed.Add(d.restoreAfter).Sub(d.clock.Now()); delay > 0 {
+		return delay
+	}
+	return 0
+}
+
+// Stats returns the effective pool size and the number of shrinks and restores so far.
+func (d *dialPressure) Stats() (active int, shrinks, restores int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.size - int(atomic.LoadInt32(&d.reduced)), d.shrinks, d.restores
+}
+
+// quiesceReduced quiesces the slots removed from the pool by dial pressure, closing their idle connections.
+func (t *hostPool) quiesceReduced(e DialPressureEvent) {
+	if !e.Shrunk {
+		return
+	}
+	for i := e.Active; i < len(t.pool)-t.reservedWrites; i++ {
+		if r, ok := t.pool[i].(*recyclableTransport); ok {
+			r.Quiesce()
+		}
+	}
+}
+
+// reducedSlot reports whether the slot at index i has been removed from the pool by dial pressure.
+func (t *hostPool) reducedSlot(i int) bool {
+	if t.pressure == nil {
+		return false
+	}
+	active, _, _ := t.pressure.Stats()
+	return i >= active && i < len(t.pool)-t.reservedWrites
+}
+
+// activeSlots removes the slots reduced by dial pressure from the first n slots of the pool, keeping at least one.
+func (t *hostPool) activeSlots(n int) int {
+	if n -= t.pressure.Reduced(); n < 1 {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,146 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsDialExhaustion(t *testing.T) {
+	addrNotAvail := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EADDRNOTAVAIL)}
+	dialTimeout := &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"address not available", addrNotAvail, true},
+		{"bare errno", syscall.EADDRNOTAVAIL, true},
+		{"wrapped address not available", fmt.Errorf("dialing: %w", addrNotAvail), true},
+		{"transport error", &url.Error{Op: "Get", URL: "https://management.azure.com", Err: &TransportError{Err: addrNotAvail}}, true},
+		{"dial timeout", dialTimeout, true},
+		{"wrapped dial timeout", fmt.Errorf("proxy: %w", dialTimeout), true},
+		{"read timeout", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, false},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, false},
+		{"other", errors.New("cannot assign"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDialExhaustion(tt.err); got != tt.want {
+				t.Errorf("isDialExhaustion(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialPressure(t *testing.T) {
+	var events []DialPressureEvent
+	d := newDialPressure("host:443", 3, time.Minute, func(e DialPressureEvent) { events = append(events, e) })
+	clock := newFakeClock()
+	d.clock = clock
+	exhausted := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.EADDRNOTAVAIL}
+
+	d.Record(errors.New("refused"))
+	if got := d.Reduced(); got != 0 {
+		t.Fatalf("expected unrelated errors to be ignored, got %d reduced slots", got)
+	}
+	d.Record(exhausted)
+	d.Record(exhausted)
+	d.Record(exhausted)
+	if got := d.Reduced(); got != 2 {
+		t.Fatalf("expected the pool to keep a slot, got %d reduced slots", got)
+	}
+	if got := d.RecycleDelay(); got != time.Minute {
+		t.Errorf("expected recycles to be delayed by a minute, got %s", got)
+	}
+
+	d.Record(nil)
+	if got := d.Reduced(); got != 2 {
+		t.Fatalf("expected no restore before a minute, got %d reduced slots", got)
+	}
+	clock.Advance(time.Minute)
+	if got := d.RecycleDelay(); got != 0 {
+		t.Errorf("expected recycles to be allowed, got a delay of %s", got)
+	}
+	if got := d.Reduced(); got != 1 {
+		t.Fatalf("expected a slot to be restored, got %d reduced slots", got)
+	}
+	clock.Advance(30 * time.Second)
+	d.Record(exhausted)
+	clock.Advance(time.Minute)
+	if got := d.Reduced(); got != 2 {
+		t.Fatalf("expected no restore until dials succeed again, got %d reduced slots", got)
+	}
+	d.Record(nil)
+	clock.Advance(time.Minute)
+	d.Record(nil)
+	if got := d.Reduced(); got != 0 {
+		t.Fatalf("expected the pool to be restored, got %d reduced slots", got)
+	}
+
+	var actives []string
+	for _, e := range events {
+		actives = append(actives, fmt.Sprintf("%t:%d", e.Shrunk, e.Active))
+	}
+	if got, want := fmt.Sprint(actives), "[true:2 true:1 false:2 true:1 false:2 false:3]"; got != want {
+		t.Errorf("expected events %s, got %s", want, got)
+	}
+	if _, shrinks, restores := d.Stats(); shrinks != 3 || restores != 3 {
+		t.Errorf("expected 3 shrinks and 3 restores, got %d and %d", shrinks, restores)
+	}
+}
+
+func TestAdaptToDialPressure(t *testing.T) {
+	parent := http.DefaultTransport.(*http.Transport).Clone()
+	parent.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.EADDRNOTAVAIL)}
+	}
+	events := make(chan DialPressureEvent, 16)
+	b := New(Options{
+		Host:                "management.azure.com",
+		Transport:           parent,
+		PoolSize:            4,
+		AdaptToDialPressure: true,
+		OnDialPressure:      func(e DialPressureEvent) { events <- e },
+	})
+	defer b.Close()
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://management.azure.com/subscriptions", nil)
+		if _, err := b.RoundTrip(req); err == nil {
+			t.Fatal("expected the dial to fail")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		e := <-events
+		if !e.Shrunk || e.Active != 3-i || e.Host != "management.azure.com:443" || !errors.Is(e.Err, syscall.EADDRNOTAVAIL) {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+
+	stats := b.Stats()
+	if stats.DialPressureShrinks != 2 {
+		t.Errorf("expected 2 shrinks, got %d", stats.DialPressureShrinks)
+	}
+	var reduced []int
+	for _, ts := range stats.Transports {
+		if ts.ReducedByDialPressure {
+			reduced = append(reduced, ts.ID)
+			if !ts.Quiesced {
+				t.Errorf("expected transport %d to be quiesced", ts.ID)
+			}
+		}
+	}
+	if fmt.Sprint(reduced) != "[2 3]" {
+		t.Errorf("expected transports 2 and 3 to be reduced, got %v", reduced)
+	}
+}
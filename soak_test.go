@@ -0,0 +1,89 @@
+package armbalancer_test
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/Azure/go-armbalancer"
+	"github.com/Azure/go-armbalancer/armbalancertest"
+)
+
+func TestSoak(t *testing.T) {
+	limit := 20
+
+	rec := &armbalancertest.Recorder{}
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Proto != "HTTP/2.0" {
+			t.Errorf("received request with proto: %s", r.Proto)
+		}
+
+		if r.Header.Get("Test") != "true" {
+			return // don't handle any requests from outside the test
+		}
+
+		n := 1
+		if rec.Add(r.RemoteAddr, 0) == 0 && rand.Intn(100) == 1 {
+			// randomly start new connections with zero quota to test min reqs per connection configuration
+			n = limit
+		}
+		count := rec.Add(r.RemoteAddr, n)
+
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Test", strconv.Itoa(limit-count))
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Dummy", "10")
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Invalid", "not-a-number")
+	}))
+	svr.Config.ConnState = rec.ConnState
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	u, _ := url.Parse(svr.URL)
+	opts := armbalancer.Options{
+		Transport:            svr.Client().Transport.(*http.Transport),
+		Host:                 u.Host,
+		PoolSize:             8,
+		RecycleThreshold:     5,
+		MinReqsBeforeRecycle: 6,
+	}
+	client := &http.Client{Transport: armbalancer.New(opts)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Add(-1)
+			for j := 0; j < 500; j++ {
+				req, _ := http.NewRequest("GET", svr.URL, nil)
+				req.Header.Set("Test", "true")
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, err := client.Get("http://not-the-host")
+	if err == nil || err.Error() != fmt.Sprintf(`Get "http://not-the-host": host "not-the-host" is not supported by the configured ARM balancer, supported host name is %q`, u.Hostname()) {
+		t.Errorf("expected error when requesting host other than the one configured, got: %s", err)
+	}
+
+	// Since connection recycling is async, we can't expect 100% conformance to the configured limits
+	report := armbalancertest.ConformanceReport(rec.Observations(), opts, armbalancertest.Criteria{
+		Limit:          limit,
+		MinConnections: 100,
+		MinClosedRatio: 0.25,
+	})
+	for _, v := range report.Violations {
+		t.Errorf("%s %+s", v, v.Addrs)
+	}
+}
@@ -0,0 +1,123 @@
+package armbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewWithValidation is like New, but returns an error instead of panicking, and validates that the host can be
+// reached like Options.ValidateOnStart does. Use New to construct a balancer offline.
+func NewWithValidation(opts Options) (*Balancer, error) {
+	opts.ValidateOnStart = true
+	return NewBuilder(opts.Transport).WithOptions(opts).AddHost(opts.Host, HostOptions{}).Build()
+}
+
+// StartupValidationError is returned when hosts can't be reached by Options.ValidateOnStart.
+type StartupValidationError struct {
+	Errors map[string]error // keyed by host:port
+}
+
+func (e *StartupValidationError) Error() string {
+	hosts := make([]string, 0, len(e.Errors))
+	for hostport := range e.Errors {
+		hosts = append(hosts, hostport)
+	}
+	sort.Strings(hosts)
+	msgs := make([]string, len(hosts))
+	for i, hostport := range hosts {
+		msgs[i] = fmt.Sprintf("%s: %s", hostport, e.Errors[hostport])
+	}
+	return "armbalancer: unreachable hosts " + strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of the dial errors matches target, e.g. context.DeadlineExceeded.
+func (e *StartupValidationError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateHosts performs a TLS handshake with every host, concurrently, using a clone of its pool's parent
+// transport. Hosts the parent reaches through a proxy are skipped.
+func (t *Balancer) validateHosts(timeout time.Duration) error {
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		errs = make(map[string]error)
+		seen = make(map[string]bool)
+	)
+	for _, p := range t.hosts {
+		hostport := net.JoinHostPort(p.host, p.port)
+		if seen[hostport] || p.parent == nil {
+			continue
+		}
+		seen[hostport] = true
+		wg.Add(1)
+		go func(tx *http.Transport, host, hostport string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := handshake(ctx, tx, host, hostport); err != nil {
+				lock.Lock()
+				errs[hostport] = err
+				lock.Unlock()
+			}
+		}(p.parent.Clone(), p.host, hostport)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return &StartupValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// handshake dials the host and performs a TLS handshake using the transport's dialers and TLS configuration.
+func handshake(ctx context.Context, tx *http.Transport, host, hostport string) error {
+	if tx.Proxy != nil {
+		proxy, err := tx.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: hostport}})
+		if err != nil {
+			return err
+		}
+		if proxy != nil {
+			return nil
+		}
+	}
+	if tx.DialTLSContext != nil {
+		conn, err := tx.DialTLSContext(ctx, "tcp", hostport)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	dial := tx.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	raw, err := dial(ctx, "tcp", hostport)
+	if err != nil {
+		return err
+	}
+	cfg := &tls.Config{}
+	if tx.TLSClientConfig != nil {
+		cfg = tx.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = canonicalHostName(host)
+	}
+	conn := tls.Client(raw, cfg)
+	defer conn.Close()
+	return conn.HandshakeContext(ctx)
+}
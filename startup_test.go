@@ -0,0 +1,62 @@
+package armbalancer
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateOnStart(t *testing.T) {
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	trusted := svr.Client().Transport.(*http.Transport)
+	b, err := NewWithValidation(Options{Host: u.Host, Transport: trusted})
+	if err != nil {
+		t.Fatalf("expected the host to be reachable with the server's CA, got: %s", err)
+	}
+	b.Close()
+
+	// The closed port is reserved by a listener closed right away
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	untrusted := &http.Transport{} // without the server's CA
+	_, err = NewBuilder(untrusted).
+		WithOptions(Options{ValidateOnStart: true}).
+		AddHost(u.Host, HostOptions{}).
+		AddHost(closed, HostOptions{}).
+		Build()
+	var verr *StartupValidationError
+	if !errors.As(err, &verr) || len(verr.Errors) != 2 {
+		t.Fatalf("expected both hosts to be reported, got: %v", err)
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	if !errors.As(verr.Errors[u.Host], &unknownAuthority) {
+		t.Errorf("expected the untrusted certificate to be reported, got: %v", verr.Errors[u.Host])
+	}
+	if verr.Errors[closed] == nil || !strings.Contains(err.Error(), closed) {
+		t.Errorf("expected the closed port to be reported, got: %s", err)
+	}
+
+	// Validation is skipped unless requested, e.g. to construct the balancer offline
+	b = New(Options{Host: closed, Transport: untrusted})
+	b.Close()
+
+	proxied := &http.Transport{Proxy: func(*http.Request) (*url.URL, error) { return url.Parse("http://" + closed) }}
+	b, err = NewWithValidation(Options{Host: u.Host, Transport: proxied})
+	if err != nil {
+		t.Errorf("expected hosts reached through a proxy to be skipped, got: %s", err)
+	}
+	b.Close()
+}
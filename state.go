@@ -0,0 +1,132 @@
+package armbalancer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"time"
+)
+
+// StateStore persists what the balancer learned about the rate limiting quota across process restarts,
+// see Options.StateStore. Load returns nil when nothing has been saved yet.
+type StateStore interface {
+	Save([]byte) error
+	Load() ([]byte, error)
+}
+
+// FileStateStore is a StateStore keeping the state in a file, which is replaced atomically when saved.
+type FileStateStore struct {
+	Path string
+}
+
+func (f FileStateStore) Save(data []byte) error {
+	tmp := f.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.Path)
+}
+
+func (f FileStateStore) Load() ([]byte, error) {
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// savedState is the JSON document persisted by StateStore.
+type savedState struct {
+	SavedAt time.Time        `json:"savedAt"`
+	Buckets map[string]int64 `json:"buckets,omitempty"` // lowest remaining quota of every bucket across all pools
+
+	// Backoffs holds the churn backoffs that were suspending recycling, see Options.ChurnBackoffGenerations.
+	Backoffs []savedBackoff `json:"backoffs,omitempty"`
+
+	expires time.Time // SavedAt plus the TTL
+}
+
+type savedBackoff struct {
+	Host        string        `json:"host"` // host:port
+	Audience    string        `json:"audience,omitempty"`
+	TransportID int           `json:"transportId"`
+	Backoff     time.Duration `json:"backoff"`
+	Until       time.Time     `json:"until"`
+}
+
+// loadState returns the persisted state, or nil if there's none, it can't be loaded or it's older than ttl.
+func loadState(store StateStore, ttl time.Duration) *savedState {
+	if store == nil {
+		return nil
+	}
+	data, err := store.Load()
+	if err != nil || data == nil {
+		return nil
+	}
+	state := &savedState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil
+	}
+	state.expires = state.SavedAt.Add(ttl)
+	if time.Now().After(state.expires) {
+		return nil
+	}
+	return state
+}
+
+// bucket returns the persisted remaining quota of the bucket, until the state expires.
+func (s *savedState) bucket(name string) (int64, bool) {
+	if s == nil || time.Now().After(s.expires) {
+		return 0, false
+	}
+	val, ok := s.Buckets[name]
+	return val, ok
+}
+
+// backoff returns the persisted churn backoff of a pooled transport, if it's still suspending recycling.
+func (s *savedState) backoff(host, port, audience string, id int) (savedBackoff, bool) {
+	if s == nil {
+		return savedBackoff{}, false
+	}
+	hostport := net.JoinHostPort(host, port)
+	for _, b := range s.Backoffs {
+		if b.Host == hostport && b.Audience == audience && b.TransportID == id && time.Now().Before(b.Until) {
+			return b, true
+		}
+	}
+	return savedBackoff{}, false
+}
+
+// saveState persists the lowest remaining quota of every bucket and the churn backoffs of every pooled transport.
+func (t *Balancer) saveState() error {
+	state := savedState{SavedAt: time.Now(), Buckets: map[string]int64{}}
+	for _, p := range t.hosts {
+		for _, rt := range p.pool {
+			r, ok := rt.(*recyclableTransport)
+			if !ok {
+				continue
+			}
+			for bucket, val := range r.state.Snapshot() {
+				if min, ok := state.Buckets[bucket]; !ok || val < min {
+					state.Buckets[bucket] = val
+				}
+			}
+			if backoff, until := r.churn.State(); time.Now().Before(until) {
+				state.Backoffs = append(state.Backoffs, savedBackoff{
+					Host:        net.JoinHostPort(p.host, p.port),
+					Audience:    p.audience,
+					TransportID: r.id,
+					Backoff:     backoff,
+					Until:       until,
+				})
+			}
+		}
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return t.store.Save(data)
+}
@@ -0,0 +1,96 @@
+package armbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStateStore(t *testing.T) {
+	store := FileStateStore{Path: filepath.Join(t.TempDir(), "state.json")}
+	if data, err := store.Load(); data != nil || err != nil {
+		t.Errorf("expected nothing to be loaded before saving, got %q: %v", data, err)
+	}
+	if err := store.Save([]byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := store.Load(); string(data) != `{"a":1}` || err != nil {
+		t.Errorf("expected the saved data to be loaded, got %q: %v", data, err)
+	}
+}
+
+func TestStatePersistence(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Writes", "42")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	store := FileStateStore{Path: filepath.Join(t.TempDir(), "state.json")}
+	newBalancer := func() *Balancer {
+		return New(Options{Transport: svr.Client().Transport.(*http.Transport), Host: u.Host, PoolSize: 2, StateStore: store, AllowSharedParent: true})
+	}
+
+	b := newBalancer()
+	req, _ := http.NewRequest("PUT", svr.URL, nil)
+	resp, err := b.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := b.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newBalancer()
+	defer restarted.Close()
+	if _, err := restarted.Reserve("Subscription-Writes", 40); err != nil {
+		t.Errorf("expected the persisted quota to be reserved from before any request, got: %s", err)
+	}
+	if _, err := restarted.Reserve("Subscription-Writes", 10); !errors.Is(err, ErrInsufficientQuota) {
+		t.Errorf("expected the persisted quota to be exhausted, got: %v", err)
+	}
+
+	// Churn backoffs are restored and saved again, while expired state is discarded
+	until := time.Now().Add(time.Hour).Round(0)
+	data, _ := json.Marshal(savedState{
+		SavedAt:  time.Now(),
+		Buckets:  map[string]int64{"Subscription-Reads": 10},
+		Backoffs: []savedBackoff{{Host: u.Host, TransportID: 1, Backoff: time.Minute, Until: until}},
+	})
+	if err := store.Save(data); err != nil {
+		t.Fatal(err)
+	}
+	b = newBalancer()
+	if backoff, suspended := b.hosts[0].pool[1].(*recyclableTransport).churn.State(); backoff != time.Minute || !suspended.Equal(until) {
+		t.Errorf("expected the churn backoff to be restored, got %s until %s", backoff, suspended)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	state := loadState(store, time.Minute)
+	if state == nil || len(state.Backoffs) != 1 || !state.Backoffs[0].Until.Equal(until) {
+		t.Errorf("expected the churn backoff to be saved again, got %+v", state)
+	}
+	if _, ok := state.bucket("Subscription-Reads"); ok {
+		t.Error("expected buckets that weren't reported since the restart not to be saved again")
+	}
+
+	data, _ = json.Marshal(savedState{SavedAt: time.Now().Add(-time.Hour), Buckets: map[string]int64{"Subscription-Reads": 10}})
+	if err := store.Save(data); err != nil {
+		t.Fatal(err)
+	}
+	b = newBalancer()
+	defer b.Close()
+	if _, err := b.Reserve("Subscription-Reads", 1); !errors.Is(err, ErrInsufficientQuota) {
+		t.Errorf("expected state older than the TTL to be discarded, got: %v", err)
+	}
+}
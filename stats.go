@@ -0,0 +1,263 @@
+package armbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point-in-time snapshot of the balancer's pooled transports.
+type Stats struct {
+	Transports []TransportStats
+
+	// AcquireWaitP50 and AcquireWaitP99 are quantiles of the time recent requests spent between entering
+	// the balancer and being dispatched on a connection.
+	AcquireWaitP50 time.Duration
+	AcquireWaitP99 time.Duration
+
+	// Attribution counts the requests by method and normalized path prefix. It's nil unless Options.TrackAttribution is set.
+	Attribution map[string]int64
+
+	// BypassedRequests counts the requests sent with a context returned by WithBypass.
+	BypassedRequests int64
+
+	// GoAwayReplays counts the requests replayed on another transport after the server sent an HTTP/2 GOAWAY
+	// and closed the connection serving them.
+	GoAwayReplays int64
+
+	// TightDeadlineRedirects counts the requests with an Options.TightDeadline sent to another transport than the one
+	// picked by the SelectionStrategy, because it was about to be recycled.
+	TightDeadlineRedirects int64
+
+	// NewConnectionsLastMinute is the number of connections established by the pooled transports over the last minute.
+	NewConnectionsLastMinute int
+
+	// DialPressureShrinks and DialPressureRestores count the slots removed and restored by Options.AdaptToDialPressure.
+	DialPressureShrinks  int64
+	DialPressureRestores int64
+
+	// BackendDiversity is the number of distinct remote IPs of the current connections of every host:port, divided by
+	// the number of its transports with an open connection. Hosts without connections are omitted.
+	// Values well below 1 usually mean that DNS returns a single address. See Options.MinBackendDiversity.
+	BackendDiversity map[string]float64
+
+	// Callers counts the recent requests of every caller by rate limiting bucket, over Options.CallerBudgetWindow.
+	// It's nil unless Options.CallerBudgets is set. Requests without a caller are counted under the empty name.
+	Callers map[string]map[string]int64
+}
+
+// TransportStats describes a single pooled transport.
+// Unless noted otherwise, counters cover the transport's current connection and are reset when it is recycled.
+type TransportStats struct {
+	Host     string // host:port
+	ID       int
+	Requests int64
+
+	// Audience is the HostOptions.Audience the transport's pool is dedicated to, canonicalized.
+	Audience string
+
+	// Generation identifies the transport's current connection. It starts at 1 and increases by one with every recycle
+	// or re-activation after being quiesced.
+	Generation int64
+
+	Errors ErrorCounters
+
+	// Methods counts requests by HTTP method over the transport's lifetime.
+	Methods map[string]int64
+
+	// ReservedForWrites is true for the transports set aside by Options.ReservedWriteSlots.
+	ReservedForWrites bool
+
+	// HostDisabled is true when the transport's host has been disabled using Balancer.SetHostEnabled.
+	HostDisabled bool
+
+	// InFlight is the number of requests waiting for a response from the transport.
+	InFlight int64
+
+	// ReducedByDialPressure is true while the transport is removed from its pool by Options.AdaptToDialPressure.
+	ReducedByDialPressure bool
+
+	// Quiesced is true when the transport's connections have been closed by Options.ShrinkIdleTransports.
+	// It's re-activated by the next request it's selected for.
+	Quiesced bool
+
+	// VetoedRecycles counts the recycles cancelled by Options.RecycleVeto over the transport's lifetime.
+	VetoedRecycles int64
+
+	// Recycles and SuppressedRecycles count the recycles performed and those skipped in dry-run mode
+	// over the transport's lifetime.
+	Recycles           int64
+	SuppressedRecycles int64
+
+	// Protocol is the protocol of the latest response served by the transport's current connection, e.g. "HTTP/2.0".
+	// HTTP/1 means balancing is degraded, see Options.OnProtocolDowngrade.
+	Protocol string
+
+	// RecyclerBusySince is when the transport's recycling goroutine started its current decision or recycle,
+	// zero while it's idle. RecyclerStalled is true once it has been busy for longer than Options.RecyclerStallTimeout.
+	RecyclerBusySince time.Time
+	RecyclerStalled   bool
+
+	// Proxy is the URL, without password, of the proxy the transport's current connection goes through.
+	// The parent transport's Proxy function is called once per connection, for its first request, and its
+	// result applies to every request sent over the connection so that its quota describes a single backend.
+	Proxy string
+
+	// TLS describes the TLS session of the transport's latest connection, for auditing. It's nil until the current
+	// connection has served a response over TLS.
+	TLS *TLSInfo
+
+	// ValidationFailures counts the transports that failed Options.ValidateTransport over the transport's lifetime.
+	ValidationFailures int64
+
+	// LingeringConnsClosed counts the connections closed by Options.LingeringConnGracePeriod over the transport's lifetime.
+	LingeringConnsClosed int64
+
+	// EvictedBuckets counts the rate limiting buckets dropped over the transport's lifetime to stay within
+	// Options.MaxTrackedBuckets.
+	EvictedBuckets int64
+
+	// TTFB and Duration are moving averages of the time to the first response byte and of the time until the
+	// response body was closed, over the transport's successful requests. Both are zero until the first response.
+	// A high Duration with a low TTFB denotes large or streamed responses rather than a slow backend.
+	TTFB     time.Duration
+	Duration time.Duration
+}
+
+type ErrorCounters struct {
+	Timeouts     int64
+	ConnResets   int64
+	TLSFailures  int64
+	OtherErrors  int64
+	ServerErrors int64 // 5xx responses
+	Throttled    int64 // 429 responses
+
+	// LastError describes the most recent error or unsuccessful (5xx/429) response, seen at LastErrorTime.
+	// The query strings of the URLs it reports are left out.
+	LastError     string
+	LastErrorTime time.Time
+}
+
+// Stats returns a snapshot of every pooled transport.
+func (t *Balancer) Stats() Stats {
+	var s Stats
+	for _, p := range t.hosts {
+		for i, rt := range p.pool {
+			if r, ok := rt.(*recyclableTransport); ok {
+				ts := r.Stats()
+				ts.ReservedForWrites = i >= len(p.pool)-p.reservedWrites
+				ts.HostDisabled = !p.Enabled()
+				ts.Audience = p.audience
+				ts.InFlight = atomic.LoadInt64(&p.usage[i].inflight)
+				ts.ReducedByDialPressure = p.reducedSlot(i)
+				ts.TTFB = p.usage[i].ttfb.Value()
+				ts.Duration = p.usage[i].duration.Value()
+				s.Transports = append(s.Transports, ts)
+			}
+		}
+	}
+	for _, p := range t.hosts {
+		s.GoAwayReplays += atomic.LoadInt64(&p.goAwayReplays)
+		s.TightDeadlineRedirects += atomic.LoadInt64(&p.riskAvoided)
+		if p.pressure != nil {
+			_, shrinks, restores := p.pressure.Stats()
+			s.DialPressureShrinks += shrinks
+			s.DialPressureRestores += restores
+		}
+	}
+	s.BypassedRequests = atomic.LoadInt64(&t.bypassed)
+	s.Attribution = t.attribution.Snapshot()
+	s.AcquireWaitP50 = t.acquireWait.Quantile(0.5)
+	s.AcquireWaitP99 = t.acquireWait.Quantile(0.99)
+	s.NewConnectionsLastMinute = t.budget.Count()
+	if t.callers != nil {
+		s.Callers = t.callers.Snapshot()
+	}
+	for hostport, d := range t.backendDiversity() {
+		if s.BackendDiversity == nil {
+			s.BackendDiversity = make(map[string]float64)
+		}
+		s.BackendDiversity[hostport] = d.Diversity()
+	}
+	return s
+}
+
+type errorState struct {
+	lock     sync.Mutex
+	counters ErrorCounters
+}
+
+func (e *errorState) Record(resp *http.Response, err error) {
+	var msg string
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	switch ClassifyError(err) {
+	case ErrorClassNone:
+		switch {
+		case resp == nil:
+			return
+		case resp.StatusCode == http.StatusTooManyRequests:
+			e.counters.Throttled++
+		case resp.StatusCode >= 500:
+			e.counters.ServerErrors++
+		default:
+			return
+		}
+		msg = fmt.Sprintf("unexpected response status: %s", resp.Status)
+	case ErrorClassTimeout:
+		e.counters.Timeouts++
+	case ErrorClassConnReset:
+		e.counters.ConnResets++
+	case ErrorClassTLS:
+		e.counters.TLSFailures++
+	default:
+		e.counters.OtherErrors++
+	}
+	if err != nil {
+		msg = redactedError(err)
+	}
+	e.counters.LastError = msg
+	e.counters.LastErrorTime = time.Now()
+}
+
+func (e *errorState) Snapshot() ErrorCounters {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.counters
+}
+
+func (e *errorState) Reset() {
+	e.lock.Lock()
+	e.counters = ErrorCounters{}
+	e.lock.Unlock()
+}
+
+type methodCounter struct {
+	lock   sync.Mutex
+	counts map[string]int64
+}
+
+func (m *methodCounter) Record(method string) {
+	if method == "" {
+		method = http.MethodGet
+	}
+	m.lock.Lock()
+	if m.counts == nil {
+		m.counts = map[string]int64{}
+	}
+	m.counts[method]++
+	m.lock.Unlock()
+}
+
+func (m *methodCounter) Snapshot() map[string]int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	counts := make(map[string]int64, len(m.counts))
+	for method, n := range m.counts {
+		counts[method] = n
+	}
+	return counts
+}
@@ -0,0 +1,163 @@
+package armbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsErrorCounters(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/throttled":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:        svr.Client().Transport.(*http.Transport),
+		Host:             u.Host,
+		PoolSize:         1,
+		RecycleThreshold: 5,
+	})
+	client := &http.Client{Transport: b}
+	for _, path := range []string{"/throttled", "/unavailable", "/unavailable", "/ok"} {
+		resp, err := client.Get(svr.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	stats := b.Stats()
+	if len(stats.Transports) != 1 {
+		t.Fatalf("expected 1 transport, got %d", len(stats.Transports))
+	}
+	s := stats.Transports[0]
+	if s.Requests != 4 || s.Errors.Throttled != 1 || s.Errors.ServerErrors != 2 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+	if s.Errors.LastError != "unexpected response status: 503 Service Unavailable" || s.Errors.LastErrorTime.IsZero() {
+		t.Errorf("unexpected last error: %q at %s", s.Errors.LastError, s.Errors.LastErrorTime)
+	}
+}
+
+func TestStatsTLSFailure(t *testing.T) {
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer svr.Close()
+
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport: http.DefaultTransport.(*http.Transport), // doesn't trust the test server's certificate
+		Host:      u.Host,
+		PoolSize:  1,
+	})
+	if _, err := (&http.Client{Transport: b}).Get(svr.URL); err == nil {
+		t.Fatal("expected TLS error")
+	}
+
+	s := b.Stats().Transports[0]
+	if s.Errors.TLSFailures != 1 {
+		t.Errorf("expected 1 TLS failure, got %+v", s.Errors)
+	}
+	if !strings.Contains(s.Errors.LastError, "certificate") {
+		t.Errorf("expected last error to describe the certificate problem, got %q", s.Errors.LastError)
+	}
+}
+
+func TestStatsResetOnRecycle(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Test", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport:            svr.Client().Transport.(*http.Transport),
+		Host:                 u.Host,
+		PoolSize:             1,
+		MinReqsBeforeRecycle: 2,
+	})
+	client := &http.Client{Transport: b}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(svr.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := b.Stats().Transports[0]
+		if s.Requests == 0 && s.Errors.ServerErrors == 0 && s.Errors.LastError == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected counters to be reset after recycling, got %+v", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStatsInFlight(t *testing.T) {
+	release := make(chan struct{})
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+
+	u, _ := url.Parse(svr.URL)
+	b := New(Options{
+		Transport: svr.Client().Transport.(*http.Transport),
+		Host:      u.Host,
+		PoolSize:  2,
+	})
+	defer b.Close()
+
+	inflight := func() (total int64) {
+		for _, ts := range b.Stats().Transports {
+			total += ts.InFlight
+		}
+		return total
+	}
+
+	done := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			req, _ := http.NewRequest("GET", svr.URL, nil)
+			if resp, err := b.RoundTrip(req); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	waitFor(t, "requests to be in flight", func() bool { return inflight() == 3 })
+	for _, ts := range b.Stats().Transports {
+		if ts.InFlight == 0 {
+			t.Errorf("expected requests to be spread across transports, got %+v", ts)
+		}
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	if n := inflight(); n != 0 {
+		t.Errorf("expected no requests in flight once they completed, got %d", n)
+	}
+}
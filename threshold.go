@@ -0,0 +1,37 @@
+package armbalancer
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+type recycleThresholdKey struct{}
+
+// WithRecycleThreshold returns a context whose requests recycle the connection serving them once their response
+// reports a remaining quota at or below n in any bucket, in addition to the recycle policy. It's meant for critical
+// sections such as a planned failover, to spread requests across healthy instances quickly. n is capped at the
+// host's RecycleThreshold times Options.MaxRecycleThresholdMultiplier. Such recycles are reported with
+// RecycleReasonRequestThreshold.
+func WithRecycleThreshold(ctx context.Context, n int64) context.Context {
+	return context.WithValue(ctx, recycleThresholdKey{}, n)
+}
+
+// checkRequestThreshold flags the connection for recycling if the request carries a threshold that its response
+// crossed. It must be called once the response's headers have been applied.
+func (t *recyclableTransport) checkRequestThreshold(req *http.Request) {
+	n, ok := req.Context().Value(recycleThresholdKey{}).(int64)
+	if !ok {
+		return
+	}
+	if n > t.maxRequestThreshold {
+		n = t.maxRequestThreshold
+	}
+	for _, val := range t.Snapshot().Remaining {
+		if reachedThreshold(val, n) {
+			atomic.StoreInt64(&t.requestThreshold, n)
+			atomic.StoreInt32(&t.thresholdCrossed, 1)
+			return
+		}
+	}
+}
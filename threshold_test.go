@@ -0,0 +1,120 @@
+package armbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestWithRecycleThreshold(t *testing.T) {
+	remaining := "500"
+	r, log := newFakeRecyclableTransport(DefaultRecyclePolicy{Threshold: 10}, func(gen int64) http.Header {
+		return remainingReads(remaining)
+	})
+	defer r.Close(false)
+	r.synchronous = true
+	r.maxRequestThreshold = 1000
+	events := make(chan RecycleEvent, 4)
+	r.onRecycle = func(e RecycleEvent) {
+		events <- e
+		log.Add(fmt.Sprintf("recycle %d", e.Generation))
+	}
+
+	send := func(ctx context.Context) {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, "GET", "https://management.azure.com/subscriptions", nil)
+		resp, err := r.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// Requests without an override, or whose threshold isn't crossed, only go through the policy
+	send(context.Background())
+	log.expect(t, "decide 1: false")
+	send(WithRecycleThreshold(context.Background(), 100))
+	log.expect(t, "decide 1: false")
+
+	send(WithRecycleThreshold(context.Background(), 600))
+	log.expect(t, "recycle 1")
+	log.expect(t, "close 1")
+	if e := <-events; e.Reason != RecycleReasonRequestThreshold || e.RequestThreshold != 600 {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	// Thresholds are capped
+	remaining = "2000"
+	send(WithRecycleThreshold(context.Background(), 1e9))
+	log.expect(t, "decide 2: false")
+	remaining = "1000"
+	send(WithRecycleThreshold(context.Background(), 1e9))
+	log.expect(t, "recycle 2")
+	if e := <-events; e.RequestThreshold != 1000 {
+		t.Errorf("expected the threshold to be capped at 1000, got %d", e.RequestThreshold)
+	}
+}
+
+func TestWithRecycleThresholdZero(t *testing.T) {
+	remaining := "1"
+	r, log := newFakeRecyclableTransport(DefaultRecyclePolicy{Threshold: -1}, func(gen int64) http.Header {
+		return remainingReads(remaining)
+	})
+	defer r.Close(false)
+	r.synchronous = true
+	r.maxRequestThreshold = 1000
+	events := make(chan RecycleEvent, 4)
+	r.onRecycle = func(e RecycleEvent) {
+		events <- e
+		log.Add(fmt.Sprintf("recycle %d", e.Generation))
+	}
+	send := func(n int64) {
+		t.Helper()
+		ctx := WithRecycleThreshold(context.Background(), n)
+		req, _ := http.NewRequestWithContext(ctx, "GET", "https://management.azure.com/subscriptions", nil)
+		resp, err := r.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	send(0)
+	log.expect(t, "decide 1: false")
+	remaining = "0"
+	send(0)
+	log.expect(t, "recycle 1")
+	log.expect(t, "close 1")
+	if e := <-events; e.Reason != RecycleReasonRequestThreshold || e.RequestThreshold != 0 {
+		t.Errorf("expected a threshold of 0 to be applied, got %+v", e)
+	}
+
+	// Thresholds capped to 0 apply as well
+	r.maxRequestThreshold = 0
+	send(500)
+	log.expect(t, "recycle 2")
+	if e := <-events; e.RequestThreshold != 0 {
+		t.Errorf("expected the threshold to be capped at 0, got %d", e.RequestThreshold)
+	}
+}
+
+func TestMaxRecycleThreshold(t *testing.T) {
+	b, err := NewBuilder(nil).
+		WithOptions(Options{RecycleThreshold: 50, MaxRecycleThresholdMultiplier: 4}).
+		AddHost("management.azure.com", HostOptions{}).
+		AddHost("eastus.management.azure.com", HostOptions{RecycleThreshold: 200}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for i, want := range []int64{200, 800} {
+		if got := b.hosts[i].pool[0].(*recyclableTransport).maxRequestThreshold; got != want {
+			t.Errorf("expected host %d to cap thresholds at %d, got %d", i, want, got)
+		}
+	}
+	if _, err := NewBuilder(nil).WithOptions(Options{MaxRecycleThresholdMultiplier: -1}).Build(); err == nil {
+		t.Error("expected a negative multiplier to be rejected")
+	}
+}
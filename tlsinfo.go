@@ -0,0 +1,77 @@
+package armbalancer
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// TLSInfo describes the TLS session of a transport's latest connection.
+type TLSInfo struct {
+	Version            uint16 // e.g. tls.VersionTLS13
+	CipherSuite        uint16 // see tls.CipherSuiteName
+	NegotiatedProtocol string // ALPN, e.g. "h2"
+
+	// LeafSerial and LeafNotAfter describe the certificate presented by the server, and are empty without one.
+	LeafSerial   string
+	LeafNotAfter time.Time
+}
+
+// CertificateChangeEvent is reported through Options.OnCertificateChange when a new connection presents a leaf
+// certificate with a different serial number than the previous connection of the same transport, e.g. because
+// the server rotated its certificate or a proxy intercepts TLS.
+type CertificateChangeEvent struct {
+	TransportID    int
+	Generation     int64 // of the new connection
+	PreviousSerial string
+	Serial         string
+	Subject        string
+	Issuer         string
+}
+
+// tlsState is the TLS session recorded for a generation.
+type tlsState struct {
+	conn *tls.ConnectionState // as returned with responses, identifying the connection
+	info TLSInfo
+}
+
+// recordTLS captures the TLS session of the connection that served a response, once per connection.
+func (t *recyclableTransport) recordTLS(gen *generation, cs *tls.ConnectionState) {
+	if cs == nil {
+		return
+	}
+	if prev, _ := gen.tls.Load().(*tlsState); prev != nil && prev.conn == cs {
+		return
+	}
+	state := &tlsState{conn: cs, info: TLSInfo{Version: cs.Version, CipherSuite: cs.CipherSuite, NegotiatedProtocol: cs.NegotiatedProtocol}}
+	if len(cs.PeerCertificates) == 0 {
+		gen.tls.Store(state)
+		return
+	}
+	leaf := cs.PeerCertificates[0]
+	state.info.LeafSerial = leaf.SerialNumber.String()
+	state.info.LeafNotAfter = leaf.NotAfter
+	gen.tls.Store(state)
+
+	previous, _ := t.certSerial.Swap(state.info.LeafSerial).(string)
+	if previous != "" && previous != state.info.LeafSerial && t.onCertChange != nil {
+		t.onCertChange(CertificateChangeEvent{
+			TransportID:    t.id,
+			Generation:     gen.number,
+			PreviousSerial: previous,
+			Serial:         state.info.LeafSerial,
+			Subject:        leaf.Subject.String(),
+			Issuer:         leaf.Issuer.String(),
+		})
+	}
+}
+
+// tlsInfo returns the TLS session of the generation's latest connection, or nil if it hasn't served
+// a TLS response yet.
+func (g *generation) tlsInfo() *TLSInfo {
+	state, _ := g.tls.Load().(*tlsState)
+	if state == nil {
+		return nil
+	}
+	info := state.info
+	return &info
+}
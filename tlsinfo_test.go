@@ -0,0 +1,125 @@
+package armbalancer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// selfSignedCert returns a certificate for management.azure.com with the given serial number.
+func selfSignedCert(t *testing.T, serial int64) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "management.azure.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Duration(serial) * time.Hour).Truncate(time.Second),
+		DNSNames:              []string{"management.azure.com"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestTLSInfo(t *testing.T) {
+	first, firstLeaf := selfSignedCert(t, 1)
+	second, secondLeaf := selfSignedCert(t, 2)
+	var current atomic.Value
+	current.Store(&first)
+
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	svr.EnableHTTP2 = true
+	// Certificates are only selected using GetCertificate for clients sending SNI
+	svr.TLS = &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return current.Load().(*tls.Certificate), nil
+	}}
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(firstLeaf)
+	roots.AddCert(secondLeaf)
+	changes := make(chan CertificateChangeEvent, 4)
+	b := New(Options{
+		Transport:           &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "management.azure.com"}, ForceAttemptHTTP2: true},
+		Host:                u.Host,
+		PoolSize:            1,
+		OnCertificateChange: func(e CertificateChangeEvent) { changes <- e },
+	})
+	defer b.Close()
+	send := func() {
+		t.Helper()
+		req, _ := http.NewRequest("GET", svr.URL, nil)
+		resp, err := b.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if info := b.Stats().Transports[0].TLS; info != nil {
+		t.Errorf("expected no TLS info before the first response, got %+v", info)
+	}
+	send()
+	send()
+	info := b.Stats().Transports[0].TLS
+	if info == nil {
+		t.Fatal("expected TLS info")
+	}
+	if info.Version != tls.VersionTLS13 || tls.CipherSuiteName(info.CipherSuite) == "" || info.NegotiatedProtocol != "h2" ||
+		info.LeafSerial != "1" || !info.LeafNotAfter.Equal(firstLeaf.NotAfter) {
+		t.Errorf("unexpected TLS info %+v", info)
+	}
+
+	// The server rotates its certificate, which the next connection notices
+	current.Store(&second)
+	if err := b.ForceRecycleAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	send()
+	select {
+	case e := <-changes:
+		if e.Generation != 2 || e.PreviousSerial != "1" || e.Serial != "2" || e.Subject != "CN=management.azure.com" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the certificate change to be reported")
+	}
+	if info := b.Stats().Transports[0].TLS; info == nil || info.LeafSerial != "2" {
+		t.Errorf("expected the new connection's certificate, got %+v", info)
+	}
+
+	// The same certificate on the next connection isn't reported
+	if err := b.ForceRecycleAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	send()
+	select {
+	case e := <-changes:
+		t.Errorf("unexpected event %+v", e)
+	default:
+	}
+}
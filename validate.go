@@ -0,0 +1,92 @@
+package armbalancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// TransportValidator checks the transport created by a recycle before it replaces the current one, e.g. that it
+// can dial hostport. It's called from the transport's recycling goroutine and should return quickly.
+// See Options.ValidateTransport.
+type TransportValidator func(ctx context.Context, rt http.RoundTripper, hostport string) error
+
+// DialValidator returns a TransportValidator that dials the host, or its proxy, using the transport's DialContext
+// and closes the connection right away. Transports other than *http.Transport are accepted without dialing.
+func DialValidator(timeout time.Duration) TransportValidator {
+	return func(ctx context.Context, rt http.RoundTripper, hostport string) error {
+		tx, ok := rt.(*http.Transport)
+		if !ok || tx.DialContext == nil {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn, err := tx.DialContext(ctx, "tcp", hostport)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// validatedGeneration creates the next generation and validates its transport. A generation that fails validation
+// is discarded and nil is returned: the recycle is then retried with exponential backoff, while the current
+// generation keeps serving requests. It must only be called from the recycling goroutine.
+func (t *recyclableTransport) validatedGeneration(event RecycleEvent) *generation {
+	t.lock.Lock()
+	gen := t.newGeneration()
+	t.lock.Unlock()
+
+	err := t.validate(context.Background(), gen.tx, net.JoinHostPort(t.host, t.port))
+	if err == nil {
+		t.validationAttempts = 0
+		return gen
+	}
+
+	t.lock.Lock()
+	if t.lastGeneration == gen.number {
+		t.lastGeneration-- // keep generation numbers contiguous
+	}
+	t.lock.Unlock()
+	gen.tx.CloseIdleConnections()
+	t.conns.CloseGeneration(gen)
+	atomic.AddInt64(&t.validationFailures, 1)
+
+	t.validationAttempts++
+	backoff := t.validationBackoff
+	for i := 1; i < t.validationAttempts && backoff < t.maxValidationBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > t.maxValidationBackoff {
+		backoff = t.maxValidationBackoff
+	}
+	if !atomic.CompareAndSwapInt32(&t.validationWait, 0, 1) {
+		return nil // a retry is already scheduled
+	}
+	if t.onValidationFailure != nil {
+		t.onValidationFailure(ValidationFailureEvent{
+			TransportID: t.id,
+			Generation:  event.Generation,
+			Reason:      event.Reason,
+			Attempt:     t.validationAttempts,
+			Err:         err,
+			RetryIn:     backoff,
+		})
+	}
+	timer := time.NewTimer(backoff)
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.done:
+			return
+		}
+		select {
+		case t.delayed <- delayedRecycle{reason: event.Reason, snapshot: event.Snapshot}:
+		case <-t.done:
+		}
+	}()
+	return nil
+}
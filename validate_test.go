@@ -0,0 +1,86 @@
+package armbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidateTransport(t *testing.T) {
+	log := newEventLog()
+	var created int32
+	r := buildRecyclableTransport(transportConfig{
+		host:   "management.azure.com",
+		port:   "443",
+		policy: RecyclePolicyFunc(func(s ConnSnapshot) bool { return true }),
+
+		onRecycle: func(e RecycleEvent) { log.Add(fmt.Sprintf("recycle %d", e.Generation)) },
+		validate: func(ctx context.Context, rt http.RoundTripper, hostport string) error {
+			if hostport != "management.azure.com:443" {
+				t.Errorf("unexpected host %q", hostport)
+			}
+			req, _ := http.NewRequest("GET", "https://management.azure.com/", nil)
+			_, err := rt.RoundTrip(req)
+			return err
+		},
+		validationBackoff:    10 * time.Millisecond,
+		maxValidationBackoff: 15 * time.Millisecond,
+		onValidationFailure: func(e ValidationFailureEvent) {
+			log.Add(fmt.Sprintf("invalid %d: attempt %d, %s, retry in %s", e.Generation, e.Attempt, e.Err, e.RetryIn))
+		},
+		newTransport: func(gen *generation) roundTripperCloser {
+			// The factory fails twice after the first generation
+			broken := atomic.AddInt32(&created, 1)
+			return &fakeTransport{gen: gen.number, log: log, respond: func(req *http.Request) (*http.Response, error) {
+				if broken == 2 || broken == 3 {
+					return nil, errors.New("proxy unavailable")
+				}
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			}}
+		},
+	})
+	defer r.Close(false)
+
+	sendFake(t, r)
+	log.expect(t, "close 2")
+	log.expect(t, "invalid 1: attempt 1, proxy unavailable, retry in 10ms")
+	sendFake(t, r) // the previous generation keeps serving
+	log.expect(t, "close 2")
+	log.expect(t, "invalid 1: attempt 2, proxy unavailable, retry in 15ms")
+	log.expect(t, "recycle 1")
+	log.expect(t, "close 1")
+
+	stats := r.Stats()
+	if stats.Generation != 2 || stats.ValidationFailures != 2 || stats.Recycles != 1 {
+		t.Errorf("expected generation 2 after 2 validation failures and a recycle, got %+v", stats)
+	}
+}
+
+func TestDialValidator(t *testing.T) {
+	validate := DialValidator(time.Second)
+	failing := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("proxy resolver unavailable")
+	}}
+	if err := validate(context.Background(), failing, "management.azure.com:443"); err == nil {
+		t.Error("expected failing dials to fail validation")
+	}
+
+	var dialed string
+	working := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}}
+	if err := validate(context.Background(), working, "management.azure.com:443"); err != nil || dialed != "management.azure.com:443" {
+		t.Errorf("expected the host to be dialed, got %q: %v", dialed, err)
+	}
+	if err := validate(context.Background(), &fakeTransport{}, "management.azure.com:443"); err != nil {
+		t.Errorf("expected other transports to be accepted, got: %s", err)
+	}
+}
@@ -0,0 +1,26 @@
+package armbalancer
+
+import "sync/atomic"
+
+// vetoed returns true if Options.RecycleVeto cancels the recycle, re-arming its trigger so that the recycle is
+// attempted again after the next response. Policy recycles need no re-arming since the policy is consulted again.
+// It must only be called from the recycling goroutine.
+func (t *recyclableTransport) vetoed(reason RecycleReason) bool {
+	if t.veto == nil || !t.veto(reason) {
+		return false
+	}
+	atomic.AddInt64(&t.vetoedRecycles, 1)
+	switch reason {
+	case RecycleReasonGoAway:
+		atomic.StoreInt32(&t.goAway, 1)
+	case RecycleReasonProtocolDowngrade:
+		atomic.StoreInt32(&t.downgrade, 1)
+	case RecycleReasonConnFailure:
+		atomic.StoreInt32(&t.connFailed, 1)
+	case RecycleReasonChaos:
+		atomic.StoreInt32(&t.chaosFired, 1)
+	case RecycleReasonRequestThreshold:
+		atomic.StoreInt32(&t.thresholdCrossed, 1) // requestThreshold still holds the applied threshold, or a newer one
+	}
+	return true
+}
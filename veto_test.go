@@ -0,0 +1,80 @@
+package armbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRecycleVeto(t *testing.T) {
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ms-Ratelimit-Remaining-Subscription-Reads", "50")
+	}))
+	svr.EnableHTTP2 = true
+	svr.StartTLS()
+	defer svr.Close()
+	u, _ := url.Parse(svr.URL)
+
+	var vetoing int32 = 1
+	var lock sync.Mutex
+	var reasons []RecycleReason
+	b := New(Options{
+		Transport:     svr.Client().Transport.(*http.Transport),
+		Host:          u.Host,
+		PoolSize:      1,
+		RecyclePolicy: DefaultRecyclePolicy{Threshold: 100, MinRequests: 1},
+		RecycleVeto: func(reason RecycleReason) bool {
+			lock.Lock()
+			defer lock.Unlock()
+			reasons = append(reasons, reason)
+			return atomic.LoadInt32(&vetoing) == 1
+		},
+	})
+	defer b.Close()
+	send := func() {
+		resp, err := b.RoundTrip(httptest.NewRequest(http.MethodGet, svr.URL, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	for i := 0; i < 3; i++ {
+		send()
+		waitFor(t, "the recycle to be vetoed", func() bool { return b.Stats().Transports[0].VetoedRecycles == int64(i+1) })
+	}
+	if s := b.Stats().Transports[0]; s.Recycles != 0 || s.Generation != 1 {
+		t.Fatalf("expected vetoed recycles not to swap the connection, got %+v", s)
+	}
+
+	// The trigger stays armed, so the next response recycles once the veto is lifted
+	atomic.StoreInt32(&vetoing, 0)
+	send()
+	waitFor(t, "the connection to be recycled", func() bool { return b.Stats().Transports[0].Recycles == 1 })
+	if s := b.Stats().Transports[0]; s.VetoedRecycles != 3 || s.Generation != 2 {
+		t.Errorf("expected the recycle to proceed, got %+v", s)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	for _, reason := range reasons {
+		if reason != RecycleReasonPolicy {
+			t.Errorf("expected policy recycles to be vetoed, got %s", reason)
+		}
+	}
+}
+
+func TestRecycleVetoRearms(t *testing.T) {
+	r := &recyclableTransport{veto: func(RecycleReason) bool { return true }, requestThreshold: 500, appliedThreshold: 500}
+	for _, reason := range []RecycleReason{RecycleReasonGoAway, RecycleReasonConnFailure, RecycleReasonRequestThreshold} {
+		if !r.vetoed(reason) {
+			t.Errorf("expected the %s recycle to be vetoed", reason)
+		}
+	}
+	if r.goAway != 1 || r.connFailed != 1 || r.thresholdCrossed != 1 || r.vetoedRecycles != 3 {
+		t.Errorf("expected the vetoed triggers to be re-armed, got goaway %d, conn failure %d, request threshold %d",
+			r.goAway, r.connFailed, r.thresholdCrossed)
+	}
+}
@@ -0,0 +1,35 @@
+package armbalancer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// process runs work of the recycling goroutine, reporting a stall if it takes longer than stallAfter.
+func (t *recyclableTransport) process(work func()) {
+	start := time.Now()
+	atomic.StoreInt64(&t.busySince, start.UnixNano())
+	defer atomic.StoreInt64(&t.busySince, 0)
+
+	if t.onStall != nil && t.stallAfter > 0 {
+		watchdog := time.AfterFunc(t.stallAfter, func() {
+			t.onStall(RecyclerStallEvent{TransportID: t.id, BusySince: start})
+		})
+		defer watchdog.Stop()
+	}
+	work()
+}
+
+// busyStart returns when the recycling goroutine started its current work, or zero if it's idle.
+func (t *recyclableTransport) busyStart() time.Time {
+	if since := atomic.LoadInt64(&t.busySince); since != 0 {
+		return time.Unix(0, since)
+	}
+	return time.Time{}
+}
+
+// stalled returns true if the recycling goroutine has been busy for longer than stallAfter.
+func (t *recyclableTransport) stalled() bool {
+	start := t.busyStart()
+	return !start.IsZero() && t.stallAfter > 0 && time.Since(start) > t.stallAfter
+}
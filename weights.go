@@ -0,0 +1,145 @@
+package armbalancer
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+)
+
+// weightTable splits requests for any of its member hosts across the enabled pools with a positive weight,
+// proportionally to their weights.
+type weightTable struct {
+	members []*hostPool
+	pools   []*hostPool
+	weights []int
+}
+
+func (w *weightTable) contains(p *hostPool) bool {
+	for _, candidate := range w.members {
+		if candidate == p {
+			return true
+		}
+	}
+	return false
+}
+
+// pick returns a pool chosen at random proportionally to its weight, or nil if every weighted pool is disabled.
+func (w *weightTable) pick() *hostPool {
+	var total int
+	for i, p := range w.pools {
+		if p.Enabled() {
+			total += w.weights[i]
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for i, p := range w.pools {
+		if !p.Enabled() {
+			continue
+		}
+		if n < w.weights[i] {
+			return p
+		}
+		n -= w.weights[i]
+	}
+	return nil
+}
+
+// SetHostWeights replaces the weights given by Options.HostWeights at runtime.
+// Passing an empty map disables the weighted split.
+func (t *Balancer) SetHostWeights(weights map[string]int) error {
+	table, err := t.buildWeightTable(weights)
+	if err != nil {
+		return err
+	}
+	t.weights.Store(table)
+	return nil
+}
+
+func (t *Balancer) buildWeightTable(weights map[string]int) (*weightTable, error) {
+	if len(weights) == 0 {
+		return nil, nil
+	}
+
+	byPool := map[*hostPool]int{}
+	rawByPool := map[*hostPool]string{}
+	for raw, weight := range weights {
+		host, port, err := normalizeHost(raw)
+		if err != nil {
+			return nil, err
+		}
+		p := t.lookupExact(host, port)
+		if p == nil {
+			return nil, fmt.Errorf("weighted host %q has not been added to the balancer", raw)
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("invalid weight %d for host %q: must not be negative", weight, raw)
+		}
+		if prev, ok := rawByPool[p]; ok {
+			return nil, fmt.Errorf("weighted hosts %q and %q both refer to %q", prev, raw, net.JoinHostPort(host, port))
+		}
+		byPool[p] = weight
+		rawByPool[p] = raw
+	}
+
+	// Iterate in registration order so that the table doesn't depend on map ordering
+	table := &weightTable{}
+	var total int
+	for _, p := range t.hosts {
+		weight, ok := byPool[p]
+		if !ok {
+			continue
+		}
+		table.members = append(table.members, p)
+		if weight == 0 {
+			continue
+		}
+		total += weight
+		table.pools = append(table.pools, p)
+		table.weights = append(table.weights, weight)
+	}
+	if total == 0 {
+		return nil, errors.New("at least one weighted host must have a positive weight")
+	}
+	return table, nil
+}
+
+// lookupExact returns the pool added for the host without an audience.
+func (t *Balancer) lookupExact(host, port string) *hostPool {
+	for _, p := range t.hosts {
+		if p.host == host && p.port == port && p.audience == "" {
+			return p
+		}
+	}
+	return nil
+}
+
+// weighted returns the pool chosen by the current weights for requests matching p, along with
+// the request rewritten to target the chosen pool's host.
+func (t *Balancer) weighted(p *hostPool, req *http.Request) (*hostPool, *http.Request) {
+	table, _ := t.weights.Load().(*weightTable)
+	if table == nil || !table.contains(p) {
+		return p, req
+	}
+	chosen := table.pick()
+	if chosen == nil || chosen == p {
+		return p, req
+	}
+
+	u := *req.URL
+	u.Host = net.JoinHostPort(chosen.host, chosen.port)
+	rewritten := *req
+	rewritten.URL = &u
+	rewritten.Host = "" // derived from the URL, so that the request is valid for the chosen host
+	if chosen.preserveHost {
+		rewritten.Host = req.Host
+		if rewritten.Host == "" {
+			rewritten.Host = req.URL.Host
+		}
+	}
+	return chosen, &rewritten
+}
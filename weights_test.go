@@ -0,0 +1,158 @@
+package armbalancer
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHostWeights(t *testing.T) {
+	var lock sync.Mutex
+	counts := map[string]int{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		counts[r.Host]++
+	})
+	public := httptest.NewServer(handler)
+	defer public.Close()
+	private := httptest.NewServer(handler)
+	defer private.Close()
+
+	publicURL, _ := url.Parse(public.URL)
+	privateURL, _ := url.Parse(private.URL)
+	b, err := NewBuilder(public.Client().Transport.(*http.Transport)).
+		WithOptions(Options{HostWeights: map[string]int{publicURL.Host: 80, privateURL.Host: 20}}).
+		AddHost(publicURL.Host, HostOptions{PoolSize: 2}).
+		AddHost(privateURL.Host, HostOptions{PoolSize: 2}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	client := &http.Client{Transport: b}
+
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			resp, err := client.Get(public.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	send(1000)
+	if n := counts[privateURL.Host]; n < 150 || n > 250 {
+		t.Errorf("expected roughly 20%% of requests to be sent to the private endpoint, got %d/1000", n)
+	}
+	if counts[publicURL.Host]+counts[privateURL.Host] != 1000 {
+		t.Errorf("expected every request to carry the Host of the endpoint serving it, got %v", counts)
+	}
+
+	if err := b.SetHostWeights(map[string]int{publicURL.Host: 0, privateURL.Host: 1}); err != nil {
+		t.Fatal(err)
+	}
+	counts = map[string]int{}
+	send(100)
+	if n := counts[privateURL.Host]; n != 100 {
+		t.Errorf("expected every request to be sent to the private endpoint after updating the weights, got %d/100", n)
+	}
+}
+
+func TestSetHostWeightsInvalid(t *testing.T) {
+	b, err := NewBuilder(nil).AddHost("a.com", HostOptions{}).AddHost("b.com", HostOptions{}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	tests := []struct {
+		name    string
+		weights map[string]int
+	}{
+		{name: "unknown host", weights: map[string]int{"a.com": 1, "c.com": 1}},
+		{name: "negative weight", weights: map[string]int{"a.com": 1, "b.com": -1}},
+		{name: "no positive weight", weights: map[string]int{"a.com": 0, "b.com": 0}},
+		{name: "invalid host", weights: map[string]int{"a.com:1:2": 1}},
+		{name: "colliding hosts", weights: map[string]int{"a.com": 1, "A.COM:443": 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := b.SetHostWeights(tt.weights); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+	if err := b.SetHostWeights(map[string]int{"A.com:443": 1, "B.Com": 1}); err != nil {
+		t.Errorf("expected hosts to be normalized, got: %s", err)
+	}
+	err = b.SetHostWeights(map[string]int{"b.com": 1, "b.com:443": 2})
+	if err == nil || !strings.Contains(err.Error(), `both refer to "b.com:443"`) {
+		t.Errorf("expected the colliding host to be named, got: %v", err)
+	}
+}
+
+func TestHostWeightsTLSServerName(t *testing.T) {
+	type seen struct{ host, serverName string }
+	requests := make(chan seen, 1)
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- seen{host: r.Host, serverName: r.TLS.ServerName}
+	}))
+	defer svr.Close()
+
+	// The test certificate is valid for example.com and 127.0.0.1, but not for localhost
+	svrURL, _ := url.Parse(svr.URL)
+	public := net.JoinHostPort("localhost", svrURL.Port())
+	private := net.JoinHostPort("127.0.0.1", svrURL.Port())
+
+	tests := []struct {
+		name          string
+		opts          HostOptions
+		wantHost      string
+		wantHandshake bool
+	}{
+		{name: "rewritten host", opts: HostOptions{TLSServerName: "example.com"}, wantHost: private, wantHandshake: true},
+		{name: "preserved host", opts: HostOptions{TLSServerName: "example.com", PreserveHostHeader: true}, wantHost: public, wantHandshake: true},
+		{name: "wrong server name", opts: HostOptions{TLSServerName: "wrong.example"}, wantHandshake: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewBuilder(svr.Client().Transport.(*http.Transport)).
+				WithOptions(Options{HostWeights: map[string]int{public: 0, private: 1}}).
+				AddHost(public, HostOptions{PoolSize: 1}).
+				AddHost(private, tt.opts).
+				Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+
+			req, _ := http.NewRequest("GET", "https://"+public, nil)
+			resp, err := b.RoundTrip(req)
+			if !tt.wantHandshake {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("expected the handshake to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			got := <-requests
+			if got.host != tt.wantHost {
+				t.Errorf("expected Host %q, got %q", tt.wantHost, got.host)
+			}
+			if got.serverName != "example.com" {
+				t.Errorf("expected the configured TLS server name to be sent, got %q", got.serverName)
+			}
+		})
+	}
+}